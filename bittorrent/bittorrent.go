@@ -4,7 +4,10 @@
 package bittorrent
 
 import (
+	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/chihaya/chihaya/pkg/log"
@@ -86,6 +89,29 @@ type AnnounceRequest struct {
 	Downloaded uint64
 	Uploaded   uint64
 
+	// NumWantSpecified is set if the client explicitly requested NumWant
+	// peers. This distinguishes a request for zero peers, e.g. by stopped or
+	// paused clients, from a request that leaves the number to the tracker.
+	// The UDP frontend treats a numwant of zero as unspecified.
+	NumWantSpecified bool
+
+	// Flags are the PeerFlags stored alongside the announcing Peer.
+	Flags PeerFlags
+
+	// ConnectionID is the connection ID of an Announce received via UDP,
+	// as specified in BEP 15. It is nil for Announces received via HTTP.
+	ConnectionID []byte
+
+	// LinkedInfoHash is the other infohash of a BEP 52 hybrid torrent, if
+	// the Announce includes both its v1 and its truncated v2 infohash.
+	// It is nil for Announces of a single infohash.
+	LinkedInfoHash *InfoHash
+
+	// Key is the key parameter of the Announce, a random value that
+	// identifies the client across changes of its IP. It is empty if the
+	// client omitted it.
+	Key string
+
 	Peer
 	Params
 }
@@ -100,6 +126,10 @@ type AnnounceResponse struct {
 	MinInterval time.Duration
 	IPv4Peers   []Peer
 	IPv6Peers   []Peer
+
+	// WarningMessage is an optional human-readable message that is sent to
+	// the client along with an otherwise successful response.
+	WarningMessage string
 }
 
 // LogFields renders the current response as a set of Logrus fields.
@@ -111,6 +141,7 @@ func (ar AnnounceResponse) LogFields() log.Fields {
 		"minInterval": ar.MinInterval,
 		"ipv4Peers":   ar.IPv4Peers,
 		"ipv6Peers":   ar.IPv6Peers,
+		"warning":     ar.WarningMessage,
 	}
 }
 
@@ -127,12 +158,17 @@ type ScrapeRequest struct {
 // ScrapeRequest.
 type ScrapeResponse struct {
 	Files []Scrape
+
+	// MinRequestInterval optionally advises the client to wait at least
+	// this long before scraping again, if the protocol supports it.
+	MinRequestInterval time.Duration
 }
 
 // LogFields renders the current response as a set of Logrus fields.
 func (sr ScrapeResponse) LogFields() log.Fields {
 	return log.Fields{
-		"files": sr.Files,
+		"files":              sr.Files,
+		"minRequestInterval": sr.MinRequestInterval,
 	}
 }
 
@@ -142,6 +178,19 @@ type Scrape struct {
 	Snatches   uint32
 	Complete   uint32
 	Incomplete uint32
+
+	// Banned is set if the infohash is explicitly disallowed by the
+	// tracker, as opposed to merely unknown.
+	Banned bool
+
+	// Failed is set if the swarm could not be scraped because of the
+	// storage, so the counts are unknown.
+	Failed bool
+
+	// Breakdown optionally holds the Scrapes of the swarm per address
+	// family, indexed by AddressFamily, if the counts are the totals of
+	// both.
+	Breakdown []Scrape
 }
 
 // ApiRequest represents the parsed parameters from an api request.
@@ -157,14 +206,20 @@ type ApiRequest struct {
 //
 // The Apis must be in the same order as the InfoHashes in the corresponding
 // ApiRequest.
+// Error and Response hold the result of methods that do not refer to
+// infohashes.
 type ApiResponse struct {
-	Files []Api
+	Files    []Api
+	Error    int
+	Response string
 }
 
 // LogFields renders the current response as a set of Logrus fields.
 func (sr ApiResponse) LogFields() log.Fields {
 	return log.Fields{
-		"files": sr.Files,
+		"files":    sr.Files,
+		"error":    sr.Error,
+		"response": sr.Response,
 	}
 }
 
@@ -190,6 +245,42 @@ type IP struct {
 	AddressFamily
 }
 
+// NormalizeIP returns ip with its AddressFamily.
+//
+// IPv4 addresses, including IPv4-mapped IPv6 addresses like ::ffff:1.2.3.4,
+// are truncated to 4 bytes and belong to the IPv4 family, so that they are
+// treated as IPv4 regardless of how they were transmitted.
+// ok is false if ip is neither an IPv4 nor an IPv6 address.
+func NormalizeIP(ip net.IP) (normalized IP, ok bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return IP{IP: ip4, AddressFamily: IPv4}, true
+	}
+	if len(ip) == net.IPv6len {
+		return IP{IP: ip, AddressFamily: IPv6}, true
+	}
+	return IP{}, false
+}
+
+// NormalizeKey returns the representation of the key parameter of an Announce
+// that is shared by all frontends, so that a client is recognized by its key
+// regardless of the protocol it announces with.
+//
+// UDP keys are 32-bit values, which are represented as eight lowercase hex
+// digits. Clients usually send the same value in hex via HTTP, so HTTP keys of
+// up to eight hex digits are represented the same way. Other keys are
+// returned unchanged.
+func NormalizeKey(key string) string {
+	if key == "" || len(key) > 8 {
+		return key
+	}
+
+	k, err := strconv.ParseUint(key, 16, 32)
+	if err != nil {
+		return key
+	}
+	return fmt.Sprintf("%08x", k)
+}
+
 // Peer represents the connection details of a peer that is returned in an
 // announce response.
 type Peer struct {
@@ -198,6 +289,31 @@ type Peer struct {
 	Port uint16
 }
 
+// PeerFlags is a bitfield of optional properties of a Peer, e.g. whether it
+// supports encrypted connections.
+//
+// PeerFlags are not part of the identity of a Peer, they are stored alongside
+// it by PeerStores that support them.
+type PeerFlags uint8
+
+// PeerFlags constants.
+const (
+	// PeerFlagCrypto is set for peers that support or require encrypted
+	// connections.
+	PeerFlagCrypto PeerFlags = 1 << iota
+
+	// PeerFlagSeedbox is set for peers that are known to be seedboxes.
+	PeerFlagSeedbox
+
+	// PeerFlagUnreachable is set for peers that could not be connected to
+	// at their announced port. PeerStores that support PeerFlags only
+	// return them if there are not enough other peers.
+	PeerFlagUnreachable
+)
+
+// Has reports whether all bits of mask are set in f.
+func (f PeerFlags) Has(mask PeerFlags) bool { return f&mask == mask }
+
 // Equal reports whether p and x are the same.
 func (p Peer) Equal(x Peer) bool { return p.EqualEndpoint(x) && p.ID == x.ID }
 
@@ -210,3 +326,84 @@ type ClientError string
 
 // Error implements the error interface for ClientError.
 func (c ClientError) Error() string { return string(c) }
+
+// RetryError is a ClientError that additionally advises the client to wait
+// for RetryIn before repeating the request.
+//
+// Hooks return a RetryError to communicate a specific back-off delay, which
+// the frontends translate into the means of their protocol.
+type RetryError struct {
+	ClientError
+	RetryIn time.Duration
+}
+
+// IsClientError reports whether err should be exposed to the client, i.e.
+// whether it is a ClientError or a RetryError.
+func IsClientError(err error) bool {
+	switch err.(type) {
+	case ClientError, RetryError:
+		return true
+	}
+	return false
+}
+
+// reasonCodes maps the ClientErrors created by NewClientError to their
+// reason codes.
+var reasonCodes = struct {
+	mu    sync.RWMutex
+	codes map[ClientError]string
+}{codes: make(map[ClientError]string)}
+
+// NewClientError returns a ClientError with message and registers code as its
+// reason code, which is returned by ReasonCode.
+//
+// It is intended for declaring sentinel errors, so that codes stay the same if
+// the message changes. Registering the same message with different codes
+// panics.
+func NewClientError(code, message string) ClientError {
+	err := ClientError(message)
+
+	reasonCodes.mu.RLock()
+	registered, ok := reasonCodes.codes[err]
+	reasonCodes.mu.RUnlock()
+	if !ok {
+		reasonCodes.mu.Lock()
+		registered, ok = reasonCodes.codes[err]
+		if !ok {
+			registered = code
+			reasonCodes.codes[err] = code
+		}
+		reasonCodes.mu.Unlock()
+	}
+
+	if registered != code {
+		panic("bittorrent: conflicting reason codes for client error " + message)
+	}
+	return err
+}
+
+// ReasonCode returns a stable code describing why a request failed with err,
+// for use in logs and metrics.
+//
+// The code of a ClientError is the one it was created with by NewClientError.
+// ClientErrors created otherwise share the code "client_error", and all
+// errors that are not exposed to the client share the code "internal_error".
+func ReasonCode(err error) string {
+	var ce ClientError
+	switch e := err.(type) {
+	case ClientError:
+		ce = e
+	case RetryError:
+		ce = e.ClientError
+	default:
+		return "internal_error"
+	}
+
+	reasonCodes.mu.RLock()
+	code, ok := reasonCodes.codes[ce]
+	reasonCodes.mu.RUnlock()
+	if !ok {
+		return "client_error"
+	}
+	return code
+}
@@ -0,0 +1,74 @@
+package bittorrent
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReasonCode(t *testing.T) {
+	errRateLimited := NewClientError("rate_limited", "rate limit exceeded")
+
+	var table = []struct {
+		err      error
+		expected string
+	}{
+		{errRateLimited, "rate_limited"},
+		// The code is kept for copies of the sentinel.
+		{ClientError("rate limit exceeded"), "rate_limited"},
+		{RetryError{ClientError: errRateLimited, RetryIn: time.Minute}, "rate_limited"},
+		{ErrInvalidInfohash, "invalid_infohash"},
+		{ClientError("not registered"), "client_error"},
+		{errors.New("connection refused"), "internal_error"},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, ReasonCode(tt.err))
+	}
+
+	require.Equal(t, errRateLimited, NewClientError("rate_limited", "rate limit exceeded"))
+	require.Panics(t, func() { NewClientError("too_many_requests", "rate limit exceeded") })
+}
+
+func TestNormalizeIP(t *testing.T) {
+	var table = []struct {
+		ip       net.IP
+		expected IP
+		ok       bool
+	}{
+		{net.ParseIP("1.2.3.4"), IP{IP: net.IP{1, 2, 3, 4}, AddressFamily: IPv4}, true},
+		{net.IP{1, 2, 3, 4}, IP{IP: net.IP{1, 2, 3, 4}, AddressFamily: IPv4}, true},
+		{net.ParseIP("::ffff:1.2.3.4"), IP{IP: net.IP{1, 2, 3, 4}, AddressFamily: IPv4}, true},
+		{net.ParseIP("fc00::1"), IP{IP: net.ParseIP("fc00::1"), AddressFamily: IPv6}, true},
+		{nil, IP{}, false},
+		{net.IP{1, 2, 3}, IP{}, false},
+	}
+
+	for _, tt := range table {
+		ip, ok := NormalizeIP(tt.ip)
+		require.Equal(t, tt.ok, ok, tt.ip)
+		require.Equal(t, tt.expected, ip, tt.ip)
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	var table = []struct {
+		key      string
+		expected string
+	}{
+		{"", ""},
+		{"5a3b9c1d", "5a3b9c1d"},
+		{"5A3B9C1D", "5a3b9c1d"},
+		{"1d", "0000001d"},
+		{"0x1d", "0x1d"},
+		{"5a3b9c1d0", "5a3b9c1d0"},
+		{"n0t-h3x", "n0t-h3x"},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, NormalizeKey(tt.key), tt.key)
+	}
+}
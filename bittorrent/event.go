@@ -46,8 +46,11 @@ func init() {
 }
 
 // NewEvent returns the proper Event given a string.
+//
+// The string is matched case-insensitively and surrounding whitespace is
+// ignored, as some clients send e.g. " Started" or "STOPPED".
 func NewEvent(eventStr string) (Event, error) {
-	if e, ok := stringToEvent[strings.ToLower(eventStr)]; ok {
+	if e, ok := stringToEvent[strings.ToLower(strings.TrimSpace(eventStr))]; ok {
 		return e, nil
 	}
 
@@ -18,6 +18,11 @@ func TestNew(t *testing.T) {
 		{"started", Started, nil},
 		{"stopped", Stopped, nil},
 		{"completed", Completed, nil},
+		{"STOPPED", Stopped, nil},
+		{" Started", Started, nil},
+		{"completed\n", Completed, nil},
+		{"  ", None, nil},
+		{"start ed", None, ErrUnknownEvent},
 		{"notAnEvent", None, ErrUnknownEvent},
 	}
 
@@ -39,11 +39,11 @@ var ErrKeyNotFound = errors.New("query: value for the provided key does not exis
 
 // ErrInvalidInfohash is returned when parsing a query encounters an infohash
 // with invalid length.
-var ErrInvalidInfohash = ClientError("provided invalid infohash")
+var ErrInvalidInfohash = NewClientError("invalid_infohash", "provided invalid infohash")
 
 // ErrInvalidQueryEscape is returned when a query string contains invalid
 // escapes.
-var ErrInvalidQueryEscape = ClientError("invalid query escape")
+var ErrInvalidQueryEscape = NewClientError("invalid_query_escape", "invalid query escape")
 
 // QueryParams parses a URL Query and implements the Params interface with some
 // additional helpers.
@@ -172,6 +172,16 @@ func (qp *QueryParams) Uint64(key string) (uint64, error) {
 	return val, nil
 }
 
+// Keys returns the lowercased keys of all parameters of the query in no
+// particular order, excluding "info_hash".
+func (qp *QueryParams) Keys() []string {
+	keys := make([]string, 0, len(qp.params))
+	for key := range qp.params {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 // InfoHashes returns a list of requested infohashes.
 func (qp *QueryParams) InfoHashes() []InfoHash {
 	return qp.infoHashes
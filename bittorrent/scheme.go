@@ -0,0 +1,25 @@
+package bittorrent
+
+import "context"
+
+// Schemes of the announce URLs requests are sent to.
+const (
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+	SchemeUDP   = "udp"
+)
+
+type schemeKey struct{}
+
+// SchemeKey is the key under which frontends store the scheme of the URL a
+// request was sent to in its context, so that middleware can tell requests
+// sent over an encrypted transport apart.
+// The value is expected to be one of the Scheme constants.
+var SchemeKey = schemeKey{}
+
+// Scheme returns the scheme of the URL a request was sent to from its
+// context, if any.
+func Scheme(ctx context.Context) (string, bool) {
+	scheme, ok := ctx.Value(SchemeKey).(string)
+	return scheme, ok
+}
@@ -4,20 +4,61 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/chihaya/chihaya/frontend"
 	"github.com/chihaya/chihaya/frontend/http"
+	"github.com/chihaya/chihaya/frontend/passkey"
 	"github.com/chihaya/chihaya/frontend/udp"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/announcehistory"
+	"github.com/chihaya/chihaya/middleware/announcesampler"
+	"github.com/chihaya/chihaya/middleware/announcescheme"
+	"github.com/chihaya/chihaya/middleware/apimetadata"
+	"github.com/chihaya/chihaya/middleware/backpressure"
+	"github.com/chihaya/chihaya/middleware/bootstrappeers"
 	"github.com/chihaya/chihaya/middleware/clientapproval"
+	"github.com/chihaya/chihaya/middleware/consistentpeerid"
+	"github.com/chihaya/chihaya/middleware/cryptonetworks"
+	"github.com/chihaya/chihaya/middleware/datacenter"
+	"github.com/chihaya/chihaya/middleware/firstannounce"
+	"github.com/chihaya/chihaya/middleware/hybridtorrents"
+	"github.com/chihaya/chihaya/middleware/infohashlimit"
+	"github.com/chihaya/chihaya/middleware/infohashratelimit"
+	"github.com/chihaya/chihaya/middleware/intervalcompliance"
+	"github.com/chihaya/chihaya/middleware/iplimit"
+	"github.com/chihaya/chihaya/middleware/ipprivacy"
 	"github.com/chihaya/chihaya/middleware/jwt"
+	"github.com/chihaya/chihaya/middleware/leechratio"
+	"github.com/chihaya/chihaya/middleware/leftsanity"
+	"github.com/chihaya/chihaya/middleware/maintenance"
+	"github.com/chihaya/chihaya/middleware/minseeders"
+	"github.com/chihaya/chihaya/middleware/monitors"
+	"github.com/chihaya/chihaya/middleware/namedenylist"
+	"github.com/chihaya/chihaya/middleware/newinfohash"
+	"github.com/chihaya/chihaya/middleware/numwantbackpressure"
 	"github.com/chihaya/chihaya/middleware/nya"
 	"github.com/chihaya/chihaya/middleware/nya/stats"
 	"github.com/chihaya/chihaya/middleware/nya/whitelist"
+	"github.com/chihaya/chihaya/middleware/operatormessage"
+	"github.com/chihaya/chihaya/middleware/portprobe"
+	"github.com/chihaya/chihaya/middleware/remoteblocklist"
+	"github.com/chihaya/chihaya/middleware/requirestarted"
+	"github.com/chihaya/chihaya/middleware/roleinterval"
+	"github.com/chihaya/chihaya/middleware/scrapecontrol"
+	"github.com/chihaya/chihaya/middleware/scrapeinterval"
+	"github.com/chihaya/chihaya/middleware/seederless"
+	"github.com/chihaya/chihaya/middleware/tarpit"
+	"github.com/chihaya/chihaya/middleware/toptalkers"
+	"github.com/chihaya/chihaya/middleware/udpsession"
+	"github.com/chihaya/chihaya/middleware/useragent"
 	"github.com/chihaya/chihaya/middleware/varinterval"
+	"github.com/chihaya/chihaya/storage"
 
 	// Imported to register as Storage Drivers.
+	_ "github.com/chihaya/chihaya/storage/bolt"
 	_ "github.com/chihaya/chihaya/storage/memory"
 	_ "github.com/chihaya/chihaya/storage/memorybysubnet"
 )
@@ -39,9 +80,18 @@ func (hookCfgs hookConfigs) Names() (hookNames []string) {
 	return
 }
 
+type authenticatorConfig struct {
+	Name   string      `yaml:"name"`
+	Config interface{} `yaml:"config"`
+}
+
 type storageConfig struct {
 	Name   string      `yaml:"name"`
 	Config interface{} `yaml:"config"`
+
+	// CompactionSchedule is the schedule in crontab format at which the
+	// storage is compacted. Empty disables compaction.
+	CompactionSchedule string `yaml:"compaction_schedule"`
 }
 
 // Config represents the configuration used for executing Chihaya.
@@ -53,11 +103,58 @@ type Config struct {
 	Storage           storageConfig `yaml:"storage"`
 	PreHooks          hookConfigs   `yaml:"prehooks"`
 	PostHooks         hookConfigs   `yaml:"posthooks"`
+
+	// Authenticator is the Authenticator used by the frontends to identify
+	// clients before the middleware runs. The name is empty if none is
+	// configured.
+	Authenticator authenticatorConfig `yaml:"authenticator"`
+
+	// StorageShutdownTimeout is the maximum duration to wait for the
+	// storage to flush its state and shut down. Zero waits indefinitely.
+	StorageShutdownTimeout time.Duration `yaml:"storage_shutdown_timeout"`
+}
+
+// CreateAuthenticator creates an instance of the Authenticator configured in
+// a Config.
+//
+// Returns nil if no Authenticator is configured.
+func (cfg Config) CreateAuthenticator() (frontend.Authenticator, error) {
+	cfgBytes, err := yaml.Marshal(cfg.Authenticator.Config)
+	if err != nil {
+		panic("failed to remarshal valid YAML")
+	}
+
+	switch cfg.Authenticator.Name {
+	case "":
+		return nil, nil
+	case "passkey":
+		var pkCfg passkey.Config
+		err := yaml.Unmarshal(cfgBytes, &pkCfg)
+		if err != nil {
+			return nil, errors.New("invalid passkey authenticator config: " + err.Error())
+		}
+		return passkey.New(pkCfg)
+	case "jwt":
+		var jwtCfg jwt.AuthenticatorConfig
+		err := yaml.Unmarshal(cfgBytes, &jwtCfg)
+		if err != nil {
+			return nil, errors.New("invalid JWT authenticator config: " + err.Error())
+		}
+		auth, err := jwt.NewAuthenticator(jwtCfg)
+		if err != nil {
+			return nil, errors.New("invalid JWT authenticator config: " + err.Error())
+		}
+		return auth, nil
+	}
+
+	return nil, errors.New("unknown authenticator: " + cfg.Authenticator.Name)
 }
 
 // CreateHooks creates instances of Hooks for all of the PreHooks and PostHooks
 // configured in a Config.
-func (cfg Config) CreateHooks() (preHooks, postHooks []middleware.Hook, err error) {
+//
+// Hooks that need to read the state of swarms use the provided PeerStore.
+func (cfg Config) CreateHooks(ps storage.PeerStore) (preHooks, postHooks []middleware.Hook, err error) {
 	for _, hookCfg := range cfg.PreHooks {
 		cfgBytes, err := yaml.Marshal(hookCfg.Config)
 		if err != nil {
@@ -87,6 +184,39 @@ func (cfg Config) CreateHooks() (preHooks, postHooks []middleware.Hook, err erro
 				return nil, nil, errors.New("invalid client approval middleware config: " + err.Error())
 			}
 			preHooks = append(preHooks, hook)
+		case "monitor detection":
+			var mdCfg monitors.Config
+			err := yaml.Unmarshal(cfgBytes, &mdCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid monitor detection middleware config: " + err.Error())
+			}
+			hook, err := monitors.NewHook(mdCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid monitor detection middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "numwant backpressure":
+			var nbCfg numwantbackpressure.Config
+			err := yaml.Unmarshal(cfgBytes, &nbCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid numwant backpressure middleware config: " + err.Error())
+			}
+			hook, err := numwantbackpressure.NewHook(nbCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid numwant backpressure middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "interval compliance":
+			var icCfg intervalcompliance.Config
+			err := yaml.Unmarshal(cfgBytes, &icCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid interval compliance middleware config: " + err.Error())
+			}
+			hook, err := intervalcompliance.NewHook(icCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid interval compliance middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
 		case "interval variation":
 			var viCfg varinterval.Config
 			err := yaml.Unmarshal(cfgBytes, &viCfg)
@@ -98,6 +228,369 @@ func (cfg Config) CreateHooks() (preHooks, postHooks []middleware.Hook, err erro
 				return nil, nil, errors.New("invalid interval variation middleware config: " + err.Error())
 			}
 			preHooks = append(preHooks, hook)
+		case "role interval":
+			var riCfg roleinterval.Config
+			err := yaml.Unmarshal(cfgBytes, &riCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid role interval middleware config: " + err.Error())
+			}
+			hook, err := roleinterval.NewHook(riCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid role interval middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "left sanity":
+			var lsCfg leftsanity.Config
+			err := yaml.Unmarshal(cfgBytes, &lsCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid left sanity middleware config: " + err.Error())
+			}
+			hook, err := leftsanity.NewHook(lsCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid left sanity middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "ip privacy":
+			var ipCfg ipprivacy.Config
+			err := yaml.Unmarshal(cfgBytes, &ipCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid ip privacy middleware config: " + err.Error())
+			}
+			hook, err := ipprivacy.NewHook(ipCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid ip privacy middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "announce history":
+			var ahCfg announcehistory.Config
+			err := yaml.Unmarshal(cfgBytes, &ahCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid announce history middleware config: " + err.Error())
+			}
+			hook, err := announcehistory.NewHook(ahCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid announce history middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "announce sampler":
+			var asCfg announcesampler.Config
+			err := yaml.Unmarshal(cfgBytes, &asCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid announce sampler middleware config: " + err.Error())
+			}
+			hook, err := announcesampler.NewHook(asCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid announce sampler middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "announce scheme":
+			var ascCfg announcescheme.Config
+			err := yaml.Unmarshal(cfgBytes, &ascCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid announce scheme middleware config: " + err.Error())
+			}
+			hook, err := announcescheme.NewHook(ascCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid announce scheme middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "interval backpressure":
+			var bpCfg backpressure.Config
+			err := yaml.Unmarshal(cfgBytes, &bpCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid interval backpressure middleware config: " + err.Error())
+			}
+			hook, err := backpressure.NewHook(bpCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid interval backpressure middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "datacenter":
+			var dcCfg datacenter.Config
+			err := yaml.Unmarshal(cfgBytes, &dcCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid datacenter middleware config: " + err.Error())
+			}
+			hook, err := datacenter.NewHook(dcCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid datacenter middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "crypto networks":
+			var cnCfg cryptonetworks.Config
+			err := yaml.Unmarshal(cfgBytes, &cnCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid crypto networks middleware config: " + err.Error())
+			}
+			hook, err := cryptonetworks.NewHook(cnCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid crypto networks middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "scrape control":
+			var scCfg scrapecontrol.Config
+			err := yaml.Unmarshal(cfgBytes, &scCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid scrape control middleware config: " + err.Error())
+			}
+			hook, err := scrapecontrol.NewHook(scCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid scrape control middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "api metadata":
+			var amCfg apimetadata.Config
+			err := yaml.Unmarshal(cfgBytes, &amCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid api metadata middleware config: " + err.Error())
+			}
+			hook, err := apimetadata.NewHook(amCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid api metadata middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "maintenance":
+			var mCfg maintenance.Config
+			err := yaml.Unmarshal(cfgBytes, &mCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid maintenance middleware config: " + err.Error())
+			}
+			hook, err := maintenance.NewHook(mCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid maintenance middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "bootstrap peers":
+			var bpCfg bootstrappeers.Config
+			err := yaml.Unmarshal(cfgBytes, &bpCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid bootstrap peers middleware config: " + err.Error())
+			}
+			hook, err := bootstrappeers.NewHook(bpCfg, ps)
+			if err != nil {
+				return nil, nil, errors.New("invalid bootstrap peers middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "top talkers":
+			var ttCfg toptalkers.Config
+			err := yaml.Unmarshal(cfgBytes, &ttCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid top talkers middleware config: " + err.Error())
+			}
+			hook, err := toptalkers.NewHook(ttCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid top talkers middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "seederless interval":
+			var slCfg seederless.Config
+			err := yaml.Unmarshal(cfgBytes, &slCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid seederless interval middleware config: " + err.Error())
+			}
+			hook, err := seederless.NewHook(slCfg, ps)
+			if err != nil {
+				return nil, nil, errors.New("invalid seederless interval middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "ip limit":
+			var ilCfg iplimit.Config
+			err := yaml.Unmarshal(cfgBytes, &ilCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid ip limit middleware config: " + err.Error())
+			}
+			hook, err := iplimit.NewHook(ilCfg, ps)
+			if err != nil {
+				return nil, nil, errors.New("invalid ip limit middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "infohash rate limit":
+			var irlCfg infohashratelimit.Config
+			err := yaml.Unmarshal(cfgBytes, &irlCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid infohash rate limit middleware config: " + err.Error())
+			}
+			hook, err := infohashratelimit.NewHook(irlCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid infohash rate limit middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "min seeders":
+			var msCfg minseeders.Config
+			err := yaml.Unmarshal(cfgBytes, &msCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid min seeders middleware config: " + err.Error())
+			}
+			hook, err := minseeders.NewHook(msCfg, ps)
+			if err != nil {
+				return nil, nil, errors.New("invalid min seeders middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "consistent peer id":
+			var cpCfg consistentpeerid.Config
+			err := yaml.Unmarshal(cfgBytes, &cpCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid consistent peer id middleware config: " + err.Error())
+			}
+			hook, err := consistentpeerid.NewHook(cpCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid consistent peer id middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "require started":
+			var rsCfg requirestarted.Config
+			err := yaml.Unmarshal(cfgBytes, &rsCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid require started middleware config: " + err.Error())
+			}
+			hook, err := requirestarted.NewHook(rsCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid require started middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "udp session":
+			var usCfg udpsession.Config
+			err := yaml.Unmarshal(cfgBytes, &usCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid udp session middleware config: " + err.Error())
+			}
+			hook, err := udpsession.NewHook(usCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid udp session middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "tarpit":
+			var tpCfg tarpit.Config
+			err := yaml.Unmarshal(cfgBytes, &tpCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid tarpit middleware config: " + err.Error())
+			}
+			hook, err := tarpit.NewHook(tpCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid tarpit middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "first announce interval":
+			var faCfg firstannounce.Config
+			err := yaml.Unmarshal(cfgBytes, &faCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid first announce interval middleware config: " + err.Error())
+			}
+			hook, err := firstannounce.NewHook(faCfg, ps)
+			if err != nil {
+				return nil, nil, errors.New("invalid first announce interval middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "hybrid torrents":
+			var htCfg hybridtorrents.Config
+			err := yaml.Unmarshal(cfgBytes, &htCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid hybrid torrents middleware config: " + err.Error())
+			}
+			hook, err := hybridtorrents.NewHook(htCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid hybrid torrents middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "user agent denylist":
+			var uaCfg useragent.Config
+			err := yaml.Unmarshal(cfgBytes, &uaCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid user agent denylist middleware config: " + err.Error())
+			}
+			hook, err := useragent.NewHook(uaCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid user agent denylist middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "infohash limit":
+			var ihlCfg infohashlimit.Config
+			err := yaml.Unmarshal(cfgBytes, &ihlCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid infohash limit middleware config: " + err.Error())
+			}
+			hook, err := infohashlimit.NewHook(ihlCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid infohash limit middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "min scrape interval":
+			var msiCfg scrapeinterval.Config
+			err := yaml.Unmarshal(cfgBytes, &msiCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid min scrape interval middleware config: " + err.Error())
+			}
+			hook, err := scrapeinterval.NewHook(msiCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid min scrape interval middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "remote blocklist":
+			var rbCfg remoteblocklist.Config
+			err := yaml.Unmarshal(cfgBytes, &rbCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid remote blocklist middleware config: " + err.Error())
+			}
+			hook, err := remoteblocklist.NewHook(rbCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid remote blocklist middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "operator message":
+			var omCfg operatormessage.Config
+			err := yaml.Unmarshal(cfgBytes, &omCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid operator message middleware config: " + err.Error())
+			}
+			hook, err := operatormessage.NewHook(omCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid operator message middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "port probe":
+			var ppCfg portprobe.Config
+			err := yaml.Unmarshal(cfgBytes, &ppCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid port probe middleware config: " + err.Error())
+			}
+			hook, err := portprobe.NewHook(ppCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid port probe middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "new infohash":
+			var niCfg newinfohash.Config
+			err := yaml.Unmarshal(cfgBytes, &niCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid new infohash middleware config: " + err.Error())
+			}
+			hook, err := newinfohash.NewHook(niCfg, ps)
+			if err != nil {
+				return nil, nil, errors.New("invalid new infohash middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "leech ratio":
+			var lrCfg leechratio.Config
+			err := yaml.Unmarshal(cfgBytes, &lrCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid leech ratio middleware config: " + err.Error())
+			}
+			hook, err := leechratio.NewHook(lrCfg, ps)
+			if err != nil {
+				return nil, nil, errors.New("invalid leech ratio middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
+		case "torrent name denylist":
+			var ndCfg namedenylist.Config
+			err := yaml.Unmarshal(cfgBytes, &ndCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid torrent name denylist middleware config: " + err.Error())
+			}
+			hook, err := namedenylist.NewHook(ndCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid torrent name denylist middleware config: " + err.Error())
+			}
+			preHooks = append(preHooks, hook)
 		case "nya prehook":
 			var nyaConfig nya.Config
 			err := yaml.Unmarshal(cfgBytes, &nyaConfig)
@@ -7,6 +7,7 @@ import (
 	"runtime/pprof"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -16,16 +17,18 @@ import (
 	"github.com/chihaya/chihaya/middleware"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/prometheus"
+	"github.com/chihaya/chihaya/pkg/schedule"
 	"github.com/chihaya/chihaya/pkg/stop"
 	"github.com/chihaya/chihaya/storage"
 )
 
 // Run represents the state of a running instance of Chihaya.
 type Run struct {
-	configFilePath string
-	peerStore      storage.PeerStore
-	logic          *middleware.Logic
-	sg             *stop.Group
+	configFilePath  string
+	peerStore       storage.PeerStore
+	logic           *middleware.Logic
+	sg              *stop.Group
+	shutdownTimeout time.Duration
 }
 
 // NewRun runs an instance of Chihaya.
@@ -48,6 +51,7 @@ func (r *Run) Start(ps storage.PeerStore) error {
 	cfg := configFile.Chihaya
 
 	r.sg = stop.NewGroup()
+	r.shutdownTimeout = cfg.StorageShutdownTimeout
 
 	log.Info("starting Prometheus server", log.Fields{"addr": cfg.PrometheusAddr})
 	r.sg.Add(prometheus.NewServer(cfg.PrometheusAddr))
@@ -61,7 +65,20 @@ func (r *Run) Start(ps storage.PeerStore) error {
 	}
 	r.peerStore = ps
 
-	preHooks, postHooks, err := cfg.CreateHooks()
+	if cfg.Storage.CompactionSchedule != "" {
+		s, err := schedule.Parse(cfg.Storage.CompactionSchedule)
+		if err != nil {
+			return errors.New("invalid storage compaction schedule: " + err.Error())
+		}
+		compaction, err := storage.NewCompactionScheduler(r.peerStore, s)
+		if err != nil {
+			return errors.New("failed to schedule storage compaction: " + err.Error())
+		}
+		log.Info("scheduled storage compaction", log.Fields{"schedule": cfg.Storage.CompactionSchedule})
+		r.sg.Add(compaction)
+	}
+
+	preHooks, postHooks, err := cfg.CreateHooks(r.peerStore)
 	if err != nil {
 		return errors.New("failed to validate hook config: " + err.Error())
 	}
@@ -69,7 +86,23 @@ func (r *Run) Start(ps storage.PeerStore) error {
 		"preHooks":  cfg.PreHooks.Names(),
 		"postHooks": cfg.PostHooks.Names(),
 	})
-	r.logic = middleware.NewLogic(cfg.Config, r.peerStore, preHooks, postHooks)
+	r.logic, err = middleware.NewLogic(cfg.Config, r.peerStore, preHooks, postHooks)
+	if err != nil {
+		return errors.New("failed to validate middleware config: " + err.Error())
+	}
+
+	auth, err := cfg.CreateAuthenticator()
+	if err != nil {
+		return errors.New("failed to validate authenticator config: " + err.Error())
+	}
+	if auth != nil {
+		log.Info("starting authenticator", log.Fields{"name": cfg.Authenticator.Name})
+		if stopper, ok := auth.(stop.Stopper); ok {
+			r.sg.Add(stopper)
+		}
+	}
+	cfg.HTTPConfig.Authenticator = auth
+	cfg.UDPConfig.Authenticator = auth
 
 	if cfg.HTTPConfig.Addr != "" {
 		log.Info("starting HTTP frontend", cfg.HTTPConfig.LogFields())
@@ -115,7 +148,7 @@ func (r *Run) Stop(keepPeerStore bool) (storage.PeerStore, error) {
 
 	if !keepPeerStore {
 		log.Debug("stopping peer store")
-		if err, closed := <-r.peerStore.Stop(); !closed {
+		if err := r.stopPeerStore(); err != nil {
 			return nil, err
 		}
 		r.peerStore = nil
@@ -124,6 +157,25 @@ func (r *Run) Stop(keepPeerStore bool) (storage.PeerStore, error) {
 	return r.peerStore, nil
 }
 
+// stopPeerStore stops the peer store, allowing it to flush its state, and
+// waits for it to finish for at most the configured shutdown timeout.
+func (r *Run) stopPeerStore() error {
+	var timeout <-chan time.Time
+	if r.shutdownTimeout > 0 {
+		timeout = time.After(r.shutdownTimeout)
+	}
+
+	select {
+	case err, ok := <-r.peerStore.Stop():
+		if ok {
+			return errors.New("failed while shutting down peer store: " + err.Error())
+		}
+		return nil
+	case <-timeout:
+		return errors.New("timed out while shutting down peer store")
+	}
+}
+
 // RunCmdFunc implements a Cobra command that runs an instance of Chihaya and
 // handles reloading and shutdown via process signals.
 func RunCmdFunc(cmd *cobra.Command, args []string) error {
@@ -0,0 +1,47 @@
+package frontend
+
+import (
+	"context"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Credentials are the authentication data a frontend extracted from a
+// request.
+type Credentials struct {
+	// Params are the parameters of the request.
+	// For UDP, these are the URL data described in BEP 41, if any.
+	Params bittorrent.Params
+
+	// Token is a token provided outside of the Params, e.g. as a bearer
+	// token in the HTTP Authorization header.
+	Token string
+}
+
+// Authenticator is the interface used by a frontend to authenticate requests
+// before they are passed to the TrackerLogic.
+//
+// Authenticators set the UserID of the client in the context, so that
+// middleware does not need to parse credentials itself.
+type Authenticator interface {
+	// Authenticate verifies the Credentials of a request.
+	//
+	// Returns the context with the UserID of the client set and no error on
+	// success. Requests without credentials are either rejected or passed
+	// on with the context unchanged, depending on the Authenticator.
+	Authenticate(context.Context, Credentials) (context.Context, error)
+}
+
+type userIDKey struct{}
+
+// UserIDKey is the key under which Authenticators store the ID of an
+// authenticated client in the context of a request.
+// The value is expected to be of type string.
+var UserIDKey = userIDKey{}
+
+// UserID returns the ID of the authenticated client from the context of a
+// request, if any.
+func UserID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(UserIDKey).(string)
+	return id, ok
+}
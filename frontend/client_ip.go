@@ -0,0 +1,38 @@
+package frontend
+
+import (
+	"context"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+type clientIPKey struct{}
+
+// ClientIPKey is the key under which frontends store the address a request
+// was received from in its context, so that middleware can tell the clients
+// of requests without a Peer, e.g. Scrapes, apart.
+// The value is expected to be of type bittorrent.IP. Addresses provided by
+// the client via parameters are never used.
+var ClientIPKey = clientIPKey{}
+
+// ClientIP returns the address a request was received from from its context,
+// if any.
+func ClientIP(ctx context.Context) (bittorrent.IP, bool) {
+	ip, ok := ctx.Value(ClientIPKey).(bittorrent.IP)
+	return ip, ok
+}
+
+type remoteIPKey struct{}
+
+// RemoteIPKey is the key under which frontends store the address of the
+// connection a request was received over in its context. It differs from the
+// ClientIP if the request was forwarded by a reverse proxy.
+// The value is expected to be of type bittorrent.IP.
+var RemoteIPKey = remoteIPKey{}
+
+// RemoteIP returns the address of the connection a request was received over
+// from its context, if any.
+func RemoteIP(ctx context.Context) (bittorrent.IP, bool) {
+	ip, ok := ctx.Value(RemoteIPKey).(bittorrent.IP)
+	return ip, ok
+}
@@ -0,0 +1,112 @@
+package http
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// maxChallengeDifficulty bounds the work required from challenged requests.
+const maxChallengeDifficulty = 32
+
+// ErrInvalidChallengeDifficulty is returned for a BotChallengeConfig with an
+// invalid Difficulty.
+var ErrInvalidChallengeDifficulty = errors.New("bot challenge difficulty must be between 0 and 32")
+
+// errBotChallenged indicates that a request was challenged as a suspected bot.
+var errBotChallenged = bittorrent.NewClientError("bot_challenge", "bot challenge")
+
+// BotChallengeConfig holds the configuration of the challenge of requests
+// that don't look like they were sent by a BitTorrent client.
+type BotChallengeConfig struct {
+	// Enabled specifies whether announces and scrapes are challenged.
+	Enabled bool `yaml:"enabled"`
+
+	// BlockedUserAgents are substrings of User-Agent headers of clients
+	// that are challenged even if their requests look valid, e.g. Mozilla/
+	// for browsers and crawlers.
+	BlockedUserAgents []string `yaml:"blocked_user_agents"`
+
+	// Difficulty is the number of leading zero bits of the SHA-256 of the
+	// request URI that a challenged request must achieve via the pow
+	// parameter to pass. Zero challenges without a way to pass.
+	Difficulty int `yaml:"difficulty"`
+}
+
+// looksLikeClient reports whether the request for action looks like it was
+// sent by a BitTorrent client, i.e. it carries the parameters required by the
+// action and no blocked User-Agent.
+func (cfg BotChallengeConfig) looksLikeClient(r *http.Request, action string) bool {
+	userAgent := r.Header.Get("User-Agent")
+	for _, blocked := range cfg.BlockedUserAgents {
+		if strings.Contains(userAgent, blocked) {
+			return false
+		}
+	}
+
+	qp, err := bittorrent.ParseURLData(r.RequestURI)
+	if err != nil {
+		return false
+	}
+
+	infoHashes := qp.InfoHashes()
+	if action == "scrape" {
+		return len(infoHashes) > 0
+	}
+
+	peerID, _ := qp.String("peer_id")
+	port, _ := qp.String("port")
+	_, err = strconv.ParseUint(port, 10, 16)
+	return len(infoHashes) == 1 && len(peerID) == 20 && err == nil
+}
+
+// solved reports whether the request carries a pow parameter that makes the
+// SHA-256 of its URI start with Difficulty zero bits.
+func (cfg BotChallengeConfig) solved(r *http.Request) bool {
+	if cfg.Difficulty == 0 || !strings.Contains(r.RequestURI, "pow=") {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(r.RequestURI))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	return zeros >= cfg.Difficulty
+}
+
+// challenge writes a challenge in response to the request for action and
+// returns true, unless challenges are disabled, the request looks like it was
+// sent by a BitTorrent client or it solved the challenge.
+//
+// The challenge is deliberately not a BitTorrent response, so that it is
+// distinguishable from any response to a client.
+func (f *Frontend) challenge(w http.ResponseWriter, r *http.Request, action string) bool {
+	if !f.BotChallenge.Enabled || f.BotChallenge.looksLikeClient(r, action) || f.BotChallenge.solved(r) {
+		return false
+	}
+
+	promBotChallengesTotal.WithLabelValues(action).Inc()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if f.BotChallenge.Difficulty == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("bot challenge: request does not look like a BitTorrent client\n"))
+		return true
+	}
+
+	w.Header().Set("X-Bot-Challenge", "sha256 "+strconv.Itoa(f.BotChallenge.Difficulty))
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("bot challenge: append a pow parameter so that the SHA-256 of the request URI starts with " +
+		strconv.Itoa(f.BotChallenge.Difficulty) + " zero bits\n"))
+	return true
+}
@@ -0,0 +1,60 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const clientAnnounce = "/announce?info_hash=%89%d4%bcR%11%16%ca%1dB%a2%f3%0d%1f%27M%94%e4h%1d%aa&peer_id=-TR2940-k8hj0wgej6ch&port=6881&left=0"
+
+func TestBotChallenge(t *testing.T) {
+	f := &Frontend{Config: Config{BotChallenge: BotChallengeConfig{
+		Enabled:           true,
+		BlockedUserAgents: []string{"Mozilla/"},
+		Difficulty:        8,
+	}}}
+
+	var table = []struct {
+		uri        string
+		action     string
+		userAgent  string
+		challenged bool
+	}{
+		{clientAnnounce, "announce", "Transmission/2.94", false},
+		{"/scrape?info_hash=%89%d4%bcR%11%16%ca%1dB%a2%f3%0d%1f%27M%94%e4h%1d%aa", "scrape", "", false},
+		{clientAnnounce, "announce", "Mozilla/5.0", true},
+		{"/announce", "announce", "", true},
+		{"/announce?info_hash=%89%d4%bcR%11%16%ca%1dB%a2%f3%0d%1f%27M%94%e4h%1d%aa&peer_id=short&port=6881", "announce", "", true},
+		{"/scrape", "scrape", "", true},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		r.Header.Set("User-Agent", tt.userAgent)
+		w := httptest.NewRecorder()
+		require.Equal(t, tt.challenged, f.challenge(w, r, tt.action), tt.uri)
+		if tt.challenged {
+			require.Equal(t, http.StatusForbidden, w.Code)
+			require.Equal(t, "sha256 8", w.Header().Get("X-Bot-Challenge"))
+		}
+	}
+
+	// A solved challenge passes.
+	var solved *http.Request
+	for pow := 0; solved == nil; pow++ {
+		r := httptest.NewRequest("GET", clientAnnounce+"&pow="+strconv.Itoa(pow), nil)
+		r.Header.Set("User-Agent", "Mozilla/5.0")
+		if f.BotChallenge.solved(r) {
+			solved = r
+		}
+	}
+	require.False(t, f.challenge(httptest.NewRecorder(), solved, "announce"))
+
+	// Without a difficulty, challenges can't be solved.
+	f.BotChallenge.Difficulty = 0
+	require.True(t, f.challenge(httptest.NewRecorder(), solved, "announce"))
+}
@@ -0,0 +1,108 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultCompressionThreshold is the size in bytes above which responses are
+// compressed, if none is configured.
+const defaultCompressionThreshold = 1024
+
+// Compressors are expensive to allocate, so they are reused.
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// acceptedEncoding returns the content coding among gzip and deflate that is
+// preferred by the given Accept-Encoding header, or an empty string if
+// neither is accepted.
+//
+// Ties are resolved in favor of gzip.
+func acceptedEncoding(header string) string {
+	var gzipQ, deflateQ, wildcardQ float64 = -1, -1, -1
+	for _, part := range strings.Split(header, ",") {
+		coding, q := strings.TrimSpace(part), 1.0
+		if i := strings.IndexByte(coding, ';'); i >= 0 {
+			param := strings.TrimSpace(coding[i+1:])
+			coding = strings.TrimSpace(coding[:i])
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					continue
+				}
+			}
+		}
+
+		switch strings.ToLower(coding) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "deflate":
+			deflateQ = q
+		case "*":
+			wildcardQ = q
+		}
+	}
+
+	if gzipQ < 0 {
+		gzipQ = wildcardQ
+	}
+	if deflateQ < 0 {
+		deflateQ = wildcardQ
+	}
+
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return "gzip"
+	case deflateQ > 0:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// writeCompressed writes the body produced by encode to w. It is compressed
+// if it is larger than threshold bytes and the client accepts gzip or
+// deflate.
+func writeCompressed(w http.ResponseWriter, r *http.Request, threshold int, encode func(io.Writer) error) error {
+	var body bytes.Buffer
+	if err := encode(&body); err != nil {
+		return err
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+	if body.Len() <= threshold || encoding == "" {
+		_, err := w.Write(body.Bytes())
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+
+	// The deflate content coding is the zlib format, not raw deflate.
+	if encoding == "gzip" {
+		gw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(gw)
+		gw.Reset(w)
+		if _, err := gw.Write(body.Bytes()); err != nil {
+			return err
+		}
+		return gw.Close()
+	}
+
+	zw := zlibWriters.Get().(*zlib.Writer)
+	defer zlibWriters.Put(zw)
+	zw.Reset(w)
+	if _, err := zw.Write(body.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
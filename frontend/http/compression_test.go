@@ -0,0 +1,84 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	var table = []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"*", "gzip"},
+		{"*, gzip;q=0", "deflate"},
+		{"br, GZIP", "gzip"},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, acceptedEncoding(tt.header), tt.header)
+	}
+}
+
+func TestWriteCompressed(t *testing.T) {
+	body := bytes.Repeat([]byte("d8:completei1e10:incompletei0ee"), 100)
+	encode := func(w io.Writer) error {
+		_, err := w.Write(body)
+		return err
+	}
+
+	var table = []struct {
+		acceptEncoding string
+		threshold      int
+		expected       string
+	}{
+		{"gzip", len(body), ""},
+		{"", 1, ""},
+		{"gzip", 1, "gzip"},
+		{"deflate", 1, "deflate"},
+	}
+
+	for _, tt := range table {
+		req := httptest.NewRequest("GET", "/scrape", nil)
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		rec := httptest.NewRecorder()
+
+		require.Nil(t, writeCompressed(rec, req, tt.threshold, encode))
+		require.Equal(t, tt.expected, rec.Header().Get("Content-Encoding"))
+		require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+
+		if tt.expected != "" {
+			require.True(t, rec.Body.Len() < len(body))
+		}
+
+		var r io.Reader = rec.Body
+		switch tt.expected {
+		case "gzip":
+			gr, err := gzip.NewReader(rec.Body)
+			require.Nil(t, err)
+			r = gr
+		case "deflate":
+			zr, err := zlib.NewReader(rec.Body)
+			require.Nil(t, err)
+			r = zr
+		}
+
+		got, err := ioutil.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, body, got)
+	}
+}
@@ -5,8 +5,11 @@ package http
 import (
 	"context"
 	"crypto/tls"
+	"io"
+	"math"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -14,15 +17,31 @@ import (
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/load"
 	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/ratelimit"
 )
 
 func init() {
 	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(promRateLimitedRequestsTotal)
+	prometheus.MustRegister(promBotChallengesTotal)
 }
 
 // ErrInvalidIP indicates an invalid IP.
-var ErrInvalidIP = bittorrent.ClientError("invalid IP")
+var ErrInvalidIP = bittorrent.NewClientError("invalid_ip", "invalid IP")
+
+// ErrRateLimited indicates that a request was rejected because the frontend
+// is receiving more requests than configured.
+var ErrRateLimited = bittorrent.NewClientError("rate_limited", "rate limit exceeded")
+
+// ErrOverloaded indicates that a request was rejected because the frontend
+// is processing the maximum number of concurrent requests.
+var ErrOverloaded = bittorrent.NewClientError("overloaded", "tracker overloaded")
+
+// defaultRateLimitRetryInterval is the retry interval communicated to
+// rate limited clients if none is configured.
+const defaultRateLimitRetryInterval = time.Minute
 
 var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
@@ -33,12 +52,28 @@ var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	[]string{"action", "address_family", "error"},
 )
 
+var promRateLimitedRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_http_rate_limited_requests_total",
+		Help: "The number of requests rejected because of the global rate limit",
+	},
+	[]string{"action"},
+)
+
+var promBotChallengesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_http_bot_challenges_total",
+		Help: "The number of requests challenged as suspected bots",
+	},
+	[]string{"action"},
+)
+
 // recordResponseDuration records the duration of time to respond to a Request
 // in milliseconds .
 func recordResponseDuration(action string, af *bittorrent.AddressFamily, err error, duration time.Duration) {
 	var errString string
 	if err != nil {
-		if _, ok := err.(bittorrent.ClientError); ok {
+		if bittorrent.IsClientError(err) {
 			errString = err.Error()
 		} else {
 			errString = "internal error"
@@ -71,28 +106,134 @@ type Config struct {
 	TLSKeyPath          string        `yaml:"tls_key_path"`
 	EnableRequestTiming bool          `yaml:"enable_request_timing"`
 	ApiAuth             string        `yaml:"api_auth"`
+
+	// SchemeHeader is the HTTP header containing the scheme of the request
+	// of the client, e.g. X-Forwarded-Proto if a reverse proxy terminates
+	// TLS. Requests received via TLS are always considered https.
+	SchemeHeader string `yaml:"scheme_header"`
+
+	// EnableRequestMetrics specifies whether the number of requests, the
+	// number of requests in flight and the size of the responses are
+	// recorded.
+	EnableRequestMetrics bool `yaml:"enable_request_metrics"`
+
+	// AnnounceRateLimit and ScrapeRateLimit are the maximum number of
+	// announces and scrapes per second accepted by the frontend.
+	// Zero disables the limit.
+	AnnounceRateLimit      float64       `yaml:"announce_rate_limit"`
+	ScrapeRateLimit        float64       `yaml:"scrape_rate_limit"`
+	RateLimitRetryInterval time.Duration `yaml:"rate_limit_retry_interval"`
+
+	// MaxConcurrentRequests is the maximum number of announces and scrapes
+	// processed concurrently.
+	// Zero disables the limit.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+
+	// LogRejections specifies whether announces and scrapes rejected by the
+	// middleware or the frontend are logged along with the reason.
+	LogRejections bool `yaml:"log_rejections"`
+
+	// StrictParams specifies whether announces and scrapes with unknown
+	// query parameters are rejected. By default they are ignored.
+	StrictParams bool `yaml:"strict_params"`
+
+	// AllowedParams are query parameters accepted in strict mode in
+	// addition to the known announce and scrape parameters, e.g. parameters
+	// read by middleware.
+	AllowedParams []string `yaml:"allowed_params"`
+
+	// CompressScrapes specifies whether scrape responses larger than
+	// CompressionThreshold bytes are compressed with gzip or deflate, if the
+	// client accepts it.
+	CompressScrapes      bool `yaml:"compress_scrapes"`
+	CompressionThreshold int  `yaml:"compression_threshold"`
+
+	// BotChallenge configures the challenge of announces and scrapes that
+	// don't look like they were sent by a BitTorrent client.
+	BotChallenge BotChallengeConfig `yaml:"bot_challenge"`
+
+	// Authenticator, if set, authenticates announces and scrapes before
+	// they are passed to the middleware.
+	Authenticator frontend.Authenticator `yaml:"-"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
-		"addr":                cfg.Addr,
-		"readTimeout":         cfg.ReadTimeout,
-		"writeTimeout":        cfg.WriteTimeout,
-		"allowIPSpoofing":     cfg.AllowIPSpoofing,
-		"realIPHeader":        cfg.RealIPHeader,
-		"tlsCertPath":         cfg.TLSCertPath,
-		"tlsKeyPath":          cfg.TLSKeyPath,
-		"enableRequestTiming": cfg.EnableRequestTiming,
-		"api_auth":            cfg.ApiAuth,
+		"addr":                 cfg.Addr,
+		"readTimeout":          cfg.ReadTimeout,
+		"writeTimeout":         cfg.WriteTimeout,
+		"allowIPSpoofing":      cfg.AllowIPSpoofing,
+		"realIPHeader":         cfg.RealIPHeader,
+		"schemeHeader":         cfg.SchemeHeader,
+		"tlsCertPath":          cfg.TLSCertPath,
+		"tlsKeyPath":           cfg.TLSKeyPath,
+		"enableRequestTiming":  cfg.EnableRequestTiming,
+		"enableRequestMetrics": cfg.EnableRequestMetrics,
+		"api_auth":             cfg.ApiAuth,
+		"announceRateLimit":    cfg.AnnounceRateLimit,
+		"scrapeRateLimit":      cfg.ScrapeRateLimit,
+		"rateLimitRetry":       cfg.RateLimitRetryInterval,
+		"maxConcurrent":        cfg.MaxConcurrentRequests,
+		"logRejections":        cfg.LogRejections,
+		"strictParams":         cfg.StrictParams,
+		"allowedParams":        cfg.AllowedParams,
+		"compressScrapes":      cfg.CompressScrapes,
+		"compressionThreshold": cfg.CompressionThreshold,
+		"botChallenge":         cfg.BotChallenge.Enabled,
 	}
 }
 
+// meteredResponseWriter is an http.ResponseWriter that counts the bytes
+// written.
+type meteredResponseWriter struct {
+	http.ResponseWriter
+	written int
+}
+
+// Write implements the io.Writer interface for a meteredResponseWriter.
+func (w *meteredResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += n
+	return n, err
+}
+
+// meter records the metrics of a request for action, if enabled.
+//
+// The returned http.ResponseWriter must be used for the response and the
+// returned function must be called once the response has been written.
+func (f *Frontend) meter(w http.ResponseWriter, action string) (http.ResponseWriter, func()) {
+	if !f.EnableRequestMetrics {
+		return w, func() {}
+	}
+
+	frontend.RecordRequestStart("http")
+	mw := &meteredResponseWriter{ResponseWriter: w}
+	return mw, func() { frontend.RecordRequestEnd("http", action, mw.written) }
+}
+
+// newLimiter creates a limiter for the given rate per second.
+// A rate <= 0 disables limiting.
+func newLimiter(rate float64) *ratelimit.Limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return ratelimit.New(rate, int(math.Ceil(rate)))
+}
+
 // Frontend represents the state of an HTTP BitTorrent Frontend.
 type Frontend struct {
 	srv    *http.Server
 	tlsCfg *tls.Config
 
+	announceLimiter *ratelimit.Limiter
+	scrapeLimiter   *ratelimit.Limiter
+	concurrency     *load.Limiter
+
+	// allowedParams is nil unless StrictParams is enabled.
+	allowedParams map[string]struct{}
+
 	logic frontend.TrackerLogic
 	Config
 }
@@ -100,9 +241,35 @@ type Frontend struct {
 // NewFrontend creates a new instance of an HTTP Frontend that asynchronously
 // serves requests.
 func NewFrontend(logic frontend.TrackerLogic, cfg Config) (*Frontend, error) {
+	if cfg.RateLimitRetryInterval <= 0 {
+		cfg.RateLimitRetryInterval = defaultRateLimitRetryInterval
+	}
+	if cfg.CompressionThreshold <= 0 {
+		cfg.CompressionThreshold = defaultCompressionThreshold
+	}
+
 	f := &Frontend{
-		logic:  logic,
-		Config: cfg,
+		announceLimiter: newLimiter(cfg.AnnounceRateLimit),
+		scrapeLimiter:   newLimiter(cfg.ScrapeRateLimit),
+		concurrency:     load.NewLimiter(cfg.MaxConcurrentRequests),
+		logic:           logic,
+		Config:          cfg,
+	}
+
+	if cfg.BotChallenge.Difficulty < 0 || cfg.BotChallenge.Difficulty > maxChallengeDifficulty {
+		return nil, ErrInvalidChallengeDifficulty
+	}
+
+	if cfg.StrictParams {
+		f.allowedParams = make(map[string]struct{}, len(cfg.AllowedParams))
+		for _, key := range cfg.AllowedParams {
+			f.allowedParams[strings.ToLower(key)] = struct{}{}
+		}
+
+		// Solved challenges carry the pow parameter.
+		if cfg.BotChallenge.Enabled && cfg.BotChallenge.Difficulty > 0 {
+			f.allowedParams["pow"] = struct{}{}
+		}
 	}
 
 	// If TLS is enabled, create a key pair.
@@ -128,6 +295,8 @@ func NewFrontend(logic frontend.TrackerLogic, cfg Config) (*Frontend, error) {
 
 // Stop provides a thread-safe way to shutdown a currently running Frontend.
 func (f *Frontend) Stop() <-chan error {
+	f.concurrency.Unregister()
+
 	c := make(chan error)
 	go func() {
 		if err := f.srv.Shutdown(context.Background()); err != nil {
@@ -145,16 +314,105 @@ func (f *Frontend) handler() http.Handler {
 	router.GET("/announce", f.announceRoute)
 	router.GET("/scrape", f.scrapeRoute)
 	router.GET("/api", f.apiRoute)
+
+	// Announces and scrapes may carry a passkey as the first path segment,
+	// i.e. /<passkey>/announce. httprouter does not allow wildcards next to
+	// the static routes, so these are dispatched from the NotFound handler.
+	router.NotFound = http.HandlerFunc(f.passkeyRoute)
 	return router
 }
 
+// passkeyRoute dispatches requests of the form /<passkey>/announce and
+// /<passkey>/scrape to the regular routes.
+func (f *Frontend) passkeyRoute(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method == http.MethodGet && len(segments) == 2 && segments[0] != "" {
+		switch segments[1] {
+		case "announce":
+			f.announceRoute(w, r, nil)
+			return
+		case "scrape":
+			f.scrapeRoute(w, r, nil)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+// requestContext returns a new context for r, tagged with its scheme, its
+// User-Agent, the addresses of its client and connection and a request ID
+// that is returned to the client in the X-Request-ID header.
+func (f *Frontend) requestContext(w http.ResponseWriter, r *http.Request) context.Context {
+	ctx := log.WithRequestID(context.Background())
+	id, _ := log.RequestID(ctx)
+	w.Header().Set(requestIDHeader, id)
+	ctx = context.WithValue(ctx, bittorrent.SchemeKey, f.scheme(r))
+	if userAgent := r.UserAgent(); userAgent != "" {
+		ctx = context.WithValue(ctx, frontend.UserAgentKey, userAgent)
+	}
+	if ip, ok := bittorrent.NormalizeIP(requestedIP(r, nil, f.RealIPHeader, false)); ok {
+		ctx = context.WithValue(ctx, frontend.ClientIPKey, ip)
+	}
+	if ip, ok := bittorrent.NormalizeIP(requestedIP(r, nil, "", false)); ok {
+		ctx = context.WithValue(ctx, frontend.RemoteIPKey, ip)
+	}
+	return ctx
+}
+
+// scheme returns the scheme of the URL r was sent to by the client.
+func (f *Frontend) scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return bittorrent.SchemeHTTPS
+	}
+
+	if f.SchemeHeader != "" && strings.EqualFold(r.Header.Get(f.SchemeHeader), bittorrent.SchemeHTTPS) {
+		return bittorrent.SchemeHTTPS
+	}
+
+	return bittorrent.SchemeHTTP
+}
+
+// authenticate runs the configured Authenticator for a request.
+//
+// If no Authenticator is configured or it rejects the request, ctx is
+// returned.
+func (f *Frontend) authenticate(ctx context.Context, r *http.Request, params bittorrent.Params) (context.Context, error) {
+	if f.Authenticator == nil {
+		return ctx, nil
+	}
+
+	creds := frontend.Credentials{Params: params}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		creds.Token = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	authCtx, err := f.Authenticator.Authenticate(ctx, creds)
+	if err != nil {
+		return ctx, err
+	}
+	return authCtx, nil
+}
+
 // listenAndServe blocks while listening and serving HTTP BitTorrent requests
 // until Stop() is called or an error is returned.
 func (f *Frontend) listenAndServe() error {
+	ln, err := net.Listen("tcp", f.Addr)
+	if err != nil {
+		return err
+	}
+
+	return f.serve(ln, f.handler())
+}
+
+// serve blocks while serving requests accepted on ln with handler until Stop()
+// is called or an error is returned. If a key pair is configured, requests are
+// served via TLS.
+func (f *Frontend) serve(ln net.Listener, handler http.Handler) error {
 	f.srv = &http.Server{
 		Addr:         f.Addr,
 		TLSConfig:    f.tlsCfg,
-		Handler:      f.handler(),
+		Handler:      handler,
 		ReadTimeout:  f.ReadTimeout,
 		WriteTimeout: f.WriteTimeout,
 	}
@@ -162,16 +420,38 @@ func (f *Frontend) listenAndServe() error {
 	// Disable KeepAlives.
 	f.srv.SetKeepAlivesEnabled(false)
 
+	if f.tlsCfg != nil {
+		ln = tls.NewListener(ln, f.tlsCfg)
+	}
+
 	// Start the HTTP server.
-	if err := f.srv.ListenAndServe(); err != http.ErrServerClosed {
+	if err := f.srv.Serve(ln); err != http.ErrServerClosed {
 		return err
 	}
 
 	return nil
 }
 
+// logRejection logs that the request r was rejected with err, if rejections
+// are logged. If ip is nil, the remote address of r is logged.
+func (f *Frontend) logRejection(ctx context.Context, r *http.Request, action string, ip net.IP, infoHashes []bittorrent.InfoHash, err error) {
+	if !f.LogRejections {
+		return
+	}
+
+	if ip == nil {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ip = net.ParseIP(host)
+	}
+	frontend.LogRejection(ctx, "http", action, ip, infoHashes, err)
+}
+
 // announceRoute parses and responds to an Announce.
 func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w, done := f.meter(w, "announce")
+	defer done()
+	ctx := f.requestContext(w, r)
+
 	var err error
 	var start time.Time
 	if f.EnableRequestTiming {
@@ -186,16 +466,46 @@ func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, _ httpr
 		}
 	}()
 
-	req, err := ParseAnnounce(r, f.RealIPHeader, f.AllowIPSpoofing)
+	if f.challenge(w, r, "announce") {
+		err = errBotChallenged
+		return
+	}
+
+	if !f.announceLimiter.Allow() {
+		promRateLimitedRequestsTotal.WithLabelValues("announce").Inc()
+		err = ErrRateLimited
+		f.logRejection(ctx, r, "announce", nil, nil, err)
+		WriteRetryError(w, err, f.RateLimitRetryInterval)
+		return
+	}
+
+	if !f.concurrency.Acquire() {
+		err = ErrOverloaded
+		f.logRejection(ctx, r, "announce", nil, nil, err)
+		WriteRetryError(w, err, f.RateLimitRetryInterval)
+		return
+	}
+	defer f.concurrency.Release()
+
+	req, err := ParseAnnounce(r, f.RealIPHeader, f.AllowIPSpoofing, f.allowedParams)
 	if err != nil {
+		f.logRejection(ctx, r, "announce", nil, nil, err)
 		WriteError(w, err)
 		return
 	}
 	af = new(bittorrent.AddressFamily)
 	*af = req.IP.AddressFamily
 
-	ctx, resp, err := f.logic.HandleAnnounce(context.Background(), req)
+	ctx, err = f.authenticate(ctx, r, req.Params)
 	if err != nil {
+		f.logRejection(ctx, r, "announce", req.IP.IP, []bittorrent.InfoHash{req.InfoHash}, err)
+		WriteError(w, err)
+		return
+	}
+
+	afterCtx, resp, err := f.logic.HandleAnnounce(ctx, req)
+	if err != nil {
+		f.logRejection(ctx, r, "announce", req.IP.IP, []bittorrent.InfoHash{req.InfoHash}, err)
 		WriteError(w, err)
 		return
 	}
@@ -206,11 +516,15 @@ func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, _ httpr
 		return
 	}
 
-	go f.logic.AfterAnnounce(ctx, req, resp)
+	go f.logic.AfterAnnounce(afterCtx, req, resp)
 }
 
 // scrapeRoute parses and responds to a Scrape.
 func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w, done := f.meter(w, "scrape")
+	defer done()
+	ctx := f.requestContext(w, r)
+
 	var err error
 	var start time.Time
 	if f.EnableRequestTiming {
@@ -225,15 +539,37 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, _ httprou
 		}
 	}()
 
-	req, err := ParseScrape(r)
+	if f.challenge(w, r, "scrape") {
+		err = errBotChallenged
+		return
+	}
+
+	if !f.scrapeLimiter.Allow() {
+		promRateLimitedRequestsTotal.WithLabelValues("scrape").Inc()
+		err = ErrRateLimited
+		f.logRejection(ctx, r, "scrape", nil, nil, err)
+		WriteRetryError(w, err, f.RateLimitRetryInterval)
+		return
+	}
+
+	if !f.concurrency.Acquire() {
+		err = ErrOverloaded
+		f.logRejection(ctx, r, "scrape", nil, nil, err)
+		WriteRetryError(w, err, f.RateLimitRetryInterval)
+		return
+	}
+	defer f.concurrency.Release()
+
+	req, err := ParseScrape(r, f.allowedParams)
 	if err != nil {
+		f.logRejection(ctx, r, "scrape", nil, nil, err)
 		WriteError(w, err)
 		return
 	}
 
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Error("http: unable to determine remote address for scrape", log.Err(err))
+		log.Error("http: unable to determine remote address for scrape", log.RequestFields(ctx, log.Err(err)))
 		WriteError(w, err)
 		return
 	}
@@ -244,30 +580,48 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, _ httprou
 	} else if len(reqIP) == net.IPv6len { // implies reqIP.To4() == nil
 		req.AddressFamily = bittorrent.IPv6
 	} else {
-		log.Error("http: invalid IP: neither v4 nor v6", log.Fields{"RemoteAddr": r.RemoteAddr})
+		log.Error("http: invalid IP: neither v4 nor v6", log.RequestFields(ctx, log.Fields{"RemoteAddr": r.RemoteAddr}))
 		WriteError(w, ErrInvalidIP)
 		return
 	}
 	af = new(bittorrent.AddressFamily)
 	*af = req.AddressFamily
 
-	ctx, resp, err := f.logic.HandleScrape(context.Background(), req)
+	ctx, err = f.authenticate(ctx, r, req.Params)
 	if err != nil {
+		f.logRejection(ctx, r, "scrape", reqIP, req.InfoHashes, err)
 		WriteError(w, err)
 		return
 	}
 
-	err = WriteScrapeResponse(w, resp)
+	afterCtx, resp, err := f.logic.HandleScrape(ctx, req)
 	if err != nil {
+		f.logRejection(ctx, r, "scrape", reqIP, req.InfoHashes, err)
 		WriteError(w, err)
 		return
 	}
 
-	go f.logic.AfterScrape(ctx, req, resp)
+	if f.CompressScrapes {
+		err = writeCompressed(w, r, f.CompressionThreshold, func(w io.Writer) error {
+			return encodeScrapeResponse(w, resp)
+		})
+	} else {
+		err = WriteScrapeResponse(w, resp)
+	}
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	go f.logic.AfterScrape(afterCtx, req, resp)
 }
 
 // apiRoute parses and responds to an API call.
 func (f *Frontend) apiRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w, done := f.meter(w, "api")
+	defer done()
+	ctx := f.requestContext(w, r)
+
 	var err error
 	start := time.Now()
 	var af *bittorrent.AddressFamily
@@ -280,14 +634,14 @@ func (f *Frontend) apiRoute(w http.ResponseWriter, r *http.Request, _ httprouter
 	}
 
 	if req.Auth != f.ApiAuth {
-		err = bittorrent.ClientError("api authentication error")
+		err = bittorrent.NewClientError("api_authentication_failed", "api authentication error")
 		WriteError(w, err)
 		return
 	}
 
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Error("http: unable to determine remote address for scrape", log.Err(err))
+		log.Error("http: unable to determine remote address for scrape", log.RequestFields(ctx, log.Err(err)))
 		WriteError(w, err)
 		return
 	}
@@ -298,14 +652,14 @@ func (f *Frontend) apiRoute(w http.ResponseWriter, r *http.Request, _ httprouter
 	} else if len(reqIP) == net.IPv6len { // implies reqIP.To4() == nil
 		req.AddressFamily = bittorrent.IPv6
 	} else {
-		log.Error("http: invalid IP: neither v4 nor v6", log.Fields{"RemoteAddr": r.RemoteAddr})
+		log.Error("http: invalid IP: neither v4 nor v6", log.RequestFields(ctx, log.Fields{"RemoteAddr": r.RemoteAddr}))
 		WriteError(w, ErrInvalidIP)
 		return
 	}
 	af = new(bittorrent.AddressFamily)
 	*af = req.AddressFamily
 
-	resp, err := f.logic.HandleApi(context.Background(), req)
+	resp, err := f.logic.HandleApi(ctx, req)
 	if err != nil {
 		WriteError(w, err)
 		return
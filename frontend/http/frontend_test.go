@@ -0,0 +1,112 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// selfSignedCertificate returns a certificate for 127.0.0.1.
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServeTLS(t *testing.T) {
+	f := &Frontend{tlsCfg: &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go f.serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "ok", string(body))
+
+	// Plaintext requests are not served.
+	if resp, err := http.Get("http://" + ln.Addr().String() + "/"); err == nil {
+		resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// contextLogic is a TrackerLogic that records the context of announces and
+// rejects them.
+type contextLogic struct {
+	ctx context.Context
+}
+
+func (l *contextLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	l.ctx = ctx
+	return nil, nil, bittorrent.ClientError("rejected")
+}
+
+func (l *contextLogic) AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+}
+
+func (l *contextLogic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error) {
+	return nil, nil, bittorrent.ClientError("rejected")
+}
+
+func (l *contextLogic) AfterScrape(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse) {
+}
+
+func (l *contextLogic) HandleApi(context.Context, *bittorrent.ApiRequest) (*bittorrent.ApiResponse, error) {
+	return nil, bittorrent.ClientError("rejected")
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	logic := &contextLogic{}
+	f := &Frontend{logic: logic, Config: Config{LogRejections: true}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb&port=6881&uploaded=0&downloaded=0&left=0", nil)
+	f.announceRoute(w, r, nil)
+
+	// The hooks see the ID that is returned to the client.
+	require.NotNil(t, logic.ctx)
+	id, ok := log.RequestID(logic.ctx)
+	require.True(t, ok)
+	require.Equal(t, id, w.Header().Get(requestIDHeader))
+	require.Equal(t, id, requestFields(w, log.Fields{})["requestID"])
+}
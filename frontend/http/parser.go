@@ -5,93 +5,196 @@ import (
 	"net/http"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
 )
 
+// ErrUnknownParam is returned for a query containing a parameter that is
+// neither known nor allowed.
+var ErrUnknownParam = bittorrent.NewClientError("unknown_parameter", "unknown query parameter")
+
+// ErrInvalidPeerID is returned for an announce whose peer_id is not exactly
+// 20 bytes after percent-decoding.
+var ErrInvalidPeerID = bittorrent.NewClientError("invalid_peer_id", "peer_id must be exactly 20 bytes")
+
+// knownAnnounceParams are the query parameters of announces sent by common
+// clients, as specified in BEP 3, BEP 7, BEP 23 and by client extensions.
+// The info_hash parameter is always known.
+var knownAnnounceParams = map[string]struct{}{
+	"peer_id":       {},
+	"port":          {},
+	"uploaded":      {},
+	"downloaded":    {},
+	"left":          {},
+	"event":         {},
+	"compact":       {},
+	"no_peer_id":    {},
+	"numwant":       {},
+	"key":           {},
+	"trackerid":     {},
+	"ip":            {},
+	"ipv4":          {},
+	"ipv6":          {},
+	"supportcrypto": {},
+	"requirecrypto": {},
+	"cryptoport":    {},
+	"corrupt":       {},
+	"redundant":     {},
+}
+
+// knownScrapeParams are the query parameters of scrapes. The info_hash
+// parameter is always known.
+var knownScrapeParams = map[string]struct{}{}
+
+// validateParams checks that all parameters of qp are contained in either
+// known or allowed and returns ErrUnknownParam otherwise.
+func validateParams(qp *bittorrent.QueryParams, known, allowed map[string]struct{}) error {
+	for _, key := range qp.Keys() {
+		if _, ok := known[key]; ok {
+			continue
+		}
+		if _, ok := allowed[key]; ok {
+			continue
+		}
+
+		// The key is not part of the error to not create a time series
+		// per key in the metrics of the frontend.
+		log.Debug("http: rejecting unknown query parameter", log.Fields{"key": key})
+		return ErrUnknownParam
+	}
+
+	return nil
+}
+
+// requiredParam returns the error for an announce whose required parameter key
+// is either missing or malformed, so that clients learn which one it is.
+func requiredParam(key string, err error) error {
+	if err == bittorrent.ErrKeyNotFound {
+		return bittorrent.NewClientError("missing_parameter", "missing required parameter: "+key)
+	}
+	return bittorrent.NewClientError("invalid_parameter", "failed to parse parameter: "+key)
+}
+
 // ParseAnnounce parses an bittorrent.AnnounceRequest from an http.Request.
 //
 // If allowIPSpoofing is true, IPs provided via params will be used.
 // If realIPHeader is not empty string, the first value of the HTTP Header with
 // that name will be used.
-func ParseAnnounce(r *http.Request, realIPHeader string, allowIPSpoofing bool) (*bittorrent.AnnounceRequest, error) {
+// If allowedParams is not nil, announces with parameters that are neither
+// known announce parameters nor contained in allowedParams are rejected.
+func ParseAnnounce(r *http.Request, realIPHeader string, allowIPSpoofing bool, allowedParams map[string]struct{}) (*bittorrent.AnnounceRequest, error) {
 	qp, err := bittorrent.ParseURLData(r.RequestURI)
 	if err != nil {
 		return nil, err
 	}
 
+	if allowedParams != nil {
+		if err := validateParams(qp, knownAnnounceParams, allowedParams); err != nil {
+			return nil, err
+		}
+	}
+
 	request := &bittorrent.AnnounceRequest{Params: qp}
 
 	eventStr, _ := qp.String("event")
 	request.Event, err = bittorrent.NewEvent(eventStr)
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to provide valid client event")
+		return nil, bittorrent.NewClientError("invalid_event", "failed to provide valid client event")
 	}
 
 	compactStr, _ := qp.String("compact")
 	request.Compact = compactStr != "" && compactStr != "0"
 
+	// Clients signal support for encrypted connections with either
+	// supportcrypto or requirecrypto.
+	for _, key := range []string{"supportcrypto", "requirecrypto"} {
+		if cryptoStr, _ := qp.String(key); cryptoStr != "" && cryptoStr != "0" {
+			request.Flags |= bittorrent.PeerFlagCrypto
+		}
+	}
+
+	// Announces of BEP 52 hybrid torrents may include both the v1 and the
+	// truncated v2 infohash, which are linked to the same swarm.
 	infoHashes := qp.InfoHashes()
 	if len(infoHashes) < 1 {
-		return nil, bittorrent.ClientError("no info_hash parameter supplied")
+		return nil, requiredParam("info_hash", bittorrent.ErrKeyNotFound)
 	}
-	if len(infoHashes) > 1 {
-		return nil, bittorrent.ClientError("multiple info_hash parameters supplied")
+	if len(infoHashes) > 2 {
+		return nil, bittorrent.NewClientError("multiple_infohashes", "multiple info_hash parameters supplied")
 	}
 	request.InfoHash = infoHashes[0]
+	if len(infoHashes) == 2 && infoHashes[1] != infoHashes[0] {
+		linked := infoHashes[1]
+		request.LinkedInfoHash = &linked
+	}
 
 	peerID, ok := qp.String("peer_id")
 	if !ok {
-		return nil, bittorrent.ClientError("failed to parse parameter: peer_id")
+		return nil, requiredParam("peer_id", bittorrent.ErrKeyNotFound)
 	}
 	if len(peerID) != 20 {
-		return nil, bittorrent.ClientError("failed to provide valid peer_id")
+		return nil, ErrInvalidPeerID
 	}
 	request.Peer.ID = bittorrent.PeerIDFromString(peerID)
 
+	key, _ := qp.String("key")
+	request.Key = bittorrent.NormalizeKey(key)
+
 	request.Left, err = qp.Uint64("left")
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to parse parameter: left")
+		return nil, requiredParam("left", err)
 	}
 
 	request.Downloaded, err = qp.Uint64("downloaded")
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to parse parameter: downloaded")
+		return nil, requiredParam("downloaded", err)
 	}
 
 	request.Uploaded, err = qp.Uint64("uploaded")
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to parse parameter: uploaded")
+		return nil, requiredParam("uploaded", err)
 	}
 
 	numwant, err := qp.Uint64("numwant")
 	if err != nil && err != bittorrent.ErrKeyNotFound {
-		return nil, bittorrent.ClientError("failed to parse parameter: numwant")
+		return nil, bittorrent.NewClientError("invalid_parameter", "failed to parse parameter: numwant")
 	}
 	request.NumWant = uint32(numwant)
+	request.NumWantSpecified = err == nil
 
 	port, err := qp.Uint64("port")
 	if err != nil {
-		return nil, bittorrent.ClientError("failed to parse parameter: port")
+		return nil, requiredParam("port", err)
 	}
 	request.Peer.Port = uint16(port)
 
-	request.Peer.IP.IP = requestedIP(r, qp, realIPHeader, allowIPSpoofing)
-	if request.Peer.IP.IP == nil {
-		return nil, bittorrent.ClientError("failed to parse peer IP address")
+	ip, ok := bittorrent.NormalizeIP(requestedIP(r, qp, realIPHeader, allowIPSpoofing))
+	if !ok {
+		return nil, bittorrent.NewClientError("invalid_ip", "failed to parse peer IP address")
 	}
+	request.Peer.IP = ip
 
 	return request, nil
 }
 
 // ParseScrape parses an bittorrent.ScrapeRequest from an http.Request.
-func ParseScrape(r *http.Request) (*bittorrent.ScrapeRequest, error) {
+//
+// If allowedParams is not nil, scrapes with parameters other than info_hash
+// that are not contained in allowedParams are rejected.
+func ParseScrape(r *http.Request, allowedParams map[string]struct{}) (*bittorrent.ScrapeRequest, error) {
 	qp, err := bittorrent.ParseURLData(r.RequestURI)
 	if err != nil {
 		return nil, err
 	}
 
+	if allowedParams != nil {
+		if err := validateParams(qp, knownScrapeParams, allowedParams); err != nil {
+			return nil, err
+		}
+	}
+
 	infoHashes := qp.InfoHashes()
 	if len(infoHashes) < 1 {
-		return nil, bittorrent.ClientError("no info_hash parameter supplied")
+		return nil, bittorrent.NewClientError("missing_infohash", "no info_hash parameter supplied")
 	}
 
 	request := &bittorrent.ScrapeRequest{
@@ -102,6 +205,16 @@ func ParseScrape(r *http.Request) (*bittorrent.ScrapeRequest, error) {
 	return request, nil
 }
 
+// swarmlessApiMethods are the api methods that don't refer to swarms, so they
+// don't require an info_hash parameter.
+var swarmlessApiMethods = map[string]struct{}{
+	"config":      {},
+	"evict-ip":    {},
+	"shards":      {},
+	"stats":       {},
+	"top-talkers": {},
+}
+
 // ParseApi parses an bittorrent.ApiRequest from an http.Request.
 func ParseApi(r *http.Request) (*bittorrent.ApiRequest, error) {
 	qp, err := bittorrent.ParseURLData(r.RequestURI)
@@ -109,19 +222,19 @@ func ParseApi(r *http.Request) (*bittorrent.ApiRequest, error) {
 		return nil, err
 	}
 
-	infoHashes := qp.InfoHashes()
-	if len(infoHashes) < 1 {
-		return nil, bittorrent.ClientError("no info_hash parameter supplied")
-	}
-
 	auth, ok := qp.String("auth")
 	if !ok {
-		return nil, bittorrent.ClientError("no auth parameter supplied")
+		return nil, bittorrent.NewClientError("missing_auth", "no auth parameter supplied")
 	}
 
 	method, ok := qp.String("method")
 	if !ok {
-		return nil, bittorrent.ClientError("no method parameter supplied")
+		return nil, bittorrent.NewClientError("missing_method", "no method parameter supplied")
+	}
+
+	infoHashes := qp.InfoHashes()
+	if _, ok := swarmlessApiMethods[method]; !ok && len(infoHashes) < 1 {
+		return nil, bittorrent.NewClientError("missing_infohash", "no info_hash parameter supplied")
 	}
 
 	request := &bittorrent.ApiRequest{
@@ -0,0 +1,164 @@
+package http
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const testAnnounce = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001&port=6881&uploaded=0&downloaded=0&left=0"
+
+func TestStrictParams(t *testing.T) {
+	var table = []struct {
+		uri     string
+		allowed map[string]struct{}
+		err     error
+	}{
+		// Unknown parameters are ignored by default.
+		{testAnnounce + "&probe=1", nil, nil},
+		{testAnnounce, map[string]struct{}{}, nil},
+		{testAnnounce + "&compact=1&numwant=50&key=abc&supportcrypto=1", map[string]struct{}{}, nil},
+		{testAnnounce + "&probe=1", map[string]struct{}{}, ErrUnknownParam},
+		{testAnnounce + "&Probe=1", map[string]struct{}{"probe": {}}, nil},
+		{testAnnounce + "&jwt=token", map[string]struct{}{"jwt": {}}, nil},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		_, err := ParseAnnounce(r, "", false, tt.allowed)
+		require.Equal(t, tt.err, err, tt.uri)
+	}
+
+	var scrapeTable = []struct {
+		uri     string
+		allowed map[string]struct{}
+		err     error
+	}{
+		{"/scrape?info_hash=aaaaaaaaaaaaaaaaaaaa&info_hash=bbbbbbbbbbbbbbbbbbbb", map[string]struct{}{}, nil},
+		{"/scrape?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001", nil, nil},
+		{"/scrape?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001", map[string]struct{}{}, ErrUnknownParam},
+	}
+
+	for _, tt := range scrapeTable {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		_, err := ParseScrape(r, tt.allowed)
+		require.Equal(t, tt.err, err, tt.uri)
+	}
+}
+
+func TestRequiredParams(t *testing.T) {
+	var table = []struct {
+		uri string
+		err error
+	}{
+		{testAnnounce, nil},
+		{"/announce?peer_id=-TR2940-000000000001&port=6881&uploaded=0&downloaded=0&left=0", bittorrent.ClientError("missing required parameter: info_hash")},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&port=6881&uploaded=0&downloaded=0&left=0", bittorrent.ClientError("missing required parameter: peer_id")},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001&port=6881&uploaded=0&downloaded=0", bittorrent.ClientError("missing required parameter: left")},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001&port=6881&uploaded=0&left=0", bittorrent.ClientError("missing required parameter: downloaded")},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001&port=6881&downloaded=0&left=0", bittorrent.ClientError("missing required parameter: uploaded")},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001&uploaded=0&downloaded=0&left=0", bittorrent.ClientError("missing required parameter: port")},
+
+		// Malformed parameters are reported as such.
+		{testAnnounce + "&numwant=many", bittorrent.ClientError("failed to parse parameter: numwant")},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001&port=6881&uploaded=0&downloaded=0&left=-1", bittorrent.ClientError("failed to parse parameter: left")},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000001&port=http&uploaded=0&downloaded=0&left=0", bittorrent.ClientError("failed to parse parameter: port")},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=short&port=6881&uploaded=0&downloaded=0&left=0", ErrInvalidPeerID},
+
+		// Peer IDs are checked after percent-decoding.
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-000000000%2001&port=6881&uploaded=0&downloaded=0&left=0", nil},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-0000000000%2001&port=6881&uploaded=0&downloaded=0&left=0", ErrInvalidPeerID},
+		{"/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=-TR2940-0000000000%01&port=6881&uploaded=0&downloaded=0&left=0", ErrInvalidPeerID},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		_, err := ParseAnnounce(r, "", false, nil)
+		require.Equal(t, tt.err, err, tt.uri)
+	}
+}
+
+func TestParseApiInfoHash(t *testing.T) {
+	var table = []struct {
+		uri string
+		err error
+	}{
+		{"/api?auth=secret&method=delete&info_hash=aaaaaaaaaaaaaaaaaaaa", nil},
+		{"/api?auth=secret&method=delete", bittorrent.ClientError("no info_hash parameter supplied")},
+		{"/api?auth=secret&method=evict-ip&ip=10.0.0.1", nil},
+		{"/api?auth=secret&method=stats", nil},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		_, err := ParseApi(r)
+		require.Equal(t, tt.err, err, tt.uri)
+	}
+}
+
+func TestParseHybridAnnounce(t *testing.T) {
+	v1 := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	v2 := bittorrent.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+
+	var table = []struct {
+		uri    string
+		linked *bittorrent.InfoHash
+		err    error
+	}{
+		{testAnnounce, nil, nil},
+		{testAnnounce + "&info_hash=bbbbbbbbbbbbbbbbbbbb", &v2, nil},
+		{testAnnounce + "&info_hash=aaaaaaaaaaaaaaaaaaaa", nil, nil},
+		{testAnnounce + "&info_hash=bbbbbbbbbbbbbbbbbbbb&info_hash=cccccccccccccccccccc", nil, bittorrent.ClientError("multiple info_hash parameters supplied")},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		req, err := ParseAnnounce(r, "", false, nil)
+		require.Equal(t, tt.err, err, tt.uri)
+		if err != nil {
+			continue
+		}
+		require.Equal(t, v1, req.InfoHash)
+		require.Equal(t, tt.linked, req.LinkedInfoHash)
+	}
+}
+
+func TestParseAnnounceKey(t *testing.T) {
+	// Hex keys are represented like UDP keys.
+	for key, expected := range map[string]string{"": "", "5a3b9c1d": "5a3b9c1d", "5A3B9C1D": "5a3b9c1d", "abcXYZ": "abcXYZ"} {
+		uri := testAnnounce
+		if key != "" {
+			uri += "&key=" + key
+		}
+		req, err := ParseAnnounce(httptest.NewRequest("GET", uri, nil), "", false, nil)
+		require.Nil(t, err)
+		require.Equal(t, expected, req.Key)
+	}
+}
+
+func TestParseAnnounceEvent(t *testing.T) {
+	var table = []struct {
+		event string
+		want  bittorrent.Event
+		err   error
+	}{
+		{"", bittorrent.None, nil},
+		{"started", bittorrent.Started, nil},
+		{"STOPPED", bittorrent.Stopped, nil},
+		{"Completed", bittorrent.Completed, nil},
+		{"%20Started", bittorrent.Started, nil},
+		{"stopped%20%0A", bittorrent.Stopped, nil},
+		{"paused", bittorrent.None, bittorrent.ClientError("failed to provide valid client event")},
+	}
+
+	for _, tt := range table {
+		req, err := ParseAnnounce(httptest.NewRequest("GET", testAnnounce+"&event="+tt.event, nil), "", false, nil)
+		require.Equal(t, tt.err, err, tt.event)
+		if err == nil {
+			require.Equal(t, tt.want, req.Event, tt.event)
+		}
+	}
+}
@@ -1,25 +1,81 @@
 package http
 
 import (
+	"io"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/frontend/http/bencode"
 	"github.com/chihaya/chihaya/pkg/log"
 )
 
+// requestIDHeader is the header of responses that carries the ID of the
+// request.
+const requestIDHeader = "X-Request-ID"
+
+// requestFields returns the Fields of f with the ID of the request that is
+// answered via w added, if any.
+func requestFields(w http.ResponseWriter, f log.Fielder) log.Fields {
+	fields := log.Fields{}
+	for k, v := range f.LogFields() {
+		fields[k] = v
+	}
+
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		fields["requestID"] = id
+	}
+	return fields
+}
+
 // WriteError communicates an error to a BitTorrent client over HTTP.
+//
+// A bittorrent.RetryError is written using WriteRetryError.
 func WriteError(w http.ResponseWriter, err error) error {
+	if retryErr, ok := err.(bittorrent.RetryError); ok {
+		return WriteRetryError(w, retryErr.ClientError, retryErr.RetryIn)
+	}
+
 	message := "internal server error"
 	if _, clientErr := err.(bittorrent.ClientError); clientErr {
 		message = err.Error()
 	} else {
-		log.Error("http: internal error", log.Err(err))
+		log.Error("http: internal error", requestFields(w, log.Err(err)))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return bencode.NewEncoder(w).Encode(bencode.Dict{
+		"failure reason": message,
+	})
+}
+
+// WriteRetryError communicates an error to a BitTorrent client over HTTP and
+// advises the client to retry after the given duration as described in BEP
+// 31.
+//
+// BEP 31 specifies the retry delay in minutes, so retryIn is rounded up to
+// full minutes. Because not all clients implement BEP 31, the delay is also
+// communicated as the interval and min interval of the response.
+func WriteRetryError(w http.ResponseWriter, err error, retryIn time.Duration) error {
+	message := "internal server error"
+	if bittorrent.IsClientError(err) {
+		message = err.Error()
+	} else {
+		log.Error("http: internal error", requestFields(w, log.Err(err)))
+	}
+
+	minutes := int64((retryIn + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
 	}
 
 	w.WriteHeader(http.StatusOK)
 	return bencode.NewEncoder(w).Encode(bencode.Dict{
 		"failure reason": message,
+		"retry in":       minutes,
+		"interval":       minutes * 60,
+		"min interval":   minutes * 60,
 	})
 }
 
@@ -33,6 +89,10 @@ func WriteAnnounceResponse(w http.ResponseWriter, resp *bittorrent.AnnounceRespo
 		"min interval": resp.MinInterval,
 	}
 
+	if resp.WarningMessage != "" {
+		bdict["warning message"] = resp.WarningMessage
+	}
+
 	// Add the peers to the dictionary in the compact format.
 	if resp.Compact {
 		var IPv4CompactDict, IPv6CompactDict []byte
@@ -72,17 +132,44 @@ func WriteAnnounceResponse(w http.ResponseWriter, resp *bittorrent.AnnounceRespo
 // WriteScrapeResponse communicates the results of a Scrape to a BitTorrent
 // client over HTTP.
 func WriteScrapeResponse(w http.ResponseWriter, resp *bittorrent.ScrapeResponse) error {
+	return encodeScrapeResponse(w, resp)
+}
+
+// encodeScrapeResponse writes the bencoded results of a Scrape to w.
+func encodeScrapeResponse(w io.Writer, resp *bittorrent.ScrapeResponse) error {
 	filesDict := bencode.NewDict()
 	for _, scrape := range resp.Files {
-		filesDict[string(scrape.InfoHash[:])] = bencode.Dict{
+		file := bencode.Dict{
 			"complete":   scrape.Complete,
 			"incomplete": scrape.Incomplete,
 		}
+		if scrape.Banned {
+			file["banned"] = 1
+		}
+		if scrape.Failed {
+			file["failed"] = 1
+		}
+		if len(scrape.Breakdown) == 2 {
+			for af, key := range map[bittorrent.AddressFamily]string{bittorrent.IPv4: "ipv4", bittorrent.IPv6: "ipv6"} {
+				file[key] = bencode.Dict{
+					"complete":   scrape.Breakdown[af].Complete,
+					"incomplete": scrape.Breakdown[af].Incomplete,
+				}
+			}
+		}
+		filesDict[string(scrape.InfoHash[:])] = file
 	}
 
-	return bencode.NewEncoder(w).Encode(bencode.Dict{
+	dict := bencode.Dict{
 		"files": filesDict,
-	})
+	}
+	if resp.MinRequestInterval > 0 {
+		dict["flags"] = bencode.Dict{
+			"min_request_interval": resp.MinRequestInterval,
+		}
+	}
+
+	return bencode.NewEncoder(w).Encode(dict)
 }
 
 // WriteApiResponse communicates the results of an Api request to a BitTorrent
@@ -96,16 +183,23 @@ func WriteApiResponse(w http.ResponseWriter, resp *bittorrent.ApiResponse) error
 		}
 	}
 
-	return bencode.NewEncoder(w).Encode(bencode.Dict{
+	bdict := bencode.Dict{
 		"files": filesDict,
-	})
+	}
+	if resp.Error != 0 || resp.Response != "" {
+		bdict["error"] = resp.Error
+		bdict["response"] = resp.Response
+	}
+
+	return bencode.NewEncoder(w).Encode(bdict)
 }
 
 func compact4(peer bittorrent.Peer) (buf []byte) {
 	if ip := peer.IP.To4(); ip == nil {
 		panic("non-IPv4 IP for Peer in IPv4Peers")
 	} else {
-		buf = []byte(ip)
+		// Copy the IP to avoid appending to the Peer's backing array.
+		buf = append(make([]byte, 0, net.IPv4len+2), ip...)
 	}
 	buf = append(buf, byte(peer.Port>>8))
 	buf = append(buf, byte(peer.Port&0xff))
@@ -113,10 +207,11 @@ func compact4(peer bittorrent.Peer) (buf []byte) {
 }
 
 func compact6(peer bittorrent.Peer) (buf []byte) {
-	if ip := peer.IP.To16(); ip == nil {
+	if ip := peer.IP.To16(); ip == nil || peer.IP.To4() != nil {
 		panic("non-IPv6 IP for Peer in IPv6Peers")
 	} else {
-		buf = []byte(ip)
+		// Copy the IP to avoid appending to the Peer's backing array.
+		buf = append(make([]byte, 0, net.IPv6len+2), ip...)
 	}
 	buf = append(buf, byte(peer.Port>>8))
 	buf = append(buf, byte(peer.Port&0xff))
@@ -1,12 +1,16 @@
 package http
 
 import (
+	"encoding/binary"
+	"net"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend/http/bencode"
 )
 
 func TestWriteError(t *testing.T) {
@@ -31,3 +35,224 @@ func TestWriteStatus(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, r.Body.String(), "d14:failure reason20:something is missinge")
 }
+
+func TestWriteRetryError(t *testing.T) {
+	var table = []struct {
+		retryIn  time.Duration
+		expected int64
+	}{
+		{0, 1},
+		{30 * time.Second, 1},
+		{time.Minute, 1},
+		{90 * time.Second, 2},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRecorder()
+		err := WriteRetryError(r, ErrRateLimited, tt.retryIn)
+		require.Nil(t, err)
+
+		got, err := bencode.Unmarshal(r.Body.Bytes())
+		require.Nil(t, err)
+		require.Equal(t, bencode.Dict{
+			"failure reason": ErrRateLimited.Error(),
+			"retry in":       tt.expected,
+			"interval":       tt.expected * 60,
+			"min interval":   tt.expected * 60,
+		}, got)
+	}
+}
+
+func TestWriteErrorRetry(t *testing.T) {
+	r := httptest.NewRecorder()
+	err := WriteError(r, bittorrent.RetryError{
+		ClientError: bittorrent.ClientError("not enough seeders"),
+		RetryIn:     5 * time.Minute,
+	})
+	require.Nil(t, err)
+
+	got, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{
+		"failure reason": "not enough seeders",
+		"retry in":       int64(5),
+		"interval":       int64(300),
+		"min interval":   int64(300),
+	}, got)
+}
+
+// decodeCompactPeers is a reference decoder for the compact peer format
+// described in BEP 23 and BEP 7.
+func decodeCompactPeers(t *testing.T, b []byte, ipLen int) (peers []bittorrent.Peer) {
+	require.Equal(t, 0, len(b)%(ipLen+2))
+	for i := 0; i < len(b); i += ipLen + 2 {
+		peers = append(peers, bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.IP(b[i : i+ipLen])},
+			Port: binary.BigEndian.Uint16(b[i+ipLen : i+ipLen+2]),
+		})
+	}
+	return
+}
+
+func TestWriteAnnounceResponseCompact(t *testing.T) {
+	v4Peers := []bittorrent.Peer{
+		{IP: bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4}, Port: 1234},
+		// IPv4 addresses in 16 byte form must be truncated.
+		{IP: bittorrent.IP{IP: net.ParseIP("5.6.7.8"), AddressFamily: bittorrent.IPv4}, Port: 5678},
+	}
+	v6Peers := []bittorrent.Peer{
+		{IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 4321},
+		{IP: bittorrent.IP{IP: net.ParseIP("2001:db8::2"), AddressFamily: bittorrent.IPv6}, Port: 8765},
+	}
+
+	var table = []struct {
+		v4, v6 []bittorrent.Peer
+	}{
+		{v4Peers, nil},
+		{nil, v6Peers},
+		{v4Peers, v6Peers},
+	}
+
+	for _, tt := range table {
+		r := httptest.NewRecorder()
+		err := WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{
+			Compact:   true,
+			IPv4Peers: tt.v4,
+			IPv6Peers: tt.v6,
+		})
+		require.Nil(t, err)
+
+		decoded, err := bencode.Unmarshal(r.Body.Bytes())
+		require.Nil(t, err)
+		d := decoded.(bencode.Dict)
+
+		for key, expected := range map[string][]bittorrent.Peer{"peers": tt.v4, "peers6": tt.v6} {
+			ipLen := net.IPv4len
+			if key == "peers6" {
+				ipLen = net.IPv6len
+			}
+
+			if len(expected) == 0 {
+				_, ok := d[key]
+				require.False(t, ok)
+				continue
+			}
+
+			got := decodeCompactPeers(t, []byte(d[key].(string)), ipLen)
+			require.Equal(t, len(expected), len(got))
+			for i := range expected {
+				require.True(t, expected[i].IP.Equal(got[i].IP.IP))
+				require.Equal(t, expected[i].Port, got[i].Port)
+			}
+		}
+	}
+}
+
+func TestCompact6RejectsIPv4(t *testing.T) {
+	peer := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("1.2.3.4")}}
+	require.Panics(t, func() { compact6(peer) })
+}
+
+func TestWriteScrapeResponseBanned(t *testing.T) {
+	ih1 := bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000002")
+
+	r := httptest.NewRecorder()
+	err := WriteScrapeResponse(r, &bittorrent.ScrapeResponse{
+		Files: []bittorrent.Scrape{{InfoHash: ih1, Complete: 1}, {InfoHash: ih2, Banned: true}},
+	})
+	require.Nil(t, err)
+	got, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{
+		"files": bencode.Dict{
+			string(ih1[:]): bencode.Dict{"complete": int64(1), "incomplete": int64(0)},
+			string(ih2[:]): bencode.Dict{"complete": int64(0), "incomplete": int64(0), "banned": int64(1)},
+		},
+	}, got)
+}
+
+func TestWriteScrapeResponseFailed(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+
+	r := httptest.NewRecorder()
+	err := WriteScrapeResponse(r, &bittorrent.ScrapeResponse{
+		Files: []bittorrent.Scrape{{InfoHash: ih, Failed: true}},
+	})
+	require.Nil(t, err)
+	got, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{
+		"files": bencode.Dict{
+			string(ih[:]): bencode.Dict{"complete": int64(0), "incomplete": int64(0), "failed": int64(1)},
+		},
+	}, got)
+}
+
+func TestWriteScrapeResponseBreakdown(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+
+	r := httptest.NewRecorder()
+	err := WriteScrapeResponse(r, &bittorrent.ScrapeResponse{
+		Files: []bittorrent.Scrape{{
+			InfoHash:   ih,
+			Complete:   3,
+			Incomplete: 1,
+			Breakdown:  []bittorrent.Scrape{{Complete: 2, Incomplete: 1}, {Complete: 1}},
+		}},
+	})
+	require.Nil(t, err)
+	got, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{
+		"files": bencode.Dict{
+			string(ih[:]): bencode.Dict{
+				"complete":   int64(3),
+				"incomplete": int64(1),
+				"ipv4":       bencode.Dict{"complete": int64(2), "incomplete": int64(1)},
+				"ipv6":       bencode.Dict{"complete": int64(1), "incomplete": int64(0)},
+			},
+		},
+	}, got)
+}
+
+func TestWriteScrapeResponseFlags(t *testing.T) {
+	r := httptest.NewRecorder()
+	err := WriteScrapeResponse(r, &bittorrent.ScrapeResponse{MinRequestInterval: 15 * time.Minute})
+	require.Nil(t, err)
+	got, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{
+		"files": bencode.Dict{},
+		"flags": bencode.Dict{"min_request_interval": int64(900)},
+	}, got)
+}
+
+func TestWriteApiResponse(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+
+	r := httptest.NewRecorder()
+	err := WriteApiResponse(r, &bittorrent.ApiResponse{
+		Files: []bittorrent.Api{{InfoHash: ih, Response: "complete=1 incomplete=0"}},
+	})
+	require.Nil(t, err)
+	got, err := bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{
+		"files": bencode.Dict{
+			string(ih[:]): bencode.Dict{"error": int64(0), "response": "complete=1 incomplete=0"},
+		},
+	}, got)
+
+	// Results of methods without infohashes are written at the top level.
+	r = httptest.NewRecorder()
+	err = WriteApiResponse(r, &bittorrent.ApiResponse{Response: "deleted=3"})
+	require.Nil(t, err)
+	got, err = bencode.Unmarshal(r.Body.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, bencode.Dict{
+		"files":    bencode.Dict{},
+		"error":    int64(0),
+		"response": "deleted=3",
+	}, got)
+}
@@ -0,0 +1,87 @@
+// Package passkey implements a frontend.Authenticator that identifies clients
+// by a passkey in the path of the announce URL, i.e. /<passkey>/announce.
+package passkey
+
+import (
+	"context"
+	"strings"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+var (
+	// ErrMissingPasskey is returned when a request without a passkey is
+	// rejected.
+	ErrMissingPasskey = bittorrent.NewClientError("missing_passkey", "unapproved request: missing passkey")
+
+	// ErrUnknownPasskey is returned when a request carries a passkey that
+	// is not configured.
+	ErrUnknownPasskey = bittorrent.NewClientError("unknown_passkey", "unapproved request: unknown passkey")
+)
+
+// Config represents the configuration of the passkey Authenticator.
+type Config struct {
+	// Passkeys maps passkeys to the IDs of their users.
+	Passkeys map[string]string `yaml:"passkeys"`
+
+	// Required specifies whether requests without a passkey are rejected.
+	Required bool `yaml:"required"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"passkeys": len(cfg.Passkeys),
+		"required": cfg.Required,
+	}
+}
+
+type authenticator struct {
+	cfg Config
+}
+
+// New returns a frontend.Authenticator that looks up the passkeys of
+// requests in the configured passkeys.
+func New(cfg Config) (frontend.Authenticator, error) {
+	return &authenticator{cfg: cfg}, nil
+}
+
+// FromPath extracts the passkey from a path of the form /<passkey>/announce
+// or /<passkey>/scrape.
+func FromPath(path string) (string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) != 2 || segments[0] == "" {
+		return "", false
+	}
+
+	switch segments[1] {
+	case "announce", "scrape":
+		return segments[0], true
+	}
+
+	return "", false
+}
+
+func (a *authenticator) Authenticate(ctx context.Context, creds frontend.Credentials) (context.Context, error) {
+	var passkey string
+	var ok bool
+	if creds.Params != nil {
+		passkey, ok = FromPath(creds.Params.RawPath())
+	}
+
+	if !ok {
+		if a.cfg.Required {
+			return ctx, ErrMissingPasskey
+		}
+		return ctx, nil
+	}
+
+	userID, ok := a.cfg.Passkeys[passkey]
+	if !ok {
+		return ctx, ErrUnknownPasskey
+	}
+
+	return context.WithValue(ctx, frontend.UserIDKey, userID), nil
+}
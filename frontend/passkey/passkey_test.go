@@ -0,0 +1,72 @@
+package passkey
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+)
+
+func credentials(t *testing.T, uri string) frontend.Credentials {
+	params, err := bittorrent.ParseURLData(uri)
+	require.Nil(t, err)
+	return frontend.Credentials{Params: params}
+}
+
+func TestFromPath(t *testing.T) {
+	var table = []struct {
+		path     string
+		expected string
+		ok       bool
+	}{
+		{"/abc/announce", "abc", true},
+		{"/abc/scrape", "abc", true},
+		{"/announce", "", false},
+		{"/abc/def/announce", "", false},
+		{"/abc/api", "", false},
+		{"//announce", "", false},
+	}
+
+	for _, tt := range table {
+		passkey, ok := FromPath(tt.path)
+		require.Equal(t, tt.ok, ok, tt.path)
+		require.Equal(t, tt.expected, passkey, tt.path)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, err := New(Config{Passkeys: map[string]string{"secret": "42"}})
+	require.Nil(t, err)
+
+	ctx, err := a.Authenticate(context.Background(), credentials(t, "/secret/announce?port=1"))
+	require.Nil(t, err)
+	userID, ok := frontend.UserID(ctx)
+	require.True(t, ok)
+	require.Equal(t, "42", userID)
+
+	_, err = a.Authenticate(context.Background(), credentials(t, "/wrong/announce"))
+	require.Equal(t, ErrUnknownPasskey, err)
+
+	ctx, err = a.Authenticate(context.Background(), credentials(t, "/announce"))
+	require.Nil(t, err)
+	_, ok = frontend.UserID(ctx)
+	require.False(t, ok)
+
+	// UDP scrapes have no params.
+	_, err = a.Authenticate(context.Background(), frontend.Credentials{})
+	require.Nil(t, err)
+}
+
+func TestAuthenticateRequired(t *testing.T) {
+	a, err := New(Config{Required: true})
+	require.Nil(t, err)
+
+	_, err = a.Authenticate(context.Background(), credentials(t, "/announce"))
+	require.Equal(t, ErrMissingPasskey, err)
+
+	_, err = a.Authenticate(context.Background(), frontend.Credentials{})
+	require.Equal(t, ErrMissingPasskey, err)
+}
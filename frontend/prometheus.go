@@ -0,0 +1,54 @@
+package frontend
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(promRequestsTotal, promRequestsInFlight, promResponseSizeBytes)
+}
+
+var promRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_frontend_requests_total",
+		Help: "The number of requests handled by a frontend",
+	},
+	[]string{"frontend", "action"},
+)
+
+var promRequestsInFlight = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chihaya_frontend_requests_in_flight",
+		Help: "The number of requests currently being handled by a frontend",
+	},
+	[]string{"frontend"},
+)
+
+var promResponseSizeBytes = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "chihaya_frontend_response_size_bytes",
+		Help:    "The size of the responses written by a frontend",
+		Buckets: prometheus.ExponentialBuckets(16, 2, 12),
+	},
+	[]string{"frontend", "action"},
+)
+
+// RecordRequestStart records that the frontend with the given name started
+// handling a request.
+//
+// Every call must be followed by a call of RecordRequestEnd once the response
+// has been written.
+func RecordRequestStart(frontendName string) {
+	promRequestsInFlight.WithLabelValues(frontendName).Inc()
+}
+
+// RecordRequestEnd records that the frontend with the given name finished
+// handling a request for action with a response of responseSize bytes.
+//
+// The action is only known after parsing the request for some frontends, so
+// it is not part of the number of requests in flight.
+func RecordRequestEnd(frontendName, action string, responseSize int) {
+	promRequestsInFlight.WithLabelValues(frontendName).Dec()
+	promRequestsTotal.WithLabelValues(frontendName, action).Inc()
+	promResponseSizeBytes.WithLabelValues(frontendName, action).Observe(float64(responseSize))
+}
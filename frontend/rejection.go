@@ -0,0 +1,54 @@
+package frontend
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// The IPs of rejected requests are truncated to the default prefix lengths of
+// the ip privacy middleware before they are logged.
+var (
+	rejectionIPv4Mask = net.CIDRMask(24, 32)
+	rejectionIPv6Mask = net.CIDRMask(48, 128)
+)
+
+// maskRejectionIP returns the network of ip that is logged for a rejection.
+func maskRejectionIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(rejectionIPv4Mask).String()
+	}
+	if len(ip) == net.IPv6len {
+		return ip.Mask(rejectionIPv6Mask).String()
+	}
+	return ""
+}
+
+// LogRejection logs a request that was rejected with err, either by the
+// TrackerLogic or by the frontend itself.
+//
+// The reason is logged as the stable code returned by bittorrent.ReasonCode.
+// The IP is truncated to its /24 or /48 network. Errors that are not exposed to
+// the client are failures rather than rejections and are not logged. The ID of
+// the request is taken from ctx.
+func LogRejection(ctx context.Context, frontendName, action string, ip net.IP, infoHashes []bittorrent.InfoHash, err error) {
+	if !bittorrent.IsClientError(err) {
+		return
+	}
+
+	hexInfoHashes := make([]string, len(infoHashes))
+	for i, ih := range infoHashes {
+		hexInfoHashes[i] = hex.EncodeToString(ih[:])
+	}
+
+	log.Info("rejected request", log.RequestFields(ctx, log.Fields{
+		"reason":     bittorrent.ReasonCode(err),
+		"frontend":   frontendName,
+		"action":     action,
+		"ip":         maskRejectionIP(ip),
+		"infoHashes": hexInfoHashes,
+	}))
+}
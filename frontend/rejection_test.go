@@ -0,0 +1,24 @@
+package frontend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskRejectionIP(t *testing.T) {
+	var table = []struct {
+		ip       net.IP
+		expected string
+	}{
+		{net.ParseIP("1.2.3.4"), "1.2.3.0"},
+		{net.IP{1, 2, 3, 4}, "1.2.3.0"},
+		{net.ParseIP("2001:db8:1:2::1"), "2001:db8:1::"},
+		{nil, ""},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, maskRejectionIP(tt.ip))
+	}
+}
@@ -9,9 +9,9 @@ import (
 	sha256 "github.com/minio/sha256-simd"
 )
 
-// ttl is the number of seconds a connection ID should be valid according to
-// BEP 15.
-const ttl = 2 * time.Minute
+// DefaultConnectionIDTTL is the duration a connection ID should be valid
+// according to BEP 15.
+const DefaultConnectionIDTTL = 2 * time.Minute
 
 // NewConnectionID creates a new 8 byte connection identifier for UDP packets
 // as described by BEP 15.
@@ -37,7 +37,10 @@ func NewConnectionID(ip net.IP, now time.Time, key string) []byte {
 }
 
 // ValidConnectionID determines whether a connection identifier is legitimate.
-func ValidConnectionID(connectionID []byte, ip net.IP, now time.Time, maxClockSkew time.Duration, key string) bool {
+//
+// A connection identifier is valid for ttl after its creation. Identifiers
+// created up to maxClockSkew in the future are accepted as well.
+func ValidConnectionID(connectionID []byte, ip net.IP, now time.Time, ttl, maxClockSkew time.Duration, key string) bool {
 	ts := time.Unix(int64(binary.BigEndian.Uint32(connectionID[:4])), 0)
 	if now.After(ts.Add(ttl)) || ts.After(now.Add(maxClockSkew)) {
 		return false
@@ -9,25 +9,60 @@ import (
 var golden = []struct {
 	createdAt int64
 	now       int64
+	ttl       time.Duration
 	ip        string
 	key       string
 	valid     bool
 }{
-	{0, 1, "127.0.0.1", "", true},
-	{0, 420420, "127.0.0.1", "", false},
-	{0, 0, "[::]", "", true},
+	{0, 1, DefaultConnectionIDTTL, "127.0.0.1", "", true},
+	{0, 420420, DefaultConnectionIDTTL, "127.0.0.1", "", false},
+	{0, 0, DefaultConnectionIDTTL, "[::]", "", true},
+
+	// Boundaries of the validity window.
+	{0, 120, DefaultConnectionIDTTL, "127.0.0.1", "", true},
+	{0, 121, DefaultConnectionIDTTL, "127.0.0.1", "", false},
+	{0, 300, 5 * time.Minute, "127.0.0.1", "", true},
+	{0, 301, 5 * time.Minute, "127.0.0.1", "", false},
+	{0, 30, 30 * time.Second, "127.0.0.1", "", true},
+	{0, 31, 30 * time.Second, "127.0.0.1", "", false},
+
+	// Boundaries of the clock skew.
+	{60, 0, DefaultConnectionIDTTL, "127.0.0.1", "", true},
+	{61, 0, DefaultConnectionIDTTL, "127.0.0.1", "", false},
 }
 
 func TestVerification(t *testing.T) {
 	for _, tt := range golden {
 		cid := NewConnectionID(net.ParseIP(tt.ip), time.Unix(tt.createdAt, 0), tt.key)
-		got := ValidConnectionID(cid, net.ParseIP(tt.ip), time.Unix(tt.now, 0), time.Minute, tt.key)
+		got := ValidConnectionID(cid, net.ParseIP(tt.ip), time.Unix(tt.now, 0), tt.ttl, time.Minute, tt.key)
 		if got != tt.valid {
-			t.Errorf("expected validity: %t got validity: %t", tt.valid, got)
+			t.Errorf("expected validity: %t got validity: %t (created at %d, now %d, ttl %s)", tt.valid, got, tt.createdAt, tt.now, tt.ttl)
 		}
 	}
 }
 
+func TestVerificationKeyChange(t *testing.T) {
+	ip := net.ParseIP("127.0.0.1")
+	createdAt := time.Unix(0, 0)
+	cid := NewConnectionID(ip, createdAt, "old key")
+
+	// Changing the private key invalidates all connection IDs, even within
+	// the validity window.
+	for _, ttl := range []time.Duration{DefaultConnectionIDTTL, time.Hour} {
+		if !ValidConnectionID(cid, ip, createdAt, ttl, time.Minute, "old key") {
+			t.Errorf("expected connection ID to be valid with the old key (ttl %s)", ttl)
+		}
+		if ValidConnectionID(cid, ip, createdAt, ttl, time.Minute, "new key") {
+			t.Errorf("expected connection ID to be invalid with the new key (ttl %s)", ttl)
+		}
+	}
+
+	// The same holds for a different IP.
+	if ValidConnectionID(cid, net.ParseIP("127.0.0.2"), createdAt, DefaultConnectionIDTTL, time.Minute, "old key") {
+		t.Errorf("expected connection ID to be invalid for a different IP")
+	}
+}
+
 func BenchmarkNewConnectionID(b *testing.B) {
 	ip := net.ParseIP("127.0.0.1")
 	key := "some random string that is hopefully at least this long"
@@ -49,7 +84,7 @@ func BenchmarkValidConnectionID(b *testing.B) {
 	cid := NewConnectionID(ip, createdAt, key)
 
 	for i := 0; i < b.N; i++ {
-		if !ValidConnectionID(cid, ip, createdAt, 10*time.Second, key) {
+		if !ValidConnectionID(cid, ip, createdAt, DefaultConnectionIDTTL, 10*time.Second, key) {
 			b.FailNow()
 		}
 	}
@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"math"
 	"math/rand"
 	"net"
 	"sync"
@@ -16,7 +17,9 @@ import (
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/frontend"
 	"github.com/chihaya/chihaya/frontend/udp/bytepool"
+	"github.com/chihaya/chihaya/pkg/load"
 	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/ratelimit"
 	"github.com/chihaya/chihaya/pkg/stop"
 )
 
@@ -24,10 +27,19 @@ var allowedGeneratedPrivateKeyRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGH
 
 func init() {
 	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(promRateLimitedRequestsTotal)
 }
 
 // ErrInvalidIP indicates an invalid IP.
-var ErrInvalidIP = bittorrent.ClientError("invalid IP")
+var ErrInvalidIP = bittorrent.NewClientError("invalid_ip", "invalid IP")
+
+// ErrRateLimited indicates that a request was rejected because the frontend
+// is receiving more requests than configured.
+var ErrRateLimited = bittorrent.NewClientError("rate_limited", "rate limit exceeded")
+
+// ErrOverloaded indicates that a request was rejected because the frontend
+// is processing the maximum number of concurrent requests.
+var ErrOverloaded = bittorrent.NewClientError("overloaded", "tracker overloaded")
 
 var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
@@ -38,12 +50,20 @@ var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	[]string{"action", "address_family", "error"},
 )
 
+var promRateLimitedRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_rate_limited_requests_total",
+		Help: "The number of requests rejected because of the global rate limit",
+	},
+	[]string{"action"},
+)
+
 // recordResponseDuration records the duration of time to respond to a UDP
 // Request in milliseconds .
 func recordResponseDuration(action string, af *bittorrent.AddressFamily, err error, duration time.Duration) {
 	var errString string
 	if err != nil {
-		if _, ok := err.(bittorrent.ClientError); ok {
+		if bittorrent.IsClientError(err) {
 			errString = err.Error()
 		} else {
 			errString = "internal error"
@@ -72,17 +92,64 @@ type Config struct {
 	MaxClockSkew        time.Duration `yaml:"max_clock_skew"`
 	AllowIPSpoofing     bool          `yaml:"allow_ip_spoofing"`
 	EnableRequestTiming bool          `yaml:"enable_request_timing"`
+
+	// EnableRequestMetrics specifies whether the number of requests, the
+	// number of requests in flight and the size of the responses are
+	// recorded.
+	EnableRequestMetrics bool `yaml:"enable_request_metrics"`
+
+	// ConnectionIDTTL is the duration a connection ID is valid after it was
+	// handed out. Announces and scrapes with an expired connection ID are
+	// rejected.
+	// If zero, the BEP 15 default of 2 minutes is used.
+	ConnectionIDTTL time.Duration `yaml:"connection_id_ttl"`
+
+	// AnnounceRateLimit and ScrapeRateLimit are the maximum number of
+	// announces and scrapes per second accepted by the frontend.
+	// Zero disables the limit.
+	AnnounceRateLimit float64 `yaml:"announce_rate_limit"`
+	ScrapeRateLimit   float64 `yaml:"scrape_rate_limit"`
+
+	// MaxConcurrentRequests is the maximum number of announces and scrapes
+	// processed concurrently.
+	// Zero disables the limit.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+
+	// LogRejections specifies whether announces and scrapes rejected by the
+	// middleware or the frontend are logged along with the reason.
+	LogRejections bool `yaml:"log_rejections"`
+
+	// Authenticator, if set, authenticates announces and scrapes before
+	// they are passed to the middleware.
+	// Credentials are only available via the URL data of BEP 41.
+	Authenticator frontend.Authenticator `yaml:"-"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
-		"addr":                cfg.Addr,
-		"privateKey":          cfg.PrivateKey,
-		"maxClockSkew":        cfg.MaxClockSkew,
-		"allowIPSpoofing":     cfg.AllowIPSpoofing,
-		"enableRequestTiming": cfg.EnableRequestTiming,
+		"addr":                 cfg.Addr,
+		"privateKey":           cfg.PrivateKey,
+		"maxClockSkew":         cfg.MaxClockSkew,
+		"connectionIDTTL":      cfg.ConnectionIDTTL,
+		"allowIPSpoofing":      cfg.AllowIPSpoofing,
+		"enableRequestTiming":  cfg.EnableRequestTiming,
+		"enableRequestMetrics": cfg.EnableRequestMetrics,
+		"announceRateLimit":    cfg.AnnounceRateLimit,
+		"scrapeRateLimit":      cfg.ScrapeRateLimit,
+		"maxConcurrent":        cfg.MaxConcurrentRequests,
+		"logRejections":        cfg.LogRejections,
+	}
+}
+
+// newLimiter creates a limiter for the given rate per second.
+// A rate <= 0 disables limiting.
+func newLimiter(rate float64) *ratelimit.Limiter {
+	if rate <= 0 {
+		return nil
 	}
+
+	return ratelimit.New(rate, int(math.Ceil(rate)))
 }
 
 // Frontend holds the state of a UDP BitTorrent Frontend.
@@ -91,6 +158,10 @@ type Frontend struct {
 	closing chan struct{}
 	wg      sync.WaitGroup
 
+	announceLimiter *ratelimit.Limiter
+	scrapeLimiter   *ratelimit.Limiter
+	concurrency     *load.Limiter
+
 	logic frontend.TrackerLogic
 	Config
 }
@@ -110,10 +181,17 @@ func NewFrontend(logic frontend.TrackerLogic, cfg Config) (*Frontend, error) {
 		log.Warn("UDP private key was not provided, using generated key", log.Fields{"key": cfg.PrivateKey})
 	}
 
+	if cfg.ConnectionIDTTL <= 0 {
+		cfg.ConnectionIDTTL = DefaultConnectionIDTTL
+	}
+
 	f := &Frontend{
-		closing: make(chan struct{}),
-		logic:   logic,
-		Config:  cfg,
+		closing:         make(chan struct{}),
+		announceLimiter: newLimiter(cfg.AnnounceRateLimit),
+		scrapeLimiter:   newLimiter(cfg.ScrapeRateLimit),
+		concurrency:     load.NewLimiter(cfg.MaxConcurrentRequests),
+		logic:           logic,
+		Config:          cfg,
 	}
 
 	go func() {
@@ -133,6 +211,8 @@ func (t *Frontend) Stop() <-chan error {
 	default:
 	}
 
+	t.concurrency.Unregister()
+
 	c := make(chan error)
 	go func() {
 		close(t.closing)
@@ -207,16 +287,24 @@ func (t *Frontend) listenAndServe() error {
 			if t.EnableRequestTiming {
 				start = time.Now()
 			}
+			w := ResponseWriter{socket: t.socket, addr: addr}
+			if t.EnableRequestMetrics {
+				frontend.RecordRequestStart("udp")
+				w.written = new(int)
+			}
 			action, af, err := t.handleRequest(
 				// Make sure the IP is copied, not referenced.
 				Request{buffer[:n], append([]byte{}, addr.IP...)},
-				ResponseWriter{t.socket, addr},
+				w,
 			)
 			if t.EnableRequestTiming {
 				recordResponseDuration(action, af, err, time.Since(start))
 			} else {
 				recordResponseDuration(action, af, err, time.Duration(0))
 			}
+			if t.EnableRequestMetrics {
+				frontend.RecordRequestEnd("udp", action, *w.written)
+			}
 		}()
 	}
 }
@@ -232,14 +320,56 @@ type Request struct {
 type ResponseWriter struct {
 	socket *net.UDPConn
 	addr   *net.UDPAddr
+
+	// written, if not nil, counts the bytes written.
+	written *int
 }
 
 // Write implements the io.Writer interface for a ResponseWriter.
 func (w ResponseWriter) Write(b []byte) (int, error) {
 	w.socket.WriteToUDP(b, w.addr)
+	if w.written != nil {
+		*w.written += len(b)
+	}
 	return len(b), nil
 }
 
+// requestContext returns a new context for a request from ip, tagged with a
+// request ID, the udp scheme and ip.
+func requestContext(ip net.IP) context.Context {
+	ctx := log.WithRequestID(context.Background())
+	ctx = context.WithValue(ctx, bittorrent.SchemeKey, bittorrent.SchemeUDP)
+	if clientIP, ok := bittorrent.NormalizeIP(ip); ok {
+		ctx = context.WithValue(ctx, frontend.ClientIPKey, clientIP)
+		ctx = context.WithValue(ctx, frontend.RemoteIPKey, clientIP)
+	}
+	return ctx
+}
+
+// authenticate runs the configured Authenticator for a request.
+//
+// If no Authenticator is configured or it rejects the request, ctx is
+// returned.
+func (t *Frontend) authenticate(ctx context.Context, params bittorrent.Params) (context.Context, error) {
+	if t.Authenticator == nil {
+		return ctx, nil
+	}
+
+	authCtx, err := t.Authenticator.Authenticate(ctx, frontend.Credentials{Params: params})
+	if err != nil {
+		return ctx, err
+	}
+	return authCtx, nil
+}
+
+// logRejection logs that a request was rejected with err, if rejections are
+// logged.
+func (t *Frontend) logRejection(ctx context.Context, action string, ip net.IP, infoHashes []bittorrent.InfoHash, err error) {
+	if t.LogRejections {
+		frontend.LogRejection(ctx, "udp", action, ip, infoHashes, err)
+	}
+}
+
 // handleRequest parses and responds to a UDP Request.
 func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string, af *bittorrent.AddressFamily, err error) {
 	if len(r.Packet) < 16 {
@@ -256,7 +386,7 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 
 	// If this isn't requesting a new connection ID and the connection ID is
 	// invalid, then fail.
-	if actionID != connectActionID && !ValidConnectionID(connID, r.IP, time.Now(), t.MaxClockSkew, t.PrivateKey) {
+	if actionID != connectActionID && !ValidConnectionID(connID, r.IP, time.Now(), t.ConnectionIDTTL, t.MaxClockSkew, t.PrivateKey) {
 		err = errBadConnectionID
 		WriteError(w, txID, err)
 		return
@@ -276,34 +406,81 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 
 	case announceActionID, announceV6ActionID:
 		actionName = "announce"
+		ctx := requestContext(r.IP)
+
+		if !t.announceLimiter.Allow() {
+			promRateLimitedRequestsTotal.WithLabelValues(actionName).Inc()
+			err = ErrRateLimited
+			t.logRejection(ctx, actionName, r.IP, nil, err)
+			WriteError(w, txID, err)
+			return
+		}
+
+		if !t.concurrency.Acquire() {
+			err = ErrOverloaded
+			t.logRejection(ctx, actionName, r.IP, nil, err)
+			WriteError(w, txID, err)
+			return
+		}
+		defer t.concurrency.Release()
 
 		var req *bittorrent.AnnounceRequest
 		req, err = ParseAnnounce(r, t.AllowIPSpoofing, actionID == announceV6ActionID)
 		if err != nil {
+			t.logRejection(ctx, actionName, r.IP, nil, err)
 			WriteError(w, txID, err)
 			return
 		}
 		af = new(bittorrent.AddressFamily)
 		*af = req.IP.AddressFamily
 
-		var ctx context.Context
+		ctx, err = t.authenticate(ctx, req.Params)
+		if err != nil {
+			t.logRejection(ctx, actionName, req.IP.IP, []bittorrent.InfoHash{req.InfoHash}, err)
+			WriteError(w, txID, err)
+			return
+		}
+
+		var afterCtx context.Context
 		var resp *bittorrent.AnnounceResponse
-		ctx, resp, err = t.logic.HandleAnnounce(context.Background(), req)
+		afterCtx, resp, err = t.logic.HandleAnnounce(ctx, req)
 		if err != nil {
+			t.logRejection(ctx, actionName, req.IP.IP, []bittorrent.InfoHash{req.InfoHash}, err)
 			WriteError(w, txID, err)
 			return
 		}
 
-		WriteAnnounce(w, txID, resp, actionID == announceV6ActionID)
+		// Clients announcing via IPv6 as described in BEP 15 use the
+		// regular announce action, but expect IPv6 peers nevertheless.
+		v6 := actionID == announceV6ActionID || req.IP.AddressFamily == bittorrent.IPv6
+		WriteAnnounce(w, txID, resp, actionID, v6)
 
-		go t.logic.AfterAnnounce(ctx, req, resp)
+		go t.logic.AfterAnnounce(afterCtx, req, resp)
 
 	case scrapeActionID:
 		actionName = "scrape"
+		ctx := requestContext(r.IP)
+
+		if !t.scrapeLimiter.Allow() {
+			promRateLimitedRequestsTotal.WithLabelValues(actionName).Inc()
+			err = ErrRateLimited
+			t.logRejection(ctx, actionName, r.IP, nil, err)
+			WriteError(w, txID, err)
+			return
+		}
+
+		if !t.concurrency.Acquire() {
+			err = ErrOverloaded
+			t.logRejection(ctx, actionName, r.IP, nil, err)
+			WriteError(w, txID, err)
+			return
+		}
+		defer t.concurrency.Release()
 
 		var req *bittorrent.ScrapeRequest
 		req, err = ParseScrape(r)
 		if err != nil {
+			t.logRejection(ctx, actionName, r.IP, nil, err)
 			WriteError(w, txID, err)
 			return
 		}
@@ -313,24 +490,32 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 		} else if len(r.IP) == net.IPv6len { // implies r.IP.To4() == nil
 			req.AddressFamily = bittorrent.IPv6
 		} else {
-			log.Error("udp: invalid IP: neither v4 nor v6", log.Fields{"IP": r.IP})
+			log.Error("udp: invalid IP: neither v4 nor v6", log.RequestFields(ctx, log.Fields{"IP": r.IP}))
 			WriteError(w, txID, ErrInvalidIP)
 			return
 		}
 		af = new(bittorrent.AddressFamily)
 		*af = req.AddressFamily
 
-		var ctx context.Context
+		ctx, err = t.authenticate(ctx, req.Params)
+		if err != nil {
+			t.logRejection(ctx, actionName, r.IP, req.InfoHashes, err)
+			WriteError(w, txID, err)
+			return
+		}
+
+		var afterCtx context.Context
 		var resp *bittorrent.ScrapeResponse
-		ctx, resp, err = t.logic.HandleScrape(context.Background(), req)
+		afterCtx, resp, err = t.logic.HandleScrape(ctx, req)
 		if err != nil {
+			t.logRejection(ctx, actionName, r.IP, req.InfoHashes, err)
 			WriteError(w, txID, err)
 			return
 		}
 
 		WriteScrape(w, txID, resp)
 
-		go t.logic.AfterScrape(ctx, req, resp)
+		go t.logic.AfterScrape(afterCtx, req, resp)
 
 	default:
 		err = errUnknownAction
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
 	"sync"
 
@@ -37,12 +38,12 @@ var (
 		bittorrent.Stopped,
 	}
 
-	errMalformedPacket   = bittorrent.ClientError("malformed packet")
-	errMalformedIP       = bittorrent.ClientError("malformed IP address")
-	errMalformedEvent    = bittorrent.ClientError("malformed event ID")
-	errUnknownAction     = bittorrent.ClientError("unknown action ID")
-	errBadConnectionID   = bittorrent.ClientError("bad connection ID")
-	errUnknownOptionType = bittorrent.ClientError("unknown option type")
+	errMalformedPacket   = bittorrent.NewClientError("malformed_packet", "malformed packet")
+	errMalformedIP       = bittorrent.NewClientError("malformed_ip", "malformed IP address")
+	errMalformedEvent    = bittorrent.NewClientError("malformed_event", "malformed event ID")
+	errUnknownAction     = bittorrent.NewClientError("unknown_action", "unknown action ID")
+	errBadConnectionID   = bittorrent.NewClientError("bad_connection_id", "bad connection ID")
+	errUnknownOptionType = bittorrent.NewClientError("unknown_option_type", "unknown option type")
 )
 
 // ParseAnnounce parses an AnnounceRequest from a UDP request.
@@ -76,17 +77,39 @@ func ParseAnnounce(r Request, allowIPSpoofing, v6 bool) (*bittorrent.AnnounceReq
 	ip := r.IP
 	ipbytes := r.Packet[84:ipEnd]
 	if allowIPSpoofing {
-		// Make sure the bytes are copied to a new slice.
-		copy(ip, net.IP(ipbytes))
+		// Make sure the bytes are copied to a new slice, as the length of
+		// the announced IP may differ from the length of r.IP.
+		ip = append(net.IP(nil), ipbytes...)
 	}
 	if !allowIPSpoofing && r.IP == nil {
 		// We have no IP address to fallback on.
 		return nil, errMalformedIP
 	}
 
+	// IPv4-mapped addresses announced "the opentracker way" are IPv4
+	// peers.
+	peerIP, ok := bittorrent.NormalizeIP(ip)
+	if !ok {
+		return nil, errMalformedIP
+	}
+
+	// A numwant of -1 leaves the number of peers to the tracker. Zero does so
+	// as well, as it always has for UDP, so only HTTP clients can request no
+	// peers at all.
 	numWant := binary.BigEndian.Uint32(r.Packet[ipEnd+4 : ipEnd+8])
+	numWantSpecified := numWant != 0 && numWant != math.MaxUint32
+	if !numWantSpecified {
+		numWant = 0
+	}
 	port := binary.BigEndian.Uint16(r.Packet[ipEnd+8 : ipEnd+10])
 
+	// Clients without a key send zero. The key is represented like by
+	// bittorrent.NormalizeKey.
+	var key string
+	if k := binary.BigEndian.Uint32(r.Packet[ipEnd : ipEnd+4]); k != 0 {
+		key = fmt.Sprintf("%08x", k)
+	}
+
 	params, err := handleOptionalParameters(r.Packet[ipEnd+10:])
 	if err != nil {
 		return nil, err
@@ -95,13 +118,20 @@ func ParseAnnounce(r Request, allowIPSpoofing, v6 bool) (*bittorrent.AnnounceReq
 	return &bittorrent.AnnounceRequest{
 		Event:      eventIDs[eventID],
 		InfoHash:   bittorrent.InfoHashFromBytes(infohash),
-		NumWant:    uint32(numWant),
+		NumWant:    numWant,
 		Left:       left,
 		Downloaded: downloaded,
 		Uploaded:   uploaded,
+
+		NumWantSpecified: numWantSpecified,
+		Key:              key,
+
+		// Copy the connection ID, the packet buffer is reused.
+		ConnectionID: append([]byte(nil), r.Packet[0:8]...),
+
 		Peer: bittorrent.Peer{
 			ID:   bittorrent.PeerIDFromBytes(peerID),
-			IP:   bittorrent.IP{IP: ip},
+			IP:   peerIP,
 			Port: port,
 		},
 		Params: params,
@@ -1,6 +1,13 @@
 package udp
 
-import "testing"
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
 
 var table = []struct {
 	data   []byte
@@ -69,3 +76,99 @@ func TestHandleOptionalParameters(t *testing.T) {
 		}
 	}
 }
+
+// announcePacket builds an announce packet for ip, in the IPv6 format if ip
+// has 16 bytes.
+func announcePacket(ip net.IP) []byte {
+	packet := make([]byte, 84)
+	copy(packet[16:36], "aaaaaaaaaaaaaaaaaaaa")
+	copy(packet[36:56], "-TR2940-000000000001")
+	packet = append(packet, ip...)
+	packet = append(packet, 0, 0, 0, 0)             // key
+	packet = append(packet, 0xFF, 0xFF, 0xFF, 0xFF) // numwant
+	return append(packet, 0x1A, 0xE1)               // port
+}
+
+func TestParseAnnounceMappedIP(t *testing.T) {
+	mapped := net.ParseIP("::ffff:1.2.3.4")
+	expected := bittorrent.IP{IP: net.IP{1, 2, 3, 4}, AddressFamily: bittorrent.IPv4}
+
+	var table = []struct {
+		remote          net.IP
+		allowIPSpoofing bool
+	}{
+		// A mapped address announced "the opentracker way".
+		{net.IP{5, 6, 7, 8}, true},
+		{net.ParseIP("fc00::1"), true},
+		// A mapped remote address.
+		{mapped, false},
+	}
+
+	for _, tt := range table {
+		req, err := ParseAnnounce(Request{Packet: announcePacket(mapped), IP: tt.remote}, tt.allowIPSpoofing, true)
+		require.Nil(t, err)
+		require.Equal(t, expected, req.IP)
+		require.Equal(t, uint16(6881), req.Port)
+		require.Equal(t, announcePacket(mapped)[0:8], req.ConnectionID)
+	}
+}
+
+func TestParseAnnounceTruncated(t *testing.T) {
+	packet := announcePacket(net.IP{1, 2, 3, 4})
+
+	// Packets ending within the peer ID or any later field are rejected.
+	for _, n := range []int{40, 55, 56, 84, len(packet) - 1} {
+		_, err := ParseAnnounce(Request{Packet: packet[:n], IP: net.IP{1, 2, 3, 4}}, false, false)
+		require.Equal(t, errMalformedPacket, err)
+	}
+}
+
+func TestParseAnnounceKey(t *testing.T) {
+	packet := announcePacket(net.IP{1, 2, 3, 4})
+	req, err := ParseAnnounce(Request{Packet: packet, IP: net.IP{1, 2, 3, 4}}, false, false)
+	require.Nil(t, err)
+	require.Equal(t, "", req.Key)
+
+	copy(packet[88:92], []byte{0xde, 0xad, 0xbe, 0xef})
+	req, err = ParseAnnounce(Request{Packet: packet, IP: net.IP{1, 2, 3, 4}}, false, false)
+	require.Nil(t, err)
+	require.Equal(t, "deadbeef", req.Key)
+}
+
+func TestParseAnnounceEvent(t *testing.T) {
+	// UDP events are IDs, so they need no normalization.
+	for id, want := range []bittorrent.Event{bittorrent.None, bittorrent.Completed, bittorrent.Started, bittorrent.Stopped} {
+		packet := announcePacket(net.IP{1, 2, 3, 4})
+		packet[83] = byte(id)
+		req, err := ParseAnnounce(Request{Packet: packet, IP: net.IP{1, 2, 3, 4}}, false, false)
+		require.Nil(t, err)
+		require.Equal(t, want, req.Event)
+	}
+
+	packet := announcePacket(net.IP{1, 2, 3, 4})
+	packet[83] = 4
+	_, err := ParseAnnounce(Request{Packet: packet, IP: net.IP{1, 2, 3, 4}}, false, false)
+	require.Equal(t, errMalformedEvent, err)
+}
+
+func TestParseAnnounceNumWant(t *testing.T) {
+	var table = []struct {
+		numWant   []byte
+		expected  uint32
+		specified bool
+	}{
+		{[]byte{0xff, 0xff, 0xff, 0xff}, 0, false},
+		// Zero leaves the number of peers to the tracker, too.
+		{[]byte{0, 0, 0, 0}, 0, false},
+		{[]byte{0, 0, 0, 50}, 50, true},
+	}
+
+	for _, tt := range table {
+		packet := announcePacket(net.IP{1, 2, 3, 4})
+		copy(packet[92:96], tt.numWant)
+		req, err := ParseAnnounce(Request{Packet: packet, IP: net.IP{1, 2, 3, 4}}, false, false)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, req.NumWant)
+		require.Equal(t, tt.specified, req.NumWantSpecified)
+	}
+}
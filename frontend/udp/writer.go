@@ -10,9 +10,19 @@ import (
 )
 
 // WriteError writes the failure reason as a null-terminated string.
+//
+// BEP 15 error responses have no field for a retry delay, so the delay of a
+// bittorrent.RetryError is appended to the failure reason, rounded up to full
+// minutes.
 func WriteError(w io.Writer, txID []byte, err error) {
-	// If the client wasn't at fault, acknowledge it.
-	if _, ok := err.(bittorrent.ClientError); !ok {
+	if retryErr, ok := err.(bittorrent.RetryError); ok {
+		minutes := int64((retryErr.RetryIn + time.Minute - 1) / time.Minute)
+		if minutes < 1 {
+			minutes = 1
+		}
+		err = fmt.Errorf("%s, retry in %d min", retryErr.Error(), minutes)
+	} else if _, ok := err.(bittorrent.ClientError); !ok {
+		// If the client wasn't at fault, acknowledge it.
 		err = fmt.Errorf("internal error occurred: %s", err.Error())
 	}
 
@@ -25,17 +35,17 @@ func WriteError(w io.Writer, txID []byte, err error) {
 }
 
 // WriteAnnounce encodes an announce response according to BEP 15.
-// The peers returned will be resp.IPv6Peers or resp.IPv4Peers, depending on
-// whether v6 is set. The action ID will be 4, according to
+//
+// The action ID of the response is the action ID of the request, i.e. either
+// 1 or 4, according to
 // http://opentracker.blog.h3q.com/2007/12/28/the-ipv6-situation/.
-func WriteAnnounce(w io.Writer, txID []byte, resp *bittorrent.AnnounceResponse, v6 bool) {
+// The peers returned will be resp.IPv6Peers or resp.IPv4Peers, depending on
+// whether v6 is set. IPv4 peers are encoded in 6 bytes, IPv6 peers are encoded
+// in 18 bytes. Peers of the other address family are never written.
+func WriteAnnounce(w io.Writer, txID []byte, resp *bittorrent.AnnounceResponse, actionID uint32, v6 bool) {
 	buf := newBuffer()
 
-	if v6 {
-		writeHeader(buf, txID, announceV6ActionID)
-	} else {
-		writeHeader(buf, txID, announceActionID)
-	}
+	writeHeader(buf, txID, actionID)
 	binary.Write(buf, binary.BigEndian, uint32(resp.Interval/time.Second))
 	binary.Write(buf, binary.BigEndian, resp.Incomplete)
 	binary.Write(buf, binary.BigEndian, resp.Complete)
@@ -46,7 +56,19 @@ func WriteAnnounce(w io.Writer, txID []byte, resp *bittorrent.AnnounceResponse,
 	}
 
 	for _, peer := range peers {
-		buf.Write(peer.IP.IP)
+		ip := peer.IP.To4()
+		if v6 {
+			if ip != nil {
+				// Never mix IPv4 addresses into an IPv6 peer list.
+				continue
+			}
+			ip = peer.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+
+		buf.Write(ip)
 		binary.Write(buf, binary.BigEndian, peer.Port)
 	}
 
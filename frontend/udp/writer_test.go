@@ -0,0 +1,94 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// decodeAnnounce is a reference decoder for announce responses as described
+// in BEP 15.
+func decodeAnnounce(t *testing.T, b []byte, ipLen int) (actionID uint32, interval time.Duration, peers []bittorrent.Peer) {
+	require.True(t, len(b) >= 20, "announce response must be at least 20 bytes")
+	actionID = binary.BigEndian.Uint32(b[0:4])
+	interval = time.Duration(binary.BigEndian.Uint32(b[8:12])) * time.Second
+
+	b = b[20:]
+	require.Equal(t, 0, len(b)%(ipLen+2))
+	for i := 0; i < len(b); i += ipLen + 2 {
+		peers = append(peers, bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.IP(b[i : i+ipLen])},
+			Port: binary.BigEndian.Uint16(b[i+ipLen : i+ipLen+2]),
+		})
+	}
+	return
+}
+
+func TestWriteAnnounce(t *testing.T) {
+	resp := &bittorrent.AnnounceResponse{
+		Interval: 30 * time.Minute,
+		IPv4Peers: []bittorrent.Peer{
+			{IP: bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4}, Port: 1234},
+			// IPv4 addresses in 16 byte form must be truncated.
+			{IP: bittorrent.IP{IP: net.ParseIP("5.6.7.8"), AddressFamily: bittorrent.IPv4}, Port: 5678},
+		},
+		IPv6Peers: []bittorrent.Peer{
+			{IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 4321},
+			// IPv4 peers must never be mixed into IPv6 responses.
+			{IP: bittorrent.IP{IP: net.ParseIP("9.9.9.9"), AddressFamily: bittorrent.IPv4}, Port: 9999},
+		},
+	}
+	txID := []byte{1, 2, 3, 4}
+
+	var table = []struct {
+		actionID uint32
+		v6       bool
+		ipLen    int
+		expected []bittorrent.Peer
+	}{
+		{announceActionID, false, net.IPv4len, resp.IPv4Peers},
+		{announceActionID, true, net.IPv6len, resp.IPv6Peers[:1]},
+		{announceV6ActionID, true, net.IPv6len, resp.IPv6Peers[:1]},
+	}
+
+	for _, tt := range table {
+		var buf bytes.Buffer
+		WriteAnnounce(&buf, txID, resp, tt.actionID, tt.v6)
+
+		actionID, interval, peers := decodeAnnounce(t, buf.Bytes(), tt.ipLen)
+		require.Equal(t, tt.actionID, actionID)
+		require.Equal(t, resp.Interval, interval)
+		require.Equal(t, txID, buf.Bytes()[4:8])
+		require.Equal(t, len(tt.expected), len(peers))
+		for i := range tt.expected {
+			require.True(t, tt.expected[i].IP.Equal(peers[i].IP.IP))
+			require.Equal(t, tt.expected[i].Port, peers[i].Port)
+		}
+	}
+}
+
+func TestWriteErrorRetry(t *testing.T) {
+	var table = []struct {
+		err      error
+		expected string
+	}{
+		{bittorrent.ClientError("denied"), "denied"},
+		{bittorrent.RetryError{ClientError: "denied", RetryIn: 90 * time.Second}, "denied, retry in 2 min"},
+		{bittorrent.RetryError{ClientError: "denied"}, "denied, retry in 1 min"},
+	}
+
+	for _, tt := range table {
+		var buf bytes.Buffer
+		WriteError(&buf, []byte{1, 2, 3, 4}, tt.err)
+
+		b := buf.Bytes()
+		require.Equal(t, errorActionID, binary.BigEndian.Uint32(b[0:4]))
+		require.Equal(t, tt.expected+"\x00", string(b[8:]))
+	}
+}
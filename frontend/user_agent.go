@@ -0,0 +1,17 @@
+package frontend
+
+import "context"
+
+type userAgentKey struct{}
+
+// UserAgentKey is the key under which frontends store the User-Agent of a
+// request in its context, if the protocol has one.
+// The value is expected to be of type string and is only set if the
+// User-Agent is not empty.
+var UserAgentKey = userAgentKey{}
+
+// UserAgent returns the User-Agent of a request from its context, if any.
+func UserAgent(ctx context.Context) (string, bool) {
+	userAgent, ok := ctx.Value(UserAgentKey).(string)
+	return userAgent, ok
+}
@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/singleflight"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// defaultAnnounceCacheTTL is the lifetime of cached peers if none is
+// configured.
+const defaultAnnounceCacheTTL = 250 * time.Millisecond
+
+// AnnounceCacheConfig holds the configuration of the cache of the peers
+// returned for announces.
+//
+// The peers of a swarm are fetched once per address family and role of the
+// announcer and shared by all announces within TTL, each of which receives
+// its own random subset without the announcer. The subsets keep the priority
+// of the storage, e.g. seeders before leechers, if the storage implements
+// storage.PeerGroupStore. Otherwise, every announcer receives the peers the
+// storage returned first. It is meant for very hot swarms, so TTL should stay
+// well below a second.
+type AnnounceCacheConfig struct {
+	// Size is the maximum number of cached peer lists. The least recently
+	// used lists are evicted first.
+	// Zero disables the cache.
+	Size int `yaml:"size"`
+
+	// TTL is the maximum age of a cached peer list.
+	// If zero, a default of 250ms is used.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+type announceCacheKey struct {
+	infoHash bittorrent.InfoHash
+	af       bittorrent.AddressFamily
+	seeding  bool
+}
+
+func (k announceCacheKey) String() string {
+	seeding := byte(0)
+	if k.seeding {
+		seeding = 1
+	}
+	return string(k.infoHash[:]) + string([]byte{byte(k.af), seeding})
+}
+
+type announceCacheEntry struct {
+	key     announceCacheKey
+	peers   []bittorrent.Peer
+	created time.Time
+
+	// ends are the ends of the groups of peers of equal priority, or nil if
+	// the storage did not report them.
+	ends []int
+
+	// complete is whether peers holds all peers the storage returned,
+	// i.e. fewer than requested.
+	complete bool
+}
+
+// announceCache is an LRU cache of the peers returned for announces.
+//
+// A nil *announceCache is never used.
+type announceCache struct {
+	ttl     time.Duration
+	flights singleflight.Group
+
+	sync.Mutex
+	size    int
+	entries map[announceCacheKey]*list.Element
+	lru     *list.List
+}
+
+// newAnnounceCache creates an announceCache for cfg.
+//
+// If the cache is disabled, nil is returned.
+func newAnnounceCache(cfg AnnounceCacheConfig) *announceCache {
+	if cfg.Size <= 0 {
+		return nil
+	}
+
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultAnnounceCacheTTL
+	}
+
+	return &announceCache{
+		ttl:     cfg.TTL,
+		size:    cfg.Size,
+		entries: make(map[announceCacheKey]*list.Element, cfg.Size),
+		lru:     list.New(),
+	}
+}
+
+// cacheAnnouncer returns the Peer on whose behalf the peers of the address
+// family af are fetched for the cache. It matches no actual peer, so no
+// announcer is missing from the cached peers.
+func cacheAnnouncer(af bittorrent.AddressFamily) bittorrent.Peer {
+	if af == bittorrent.IPv6 {
+		return bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv6unspecified, AddressFamily: af}}
+	}
+	return bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4zero.To4(), AddressFamily: af}}
+}
+
+// peers returns at least numWant peers of the swarm identified by key from
+// the cache, or all of them if it has fewer, and the ends of their groups. If
+// they are not cached, too old or too few, fetch is called to get numWant
+// peers from the storage.
+//
+// The store is queried without holding the lock, but only once for concurrent
+// misses of the same swarm, which share its result.
+//
+// The returned slices are shared and must not be modified. Failed fetches are
+// not cached.
+func (c *announceCache) peers(key announceCacheKey, numWant int, now time.Time, fetch func(numWant int) ([]bittorrent.Peer, []int, error)) ([]bittorrent.Peer, []int, error) {
+	c.Lock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*announceCacheEntry)
+		if now.Sub(entry.created) <= c.ttl && (entry.complete || len(entry.peers) >= numWant) {
+			c.lru.MoveToFront(e)
+			c.Unlock()
+			PromAnnounceCacheHitsTotal.Inc()
+			return entry.peers, entry.ends, nil
+		}
+	}
+	c.Unlock()
+
+	v, err, _ := c.flights.Do(key.String(), func() (interface{}, error) {
+		peers, ends, err := fetch(numWant)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &announceCacheEntry{key: key, peers: peers, ends: ends, created: now, complete: len(peers) < numWant}
+		c.add(entry)
+		return entry, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := v.(*announceCacheEntry)
+	return entry.peers, entry.ends, nil
+}
+
+// add adds entry to the cache, replacing the entry of the same swarm and
+// evicting the least recently used one if the cache is full.
+func (c *announceCache) add(entry *announceCacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[entry.key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*announceCacheEntry).key)
+	}
+}
+
+// cachedPeers returns numWant peers for req from the announce cache.
+//
+// Every cached list holds as many peers as the largest numwant allows, so that
+// it serves all announcers. The peers are shuffled within their groups before
+// the announcer is excluded and the list is cut to numWant, so that every
+// response holds a random subset that the storage would also have
+// prioritized, e.g. seeders for leechers and reachable peers.
+func (h *responseHook) cachedPeers(req *bittorrent.AnnounceRequest, seeding bool, numWant int) ([]bittorrent.Peer, error) {
+	fill := numWant
+	if maxNumWant := int(h.config.load().MaxNumWant); maxNumWant > fill {
+		fill = maxNumWant
+	}
+
+	af := req.IP.AddressFamily
+	key := announceCacheKey{infoHash: req.InfoHash, af: af, seeding: seeding}
+	cached, ends, err := h.announceCache.peers(key, fill+1, time.Now(), func(numWant int) ([]bittorrent.Peer, []int, error) {
+		anonymous := *req
+		anonymous.Peer = cacheAnnouncer(af)
+		return h.groupedPeers(&anonymous, seeding, numWant)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]bittorrent.Peer, len(cached))
+	copy(peers, cached)
+	start := 0
+	for _, end := range ends {
+		shufflePeers(req, peers[start:end])
+		start = end
+	}
+
+	// The storage would have skipped the announcer itself, or all of its
+	// entries if configured.
+	n := 0
+	for _, p := range peers {
+		if p.Equal(req.Peer) || h.excludeAnnouncer && (p.ID == req.Peer.ID || p.EqualEndpoint(req.Peer)) {
+			continue
+		}
+		peers[n] = p
+		n++
+	}
+	peers = peers[:n]
+
+	if len(peers) > numWant {
+		peers = peers[:numWant]
+	}
+	h.shuffler.shuffle(req, peers)
+	return peers, nil
+}
+
+// groupedPeers fetches peers for req from the storage like storedPeers, along
+// with the ends of their groups if the storage reports them.
+//
+// Long-lived peers are ranked individually, so they are never grouped.
+func (h *responseHook) groupedPeers(req *bittorrent.AnnounceRequest, seeding bool, numWant int) ([]bittorrent.Peer, []int, error) {
+	_, longLived := h.store.(storage.SeenCountStore)
+	if gs, ok := h.store.(storage.PeerGroupStore); ok && !(longLived && h.preferLongLivedPeers) {
+		return gs.AnnouncePeerGroups(req.InfoHash, seeding, numWant, req.Peer)
+	}
+
+	peers, err := h.storedPeers(req, seeding, numWant, 0)
+	return peers, nil, err
+}
@@ -0,0 +1,270 @@
+// Package announcehistory implements a Hook that keeps the recent Announces
+// of selected swarms in memory and exposes them via the "history" api
+// method, for debugging.
+package announcehistory
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Defaults of the configuration.
+const (
+	defaultSize          = 100
+	defaultMaxAge        = time.Hour
+	defaultMaxInfoHashes = 16
+)
+
+// Errors of the configuration.
+var (
+	ErrInvalidSize          = errors.New("size must not be negative")
+	ErrInvalidMaxInfoHashes = errors.New("max_infohashes must not be negative")
+	ErrTooManyInfoHashes    = errors.New("more infohashes than max_infohashes")
+)
+
+// Config represents the configuration for the announce history middleware.
+type Config struct {
+	// Size is the number of Announces kept per swarm.
+	// If zero, a default of 100 is used.
+	Size int `yaml:"size"`
+
+	// MaxAge is the duration after which Announces are no longer returned.
+	// If zero, a default of 1h is used.
+	MaxAge time.Duration `yaml:"max_age"`
+
+	// MaxInfoHashes is the maximum number of swarms whose Announces are kept
+	// at the same time, which bounds the memory used to Size times
+	// MaxInfoHashes Announces.
+	// If zero, a default of 16 is used.
+	MaxInfoHashes int `yaml:"max_infohashes"`
+
+	// InfoHashes is a list of hex-encoded infohashes whose Announces are
+	// kept from startup. Others can be added via the api.
+	InfoHashes []string `yaml:"infohashes"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"size":          cfg.Size,
+		"maxAge":        cfg.MaxAge,
+		"maxInfoHashes": cfg.MaxInfoHashes,
+		"infoHashes":    cfg.InfoHashes,
+	}
+}
+
+// entry is a recorded Announce.
+type entry struct {
+	time       time.Time
+	ip         bittorrent.IP
+	port       uint16
+	peerID     bittorrent.PeerID
+	event      bittorrent.Event
+	left       uint64
+	uploaded   uint64
+	downloaded uint64
+	numWant    uint32
+}
+
+// String renders e as it is returned by the api, e.g.
+// 2009-11-10T23:00:00Z 1.2.3.4:6881 "-TR2940-k8hj0wgej6ch" event=started left=10 uploaded=0 downloaded=0 numwant=50
+func (e entry) String() string {
+	return fmt.Sprintf("%s %s %q event=%s left=%d uploaded=%d downloaded=%d numwant=%d",
+		e.time.UTC().Format(time.RFC3339),
+		net.JoinHostPort(e.ip.String(), strconv.Itoa(int(e.port))),
+		e.peerID.String(),
+		e.event,
+		e.left,
+		e.uploaded,
+		e.downloaded,
+		e.numWant,
+	)
+}
+
+// ring holds the most recent Announces of a swarm.
+type ring struct {
+	sync.Mutex
+	entries []entry
+	next    int
+	full    bool
+}
+
+func (r *ring) add(e entry) {
+	r.Lock()
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	r.full = r.full || r.next == 0
+	r.Unlock()
+}
+
+// since returns the entries recorded after cutoff, oldest first.
+func (r *ring) since(cutoff time.Time) []entry {
+	r.Lock()
+	defer r.Unlock()
+
+	start, n := 0, r.next
+	if r.full {
+		start, n = r.next, len(r.entries)
+	}
+
+	entries := make([]entry, 0, n)
+	for i := 0; i < n; i++ {
+		e := r.entries[(start+i)%len(r.entries)]
+		if e.time.After(cutoff) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+type hook struct {
+	cfg Config
+
+	ringsM sync.RWMutex
+	rings  map[bittorrent.InfoHash]*ring
+}
+
+// NewHook returns an instance of the announce history middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	switch {
+	case cfg.Size < 0:
+		return nil, ErrInvalidSize
+	case cfg.Size == 0:
+		cfg.Size = defaultSize
+	}
+
+	switch {
+	case cfg.MaxInfoHashes < 0:
+		return nil, ErrInvalidMaxInfoHashes
+	case cfg.MaxInfoHashes == 0:
+		cfg.MaxInfoHashes = defaultMaxInfoHashes
+	}
+
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = defaultMaxAge
+	}
+
+	if len(cfg.InfoHashes) > cfg.MaxInfoHashes {
+		return nil, ErrTooManyInfoHashes
+	}
+
+	h := &hook{
+		cfg:   cfg,
+		rings: make(map[bittorrent.InfoHash]*ring, cfg.MaxInfoHashes),
+	}
+
+	for _, ihString := range cfg.InfoHashes {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			return nil, errors.New("infohash " + ihString + " must be 40 hex characters")
+		}
+		h.rings[bittorrent.InfoHashFromBytes(ihBytes)] = &ring{entries: make([]entry, cfg.Size)}
+	}
+
+	return h, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.ringsM.RLock()
+	r, ok := h.rings[req.InfoHash]
+	h.ringsM.RUnlock()
+	if !ok {
+		return ctx, nil
+	}
+
+	r.add(entry{
+		time:       time.Now(),
+		ip:         middleware.LoggableIP(ctx, req.Peer.IP),
+		port:       req.Peer.Port,
+		peerID:     req.Peer.ID,
+		event:      req.Event,
+		left:       req.Left,
+		uploaded:   req.Uploaded,
+		downloaded: req.Downloaded,
+		numWant:    req.NumWant,
+	})
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not recorded.
+	return ctx, nil
+}
+
+// HandleApi answers the "history" api method, which returns the recent
+// Announces of every requested swarm.
+//
+// With record=1, swarms are added to the recorded swarms, as long as there
+// are fewer than MaxInfoHashes. With record=0, they are removed along with
+// their Announces.
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	if req.Method != "history" {
+		return ctx, nil
+	}
+
+	var record string
+	if req.Params != nil {
+		record, _ = req.Params.String("record")
+	}
+
+	for _, infoHash := range req.InfoHashes {
+		switch record {
+		case "1":
+			resp.Files = append(resp.Files, h.record(infoHash))
+		case "0":
+			h.ringsM.Lock()
+			delete(h.rings, infoHash)
+			h.ringsM.Unlock()
+			resp.Files = append(resp.Files, bittorrent.Api{InfoHash: infoHash, Response: "not recording"})
+		default:
+			resp.Files = append(resp.Files, h.history(infoHash))
+		}
+	}
+
+	return ctx, nil
+}
+
+// record starts recording the Announces of the swarm identified by infoHash.
+func (h *hook) record(infoHash bittorrent.InfoHash) bittorrent.Api {
+	h.ringsM.Lock()
+	defer h.ringsM.Unlock()
+
+	if _, ok := h.rings[infoHash]; !ok {
+		if len(h.rings) >= h.cfg.MaxInfoHashes {
+			return bittorrent.Api{InfoHash: infoHash, Error: 1, Response: "too many recorded infohashes"}
+		}
+		h.rings[infoHash] = &ring{entries: make([]entry, h.cfg.Size)}
+	}
+
+	return bittorrent.Api{InfoHash: infoHash, Response: "recording"}
+}
+
+// history describes the recent Announces of the swarm identified by infoHash.
+func (h *hook) history(infoHash bittorrent.InfoHash) bittorrent.Api {
+	h.ringsM.RLock()
+	r, ok := h.rings[infoHash]
+	h.ringsM.RUnlock()
+	if !ok {
+		return bittorrent.Api{InfoHash: infoHash, Error: 1, Response: "not recording"}
+	}
+
+	entries := r.since(time.Now().Add(-h.cfg.MaxAge))
+	announces := make([]string, 0, len(entries))
+	for _, e := range entries {
+		announces = append(announces, e.String())
+	}
+
+	return bittorrent.Api{InfoHash: infoHash, Response: strings.Join(announces, "; ")}
+}
@@ -0,0 +1,85 @@
+package announcehistory
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 = bittorrent.InfoHashFromString("00000000000000000002")
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{}, nil},
+		{Config{InfoHashes: []string{"3030303030303030303030303030303030303031"}}, nil},
+		{Config{Size: -1}, ErrInvalidSize},
+		{Config{MaxInfoHashes: -1}, ErrInvalidMaxInfoHashes},
+		{Config{MaxInfoHashes: 1, InfoHashes: []string{"3030303030303030303030303030303030303031", "3030303030303030303030303030303030303032"}}, ErrTooManyInfoHashes},
+	}
+
+	for _, tt := range table {
+		_, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+	}
+}
+
+func api(h *hook, infoHash bittorrent.InfoHash, query string) bittorrent.Api {
+	params, _ := bittorrent.ParseURLData("/api?" + query)
+	resp := &bittorrent.ApiResponse{}
+	h.HandleApi(context.Background(), &bittorrent.ApiRequest{InfoHashes: []bittorrent.InfoHash{infoHash}, Method: "history", Params: params}, resp)
+	return resp.Files[0]
+}
+
+func TestHistory(t *testing.T) {
+	h, err := NewHook(Config{Size: 2, MaxInfoHashes: 1})
+	require.Nil(t, err)
+
+	announce := func(infoHash bittorrent.InfoHash, event bittorrent.Event, left uint64) {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: infoHash,
+			Event:    event,
+			Left:     left,
+			Peer: bittorrent.Peer{
+				ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+				Port: 6881,
+				IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+			},
+		}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+
+	require.Equal(t, 1, api(h.(*hook), ih1, "").Error)
+	require.Equal(t, "recording", api(h.(*hook), ih1, "record=1").Response)
+	require.Equal(t, 1, api(h.(*hook), ih2, "record=1").Error)
+
+	announce(ih1, bittorrent.Started, 30)
+	announce(ih1, bittorrent.None, 20)
+	announce(ih1, bittorrent.Completed, 0)
+	announce(ih2, bittorrent.Started, 10)
+
+	// Only the most recent announces are kept, oldest first.
+	entries := strings.Split(api(h.(*hook), ih1, "").Response, "; ")
+	require.Equal(t, 2, len(entries))
+	require.True(t, strings.Contains(entries[0], ` 1.2.3.4:6881 "-TR2940-000000000001" event=none left=20 `))
+	require.True(t, strings.Contains(entries[1], " event=completed left=0 "))
+
+	// Old announces are not returned.
+	h.(*hook).cfg.MaxAge = -time.Nanosecond
+	require.Equal(t, "", api(h.(*hook), ih1, "").Response)
+
+	require.Equal(t, "not recording", api(h.(*hook), ih1, "record=0").Response)
+	require.Equal(t, "recording", api(h.(*hook), ih2, "record=1").Response)
+}
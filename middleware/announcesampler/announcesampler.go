@@ -0,0 +1,178 @@
+// Package announcesampler implements a Hook that writes a sample of the
+// Announces matching a filter to the debug log.
+package announcesampler
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"net"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrInvalidSampleRate is returned for a config with an invalid SampleRate.
+var ErrInvalidSampleRate = errors.New("invalid sample_rate")
+
+// Config represents the configuration for the announcesampler middleware.
+type Config struct {
+	// PeerIDPrefixes is a list of peer ID prefixes to match, e.g. "-qB".
+	PeerIDPrefixes []string `yaml:"peer_id_prefixes"`
+
+	// InfoHashes is a list of hex-encoded infohashes to match.
+	InfoHashes []string `yaml:"infohashes"`
+
+	// SampleRate is the fraction of matched Announces that are logged.
+	// A SampleRate of 0 disables the middleware.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	// Anonymize specifies whether the IP of the peer is truncated to its
+	// network and the request parameters are omitted before logging.
+	Anonymize bool `yaml:"anonymize"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"peerIDPrefixes": cfg.PeerIDPrefixes,
+		"infoHashes":     cfg.InfoHashes,
+		"sampleRate":     cfg.SampleRate,
+		"anonymize":      cfg.Anonymize,
+	}
+}
+
+type hook struct {
+	prefixes   [][]byte
+	infoHashes map[bittorrent.InfoHash]struct{}
+	threshold  int
+	anonymize  bool
+}
+
+// NewHook returns an instance of the announcesampler middleware.
+//
+// If neither PeerIDPrefixes nor InfoHashes are configured, all Announces
+// match.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, ErrInvalidSampleRate
+	}
+
+	h := &hook{
+		infoHashes: make(map[bittorrent.InfoHash]struct{}, len(cfg.InfoHashes)),
+		threshold:  int(cfg.SampleRate * (1 << 24)),
+		anonymize:  cfg.Anonymize,
+	}
+
+	for _, prefix := range cfg.PeerIDPrefixes {
+		if len(prefix) == 0 || len(prefix) > 20 {
+			return nil, errors.New("peer ID prefix " + prefix + " must be between 1 and 20 bytes")
+		}
+		h.prefixes = append(h.prefixes, []byte(prefix))
+	}
+
+	for _, ihString := range cfg.InfoHashes {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			return nil, errors.New("infohash " + ihString + " must be 40 hex characters")
+		}
+		h.infoHashes[bittorrent.InfoHashFromBytes(ihBytes)] = struct{}{}
+	}
+
+	return h, nil
+}
+
+// matches reports whether req matches any of the configured filters.
+func (h *hook) matches(req *bittorrent.AnnounceRequest) bool {
+	if len(h.prefixes) == 0 && len(h.infoHashes) == 0 {
+		return true
+	}
+
+	if _, ok := h.infoHashes[req.InfoHash]; ok {
+		return true
+	}
+
+	for _, prefix := range h.prefixes {
+		if string(req.Peer.ID[:len(prefix)]) == string(prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sampled reports whether req is part of the sample.
+//
+// The decision is derived from the request, so repeated Announces of the same
+// peer in the same swarm are either all logged or not at all.
+func (h *hook) sampled(req *bittorrent.AnnounceRequest) bool {
+	if h.threshold >= 1<<24 {
+		return true
+	}
+
+	f := fnv.New64a()
+	f.Write(req.InfoHash[:])
+	f.Write(req.Peer.ID[:])
+	return int(f.Sum64()%(1<<24)) < h.threshold
+}
+
+// anonymizeIP truncates ip to its /24 or /48 network.
+func anonymizeIP(ip bittorrent.IP) bittorrent.IP {
+	if ip.AddressFamily == bittorrent.IPv4 {
+		return bittorrent.IP{IP: ip.Mask(net.CIDRMask(24, 32)), AddressFamily: ip.AddressFamily}
+	}
+	return bittorrent.IP{IP: ip.Mask(net.CIDRMask(48, 128)), AddressFamily: ip.AddressFamily}
+}
+
+func (h *hook) requestFields(ctx context.Context, req *bittorrent.AnnounceRequest) log.Fields {
+	fields := log.Fields{
+		"event":      req.Event.String(),
+		"infoHash":   hex.EncodeToString(req.InfoHash[:]),
+		"compact":    req.Compact,
+		"numWant":    req.NumWant,
+		"left":       req.Left,
+		"downloaded": req.Downloaded,
+		"uploaded":   req.Uploaded,
+		"peerID":     hex.EncodeToString(req.Peer.ID[:]),
+		"port":       req.Peer.Port,
+	}
+
+	if h.anonymize {
+		fields["ip"] = anonymizeIP(req.Peer.IP).String()
+		return fields
+	}
+
+	fields["ip"] = middleware.LoggableIP(ctx, req.Peer.IP).String()
+	if req.Params != nil {
+		fields["path"] = req.Params.RawPath()
+		fields["query"] = req.Params.RawQuery()
+	}
+
+	return fields
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.threshold == 0 || !log.DebugEnabled() {
+		return ctx, nil
+	}
+
+	if !h.matches(req) || !h.sampled(req) {
+		return ctx, nil
+	}
+
+	log.Debug("sampled announce", log.RequestFields(ctx, h.requestFields(ctx, req)))
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not sampled.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis are not sampled.
+	return ctx, nil
+}
@@ -0,0 +1,140 @@
+package announcesampler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("01234567890123456789")
+	ih2 = bittorrent.InfoHashFromString("abcdefghijklmnopqrst")
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{SampleRate: 0.5}, nil},
+		{Config{SampleRate: 0}, nil},
+		{Config{SampleRate: 1}, nil},
+		{Config{SampleRate: -0.1}, ErrInvalidSampleRate},
+		{Config{SampleRate: 1.1}, ErrInvalidSampleRate},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%+v", tt), func(t *testing.T) {
+			_, err := NewHook(tt.cfg)
+			require.Equal(t, tt.expected, err)
+		})
+	}
+
+	_, err := NewHook(Config{SampleRate: 1, InfoHashes: []string{"abc"}})
+	require.NotNil(t, err)
+
+	_, err = NewHook(Config{SampleRate: 1, PeerIDPrefixes: []string{""}})
+	require.NotNil(t, err)
+}
+
+func TestMatches(t *testing.T) {
+	h, err := NewHook(Config{
+		SampleRate:     1,
+		PeerIDPrefixes: []string{"-qB"},
+		InfoHashes:     []string{fmt.Sprintf("%x", ih1[:])},
+	})
+	require.Nil(t, err)
+
+	var table = []struct {
+		infoHash bittorrent.InfoHash
+		peerID   string
+		expected bool
+	}{
+		{ih1, "-TR2940-000000000000", true},
+		{ih2, "-qB4250-000000000000", true},
+		{ih2, "-TR2940-000000000000", false},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: tt.infoHash,
+			Peer:     bittorrent.Peer{ID: bittorrent.PeerIDFromString(tt.peerID)},
+		}
+		require.Equal(t, tt.expected, h.(*hook).matches(req))
+	}
+
+	h, err = NewHook(Config{SampleRate: 1})
+	require.Nil(t, err)
+	require.True(t, h.(*hook).matches(&bittorrent.AnnounceRequest{InfoHash: ih2}))
+}
+
+func TestSampled(t *testing.T) {
+	h, err := NewHook(Config{SampleRate: 0.5})
+	require.Nil(t, err)
+
+	var sampled int
+	for i := 0; i < 1000; i++ {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: ih1,
+			Peer:     bittorrent.Peer{ID: bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-%012d", i*7919))},
+		}
+		if h.(*hook).sampled(req) {
+			sampled++
+		}
+		// The decision must be stable for the same request.
+		require.Equal(t, h.(*hook).sampled(req), h.(*hook).sampled(req))
+	}
+	require.True(t, sampled > 0 && sampled < 1000)
+}
+
+func TestAnonymize(t *testing.T) {
+	h, err := NewHook(Config{SampleRate: 1, Anonymize: true})
+	require.Nil(t, err)
+
+	params, err := bittorrent.ParseURLData("/announce?passkey=secret")
+	require.Nil(t, err)
+
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih1,
+		Peer: bittorrent.Peer{
+			IP: bittorrent.IP{IP: net.ParseIP("10.11.12.13").To4(), AddressFamily: bittorrent.IPv4},
+		},
+		Params: params,
+	}
+
+	fields := h.(*hook).requestFields(context.Background(), req)
+	require.Equal(t, "10.11.12.0", fields["ip"])
+	_, ok := fields["query"]
+	require.False(t, ok)
+
+	req.Peer.IP = bittorrent.IP{IP: net.ParseIP("2001:db8:1:2::1"), AddressFamily: bittorrent.IPv6}
+	fields = h.(*hook).requestFields(context.Background(), req)
+	require.Equal(t, "2001:db8:1::", fields["ip"])
+}
+
+func TestMaskedIP(t *testing.T) {
+	h, err := NewHook(Config{SampleRate: 1})
+	require.Nil(t, err)
+
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih1,
+		Peer: bittorrent.Peer{
+			IP: bittorrent.IP{IP: net.ParseIP("10.11.12.13").To4(), AddressFamily: bittorrent.IPv4},
+		},
+	}
+
+	fields := h.(*hook).requestFields(context.Background(), req)
+	require.Equal(t, "10.11.12.13", fields["ip"])
+
+	// A privacy-masked IP set by other middleware is logged instead.
+	masked := bittorrent.IP{IP: net.ParseIP("10.11.0.0").To4(), AddressFamily: bittorrent.IPv4}
+	ctx := context.WithValue(context.Background(), middleware.MaskedIPKey, masked)
+	fields = h.(*hook).requestFields(ctx, req)
+	require.Equal(t, "10.11.0.0", fields["ip"])
+}
@@ -0,0 +1,141 @@
+// Package announcescheme implements a Hook that warns or rejects clients
+// announcing via plaintext HTTP, e.g. while a tracker migrates to HTTPS.
+package announcescheme
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Actions for Announces sent via plaintext HTTP.
+const (
+	ActionAllow  = "allow"
+	ActionWarn   = "warn"
+	ActionReject = "reject"
+)
+
+// defaultWarningMessage is the message sent to warned or softly rejected
+// clients if none is configured.
+const defaultWarningMessage = "please switch to the https announce URL of this tracker"
+
+// ErrPlaintextAnnounce is returned for Announces sent via plaintext HTTP that
+// are rejected.
+var ErrPlaintextAnnounce = bittorrent.NewClientError("plaintext_announce", "announces via http are no longer accepted, use https")
+
+// Errors of the configuration.
+var (
+	ErrInvalidAction      = errors.New("plaintext must be allow, warn or reject")
+	ErrInvalidRejectAfter = errors.New("reject_after must be an RFC 3339 timestamp")
+)
+
+// Config represents the configuration for the announce scheme middleware.
+type Config struct {
+	// Plaintext specifies how Announces sent via plaintext HTTP are
+	// handled. They are either allowed, answered with a warning message,
+	// or rejected.
+	// If empty, they are allowed.
+	Plaintext string `yaml:"plaintext"`
+
+	// RejectAfter is an optional RFC 3339 timestamp after which Announces
+	// sent via plaintext HTTP are rejected, whatever the Plaintext action.
+	// This ends a migration window in which clients are warned.
+	RejectAfter string `yaml:"reject_after"`
+
+	// WarningMessage is the message sent to warned clients.
+	// If empty, a default asking to switch to https is used.
+	WarningMessage string `yaml:"warning_message"`
+
+	// SoftReject configures how Announces are rejected. The WarningMessage
+	// is used for softly rejected clients, unless it is configured here.
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"plaintext":      cfg.Plaintext,
+		"rejectAfter":    cfg.RejectAfter,
+		"warningMessage": cfg.WarningMessage,
+		"softReject":     cfg.SoftReject.Enabled,
+	}
+}
+
+type hook struct {
+	cfg         Config
+	rejectAfter time.Time
+	now         func() time.Time
+}
+
+// NewHook returns an instance of the announce scheme middleware.
+//
+// Only Announces received by the HTTP frontend are affected. Announces
+// received via UDP are not encrypted either, but can't be told to switch to
+// https.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	switch cfg.Plaintext {
+	case "":
+		cfg.Plaintext = ActionAllow
+	case ActionAllow, ActionWarn, ActionReject:
+	default:
+		return nil, ErrInvalidAction
+	}
+
+	h := &hook{now: time.Now}
+	if cfg.RejectAfter != "" {
+		t, err := time.Parse(time.RFC3339, cfg.RejectAfter)
+		if err != nil {
+			return nil, ErrInvalidRejectAfter
+		}
+		h.rejectAfter = t
+	}
+
+	if cfg.WarningMessage == "" {
+		cfg.WarningMessage = defaultWarningMessage
+	}
+	if cfg.SoftReject.WarningMessage == "" {
+		cfg.SoftReject.WarningMessage = cfg.WarningMessage
+	}
+	h.cfg = cfg
+
+	return h, nil
+}
+
+// action returns the action for Announces sent via plaintext HTTP at now.
+func (h *hook) action(now time.Time) string {
+	if !h.rejectAfter.IsZero() && !now.Before(h.rejectAfter) {
+		return ActionReject
+	}
+	return h.cfg.Plaintext
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if scheme, _ := bittorrent.Scheme(ctx); scheme != bittorrent.SchemeHTTP {
+		return ctx, nil
+	}
+
+	switch h.action(h.now()) {
+	case ActionWarn:
+		if resp.WarningMessage == "" {
+			resp.WarningMessage = h.cfg.WarningMessage
+		}
+	case ActionReject:
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrPlaintextAnnounce)
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrape responses can't carry a warning, so scrapes are not affected.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are not sent by clients.
+	return ctx, nil
+}
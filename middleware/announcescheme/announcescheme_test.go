@@ -0,0 +1,77 @@
+package announcescheme
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{}, nil},
+		{Config{Plaintext: ActionWarn, RejectAfter: "2030-01-01T00:00:00Z"}, nil},
+		{Config{Plaintext: "deny"}, ErrInvalidAction},
+		{Config{RejectAfter: "2030-01-01"}, ErrInvalidRejectAfter},
+	}
+
+	for _, tt := range table {
+		_, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	withScheme := func(scheme string) context.Context {
+		return context.WithValue(context.Background(), bittorrent.SchemeKey, scheme)
+	}
+
+	var table = []struct {
+		cfg     Config
+		ctx     context.Context
+		warning string
+		err     error
+	}{
+		// Both schemes are allowed by default.
+		{Config{}, withScheme(bittorrent.SchemeHTTP), "", nil},
+		{Config{Plaintext: ActionWarn}, withScheme(bittorrent.SchemeHTTP), defaultWarningMessage, nil},
+		{Config{Plaintext: ActionWarn, WarningMessage: "use https"}, withScheme(bittorrent.SchemeHTTP), "use https", nil},
+		{Config{Plaintext: ActionReject}, withScheme(bittorrent.SchemeHTTP), "", ErrPlaintextAnnounce},
+		{Config{Plaintext: ActionReject, SoftReject: middleware.SoftRejectConfig{Enabled: true}}, withScheme(bittorrent.SchemeHTTP), defaultWarningMessage, nil},
+
+		// The migration window ended.
+		{Config{Plaintext: ActionWarn, RejectAfter: "2000-01-01T00:00:00Z"}, withScheme(bittorrent.SchemeHTTP), "", ErrPlaintextAnnounce},
+		{Config{Plaintext: ActionWarn, RejectAfter: "2100-01-01T00:00:00Z"}, withScheme(bittorrent.SchemeHTTP), defaultWarningMessage, nil},
+
+		// Other schemes are never affected.
+		{Config{Plaintext: ActionReject}, withScheme(bittorrent.SchemeHTTPS), "", nil},
+		{Config{Plaintext: ActionReject}, withScheme(bittorrent.SchemeUDP), "", nil},
+		{Config{Plaintext: ActionReject}, context.Background(), "", nil},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Nil(t, err)
+
+		resp := &bittorrent.AnnounceResponse{}
+		_, err = h.HandleAnnounce(tt.ctx, &bittorrent.AnnounceRequest{}, resp)
+		require.Equal(t, tt.err, err)
+		require.Equal(t, tt.warning, resp.WarningMessage)
+	}
+}
+
+func TestRejectAfter(t *testing.T) {
+	h, err := NewHook(Config{Plaintext: ActionWarn, RejectAfter: "2030-01-01T00:00:00Z"})
+	require.Nil(t, err)
+
+	deadline := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, ActionWarn, h.(*hook).action(deadline.Add(-time.Second)))
+	require.Equal(t, ActionReject, h.(*hook).action(deadline))
+}
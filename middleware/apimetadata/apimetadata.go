@@ -0,0 +1,68 @@
+// Package apimetadata implements a Hook that annotates the responses of the
+// "stats" API method with torrent names from an external metadata provider.
+//
+// Responses to BitTorrent clients are not altered.
+package apimetadata
+
+import (
+	"context"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/metadata"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Config represents the configuration for the apimetadata middleware.
+type Config struct {
+	Metadata metadata.Config `yaml:"metadata"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return cfg.Metadata.LogFields()
+}
+
+type hook struct {
+	provider metadata.Provider
+}
+
+// NewHook returns an instance of the apimetadata middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	provider, err := metadata.New(cfg.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hook{provider: provider}, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Announces are not annotated.
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not annotated.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	if req.Method != "stats" {
+		return ctx, nil
+	}
+
+	names := make(map[bittorrent.InfoHash]string, len(req.InfoHashes))
+	for _, infoHash := range req.InfoHashes {
+		name, err := h.provider.Name(infoHash)
+		if err == metadata.ErrUnknownInfoHash || err == metadata.ErrSourceUnavailable {
+			continue
+		} else if err != nil {
+			log.Warn("failed to look up torrent metadata", log.Err(err))
+			continue
+		}
+		names[infoHash] = name
+	}
+
+	return context.WithValue(ctx, middleware.TorrentNamesKey, names), nil
+}
@@ -0,0 +1,122 @@
+// Package backpressure implements a Hook that increases the announce interval
+// while the tracker is under load.
+package backpressure
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/load"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrInvalidThreshold is returned for a config with an invalid Threshold.
+var ErrInvalidThreshold = errors.New("invalid threshold")
+
+// ErrInvalidMaxInterval is returned for a config with an invalid
+// MaxInterval.
+var ErrInvalidMaxInterval = errors.New("invalid max_interval")
+
+// Config represents the configuration for the backpressure middleware.
+type Config struct {
+	// Threshold is the load level, between 0 and 1, above which the
+	// interval is increased.
+	Threshold float64 `yaml:"threshold"`
+
+	// MinInterval is the interval sent to clients when the load just
+	// exceeds Threshold.
+	// If it is lower than the interval of a response, the interval of the
+	// response is used instead.
+	MinInterval time.Duration `yaml:"min_interval"`
+
+	// MaxInterval is the interval sent to clients at full load.
+	MaxInterval time.Duration `yaml:"max_interval"`
+
+	// ModifyMinInterval specifies whether min_interval should be increased
+	// proportionally as well.
+	ModifyMinInterval bool `yaml:"modify_min_interval"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"threshold":         cfg.Threshold,
+		"minInterval":       cfg.MinInterval,
+		"maxInterval":       cfg.MaxInterval,
+		"modifyMinInterval": cfg.ModifyMinInterval,
+	}
+}
+
+func checkConfig(cfg Config) error {
+	if cfg.Threshold < 0 || cfg.Threshold >= 1 {
+		return ErrInvalidThreshold
+	}
+
+	if cfg.MaxInterval <= 0 || cfg.MaxInterval < cfg.MinInterval {
+		return ErrInvalidMaxInterval
+	}
+
+	return nil
+}
+
+type hook struct {
+	cfg   Config
+	level func() float64
+}
+
+// NewHook returns an instance of the backpressure middleware.
+//
+// The load is read from the Limiters registered with the load package.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if err := checkConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return &hook{cfg: cfg, level: load.Level}, nil
+}
+
+// interval scales base to the current load.
+func (h *hook) interval(base time.Duration, level float64) time.Duration {
+	if base >= h.cfg.MaxInterval {
+		return base
+	}
+
+	if base < h.cfg.MinInterval {
+		base = h.cfg.MinInterval
+	}
+
+	factor := (level - h.cfg.Threshold) / (1 - h.cfg.Threshold)
+	return base + time.Duration(factor*float64(h.cfg.MaxInterval-base))
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	level := h.level()
+	if level <= h.cfg.Threshold {
+		return ctx, nil
+	}
+
+	interval := h.interval(resp.Interval, level)
+
+	if h.cfg.ModifyMinInterval && resp.Interval > 0 {
+		resp.MinInterval = time.Duration(float64(resp.MinInterval) * float64(interval) / float64(resp.Interval))
+		if resp.MinInterval > interval {
+			resp.MinInterval = interval
+		}
+	}
+	resp.Interval = interval
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't have an interval.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis don't have an interval.
+	return ctx, nil
+}
@@ -0,0 +1,70 @@
+package backpressure
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var configTests = []struct {
+	cfg      Config
+	expected error
+}{
+	{Config{Threshold: 0.5, MinInterval: time.Minute, MaxInterval: time.Hour}, nil},
+	{Config{Threshold: 0, MaxInterval: time.Hour}, nil},
+	{Config{Threshold: -0.1, MaxInterval: time.Hour}, ErrInvalidThreshold},
+	{Config{Threshold: 1, MaxInterval: time.Hour}, ErrInvalidThreshold},
+	{Config{Threshold: 0.5}, ErrInvalidMaxInterval},
+	{Config{Threshold: 0.5, MinInterval: time.Hour, MaxInterval: time.Minute}, ErrInvalidMaxInterval},
+}
+
+func TestCheckConfig(t *testing.T) {
+	for _, tt := range configTests {
+		t.Run(fmt.Sprintf("%#v", tt.cfg), func(t *testing.T) {
+			require.Equal(t, tt.expected, checkConfig(tt.cfg))
+		})
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	var table = []struct {
+		level               float64
+		interval            time.Duration
+		expectedInterval    time.Duration
+		expectedMinInterval time.Duration
+	}{
+		{0, 30 * time.Minute, 30 * time.Minute, 15 * time.Minute},
+		{0.5, 30 * time.Minute, 30 * time.Minute, 15 * time.Minute},
+		{0.75, 30 * time.Minute, 60 * time.Minute, 30 * time.Minute},
+		{1, 30 * time.Minute, 90 * time.Minute, 45 * time.Minute},
+		// Intervals below MinInterval are lifted to MinInterval.
+		{0.75, 10 * time.Minute, 60 * time.Minute, 60 * time.Minute},
+		// Intervals above MaxInterval are never lowered.
+		{1, 120 * time.Minute, 120 * time.Minute, 15 * time.Minute},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%#v", tt), func(t *testing.T) {
+			h, err := NewHook(Config{
+				Threshold:         0.5,
+				MinInterval:       30 * time.Minute,
+				MaxInterval:       90 * time.Minute,
+				ModifyMinInterval: true,
+			})
+			require.Nil(t, err)
+			h.(*hook).level = func() float64 { return tt.level }
+
+			req := &bittorrent.AnnounceRequest{}
+			resp := &bittorrent.AnnounceResponse{Interval: tt.interval, MinInterval: 15 * time.Minute}
+			_, err = h.HandleAnnounce(context.Background(), req, resp)
+			require.Nil(t, err)
+			require.Equal(t, tt.expectedInterval, resp.Interval)
+			require.Equal(t, tt.expectedMinInterval, resp.MinInterval)
+		})
+	}
+}
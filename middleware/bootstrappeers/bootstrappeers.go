@@ -0,0 +1,145 @@
+// Package bootstrappeers implements a Hook that returns configured peers, e.g.
+// seed boxes, to leechers of swarms with too few seeders.
+package bootstrappeers
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// ErrNoPeers is returned for a config without peers.
+var ErrNoPeers = errors.New("no peers configured")
+
+// Config represents the configuration for the bootstrap peers middleware.
+type Config struct {
+	// Peers are the endpoints of the injected peers in host:port format,
+	// where host must be an IP.
+	Peers []string `yaml:"peers"`
+
+	// MinSeeders is the number of seeders of torrents not contained in
+	// Torrents below which the peers are injected. Zero disables injection.
+	MinSeeders uint32 `yaml:"min_seeders"`
+
+	// Torrents maps hex-encoded infohashes to the number of seeders below
+	// which the peers are injected for them.
+	Torrents map[string]uint32 `yaml:"torrents"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"peers":      cfg.Peers,
+		"minSeeders": cfg.MinSeeders,
+		"torrents":   len(cfg.Torrents),
+	}
+}
+
+type hook struct {
+	store      storage.PeerStore
+	peers      []bittorrent.Peer
+	minSeeders uint32
+	torrents   map[bittorrent.InfoHash]uint32
+}
+
+// NewHook returns an instance of the bootstrap peers middleware that reads the
+// number of seeders from the given PeerStore.
+func NewHook(cfg Config, store storage.PeerStore) (middleware.Hook, error) {
+	if len(cfg.Peers) == 0 {
+		return nil, ErrNoPeers
+	}
+
+	h := &hook{
+		store:      store,
+		minSeeders: cfg.MinSeeders,
+		torrents:   make(map[bittorrent.InfoHash]uint32, len(cfg.Torrents)),
+	}
+
+	for _, endpoint := range cfg.Peers {
+		p, err := parsePeer(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		h.peers = append(h.peers, p)
+	}
+
+	for ihString, minSeeders := range cfg.Torrents {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			return nil, errors.New("infohash " + ihString + " must be 40 hex characters")
+		}
+		h.torrents[bittorrent.InfoHashFromBytes(ihBytes)] = minSeeders
+	}
+
+	return h, nil
+}
+
+// parsePeer parses a Peer from an endpoint in host:port format.
+func parsePeer(endpoint string) (bittorrent.Peer, error) {
+	invalid := errors.New("peer " + endpoint + " must be an IP and a port")
+
+	host, portString, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return bittorrent.Peer{}, invalid
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || port == 0 {
+		return bittorrent.Peer{}, invalid
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return bittorrent.Peer{}, invalid
+	}
+
+	p := bittorrent.Peer{Port: uint16(port)}
+	if ip4 := ip.To4(); ip4 != nil {
+		p.IP = bittorrent.IP{IP: ip4, AddressFamily: bittorrent.IPv4}
+	} else {
+		p.IP = bittorrent.IP{IP: ip, AddressFamily: bittorrent.IPv6}
+	}
+
+	return p, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Seeders don't download from the injected peers.
+	if req.Left == 0 {
+		return ctx, nil
+	}
+
+	minSeeders, ok := h.torrents[req.InfoHash]
+	if !ok {
+		minSeeders = h.minSeeders
+	}
+	if minSeeders == 0 {
+		return ctx, nil
+	}
+
+	// Only seeders of the address family of the leecher can serve it.
+	if h.store.ScrapeSwarm(req.InfoHash, req.IP.AddressFamily).Complete >= minSeeders {
+		return ctx, nil
+	}
+
+	injected, _ := ctx.Value(middleware.InjectedPeersKey).([]bittorrent.Peer)
+	injected = append(injected[:len(injected):len(injected)], h.peers...)
+	return context.WithValue(ctx, middleware.InjectedPeersKey, injected), nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't return peers.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis don't return peers.
+	return ctx, nil
+}
@@ -0,0 +1,102 @@
+package bootstrappeers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("01234567890123456789")
+	ih2 = bittorrent.InfoHashFromString("abcdefghijklmnopqrst")
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		peers []string
+		valid bool
+	}{
+		{[]string{"1.2.3.4:6881"}, true},
+		{[]string{"1.2.3.4:6881", "[fc00::1]:6881"}, true},
+		{nil, false},
+		{[]string{"1.2.3.4"}, false},
+		{[]string{"seedbox.example.com:6881"}, false},
+		{[]string{"1.2.3.4:0"}, false},
+		{[]string{"1.2.3.4:65536"}, false},
+	}
+
+	for _, tt := range table {
+		_, err := NewHook(Config{Peers: tt.peers}, nil)
+		require.Equal(t, tt.valid, err == nil, tt.peers)
+	}
+
+	_, err := NewHook(Config{Peers: []string{"1.2.3.4:6881"}, Torrents: map[string]uint32{"nonsense": 1}}, nil)
+	require.NotNil(t, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	for _, ip := range []string{"10.0.0.1", "fc00::1"} {
+		seeder := bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.ParseIP(ip), AddressFamily: bittorrent.IPv4},
+		}
+		if seeder.IP.To4() != nil {
+			seeder.IP.IP = seeder.IP.To4()
+		} else {
+			seeder.IP.AddressFamily = bittorrent.IPv6
+		}
+		require.Nil(t, ps.PutSeeder(ih1, seeder))
+	}
+
+	h, err := NewHook(Config{
+		Peers:      []string{"1.2.3.4:6881", "[fc00::2]:6881"},
+		MinSeeders: 2,
+		Torrents:   map[string]uint32{fmt.Sprintf("%x", ih2[:]): 0},
+	}, ps)
+	require.Nil(t, err)
+
+	var table = []struct {
+		infoHash bittorrent.InfoHash
+		left     uint64
+		injected bool
+	}{
+		// Seeders of the other address family don't count.
+		{ih1, 10, true},
+		// Seeders don't receive injected peers.
+		{ih1, 0, false},
+		// Injection is disabled for ih2.
+		{ih2, 10, false},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: tt.infoHash,
+			Left:     tt.left,
+			Peer:     bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("10.0.0.2").To4(), AddressFamily: bittorrent.IPv4}},
+		}
+		ctx, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+
+		injected, _ := ctx.Value(middleware.InjectedPeersKey).([]bittorrent.Peer)
+		if tt.injected {
+			require.Len(t, injected, 2)
+			require.Equal(t, uint16(6881), injected[0].Port)
+			require.Equal(t, bittorrent.IPv4, injected[0].IP.AddressFamily)
+			require.Equal(t, bittorrent.IPv6, injected[1].IP.AddressFamily)
+		} else {
+			require.Nil(t, injected)
+		}
+	}
+}
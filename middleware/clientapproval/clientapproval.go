@@ -11,18 +11,20 @@ import (
 )
 
 // ErrClientUnapproved is the error returned when a client's PeerID is invalid.
-var ErrClientUnapproved = bittorrent.ClientError("unapproved client")
+var ErrClientUnapproved = bittorrent.NewClientError("unapproved_client", "unapproved client")
 
 // Config represents all the values required by this middleware to validate
 // peers based on their BitTorrent client ID.
 type Config struct {
-	Whitelist []string `yaml:"whitelist"`
-	Blacklist []string `yaml:"blacklist"`
+	Whitelist  []string                    `yaml:"whitelist"`
+	Blacklist  []string                    `yaml:"blacklist"`
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
 }
 
 type hook struct {
 	approved   map[bittorrent.ClientID]struct{}
 	unapproved map[bittorrent.ClientID]struct{}
+	softReject middleware.SoftRejectConfig
 }
 
 // NewHook returns an instance of the client approval middleware.
@@ -30,6 +32,7 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 	h := &hook{
 		approved:   make(map[bittorrent.ClientID]struct{}),
 		unapproved: make(map[bittorrent.ClientID]struct{}),
+		softReject: cfg.SoftReject,
 	}
 
 	for _, cidString := range cfg.Whitelist {
@@ -60,13 +63,13 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 
 	if len(h.approved) > 0 {
 		if _, found := h.approved[clientID]; !found {
-			return ctx, ErrClientUnapproved
+			return h.softReject.Reject(ctx, resp, ErrClientUnapproved)
 		}
 	}
 
 	if len(h.unapproved) > 0 {
 		if _, found := h.unapproved[clientID]; found {
-			return ctx, ErrClientUnapproved
+			return h.softReject.Reject(ctx, resp, ErrClientUnapproved)
 		}
 	}
 
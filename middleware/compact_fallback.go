@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Modes of answering clients that request compact responses but can't parse
+// compact IPv6 peers.
+const (
+	// CompactFallbackNonCompact answers them with a non-compact response.
+	CompactFallbackNonCompact = "non_compact"
+
+	// CompactFallbackOmitIPv6 answers them without IPv6 peers.
+	CompactFallbackOmitIPv6 = "omit_ipv6"
+
+	// CompactFallbackReject rejects their announces with
+	// ErrCompactIPv6Unsupported.
+	CompactFallbackReject = "reject"
+)
+
+// ErrCompactIPv6Unsupported is returned for an announce of a client that would
+// receive compact IPv6 peers it can't parse, if configured.
+var ErrCompactIPv6Unsupported = bittorrent.NewClientError("compact_ipv6_unsupported", "client does not support compact IPv6 peers")
+
+// CompactFallbackConfig holds the configuration of the responses to clients
+// that request compact responses but can't parse compact IPv6 peers, which
+// some very old clients do.
+//
+// It only affects responses with IPv6 peers, which usually only go to IPv6
+// announcers. Responses with IPv4 peers only stay compact.
+type CompactFallbackConfig struct {
+	// Clients are the client IDs of the affected clients, e.g. UT1800 for
+	// peer IDs starting with -UT1800-.
+	// If empty, the fallback is disabled.
+	Clients []string `yaml:"clients"`
+
+	// Mode is one of CompactFallbackNonCompact, CompactFallbackOmitIPv6
+	// and CompactFallbackReject.
+	// If empty, CompactFallbackNonCompact is used.
+	Mode string `yaml:"mode"`
+}
+
+// compactFallback adapts the responses to clients that can't parse compact
+// IPv6 peers.
+//
+// A nil *compactFallback never changes a response.
+type compactFallback struct {
+	clients map[bittorrent.ClientID]struct{}
+	mode    string
+}
+
+// newCompactFallback creates a compactFallback for cfg.
+//
+// Client IDs that are not 6 bytes long are skipped with a warning. If no
+// valid client IDs remain, nil is returned.
+func newCompactFallback(cfg CompactFallbackConfig) *compactFallback {
+	clients := make(map[bittorrent.ClientID]struct{}, len(cfg.Clients))
+	for _, client := range cfg.Clients {
+		if len(client) != 6 {
+			log.Warn("ignoring compact fallback client ID that is not 6 bytes", log.Fields{"client": client})
+			continue
+		}
+		var cid bittorrent.ClientID
+		copy(cid[:], client)
+		clients[cid] = struct{}{}
+	}
+	if len(clients) == 0 {
+		return nil
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = CompactFallbackNonCompact
+	case CompactFallbackNonCompact, CompactFallbackOmitIPv6, CompactFallbackReject:
+	default:
+		log.Warn("unknown compact fallback mode, using non_compact", log.Fields{"mode": cfg.Mode})
+		cfg.Mode = CompactFallbackNonCompact
+	}
+
+	return &compactFallback{clients: clients, mode: cfg.Mode}
+}
+
+// apply adapts resp if it is a compact response with IPv6 peers to one of the
+// configured clients.
+//
+// Only the HTTP frontend distinguishes compact responses, so responses of
+// other frontends, e.g. UDP, are never changed.
+func (f *compactFallback) apply(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	if f == nil || !resp.Compact || len(resp.IPv6Peers) == 0 {
+		return nil
+	}
+
+	if scheme, _ := bittorrent.Scheme(ctx); scheme != bittorrent.SchemeHTTP && scheme != bittorrent.SchemeHTTPS {
+		return nil
+	}
+
+	if _, ok := f.clients[bittorrent.NewClientID(req.Peer.ID)]; !ok {
+		return nil
+	}
+
+	PromCompactFallbacksTotal.WithLabelValues(f.mode).Inc()
+	switch f.mode {
+	case CompactFallbackOmitIPv6:
+		resp.IPv6Peers = nil
+	case CompactFallbackReject:
+		return ErrCompactIPv6Unsupported
+	default:
+		resp.Compact = false
+	}
+
+	return nil
+}
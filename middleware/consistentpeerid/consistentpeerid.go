@@ -0,0 +1,176 @@
+// Package consistentpeerid implements a Hook that detects peers changing their
+// peer ID during a session.
+package consistentpeerid
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Policies for Announces with a changed peer ID.
+const (
+	PolicyReject = "reject"
+	PolicyFlag   = "flag"
+)
+
+// defaultSessionWindow is the default of the SessionWindow.
+const defaultSessionWindow = time.Hour
+
+// ErrPeerIDChanged is returned when a peer announces with a different peer ID
+// than before in the same session.
+var ErrPeerIDChanged = bittorrent.NewClientError("peer_id_changed", "peer ID changed during session")
+
+// ErrInvalidPolicy is returned for a config with an unknown Policy.
+var ErrInvalidPolicy = errors.New("policy must be reject or flag")
+
+// ErrInvalidMaxChanges is returned for a config with a negative MaxChanges.
+var ErrInvalidMaxChanges = errors.New("max_changes must not be negative")
+
+// Config represents the configuration for the consistent peer ID middleware.
+type Config struct {
+	// SessionWindow is the duration an endpoint in a swarm is remembered
+	// after its last announce. It should exceed the announce interval.
+	// If zero, a default of 1h is used.
+	SessionWindow time.Duration `yaml:"session_window"`
+
+	// MaxChanges is the number of peer ID changes of an endpoint that are
+	// tolerated within a session before Policy applies.
+	MaxChanges int `yaml:"max_changes"`
+
+	// Policy specifies how Announces exceeding MaxChanges are handled. They
+	// are either rejected or flagged as suspected abuse via
+	// middleware.SuspectedAbuseKey.
+	// If empty, they are rejected.
+	Policy string `yaml:"policy"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"sessionWindow": cfg.SessionWindow,
+		"maxChanges":    cfg.MaxChanges,
+		"policy":        cfg.Policy,
+		"softReject":    cfg.SoftReject.Enabled,
+	}
+}
+
+// endpointKey identifies an endpoint in a swarm.
+type endpointKey struct {
+	infoHash bittorrent.InfoHash
+	ip       [16]byte
+	port     uint16
+}
+
+func (k endpointKey) String() string {
+	return string(k.infoHash[:]) + string(k.ip[:]) + string([]byte{byte(k.port >> 8), byte(k.port)})
+}
+
+// session is the state of an endpoint in a swarm.
+type session struct {
+	peerID  bittorrent.PeerID
+	changes int
+}
+
+type hook struct {
+	cfg      Config
+	sessions *expiring.Map
+}
+
+// NewHook returns an instance of the consistent peer ID middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	switch cfg.Policy {
+	case "":
+		cfg.Policy = PolicyReject
+	case PolicyReject, PolicyFlag:
+	default:
+		return nil, ErrInvalidPolicy
+	}
+
+	if cfg.MaxChanges < 0 {
+		return nil, ErrInvalidMaxChanges
+	}
+
+	if cfg.SessionWindow <= 0 {
+		cfg.SessionWindow = defaultSessionWindow
+	}
+
+	return &hook{
+		cfg:      cfg,
+		sessions: expiring.New(0, cfg.SessionWindow/2),
+	}, nil
+}
+
+func newEndpointKey(req *bittorrent.AnnounceRequest) endpointKey {
+	k := endpointKey{infoHash: req.InfoHash, port: req.Peer.Port}
+	copy(k.ip[:], req.Peer.IP.To16())
+	return k
+}
+
+// observe records that the endpoint identified by k announced with peerID
+// and returns the number of peer ID changes in the current session.
+func (h *hook) observe(k endpointKey, peerID bittorrent.PeerID, now time.Time) (changes int) {
+	h.sessions.Update(k.String(), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		sess := session{peerID: peerID}
+		if ok {
+			sess = e.Value.(session)
+			if sess.peerID != peerID {
+				sess.peerID = peerID
+				sess.changes++
+			}
+		}
+
+		changes = sess.changes
+		return expiring.Entry{Value: sess, Expires: now.Add(h.cfg.SessionWindow)}
+	})
+	return
+}
+
+// forget ends the session of the endpoint identified by k if it uses peerID.
+func (h *hook) forget(k endpointKey, peerID bittorrent.PeerID) {
+	h.sessions.Update(k.String(), time.Now(), func(e expiring.Entry, ok bool) expiring.Entry {
+		if ok && e.Value.(session).peerID == peerID {
+			return expiring.Entry{}
+		}
+		return e
+	})
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	k := newEndpointKey(req)
+	if req.Event == bittorrent.Stopped {
+		h.forget(k, req.Peer.ID)
+		return ctx, nil
+	}
+
+	if h.observe(k, req.Peer.ID, time.Now()) <= h.cfg.MaxChanges {
+		return ctx, nil
+	}
+
+	if h.cfg.Policy == PolicyFlag {
+		return context.WithValue(ctx, middleware.SuspectedAbuseKey, struct{}{}), nil
+	}
+
+	return h.cfg.SoftReject.Reject(ctx, resp, ErrPeerIDChanged)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't carry a peer ID.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are trusted.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	return h.sessions.Stop()
+}
@@ -0,0 +1,105 @@
+package consistentpeerid
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func announce(event bittorrent.Event, peerID, ip string, port uint16) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHashFromString("00000000000000000001"),
+		Event:    event,
+		Peer: bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(peerID),
+			IP:   bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		},
+	}
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{Policy: "invalid"})
+	require.Equal(t, ErrInvalidPolicy, err)
+
+	_, err = NewHook(Config{MaxChanges: -1})
+	require.Equal(t, ErrInvalidMaxChanges, err)
+
+	h, err := NewHook(Config{})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+	require.Equal(t, PolicyReject, h.(*hook).cfg.Policy)
+	require.Equal(t, defaultSessionWindow, h.(*hook).cfg.SessionWindow)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{MaxChanges: 1})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	var table = []struct {
+		event    bittorrent.Event
+		peerID   string
+		ip       string
+		port     uint16
+		expected error
+	}{
+		{bittorrent.Started, "-TR2940-000000000001", "1.2.3.4", 6881, nil},
+		{bittorrent.None, "-TR2940-000000000001", "1.2.3.4", 6881, nil},
+
+		// One change is tolerated.
+		{bittorrent.None, "-TR2940-000000000002", "1.2.3.4", 6881, nil},
+		{bittorrent.None, "-TR2940-000000000002", "1.2.3.4", 6881, nil},
+		{bittorrent.None, "-TR2940-000000000003", "1.2.3.4", 6881, ErrPeerIDChanged},
+
+		// Other endpoints are independent.
+		{bittorrent.None, "-TR2940-000000000004", "1.2.3.4", 6882, nil},
+		{bittorrent.None, "-TR2940-000000000004", "1.2.3.5", 6881, nil},
+
+		// Stopping ends the session.
+		{bittorrent.Stopped, "-TR2940-000000000003", "1.2.3.4", 6881, nil},
+		{bittorrent.Started, "-TR2940-000000000005", "1.2.3.4", 6881, nil},
+	}
+
+	for _, tt := range table {
+		_, err := h.HandleAnnounce(context.Background(), announce(tt.event, tt.peerID, tt.ip, tt.port), &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err)
+	}
+}
+
+func TestPolicyFlag(t *testing.T) {
+	h, err := NewHook(Config{Policy: PolicyFlag})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	ctx, err := h.HandleAnnounce(context.Background(), announce(bittorrent.Started, "-TR2940-000000000001", "1.2.3.4", 6881), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Nil(t, ctx.Value(middleware.SuspectedAbuseKey))
+
+	ctx, err = h.HandleAnnounce(context.Background(), announce(bittorrent.None, "-TR2940-000000000002", "1.2.3.4", 6881), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SuspectedAbuseKey))
+}
+
+func TestSessionWindow(t *testing.T) {
+	h, err := NewHook(Config{SessionWindow: time.Minute})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	k := newEndpointKey(announce(bittorrent.None, "-TR2940-000000000001", "1.2.3.4", 6881))
+	id1 := bittorrent.PeerIDFromString("-TR2940-000000000001")
+	id2 := bittorrent.PeerIDFromString("-TR2940-000000000002")
+	now := time.Now()
+
+	require.Equal(t, 0, h.(*hook).observe(k, id1, now))
+	require.Equal(t, 1, h.(*hook).observe(k, id2, now.Add(59*time.Second)))
+
+	// A new session starts after the window.
+	require.Equal(t, 0, h.(*hook).observe(k, id1, now.Add(3*time.Minute)))
+}
@@ -0,0 +1,99 @@
+// Package cryptonetworks implements a Hook that rejects Announces of peers
+// from configured networks that do not support encrypted connections.
+package cryptonetworks
+
+import (
+	"context"
+	"errors"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/cidr"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrCryptoRequired is returned when a peer from a configured network
+// announces without support for encrypted connections.
+var ErrCryptoRequired = bittorrent.NewClientError("crypto_required", "encrypted connections are required from your network")
+
+// ErrNoRanges is returned for a config without any ranges.
+var ErrNoRanges = errors.New("no ranges configured")
+
+// Config represents the configuration for the crypto networks middleware.
+type Config struct {
+	// Ranges is a list of ranges in CIDR notation from which peers must
+	// support encrypted connections.
+	Ranges []string `yaml:"ranges"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"ranges":     len(cfg.Ranges),
+		"softReject": cfg.SoftReject.Enabled,
+	}
+}
+
+type hook struct {
+	cfg Config
+	v4  *cidr.Trie
+	v6  *cidr.Trie
+}
+
+// NewHook returns an instance of the crypto networks middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if len(cfg.Ranges) == 0 {
+		return nil, ErrNoRanges
+	}
+
+	h := &hook{
+		cfg: cfg,
+		v4:  cidr.NewIPv4(),
+		v6:  cidr.NewIPv6(),
+	}
+
+	for _, r := range cfg.Ranges {
+		ipNet, err := cidr.ParseRange(r)
+		if err != nil {
+			return nil, errors.New("invalid range " + r + ": " + err.Error())
+		}
+
+		if ipNet.IP.To4() != nil {
+			err = h.v4.Insert(ipNet)
+		} else {
+			err = h.v6.Insert(ipNet)
+		}
+		if err != nil {
+			return nil, errors.New("invalid range " + r + ": " + err.Error())
+		}
+	}
+
+	return h, nil
+}
+
+func (h *hook) contains(ip bittorrent.IP) bool {
+	if ip.AddressFamily == bittorrent.IPv4 {
+		return h.v4.Contains(ip.IP)
+	}
+	return h.v6.Contains(ip.IP)
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Flags.Has(bittorrent.PeerFlagCrypto) || !h.contains(req.Peer.IP) {
+		return ctx, nil
+	}
+
+	return h.cfg.SoftReject.Reject(ctx, resp, ErrCryptoRequired)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't involve peer connections.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are trusted.
+	return ctx, nil
+}
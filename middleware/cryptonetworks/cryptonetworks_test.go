@@ -0,0 +1,54 @@
+package cryptonetworks
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func announce(ip string, flags bittorrent.PeerFlags) *bittorrent.AnnounceRequest {
+	parsed := net.ParseIP(ip)
+	af := bittorrent.IPv6
+	if parsed.To4() != nil {
+		parsed = parsed.To4()
+		af = bittorrent.IPv4
+	}
+
+	return &bittorrent.AnnounceRequest{
+		Peer:  bittorrent.Peer{IP: bittorrent.IP{IP: parsed, AddressFamily: af}},
+		Flags: flags,
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrNoRanges, err)
+
+	_, err = NewHook(Config{Ranges: []string{"invalid"}})
+	require.NotNil(t, err)
+
+	h, err := NewHook(Config{Ranges: []string{"10.0.0.0/8", "2001:db8::/32"}})
+	require.Nil(t, err)
+
+	var table = []struct {
+		ip       string
+		flags    bittorrent.PeerFlags
+		expected error
+	}{
+		{"10.1.2.3", 0, ErrCryptoRequired},
+		{"2001:db8::1", 0, ErrCryptoRequired},
+		{"10.1.2.3", bittorrent.PeerFlagCrypto, nil},
+		{"2001:db8::1", bittorrent.PeerFlagCrypto, nil},
+		{"11.1.2.3", 0, nil},
+		{"2001:db9::1", 0, nil},
+	}
+
+	for _, tt := range table {
+		_, err = h.HandleAnnounce(context.Background(), announce(tt.ip, tt.flags), &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err, tt.ip)
+	}
+}
@@ -0,0 +1,238 @@
+// Package datacenter implements a Hook that rejects or flags Announces from
+// peers whose IP is contained in a list of datacenter ranges.
+package datacenter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/cidr"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// ErrDatacenterIP is returned when a peer announces from a datacenter range.
+var ErrDatacenterIP = bittorrent.NewClientError("datacenter_ip", "announces from datacenter IP ranges are not allowed")
+
+// ErrNoRanges is returned for a config without any ranges or ranges file.
+var ErrNoRanges = errors.New("no ranges or ranges_file configured")
+
+type datacenterIP struct{}
+
+// DatacenterIPKey is the key under which the hook stores whether an Announce
+// originates from a datacenter range.
+// The value is of type bool and only set for matching Announces that were not
+// rejected.
+var DatacenterIPKey = datacenterIP{}
+
+// Config represents the configuration for the datacenter middleware.
+type Config struct {
+	// Ranges is a list of ranges in CIDR notation.
+	Ranges []string `yaml:"ranges"`
+
+	// RangesFile is the path to a file containing one range in CIDR
+	// notation per line. Empty lines and lines starting with # are
+	// ignored.
+	RangesFile string `yaml:"ranges_file"`
+
+	// ReloadInterval is the interval in which RangesFile is checked for
+	// modifications and reloaded. Zero disables reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// Reject specifies whether matching Announces are rejected. If false,
+	// they are flagged via DatacenterIPKey and bittorrent.PeerFlagSeedbox.
+	Reject bool `yaml:"reject"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"ranges":         len(cfg.Ranges),
+		"rangesFile":     cfg.RangesFile,
+		"reloadInterval": cfg.ReloadInterval,
+		"reject":         cfg.Reject,
+		"softReject":     cfg.SoftReject.Enabled,
+	}
+}
+
+// tables holds the ranges of both address families.
+type tables struct {
+	v4 *cidr.Trie
+	v6 *cidr.Trie
+}
+
+func (t *tables) insert(s string) error {
+	ipNet, err := cidr.ParseRange(s)
+	if err != nil {
+		return err
+	}
+
+	if ipNet.IP.To4() != nil {
+		return t.v4.Insert(ipNet)
+	}
+	return t.v6.Insert(ipNet)
+}
+
+func (t *tables) contains(ip bittorrent.IP) bool {
+	if ip.AddressFamily == bittorrent.IPv4 {
+		return t.v4.Contains(ip.IP)
+	}
+	return t.v6.Contains(ip.IP)
+}
+
+type hook struct {
+	cfg     Config
+	tables  atomic.Value // *tables
+	modTime time.Time
+	closing chan struct{}
+}
+
+// NewHook returns an instance of the datacenter middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if len(cfg.Ranges) == 0 && cfg.RangesFile == "" {
+		return nil, ErrNoRanges
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+
+	if cfg.RangesFile != "" && cfg.ReloadInterval > 0 {
+		go func() {
+			for {
+				select {
+				case <-h.closing:
+					return
+				case <-time.After(cfg.ReloadInterval):
+					if err := h.reload(); err != nil {
+						log.Error("failed to reload datacenter ranges", log.Err(err))
+					}
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+// load builds new tables from the configured ranges and the ranges file and
+// replaces the current tables with them.
+func (h *hook) load() error {
+	t := &tables{v4: cidr.NewIPv4(), v6: cidr.NewIPv6()}
+
+	for _, r := range h.cfg.Ranges {
+		if err := t.insert(r); err != nil {
+			return errors.New("invalid range " + r + ": " + err.Error())
+		}
+	}
+
+	if h.cfg.RangesFile != "" {
+		f, err := os.Open(h.cfg.RangesFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		if err := parseRanges(f, t); err != nil {
+			return err
+		}
+		h.modTime = fi.ModTime()
+	}
+
+	h.tables.Store(t)
+	log.Debug("loaded datacenter ranges", log.Fields{
+		"ipv4Ranges": t.v4.Len(),
+		"ipv6Ranges": t.v6.Len(),
+	})
+
+	return nil
+}
+
+// reload loads the ranges again if the ranges file was modified.
+//
+// If the new ranges are invalid, the current ranges are kept.
+func (h *hook) reload() error {
+	fi, err := os.Stat(h.cfg.RangesFile)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	return h.load()
+}
+
+func parseRanges(r io.Reader, t *tables) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := t.insert(line); err != nil {
+			return errors.New("invalid range " + line + ": " + err.Error())
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.tables.Load().(*tables).contains(req.Peer.IP) {
+		return ctx, nil
+	}
+
+	if h.cfg.Reject {
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrDatacenterIP)
+	}
+
+	req.Flags |= bittorrent.PeerFlagSeedbox
+	return context.WithValue(ctx, DatacenterIPKey, true), nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't require any protection.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api doesn't require any protection.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(chan error)
+	go func() {
+		close(h.closing)
+		close(c)
+	}()
+	return c
+}
@@ -0,0 +1,103 @@
+package datacenter
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func announce(ip string) *bittorrent.AnnounceRequest {
+	parsed := net.ParseIP(ip)
+	af := bittorrent.IPv6
+	if parsed.To4() != nil {
+		parsed = parsed.To4()
+		af = bittorrent.IPv4
+	}
+
+	return &bittorrent.AnnounceRequest{
+		Peer: bittorrent.Peer{IP: bittorrent.IP{IP: parsed, AddressFamily: af}},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrNoRanges, err)
+
+	_, err = NewHook(Config{Ranges: []string{"invalid"}})
+	require.NotNil(t, err)
+
+	h, err := NewHook(Config{Ranges: []string{"10.0.0.0/8", "2001:db8::/32"}, Reject: true})
+	require.Nil(t, err)
+
+	for _, ip := range []string{"10.1.2.3", "2001:db8::1"} {
+		_, err = h.HandleAnnounce(context.Background(), announce(ip), &bittorrent.AnnounceResponse{})
+		require.Equal(t, ErrDatacenterIP, err)
+	}
+
+	for _, ip := range []string{"11.1.2.3", "2001:db9::1"} {
+		_, err = h.HandleAnnounce(context.Background(), announce(ip), &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+
+	h, err = NewHook(Config{Ranges: []string{"10.0.0.0/8"}})
+	require.Nil(t, err)
+
+	req := announce("10.1.2.3")
+	ctx, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, true, ctx.Value(DatacenterIPKey))
+	require.True(t, req.Flags.Has(bittorrent.PeerFlagSeedbox))
+
+	h, err = NewHook(Config{
+		Ranges:     []string{"10.0.0.0/8"},
+		Reject:     true,
+		SoftReject: middleware.SoftRejectConfig{Enabled: true},
+	})
+	require.Nil(t, err)
+
+	ctx, err = h.HandleAnnounce(context.Background(), announce("10.1.2.3"), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+}
+
+func TestReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "datacenter")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("# comment\n\n10.0.0.0/8\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	h, err := NewHook(Config{RangesFile: f.Name(), Reject: true})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	_, err = h.HandleAnnounce(context.Background(), announce("10.1.2.3"), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrDatacenterIP, err)
+
+	require.Nil(t, ioutil.WriteFile(f.Name(), []byte("192.168.0.0/16\n"), 0644))
+	require.Nil(t, os.Chtimes(f.Name(), time.Now(), time.Now().Add(time.Minute)))
+	require.Nil(t, h.(*hook).reload())
+
+	_, err = h.HandleAnnounce(context.Background(), announce("10.1.2.3"), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), announce("192.168.1.1"), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrDatacenterIP, err)
+
+	// Invalid files keep the current ranges.
+	require.Nil(t, ioutil.WriteFile(f.Name(), []byte("invalid\n"), 0644))
+	require.Nil(t, os.Chtimes(f.Name(), time.Now(), time.Now().Add(2*time.Minute)))
+	require.NotNil(t, h.(*hook).reload())
+
+	_, err = h.HandleAnnounce(context.Background(), announce("192.168.1.1"), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrDatacenterIP, err)
+}
@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// defaultFamilyFallbackMessage is the warning message sent to clients whose
+// address family has no peers in a swarm with peers of the other one, if none
+// is configured.
+const defaultFamilyFallbackMessage = "this torrent only has peers of the other IP version, try announcing via IPv4 and IPv6"
+
+// DualStackSplitPreferNative divides numwant between the address families by
+// returning the peers of the address family of the announce first and filling
+// the remaining slots with those of the other one.
+const DualStackSplitPreferNative = "prefer_native"
+
+// FamilyFallbackConfig holds the configuration of the responses to announces
+// from an address family without peers in a swarm that has peers of the other
+// address family, which otherwise look like the torrent is dead.
+type FamilyFallbackConfig struct {
+	// Enabled specifies whether such responses carry a warning message.
+	Enabled bool `yaml:"enabled"`
+
+	// WarningMessage is the warning message.
+	// If empty, a default suggesting to announce via both IP versions is
+	// used.
+	WarningMessage string `yaml:"warning_message"`
+
+	// DualStackPeers specifies whether dual-stack clients receive the
+	// peers of the other address family instead of the warning message.
+	// Clients are considered dual-stack if they announce an address of the
+	// other address family via the ipv4 or ipv6 parameter of BEP 7. Only
+	// the HTTP frontend can return peers of both address families, so
+	// clients of other frontends receive the warning message.
+	DualStackPeers bool `yaml:"dual_stack_peers"`
+
+	// DualStackSplit specifies how numwant is divided between the address
+	// families for dual-stack clients if DualStackPeers is enabled, in
+	// which case they always receive peers of both address families.
+	// It is either DualStackSplitPreferNative or the percentages for the
+	// address family of the announce and the other one, e.g. "70/30".
+	// Slots that one address family can't fill go to the other one.
+	// If empty, dual-stack clients only receive the peers of the other
+	// address family if there are none of theirs.
+	DualStackSplit string `yaml:"dual_stack_split"`
+}
+
+// familyFallback handles announces from an address family without peers.
+//
+// A nil *familyFallback never handles them.
+type familyFallback struct {
+	warningMessage string
+	dualStackPeers bool
+
+	// split is whether dual-stack clients always receive peers of both
+	// address families, nativeShare the share of numwant for the address
+	// family of the announce.
+	split       bool
+	nativeShare float64
+}
+
+// newFamilyFallback creates a familyFallback for cfg.
+//
+// If the fallback is disabled, nil is returned.
+func newFamilyFallback(cfg FamilyFallbackConfig) *familyFallback {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if cfg.WarningMessage == "" {
+		cfg.WarningMessage = defaultFamilyFallbackMessage
+	}
+
+	f := &familyFallback{
+		warningMessage: cfg.WarningMessage,
+		dualStackPeers: cfg.DualStackPeers,
+	}
+
+	if cfg.DualStackSplit != "" {
+		share, ok := parseDualStackSplit(cfg.DualStackSplit)
+		if !ok {
+			log.Warn("invalid dual-stack split, using prefer_native", log.Fields{"split": cfg.DualStackSplit})
+			share = 1
+		}
+		f.split = true
+		f.nativeShare = share
+	}
+
+	return f
+}
+
+// parseDualStackSplit parses a DualStackSplit into the share of numwant for
+// the address family of the announce.
+func parseDualStackSplit(split string) (float64, bool) {
+	if split == DualStackSplitPreferNative {
+		return 1, true
+	}
+
+	parts := strings.Split(split, "/")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	native, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || native < 0 {
+		return 0, false
+	}
+	other, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || other < 0 || native+other != 100 {
+		return 0, false
+	}
+
+	return float64(native) / 100, true
+}
+
+// divide returns how many of native peers of the address family of an
+// announce and other peers of the other address family are returned for
+// numWant.
+//
+// Each address family receives its share of numWant first, then the slots
+// one of them can't fill go to the other one.
+func (f *familyFallback) divide(numWant, native, other int) (int, int) {
+	n := int(float64(numWant)*f.nativeShare + 0.5)
+	if n > native {
+		n = native
+	}
+	o := numWant - n
+	if o > other {
+		o = other
+	}
+	if n+o < numWant {
+		n = numWant - o
+		if n > native {
+			n = native
+		}
+	}
+
+	return n, o
+}
+
+// otherFamily returns the address family that is not af.
+func otherFamily(af bittorrent.AddressFamily) bittorrent.AddressFamily {
+	if af == bittorrent.IPv4 {
+		return bittorrent.IPv6
+	}
+	return bittorrent.IPv4
+}
+
+// bothFamilies reports whether the frontend that received the request of ctx
+// can return peers of both address families, which only the HTTP frontend
+// can. The UDP frontend only writes the peers of the address family of the
+// announce.
+func bothFamilies(ctx context.Context) bool {
+	scheme, _ := bittorrent.Scheme(ctx)
+	return scheme == bittorrent.SchemeHTTP || scheme == bittorrent.SchemeHTTPS
+}
+
+// otherFamilyIP returns the address of the other address family that the
+// client of req announced via the ipv4 or ipv6 parameter of BEP 7, if any.
+//
+// The address is not verified, so it must not be stored.
+func otherFamilyIP(req *bittorrent.AnnounceRequest) (bittorrent.IP, bool) {
+	if req.Params == nil {
+		return bittorrent.IP{}, false
+	}
+
+	key := "ipv6"
+	if req.IP.AddressFamily == bittorrent.IPv6 {
+		key = "ipv4"
+	}
+	value, ok := req.Params.String(key)
+	if !ok {
+		return bittorrent.IP{}, false
+	}
+
+	// The address may be followed by a port.
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	ip, ok := bittorrent.NormalizeIP(net.ParseIP(value))
+	if !ok || ip.AddressFamily == req.IP.AddressFamily {
+		return bittorrent.IP{}, false
+	}
+
+	return ip, true
+}
+
+// splitDualStack divides numwant between the peers of both address families
+// for dual-stack clients, if configured.
+//
+// It returns the peers of the address family of req, a prefix of peers, and
+// those of the other address family.
+func (h *responseHook) splitDualStack(ctx context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer, mask bittorrent.PeerFlags) ([]bittorrent.Peer, []bittorrent.Peer, error) {
+	f := h.familyFallback
+	if f == nil || !f.dualStackPeers || !f.split || req.Event == bittorrent.Stopped || !bothFamilies(ctx) {
+		return peers, nil, nil
+	}
+
+	// With prefer_native, full responses don't need the other address
+	// family.
+	numWant := int(req.NumWant)
+	if f.nativeShare == 1 && len(peers) >= numWant {
+		return peers, nil, nil
+	}
+
+	ip, ok := otherFamilyIP(req)
+	if !ok {
+		return peers, nil, nil
+	}
+
+	otherReq := *req
+	otherReq.Peer.IP = ip
+	others, err := h.announcePeers(&otherReq, req.Left == 0, numWant, mask)
+	if err != nil && err != storage.ErrResourceDoesNotExist {
+		return nil, nil, err
+	}
+	h.shuffler.shuffle(req, others)
+
+	n, o := f.divide(numWant, len(peers), len(others))
+	return peers[:n], others[:o], nil
+}
+
+// fallBack handles an announce for which the swarm of the address family of
+// req has no peers, if configured.
+//
+// If the swarm of the other address family has peers, dual-stack clients of
+// the HTTP frontend receive those if configured, other clients a warning
+// message.
+func (h *responseHook) fallBack(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, mask bittorrent.PeerFlags) error {
+	if h.familyFallback == nil {
+		return nil
+	}
+
+	other := otherFamily(req.IP.AddressFamily)
+	if s := h.store.ScrapeSwarm(req.InfoHash, other); s.Complete+s.Incomplete == 0 {
+		return nil
+	}
+
+	if ip, ok := otherFamilyIP(req); ok && h.familyFallback.dualStackPeers && bothFamilies(ctx) {
+		otherReq := *req
+		otherReq.Peer.IP = ip
+		peers, err := h.announcePeers(&otherReq, req.Left == 0, int(req.NumWant), mask)
+		if err != nil && err != storage.ErrResourceDoesNotExist {
+			return err
+		}
+		if len(peers) > 0 {
+			h.shuffler.shuffle(req, peers)
+			if other == bittorrent.IPv4 {
+				resp.IPv4Peers = peers
+			} else {
+				resp.IPv6Peers = peers
+			}
+			return nil
+		}
+	}
+
+	log.Debug("swarm only has peers of the other address family", log.RequestFields(ctx, log.Fields{
+		"infoHash": req.InfoHash,
+	}))
+	if resp.WarningMessage == "" {
+		resp.WarningMessage = h.familyFallback.warningMessage
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+// Package firstannounce implements a Hook that sends a shorter announce
+// interval to peers announcing to a swarm for the first time.
+package firstannounce
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Defaults of the configuration.
+const (
+	defaultPeerLifetime = time.Hour
+	defaultMaxPeers     = 1000000
+)
+
+// Errors of the configuration.
+var (
+	ErrInvalidInterval = errors.New("interval must be positive")
+	ErrInvalidMaxPeers = errors.New("max_peers must not be negative")
+)
+
+// Config represents the configuration for the first announce interval
+// middleware.
+type Config struct {
+	// Interval is the interval sent to peers on their first Announce to a
+	// swarm. It never undercuts the min interval of the response and is
+	// only used if it is shorter than the interval of the response.
+	Interval time.Duration `yaml:"interval"`
+
+	// PeerLifetime is the duration a peer is remembered after its last
+	// announce, unless the PeerStore tracks the peers. It should exceed the
+	// announce interval.
+	// If zero, a default of 1h is used.
+	PeerLifetime time.Duration `yaml:"peer_lifetime"`
+
+	// MaxPeers is the maximum number of peers that are remembered, unless
+	// the PeerStore tracks the peers.
+	// Beyond that, the peers that announced least recently are forgotten.
+	// If zero, a default of 1000000 is used.
+	MaxPeers int `yaml:"max_peers"`
+
+	// GracePeriod is the duration after startup during which only
+	// Announces with the started event count as first Announces, so that
+	// the peers remembered before a restart don't all announce early.
+	// If zero, PeerLifetime is used.
+	GracePeriod time.Duration `yaml:"grace_period"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"interval":     cfg.Interval,
+		"peerLifetime": cfg.PeerLifetime,
+		"maxPeers":     cfg.MaxPeers,
+		"gracePeriod":  cfg.GracePeriod,
+	}
+}
+
+// peerKey identifies a peer in a swarm.
+type peerKey struct {
+	infoHash bittorrent.InfoHash
+	peerID   bittorrent.PeerID
+}
+
+func (k peerKey) String() string {
+	return string(k.infoHash[:]) + string(k.peerID[:])
+}
+
+// peerStore is implemented by PeerStores that count the Announces of their
+// Peers and can describe them, which already tells the known peers apart.
+type peerStore interface {
+	storage.SeenCountStore
+	storage.PeerInfoStore
+}
+
+type hook struct {
+	cfg      Config
+	graceEnd time.Time
+
+	// store is used to look up the known peers, if the PeerStore tracks
+	// them. Otherwise, they are remembered in peers.
+	store peerStore
+	peers *expiring.Map
+}
+
+// NewHook returns an instance of the first announce interval middleware.
+//
+// If the PeerStore counts the Announces of its Peers, known peers are looked
+// up in it. Otherwise, they are kept in memory. Either way, only Announces
+// with the started event receive the shorter interval for the GracePeriod
+// after a restart.
+func NewHook(cfg Config, store storage.PeerStore) (middleware.Hook, error) {
+	if cfg.Interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	if cfg.MaxPeers < 0 {
+		return nil, ErrInvalidMaxPeers
+	}
+
+	if cfg.PeerLifetime <= 0 {
+		cfg.PeerLifetime = defaultPeerLifetime
+	}
+	if cfg.MaxPeers == 0 {
+		cfg.MaxPeers = defaultMaxPeers
+	}
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = cfg.PeerLifetime
+	}
+
+	h := &hook{
+		cfg:      cfg,
+		graceEnd: time.Now().Add(cfg.GracePeriod),
+	}
+	if ps, ok := store.(peerStore); ok {
+		h.store = ps
+	} else {
+		h.peers = expiring.New(cfg.MaxPeers, cfg.PeerLifetime/2)
+	}
+
+	return h, nil
+}
+
+// seen reports whether the peer of req was known at now and remembers it.
+func (h *hook) seen(req *bittorrent.AnnounceRequest, now time.Time) (known bool) {
+	if h.store != nil {
+		infos, err := h.store.PeerInfo(req.InfoHash, req.Peer.ID)
+		if err != nil && err != storage.ErrResourceDoesNotExist {
+			// Keep the normal interval if in doubt.
+			log.Warn("failed to look up peer", log.Err(err))
+			return true
+		}
+		return len(infos) > 0
+	}
+
+	k := peerKey{req.InfoHash, req.Peer.ID}
+	h.peers.Update(k.String(), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		known = ok
+		return expiring.Entry{Expires: now.Add(h.cfg.PeerLifetime)}
+	})
+	return
+}
+
+// forget removes the peer of req from the known peers.
+//
+// Peers of the PeerStore are removed by the PeerStore.
+func (h *hook) forget(req *bittorrent.AnnounceRequest) {
+	if h.peers != nil {
+		h.peers.Delete(peerKey{req.InfoHash, req.Peer.ID}.String())
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	now := time.Now()
+
+	if req.Event == bittorrent.Stopped {
+		h.forget(req)
+		return ctx, nil
+	}
+
+	seen := h.seen(req, now)
+	switch {
+	case req.Event == bittorrent.Started:
+	case seen:
+		return ctx, nil
+	case now.Before(h.graceEnd):
+		// The peer may have announced before a restart.
+		return ctx, nil
+	}
+
+	interval := h.cfg.Interval
+	if interval < resp.MinInterval {
+		interval = resp.MinInterval
+	}
+	if interval < resp.Interval {
+		resp.Interval = interval
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't have an interval.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis don't have an interval.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	if h.peers == nil {
+		c := make(chan error)
+		close(c)
+		return c
+	}
+	return h.peers.Stop()
+}
@@ -0,0 +1,123 @@
+package firstannounce
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func announce(event bittorrent.Event, peerID string) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHashFromString("00000000000000000001"),
+		Event:    event,
+		Peer:     bittorrent.Peer{ID: bittorrent.PeerIDFromString(peerID)},
+	}
+}
+
+// newHook creates a hook whose grace period already ended.
+func newHook(t *testing.T, cfg Config) *hook {
+	h, err := NewHook(cfg, nil)
+	require.Nil(t, err)
+	h.(*hook).graceEnd = time.Now()
+	return h.(*hook)
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{}, nil)
+	require.Equal(t, ErrInvalidInterval, err)
+
+	h, err := NewHook(Config{Interval: time.Minute}, nil)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+	require.Equal(t, defaultPeerLifetime, h.(*hook).cfg.GracePeriod)
+
+	_, err = NewHook(Config{Interval: time.Minute, MaxPeers: -1}, nil)
+	require.Equal(t, ErrInvalidMaxPeers, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h := newHook(t, Config{Interval: 5 * time.Minute})
+	defer func() { <-h.Stop() }()
+
+	var table = []struct {
+		event       bittorrent.Event
+		peerID      string
+		minInterval time.Duration
+		expected    time.Duration
+	}{
+		// The first announce of a peer is shortened, later ones are not.
+		{bittorrent.None, "-TR2940-000000000001", 0, 5 * time.Minute},
+		{bittorrent.None, "-TR2940-000000000001", 0, 30 * time.Minute},
+
+		// Started events begin a new session, stopped events end it.
+		{bittorrent.Started, "-TR2940-000000000001", 0, 5 * time.Minute},
+		{bittorrent.Stopped, "-TR2940-000000000001", 0, 30 * time.Minute},
+		{bittorrent.Completed, "-TR2940-000000000001", 0, 5 * time.Minute},
+
+		// The min interval is never undercut.
+		{bittorrent.Started, "-TR2940-000000000002", 10 * time.Minute, 10 * time.Minute},
+		{bittorrent.Started, "-TR2940-000000000003", 30 * time.Minute, 30 * time.Minute},
+	}
+
+	for _, tt := range table {
+		resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute, MinInterval: tt.minInterval}
+		_, err := h.HandleAnnounce(context.Background(), announce(tt.event, tt.peerID), resp)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, resp.Interval)
+	}
+
+	// Longer intervals are never used.
+	resp := &bittorrent.AnnounceResponse{Interval: time.Minute}
+	_, err := h.HandleAnnounce(context.Background(), announce(bittorrent.Started, "-TR2940-000000000004"), resp)
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, resp.Interval)
+}
+
+func TestGracePeriod(t *testing.T) {
+	h, err := NewHook(Config{Interval: 5 * time.Minute}, nil)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	// Unknown peers may have announced before a restart.
+	resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute}
+	_, err = h.HandleAnnounce(context.Background(), announce(bittorrent.None, "-TR2940-000000000001"), resp)
+	require.Nil(t, err)
+	require.Equal(t, 30*time.Minute, resp.Interval)
+
+	resp = &bittorrent.AnnounceResponse{Interval: 30 * time.Minute}
+	_, err = h.HandleAnnounce(context.Background(), announce(bittorrent.Started, "-TR2940-000000000002"), resp)
+	require.Nil(t, err)
+	require.Equal(t, 5*time.Minute, resp.Interval)
+}
+
+func TestPeerStore(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	h, err := NewHook(Config{Interval: 5 * time.Minute}, ps)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+	h.(*hook).graceEnd = time.Now()
+	require.Nil(t, h.(*hook).peers)
+
+	req := announce(bittorrent.None, "-TR2940-000000000001")
+	resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, 5*time.Minute, resp.Interval)
+
+	// Peers of the PeerStore are known.
+	req.Peer.IP = bittorrent.IP{IP: net.IPv4(1, 2, 3, 4).To4(), AddressFamily: bittorrent.IPv4}
+	require.Nil(t, ps.PutLeecher(req.InfoHash, req.Peer))
+	resp = &bittorrent.AnnounceResponse{Interval: 30 * time.Minute}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, 30*time.Minute, resp.Interval)
+}
@@ -3,9 +3,18 @@ package middleware
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/storage"
 )
 
@@ -25,38 +34,121 @@ type skipSwarmInteraction struct{}
 // middleware to skip.
 var SkipSwarmInteractionKey = skipSwarmInteraction{}
 
+// swarmInteractionHook stores the announcing Peer and performs the swarm
+// mutations of the api.
+//
+// If readOnly is set, the PeerStore is never modified.
 type swarmInteractionHook struct {
-	store storage.PeerStore
+	store        storage.PeerStore
+	ttl          PeerTTLConfig
+	ttlOverrides map[bittorrent.InfoHash]time.Duration
+	readOnly     bool
 }
 
+// attributes returns the PeerAttributes to store for the announcing Peer.
+//
+// The origin of the Peer is the scheme of the announce URL and its source is
+// the address of the connection, if the frontend stored them in ctx. The TTL
+// of the Peer depends on its role, unless it is overridden for the infohash.
+func (h *swarmInteractionHook) attributes(ctx context.Context, req *bittorrent.AnnounceRequest) storage.PeerAttributes {
+	attrs := storage.PeerAttributes{Flags: req.Flags}
+	attrs.Origin, _ = bittorrent.Scheme(ctx)
+	attrs.Key = req.Key
+	if ip, ok := frontend.RemoteIP(ctx); ok && !ip.Equal(req.IP.IP) {
+		attrs.SourceIP = ip
+	}
+	attrs.Uploaded = req.Uploaded
+	attrs.Downloaded = req.Downloaded
+
+	switch {
+	case req.Left == 0:
+		attrs.TTL = h.ttl.Seeder
+	case req.Event == bittorrent.Started && h.ttl.Started > 0:
+		attrs.TTL = h.ttl.Started
+	default:
+		attrs.TTL = h.ttl.Leecher
+	}
+
+	if ttl, ok := h.ttlOverrides[req.InfoHash]; ok {
+		attrs.TTL = ttl
+	}
+
+	return attrs
+}
+
+// HandleAnnounce stores or removes the announcing Peer.
+//
+// The role of the Peer is determined by Left rather than the event, because
+// some combinations are valid but unusual:
+// - stopped removes the Peer whatever its role, which is a no-op for a Peer
+//     that is not in the swarm, e.g. if stopped is its first announce.
+// - completed with nothing left graduates the Peer, or stores it as a
+//     seeder if it is not in the swarm as a leecher.
+// - completed with something left, e.g. after a client finished only the
+//     selected files, stores the Peer as a leecher.
+// - started with nothing left stores the Peer as a new seeder.
+// - something left after having been a seeder, e.g. after a client found
+//     its data corrupted, stores the Peer as a leecher in addition, until its
+//     seeder entry expires.
 func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
-	if ctx.Value(SkipSwarmInteractionKey) != nil {
+	if h.readOnly || ctx.Value(SkipSwarmInteractionKey) != nil {
 		return ctx, nil
 	}
 
+	attrs := h.attributes(ctx, req)
+	as, ok := h.store.(storage.PeerAttributeStore)
+	withAttributes := ok && !attrs.IsZero()
+
+	af := req.IP.AddressFamily
+
 	switch {
 	case req.Event == bittorrent.Stopped:
-		err = h.store.DeleteSeeder(req.InfoHash, req.Peer)
-		if err != nil && err != storage.ErrResourceDoesNotExist {
-			return ctx, err
+		seederErr := h.store.DeleteSeeder(req.InfoHash, req.Peer)
+		if seederErr != nil && seederErr != storage.ErrResourceDoesNotExist {
+			return ctx, seederErr
 		}
 
-		err = h.store.DeleteLeecher(req.InfoHash, req.Peer)
-		if err != nil && err != storage.ErrResourceDoesNotExist {
-			return ctx, err
+		leecherErr := h.store.DeleteLeecher(req.InfoHash, req.Peer)
+		if leecherErr != nil && leecherErr != storage.ErrResourceDoesNotExist {
+			return ctx, leecherErr
+		}
+
+		if seederErr == nil || leecherErr == nil {
+			recordTransition(transitionStopped, af)
+		}
+	case req.Event == bittorrent.Completed && req.Left == 0:
+		if withAttributes {
+			err = as.GraduateLeecherWithAttributes(req.InfoHash, req.Peer, attrs)
+		} else {
+			err = h.store.GraduateLeecher(req.InfoHash, req.Peer)
+		}
+		if err == nil {
+			recordTransition(transitionGraduation, af)
 		}
-	case req.Event == bittorrent.Completed:
-		err = h.store.GraduateLeecher(req.InfoHash, req.Peer)
 		return ctx, err
 	case req.Left == 0:
-		// Completed events will also have Left == 0, but by making this
-		// an extra case we can treat "old" seeders differently from
-		// graduating leechers. (Calling PutSeeder is probably faster
-		// than calling GraduateLeecher.)
-		err = h.store.PutSeeder(req.InfoHash, req.Peer)
+		// Completed events with Left == 0 are handled above, so we can
+		// treat "old" seeders differently from graduating leechers.
+		// (Calling PutSeeder is probably faster than calling
+		// GraduateLeecher.)
+		if withAttributes {
+			err = as.PutSeederWithAttributes(req.InfoHash, req.Peer, attrs)
+		} else {
+			err = h.store.PutSeeder(req.InfoHash, req.Peer)
+		}
+		if err == nil && req.Event == bittorrent.Started {
+			recordTransition(transitionNewSeeder, af)
+		}
 		return ctx, err
 	default:
-		err = h.store.PutLeecher(req.InfoHash, req.Peer)
+		if withAttributes {
+			err = as.PutLeecherWithAttributes(req.InfoHash, req.Peer, attrs)
+		} else {
+			err = h.store.PutLeecher(req.InfoHash, req.Peer)
+		}
+		if err == nil && req.Event == bittorrent.Started {
+			recordTransition(transitionNewLeecher, af)
+		}
 		return ctx, err
 	}
 
@@ -68,68 +160,244 @@ func (h *swarmInteractionHook) HandleScrape(ctx context.Context, _ *bittorrent.S
 	return ctx, nil
 }
 
+// mutatingApiMethods are the api methods that change the state of swarms or
+// torrents, which are refused in read-only mode.
+var mutatingApiMethods = map[string]struct{}{
+	"ban":      {},
+	"delete":   {},
+	"evict-ip": {},
+	"kick":     {},
+	"unban":    {},
+}
+
+// refuseReadOnly turns resp into the refusal of a mutating api method in
+// read-only mode.
+func refuseReadOnly(resp *bittorrent.ApiResponse) {
+	resp.Error = 1
+	resp.Response = "tracker is read-only"
+}
+
 func (h *swarmInteractionHook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
-	if req.Method == "delete" {
+	if _, mutating := mutatingApiMethods[req.Method]; mutating && h.readOnly {
+		refuseReadOnly(resp)
+		return ctx, nil
+	}
+
+	switch req.Method {
+	case "delete":
 		for _, infoHash := range req.InfoHashes {
 			h.store.DeleteInfoHash(infoHash)
 		}
+	case "evict-ip":
+		h.evictIP(req.Params, resp)
+	case "kick":
+		for _, infoHash := range req.InfoHashes {
+			resp.Files = append(resp.Files, h.kick(infoHash, req.Params))
+		}
 	}
 
 	return ctx, nil
 }
 
+// evictIP removes all peers announced from the IP given by the ip parameter
+// from all swarms.
+func (h *swarmInteractionHook) evictIP(params bittorrent.Params, resp *bittorrent.ApiResponse) {
+	resp.Error = 1
+
+	es, ok := h.store.(storage.PeerEvictionStore)
+	if !ok {
+		resp.Response = "evict-ip not supported by storage"
+		return
+	}
+
+	var ipString string
+	if params != nil {
+		ipString, _ = params.String("ip")
+	}
+	ip := bittorrent.IP{IP: net.ParseIP(ipString)}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip.IP, ip.AddressFamily = ip4, bittorrent.IPv4
+	} else if ip.IP != nil {
+		ip.AddressFamily = bittorrent.IPv6
+	} else {
+		resp.Response = "invalid ip"
+		return
+	}
+
+	deleted, err := es.DeletePeersByIP(ip)
+	if err != nil && err != storage.ErrResourceDoesNotExist {
+		resp.Response = err.Error()
+		return
+	}
+
+	resp.Error = 0
+	resp.Response = fmt.Sprintf("deleted=%d", deleted)
+}
+
+// kick removes all entries of the peer identified by the peer_id parameter
+// from the swarm identified by infoHash, in both roles and address families.
+func (h *swarmInteractionHook) kick(infoHash bittorrent.InfoHash, params bittorrent.Params) bittorrent.Api {
+	api := bittorrent.Api{InfoHash: infoHash, Error: 1}
+
+	ds, ok := h.store.(storage.PeerDeletionStore)
+	is, ok2 := h.store.(storage.PeerInfoStore)
+	if !ok || !ok2 {
+		api.Response = "kick not supported by storage"
+		return api
+	}
+
+	var peerID string
+	if params != nil {
+		peerID, _ = params.String("peer_id")
+	}
+	if len(peerID) != 20 {
+		api.Response = "invalid peer_id"
+		return api
+	}
+
+	// The entries are found by their peer ID, as the endpoint of the peer
+	// may have changed between announces.
+	infos, err := is.PeerInfo(infoHash, bittorrent.PeerIDFromString(peerID))
+	if err != nil && err != storage.ErrResourceDoesNotExist {
+		api.Response = err.Error()
+		return api
+	}
+
+	removed := false
+	for _, info := range infos {
+		deleted, err := ds.DeletePeer(infoHash, info.Peer)
+		if err != nil {
+			api.Response = err.Error()
+			return api
+		}
+		removed = removed || deleted
+	}
+
+	api.Error = 0
+	api.Response = fmt.Sprintf("removed=%t", removed)
+	return api
+}
+
 // ErrInvalidIP indicates an invalid IP for an Announce.
 var ErrInvalidIP = errors.New("invalid IP")
 
+// ErrInvalidTransferAmount indicates an Announce with a value of uploaded,
+// downloaded or left that is out of range.
+var ErrInvalidTransferAmount = bittorrent.NewClientError("invalid_transfer_amount", "invalid uploaded, downloaded or left")
+
+// maxTransferAmount is the highest value of uploaded, downloaded and left
+// accepted in an Announce.
+// BEP 15 defines these values as signed 64-bit integers, so higher values
+// are either negative or the all-max sentinel of a broken client.
+const maxTransferAmount = math.MaxInt64
+
+// ErrTooManyInfoHashes indicates a Scrape for more infohashes than accepted.
+var ErrTooManyInfoHashes = bittorrent.NewClientError("too_many_infohashes", "too many infohashes")
+
+// ErrTooManyDuplicateInfoHashes indicates a Scrape that repeats infohashes
+// more often than accepted.
+var ErrTooManyDuplicateInfoHashes = bittorrent.NewClientError("too_many_duplicate_infohashes", "too many duplicate infohashes")
+
 // sanitizationHook enforces semantic assumptions about requests that may have
 // not been accounted for in a tracker frontend.
 //
 // The SanitizationHook performs the following checks:
+// - numWantOverrides: Replaces maxNumWant and defaultNumWant for specific
+//     infohashes.
 // - maxNumWant: Checks whether the numWant parameter of an announce is below
 //     a limit. Sets it to the limit if the value is higher.
 // - defaultNumWant: Checks whether the numWant parameter of an announce is
-//     zero. Sets it to the default if it is.
+//     zero without being explicitly requested. Sets it to the default if it
+//     is.
 // - IP sanitization: Checks whether the announcing Peer's IP address is either
 //     IPv4 or IPv6. Returns ErrInvalidIP if the address is neither IPv4 nor
 //     IPv6. Sets the Peer.AddressFamily field accordingly. Truncates IPv4
 //     addresses to have a length of 4 bytes.
+// - Transfer amounts: Checks whether uploaded, downloaded and left of an
+//     announce fit into a signed 64-bit integer. Returns
+//     ErrInvalidTransferAmount if any of them does not.
+// - rejectScrapeInfoHashes: Checks whether the number of infohashes of a
+//     scrape is below a limit. Returns ErrTooManyInfoHashes if it is higher.
+// - maxScrapeInfoHashes: Checks whether the number of infohashes of a scrape
+//     is below a limit. Truncates the infohashes to the limit if it is higher.
+// - rejectScrapeDuplicates: Checks whether the number of repeated infohashes
+//     of a scrape is below a limit, if set. Returns
+//     ErrTooManyDuplicateInfoHashes if it is higher.
+//
+// The limits are read from the RuntimeConfig held by config, which also
+// answers the "config" api method.
 type sanitizationHook struct {
-	maxNumWant          uint32
-	defaultNumWant      uint32
-	maxScrapeInfoHashes uint32
+	config                 *runtimeConfig
+	rejectScrapeDuplicates uint32
+	numWantOverrides       map[bittorrent.InfoHash]uint32
 }
 
 func (h *sanitizationHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
-	if req.NumWant > h.maxNumWant {
-		req.NumWant = h.maxNumWant
+	rc := h.config.load()
+	maxNumWant, defaultNumWant := rc.MaxNumWant, rc.DefaultNumWant
+	if numWant, ok := h.numWantOverrides[req.InfoHash]; ok {
+		maxNumWant, defaultNumWant = numWant, numWant
 	}
 
-	if req.NumWant == 0 {
-		req.NumWant = h.defaultNumWant
+	if req.NumWant > maxNumWant {
+		req.NumWant = maxNumWant
 	}
 
-	if ip := req.Peer.IP.To4(); ip != nil {
-		req.Peer.IP.IP = ip
-		req.Peer.IP.AddressFamily = bittorrent.IPv4
-	} else if len(req.Peer.IP.IP) == net.IPv6len { // implies req.Peer.IP.To4() == nil
-		req.Peer.IP.AddressFamily = bittorrent.IPv6
-	} else {
+	if req.NumWant == 0 && !req.NumWantSpecified {
+		req.NumWant = defaultNumWant
+	}
+
+	ip, ok := bittorrent.NormalizeIP(req.Peer.IP.IP)
+	if !ok {
 		return ctx, ErrInvalidIP
 	}
+	req.Peer.IP = ip
+
+	if req.Uploaded > maxTransferAmount || req.Downloaded > maxTransferAmount || req.Left > maxTransferAmount {
+		log.Debug("rejecting announce with invalid transfer amount", log.RequestFields(ctx, log.Fields{
+			"uploaded":   req.Uploaded,
+			"downloaded": req.Downloaded,
+			"left":       req.Left,
+		}))
+		return ctx, ErrInvalidTransferAmount
+	}
 
 	return ctx, nil
 }
 
 func (h *sanitizationHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
-	if len(req.InfoHashes) > int(h.maxScrapeInfoHashes) {
-		req.InfoHashes = req.InfoHashes[:h.maxScrapeInfoHashes]
+	rc := h.config.load()
+	if len(req.InfoHashes) > int(rc.RejectScrapeInfoHashes) {
+		return ctx, ErrTooManyInfoHashes
+	}
+
+	if h.rejectScrapeDuplicates > 0 && duplicates(req.InfoHashes) > int(h.rejectScrapeDuplicates) {
+		return ctx, ErrTooManyDuplicateInfoHashes
+	}
+
+	if len(req.InfoHashes) > int(rc.MaxScrapeInfoHashes) {
+		req.InfoHashes = req.InfoHashes[:rc.MaxScrapeInfoHashes]
 	}
 
 	return ctx, nil
 }
 
+// duplicates returns the number of infoHashes that repeat a previous one.
+func duplicates(infoHashes []bittorrent.InfoHash) int {
+	seen := make(map[bittorrent.InfoHash]struct{}, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		seen[infoHash] = struct{}{}
+	}
+
+	return len(infoHashes) - len(seen)
+}
+
 func (h *sanitizationHook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
 	// We trust ourselves, do we?
+	if req.Method == "config" {
+		h.config.handleApi(req.Params, resp)
+	}
+
 	return ctx, nil
 }
 
@@ -141,6 +409,66 @@ type skipResponseHook struct{}
 // skip.
 var SkipResponseHookKey = skipResponseHook{}
 
+type authenticated struct{}
+
+// AuthenticatedKey is a key for the context of a request to mark it as sent
+// by an authenticated client.
+// It is set by authentication middleware; any non-nil value marks the request
+// as authenticated.
+var AuthenticatedKey = authenticated{}
+
+type suspectedAbuse struct{}
+
+// SuspectedAbuseKey is a key for the context of a request to mark it as sent
+// by a suspected abuser.
+// It is set by middleware detecting abuse; any non-nil value marks the
+// request as suspicious to middleware further down the chain.
+var SuspectedAbuseKey = suspectedAbuse{}
+
+type maskedIP struct{}
+
+// MaskedIPKey is the key under which to store a privacy-masked copy of the IP
+// of the announcing Peer.
+// The value is expected to be of type bittorrent.IP. Middleware that logs or
+// records IPs should use LoggableIP instead of the IP of the request, which
+// stays unmodified for the swarm.
+var MaskedIPKey = maskedIP{}
+
+// LoggableIP returns the IP stored under MaskedIPKey in ctx, or ip if none is
+// set.
+func LoggableIP(ctx context.Context, ip bittorrent.IP) bittorrent.IP {
+	if masked, ok := ctx.Value(MaskedIPKey).(bittorrent.IP); ok {
+		return masked
+	}
+	return ip
+}
+
+type torrentNames struct{}
+
+// TorrentNamesKey is the key under which to store the names of torrents for
+// an API request.
+// The value is expected to be of type map[bittorrent.InfoHash]string. Names
+// are included in the responses of the "stats" method.
+var TorrentNamesKey = torrentNames{}
+
+type bannedInfoHashes struct{}
+
+// BannedInfoHashesKey is the key under which to store the infohashes of a
+// Scrape that are explicitly disallowed by the tracker.
+// The value is expected to be of type map[bittorrent.InfoHash]struct{}. The
+// Scrapes of these infohashes are zeroed and marked as banned.
+var BannedInfoHashesKey = bannedInfoHashes{}
+
+type linkedInfoHashes struct{}
+
+// LinkedInfoHashesKey is the key under which to store the swarms of the
+// infohashes of a Scrape that are linked to another infohash, e.g. those of
+// BEP 52 hybrid torrents.
+// The value is expected to be of type
+// map[bittorrent.InfoHash]bittorrent.InfoHash. These infohashes are answered
+// with the Scrape of the swarm they map to.
+var LinkedInfoHashesKey = linkedInfoHashes{}
+
 type scrapeAddressType struct{}
 
 // ScrapeIsIPv6Key is the key under which to store whether or not the
@@ -150,8 +478,43 @@ type scrapeAddressType struct{}
 // it being set to false.
 var ScrapeIsIPv6Key = scrapeAddressType{}
 
+type peerFlagsMask struct{}
+
+// PeerFlagsMaskKey is the key under which to store the PeerFlags that the
+// Peers returned for an Announce must have.
+// The value is expected to be of type bittorrent.PeerFlags.
+// It is ignored if the PeerStore does not implement
+// storage.PeerAttributeStore.
+var PeerFlagsMaskKey = peerFlagsMask{}
+
+type injectedPeers struct{}
+
+// InjectedPeersKey is the key under which to store Peers that are returned for
+// an Announce in addition to the Peers of the swarm.
+// The value is expected to be of type []bittorrent.Peer. Only Peers of the
+// address family of the announcing Peer are returned. They are returned
+// first and count against numwant.
+var InjectedPeersKey = injectedPeers{}
+
 type responseHook struct {
-	store storage.PeerStore
+	store                storage.PeerStore
+	peersOnStopped       bool
+	maxSeedersForSeeders uint32
+	config               *runtimeConfig
+	deduplicateScrapes   bool
+	scrapeCache          *scrapeCache
+	announceCache        *announceCache
+	storeErrors          StoreErrorConfig
+	scrapeErrors         string
+	preferLongLivedPeers bool
+	excludeAnnouncer     bool
+	maxResponseSize      int
+	padder               *peerPadder
+	shuffler             *peerShuffler
+	mergeAddressFamilies bool
+	familyBreakdown      bool
+	familyFallback       *familyFallback
+	compactFallback      *compactFallback
 }
 
 func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
@@ -160,32 +523,282 @@ func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.Annou
 	}
 
 	// Add the Scrape data to the response.
-	s := h.store.ScrapeSwarm(req.InfoHash, req.IP.AddressFamily)
+	s, err := h.scrape(req.InfoHash, req.IP.AddressFamily, false, time.Time{})
+	if err != nil {
+		if h.storeErrors.FailSoft {
+			h.failSoftly(ctx, resp, err)
+			return ctx, nil
+		}
+		return ctx, err
+	}
 	resp.Incomplete = s.Incomplete
 	resp.Complete = s.Complete
 
-	err = h.appendPeers(req, resp)
-	return ctx, err
+	// Peers that stopped don't need any peers, unless configured otherwise
+	// for tools that want the last known peers of a swarm.
+	if req.Event == bittorrent.Stopped && !h.peersOnStopped {
+		return ctx, nil
+	}
+
+	// Clients explicitly requesting zero peers, e.g. because they are
+	// paused, don't get any.
+	if req.NumWant == 0 && req.NumWantSpecified {
+		return ctx, nil
+	}
+
+	mask, _ := ctx.Value(PeerFlagsMaskKey).(bittorrent.PeerFlags)
+	injected, _ := ctx.Value(InjectedPeersKey).([]bittorrent.Peer)
+	if err = h.appendPeers(ctx, req, resp, mask, injected); err != nil {
+		if h.storeErrors.FailSoft {
+			h.failSoftly(ctx, resp, err)
+			return ctx, nil
+		}
+		return ctx, err
+	}
+
+	if err = h.compactFallback.apply(ctx, req, resp); err != nil {
+		return ctx, err
+	}
+
+	h.limitSize(ctx, req, resp)
+	return ctx, nil
+}
+
+// failSoftly turns resp into a valid response without peers and with a short
+// interval after the storage failed with err.
+//
+// Failed Scrapes are handled per infohash instead, see ScrapeErrorsFail.
+func (h *responseHook) failSoftly(ctx context.Context, resp *bittorrent.AnnounceResponse, err error) {
+	log.Error("storage failed, responding without peers", log.RequestFields(ctx, log.Err(err)))
+
+	interval := h.storeErrors.Interval
+	if interval <= 0 {
+		interval = defaultStoreErrorInterval
+	}
+
+	resp.Interval = interval
+	resp.MinInterval = interval
+	resp.IPv4Peers = nil
+	resp.IPv6Peers = nil
+}
+
+// announcePeers fetches peers for req from the storage without the announcer, if
+// configured.
+//
+// Without a mask, the peers are taken from the announce cache if it is
+// enabled.
+func (h *responseHook) announcePeers(req *bittorrent.AnnounceRequest, seeding bool, numWant int, mask bittorrent.PeerFlags) ([]bittorrent.Peer, error) {
+	if h.announceCache != nil && mask == 0 {
+		return h.cachedPeers(req, seeding, numWant)
+	}
+
+	if !h.excludeAnnouncer {
+		return h.storedPeers(req, seeding, numWant, mask)
+	}
+
+	// Request one more peer, because the result may contain the announcer.
+	peers, err := h.storedPeers(req, seeding, numWant+1, mask)
+	peers = excludeAnnouncer(req.Peer, peers)
+	if len(peers) > numWant {
+		peers = peers[:numWant]
+	}
+	return peers, err
 }
 
-func (h *responseHook) appendPeers(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+// storedPeers fetches peers for req from the storage, restricted to peers with
+// all bits of mask set if the storage supports it.
+// Otherwise, long-lived peers are preferred if configured and supported.
+func (h *responseHook) storedPeers(req *bittorrent.AnnounceRequest, seeding bool, numWant int, mask bittorrent.PeerFlags) ([]bittorrent.Peer, error) {
+	if as, ok := h.store.(storage.PeerAttributeStore); ok && mask != 0 {
+		return as.AnnouncePeersWithFlags(req.InfoHash, seeding, numWant, req.Peer, mask)
+	}
+	if ss, ok := h.store.(storage.SeenCountStore); ok && h.preferLongLivedPeers {
+		return ss.AnnounceLongLivedPeers(req.InfoHash, seeding, numWant, req.Peer)
+	}
+	return h.store.AnnouncePeers(req.InfoHash, seeding, numWant, req.Peer)
+}
+
+// appendSeeders fills up the peers returned to a seeder with at most
+// maxSeedersForSeeders other seeders.
+//
+// The storage returns seeders first to peers that are not seeding, so they
+// are requested as if req was leeching.
+func (h *responseHook) appendSeeders(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer, mask bittorrent.PeerFlags) ([]bittorrent.Peer, error) {
+	free := int(req.NumWant) - len(peers)
+	if free > int(h.maxSeedersForSeeders) {
+		free = int(h.maxSeedersForSeeders)
+	}
+	if free <= 0 {
+		return peers, nil
+	}
+
+	// Request one more peer, because the result may contain the announcer.
+	candidates, err := h.announcePeers(req, false, free+1, mask)
+	if err != nil {
+		return peers, err
+	}
+
+	leechers := peers
+	for _, p := range candidates {
+		if free == 0 {
+			break
+		}
+		if p.Equal(req.Peer) || containsPeer(leechers, p) {
+			continue
+		}
+
+		peers = append(peers, p)
+		free--
+	}
+
+	return peers, nil
+}
+
+// shufflePeers shuffles peers in place.
+//
+// The shuffle is seeded per request from the request and the current time, so
+// the order differs between clients and between announces of the same client.
+func shufflePeers(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) {
+	s0, s1 := random.DeriveEntropyFromRequest(req)
+	s0 ^= uint64(time.Now().UnixNano())
+
+	var j int
+	for i := len(peers) - 1; i > 0; i-- {
+		j, s0, s1 = random.Intn(s0, s1, i+1)
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+}
+
+// containsPeer reports whether peers contains p.
+func containsPeer(peers []bittorrent.Peer, p bittorrent.Peer) bool {
+	for _, peer := range peers {
+		if peer.Equal(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludeAnnouncer removes the peers with the peer ID or the endpoint of
+// announcer from peers.
+func excludeAnnouncer(announcer bittorrent.Peer, peers []bittorrent.Peer) []bittorrent.Peer {
+	filtered := peers[:0]
+	for _, p := range peers {
+		if p.ID == announcer.ID || p.EqualEndpoint(announcer) {
+			continue
+		}
+		filtered = append(filtered, p)
+	}
+	return filtered
+}
+
+// injectPeers prepends the injected Peers of the address family of req to
+// peers and limits the result to numwant Peers.
+//
+// Injected Peers usually don't know the ID of the client at their endpoint,
+// so the announcer and duplicates are skipped by their endpoint.
+func injectPeers(req *bittorrent.AnnounceRequest, peers, injected []bittorrent.Peer) []bittorrent.Peer {
+	var result []bittorrent.Peer
+	for _, p := range injected {
+		if p.IP.AddressFamily != req.IP.AddressFamily || p.EqualEndpoint(req.Peer) || containsEndpoint(result, p) {
+			continue
+		}
+		result = append(result, p)
+	}
+	if len(result) == 0 {
+		return peers
+	}
+
+	for _, p := range peers {
+		if !containsEndpoint(result, p) {
+			result = append(result, p)
+		}
+	}
+
+	if len(result) > int(req.NumWant) {
+		result = result[:req.NumWant]
+	}
+
+	return result
+}
+
+// containsEndpoint reports whether peers contains a Peer with the endpoint of
+// p.
+func containsEndpoint(peers []bittorrent.Peer, p bittorrent.Peer) bool {
+	for _, peer := range peers {
+		if peer.EqualEndpoint(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, mask bittorrent.PeerFlags, injected []bittorrent.Peer) error {
 	seeding := req.Left == 0
-	peers, err := h.store.AnnouncePeers(req.InfoHash, seeding, int(req.NumWant), req.Peer)
+
+	peers, err := h.announcePeers(req, seeding, int(req.NumWant), mask)
 	if err != nil && err != storage.ErrResourceDoesNotExist {
 		return err
 	}
 
+	// Seeders receive leechers first. If configured, the remaining slots
+	// are filled with some seeders, e.g. for clients relying on PEX.
+	if seeding && h.maxSeedersForSeeders > 0 && err == nil {
+		peers, err = h.appendSeeders(req, peers, mask)
+		if err != nil && err != storage.ErrResourceDoesNotExist {
+			return err
+		}
+	}
+
+	// The order of the peers reflects the iteration order of the storage,
+	// which would make many clients connect to the same peers first.
+	h.shuffler.shuffle(req, peers)
+
+	peers = injectPeers(req, peers, injected)
+
+	// If configured, dual-stack clients receive peers of both address
+	// families.
+	peers, others, err := h.splitDualStack(ctx, req, peers, mask)
+	if err != nil {
+		return err
+	}
+
+	// If configured, clients learn about the peers of the other address
+	// family if there are none of theirs.
+	if len(peers) == 0 && len(others) == 0 && req.Event != bittorrent.Stopped {
+		if err := h.fallBack(ctx, req, resp, mask); err != nil {
+			return err
+		}
+	}
+
 	// Some clients expect a minimum of their own peer representation returned to
 	// them if they are the only peer in a swarm.
-	if len(peers) == 0 {
+	// Peers that stopped have already been removed from the swarm.
+	if len(peers) == 0 && req.Event != bittorrent.Stopped {
 		peers = append(peers, req.Peer)
 	}
 
+	// If configured, small swarms are hidden by padding to numwant. The
+	// peers of the other address family take their share of it.
+	padReq := req
+	if len(others) > 0 {
+		r := *req
+		r.NumWant -= uint32(len(others))
+		padReq = &r
+	}
+	peers = h.padder.pad(ctx, padReq, peers)
+
 	switch req.IP.AddressFamily {
 	case bittorrent.IPv4:
 		resp.IPv4Peers = peers
+		if len(others) > 0 {
+			resp.IPv6Peers = others
+		}
 	case bittorrent.IPv6:
 		resp.IPv6Peers = peers
+		if len(others) > 0 {
+			resp.IPv4Peers = others
+		}
 	default:
 		panic("attempted to append peer that is neither IPv4 nor IPv6")
 	}
@@ -198,13 +811,343 @@ func (h *responseHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeR
 		return ctx, nil
 	}
 
+	banned, _ := ctx.Value(BannedInfoHashesKey).(map[bittorrent.InfoHash]struct{})
+	linked, _ := ctx.Value(LinkedInfoHashesKey).(map[bittorrent.InfoHash]bittorrent.InfoHash)
+
+	// Repeated infohashes are answered with the same Scrape instead of
+	// looking them up again, if configured.
+	var scraped map[bittorrent.InfoHash]bittorrent.Scrape
+	if h.deduplicateScrapes {
+		scraped = make(map[bittorrent.InfoHash]bittorrent.Scrape, len(req.InfoHashes))
+	}
+
+	// Under load, Scrapes are answered from the cache if configured.
+	cached := h.scrapeCache.active()
+	now := time.Now()
+
 	for _, infoHash := range req.InfoHashes {
-		resp.Files = append(resp.Files, h.store.ScrapeSwarm(infoHash, req.AddressFamily))
+		if _, ok := banned[infoHash]; ok {
+			resp.Files = append(resp.Files, bittorrent.Scrape{InfoHash: infoHash, Banned: true})
+			continue
+		}
+		if scrape, ok := scraped[infoHash]; ok {
+			resp.Files = append(resp.Files, scrape)
+			continue
+		}
+
+		swarm := infoHash
+		if linkedSwarm, ok := linked[infoHash]; ok {
+			swarm = linkedSwarm
+		}
+		scrape, err := h.scrape(swarm, req.AddressFamily, cached, now)
+		if err != nil {
+			PromScrapeFailuresTotal.Inc()
+			switch h.scrapeErrors {
+			case ScrapeErrorsOmit:
+				if scheme, _ := bittorrent.Scheme(ctx); scheme != bittorrent.SchemeUDP {
+					continue
+				}
+				scrape = bittorrent.Scrape{}
+			case ScrapeErrorsMark:
+				scrape = bittorrent.Scrape{Failed: true}
+			default:
+				return ctx, err
+			}
+		}
+		scrape.InfoHash = infoHash
+		if scraped != nil {
+			scraped[infoHash] = scrape
+		}
+		resp.Files = append(resp.Files, scrape)
+	}
+
+	if maxScrapeFiles := h.config.load().MaxScrapeFiles; maxScrapeFiles > 0 && len(resp.Files) > int(maxScrapeFiles) {
+		PromScrapeFilesTruncatedTotal.Add(float64(len(resp.Files) - int(maxScrapeFiles)))
+		resp.Files = resp.Files[:maxScrapeFiles]
 	}
 
 	return ctx, nil
 }
 
+// scrape returns the Scrape of the swarm identified by infoHash in the given
+// address family, or in both combined if configured. If cached is set, the
+// Scrapes are read from the cache.
+//
+// If the combined Scrape fails for either address family, it fails.
+func (h *responseHook) scrape(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily, cached bool, now time.Time) (bittorrent.Scrape, error) {
+	scrapeFamily := func(af bittorrent.AddressFamily) (bittorrent.Scrape, error) {
+		if cached {
+			return h.scrapeCache.scrape(h.store, infoHash, af, now)
+		}
+		return scrapeSwarm(h.store, infoHash, af)
+	}
+
+	if !h.mergeAddressFamilies {
+		return scrapeFamily(af)
+	}
+
+	v4, err := scrapeFamily(bittorrent.IPv4)
+	if err != nil {
+		return bittorrent.Scrape{}, err
+	}
+	v6, err := scrapeFamily(bittorrent.IPv6)
+	if err != nil {
+		return bittorrent.Scrape{}, err
+	}
+	merged := bittorrent.Scrape{
+		InfoHash:   infoHash,
+		Snatches:   v4.Snatches + v6.Snatches,
+		Complete:   v4.Complete + v6.Complete,
+		Incomplete: v4.Incomplete + v6.Incomplete,
+	}
+	if h.familyBreakdown {
+		merged.Breakdown = []bittorrent.Scrape{bittorrent.IPv4: v4, bittorrent.IPv6: v6}
+	}
+
+	return merged, nil
+}
+
+// scrapeSwarm scrapes the swarm identified by infoHash in store, reporting
+// errors if store implements storage.FallibleScrapeStore.
+func scrapeSwarm(store storage.PeerStore, infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) (bittorrent.Scrape, error) {
+	if fs, ok := store.(storage.FallibleScrapeStore); ok {
+		return fs.TryScrapeSwarm(infoHash, af)
+	}
+	return store.ScrapeSwarm(infoHash, af), nil
+}
+
 func (h *responseHook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	if ctx.Value(SkipResponseHookKey) != nil {
+		return ctx, nil
+	}
+
+	switch req.Method {
+	case "peer-status":
+		for _, infoHash := range req.InfoHashes {
+			resp.Files = append(resp.Files, h.peerStatus(infoHash, req.Params))
+		}
+	case "stats":
+		names, _ := ctx.Value(TorrentNamesKey).(map[bittorrent.InfoHash]string)
+		var clients string
+		if req.Params != nil {
+			clients, _ = req.Params.String("clients")
+		}
+		if pc, ok := h.store.(storage.PeerCountStore); ok && resp.Response == "" {
+			resp.Response = peerCounts(pc)
+		}
+		if ps, ok := h.store.(storage.PeerOriginStore); ok {
+			if origins := originCounts(ps); origins != "" {
+				resp.Response = strings.TrimPrefix(resp.Response+" "+origins, " ")
+			}
+		}
+		for _, infoHash := range req.InfoHashes {
+			api := h.stats(infoHash, names)
+			if clients != "" && clients != "0" {
+				h.appendClientStats(&api)
+			}
+			resp.Files = append(resp.Files, api)
+		}
+	case "shards":
+		ss, ok := h.store.(storage.ShardStatsStore)
+		if !ok {
+			resp.Error = 1
+			resp.Response = "shard stats not supported by storage"
+			break
+		}
+		top := defaultShardStatsTop
+		if req.Params != nil {
+			if v, ok := req.Params.String("top"); ok {
+				if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+					top = n
+				}
+			}
+		}
+		resp.Response = shardStats(ss.ShardStats(), top)
+	}
+
 	return ctx, nil
 }
+
+// defaultShardStatsTop is the number of shards listed by the "shards" api
+// method if the top parameter is missing.
+const defaultShardStatsTop = 10
+
+// shardStats describes the load of the shards of the storage and lists the top
+// shards with the most peers, e.g. shards=4 max_peers=10 mean_peers=3
+// hot=2:ipv4:1/8/2:12ms/40,0:ipv4:2/1/1:1ms/3, where every hot shard is
+// described by its index, address family, numbers of swarms, seeders and
+// leechers, the time announces and scrapes waited for its lock and the number
+// of times they locked it.
+func shardStats(stats []storage.ShardStats, top int) string {
+	if len(stats) == 0 {
+		return "shards=0"
+	}
+
+	var total, max uint64
+	indices := make([]int, len(stats))
+	for i, s := range stats {
+		indices[i] = i
+		peers := s.Seeders + s.Leechers
+		total += peers
+		if peers > max {
+			max = peers
+		}
+	}
+
+	sort.SliceStable(indices, func(i, j int) bool {
+		a, b := stats[indices[i]], stats[indices[j]]
+		if pa, pb := a.Seeders+a.Leechers, b.Seeders+b.Leechers; pa != pb {
+			return pa > pb
+		}
+		return a.LockWait > b.LockWait
+	})
+	if top < len(indices) {
+		indices = indices[:top]
+	}
+
+	hot := make([]string, 0, len(indices))
+	for _, i := range indices {
+		s := stats[i]
+		af := "ipv4"
+		if s.AddressFamily == bittorrent.IPv6 {
+			af = "ipv6"
+		}
+		hot = append(hot, fmt.Sprintf("%d:%s:%d/%d/%d:%s/%d", i, af, s.Swarms, s.Seeders, s.Leechers, s.LockWait.Truncate(time.Millisecond), s.Locks))
+	}
+
+	return fmt.Sprintf("shards=%d max_peers=%d mean_peers=%d hot=%s", len(stats), max, total/uint64(len(stats)), strings.Join(hot, ","))
+}
+
+// stats describes the swarm identified by infoHash across both address
+// families, including the counts per address family if configured and its
+// name if known.
+func (h *responseHook) stats(infoHash bittorrent.InfoHash, names map[bittorrent.InfoHash]string) bittorrent.Api {
+	v4 := h.store.ScrapeSwarm(infoHash, bittorrent.IPv4)
+	v6 := h.store.ScrapeSwarm(infoHash, bittorrent.IPv6)
+
+	response := fmt.Sprintf("complete=%d incomplete=%d", v4.Complete+v6.Complete, v4.Incomplete+v6.Incomplete)
+	if h.familyBreakdown {
+		response += fmt.Sprintf(" ipv4_complete=%d ipv4_incomplete=%d ipv6_complete=%d ipv6_incomplete=%d", v4.Complete, v4.Incomplete, v6.Complete, v6.Incomplete)
+	}
+	if name, ok := names[infoHash]; ok {
+		response += fmt.Sprintf(" name=%q", name)
+	}
+
+	return bittorrent.Api{InfoHash: infoHash, Response: response}
+}
+
+// peerCounts describes the total numbers of peers per address family, e.g.
+// ipv4_seeders=10 ipv4_leechers=5 ipv6_seeders=2 ipv6_leechers=1.
+func peerCounts(pc storage.PeerCountStore) string {
+	v4 := pc.PeerCounts(bittorrent.IPv4)
+	v6 := pc.PeerCounts(bittorrent.IPv6)
+
+	return fmt.Sprintf("ipv4_seeders=%d ipv4_leechers=%d ipv6_seeders=%d ipv6_leechers=%d", v4.Seeders, v4.Leechers, v6.Seeders, v6.Leechers)
+}
+
+// originCounts describes the total numbers of peers per origin, e.g.
+// origins=http:10/5,udp:2/1, if the storage stores origins.
+func originCounts(ps storage.PeerOriginStore) string {
+	counts := ps.PeerOriginCounts()
+	if len(counts) == 0 {
+		return ""
+	}
+
+	origins := make([]string, 0, len(counts))
+	for origin, c := range counts {
+		origins = append(origins, fmt.Sprintf("%s:%d/%d", origin, c.Seeders, c.Leechers))
+	}
+	sort.Strings(origins)
+
+	return "origins=" + strings.Join(origins, ",")
+}
+
+// appendClientStats adds the numbers of seeders and leechers per client
+// software to the stats of a swarm, e.g. clients="TR2940":2/1,"qB4250":0/1.
+//
+// This iterates the peers of the swarm and is therefore only done if requested
+// via the clients parameter.
+func (h *responseHook) appendClientStats(api *bittorrent.Api) {
+	cs, ok := h.store.(storage.ClientStatsStore)
+	if !ok {
+		api.Error = 1
+		api.Response = "client stats not supported by storage"
+		return
+	}
+
+	stats, err := cs.ClientStats(api.InfoHash)
+	if err != nil && err != storage.ErrResourceDoesNotExist {
+		api.Error = 1
+		api.Response = err.Error()
+		return
+	}
+
+	clients := make([]string, 0, len(stats))
+	for cid, counts := range stats {
+		clients = append(clients, fmt.Sprintf("%q:%d/%d", string(cid[:]), counts.Seeders, counts.Leechers))
+	}
+	sort.Strings(clients)
+
+	api.Response += " clients=" + strings.Join(clients, ",")
+}
+
+// peerStatus describes the state of the peer identified by the peer_id
+// parameter in the swarm identified by infoHash.
+func (h *responseHook) peerStatus(infoHash bittorrent.InfoHash, params bittorrent.Params) bittorrent.Api {
+	api := bittorrent.Api{InfoHash: infoHash, Error: 1}
+
+	is, ok := h.store.(storage.PeerInfoStore)
+	if !ok {
+		api.Response = "peer-status not supported by storage"
+		return api
+	}
+
+	var peerID string
+	if params != nil {
+		peerID, _ = params.String("peer_id")
+	}
+	if len(peerID) != 20 {
+		api.Response = "invalid peer_id"
+		return api
+	}
+
+	infos, err := is.PeerInfo(infoHash, bittorrent.PeerIDFromString(peerID))
+	if err == storage.ErrResourceDoesNotExist {
+		api.Response = "peer not found"
+		return api
+	} else if err != nil {
+		api.Response = err.Error()
+		return api
+	}
+
+	statuses := make([]string, 0, len(infos))
+	for _, info := range infos {
+		role := "leecher"
+		if info.Seeder {
+			role = "seeder"
+		}
+
+		status := fmt.Sprintf("%s %s last_seen=%s ttl=%s flags=%d seen=%d",
+			role,
+			net.JoinHostPort(info.Peer.IP.String(), strconv.Itoa(int(info.Peer.Port))),
+			info.LastSeen.UTC().Format(time.RFC3339),
+			info.TTL.Truncate(time.Second),
+			info.Flags,
+			info.SeenCount,
+		)
+		if info.Origin != "" {
+			status += " origin=" + info.Origin
+		}
+		if info.SourceIP.IP != nil {
+			status += " source=" + info.SourceIP.String()
+		}
+		if info.Uploaded != 0 || info.Downloaded != 0 {
+			status += fmt.Sprintf(" uploaded=%d downloaded=%d", info.Uploaded, info.Downloaded)
+		}
+		statuses = append(statuses, status)
+	}
+
+	api.Error = 0
+	api.Response = strings.Join(statuses, "; ")
+	return api
+}
@@ -0,0 +1,1705 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func TestSwarmInteractionAttributes(t *testing.T) {
+	h := &swarmInteractionHook{ttl: PeerTTLConfig{
+		Started: time.Minute,
+		Leecher: 2 * time.Minute,
+		Seeder:  3 * time.Minute,
+	}}
+
+	var table = []struct {
+		event    bittorrent.Event
+		left     uint64
+		expected time.Duration
+	}{
+		{bittorrent.Started, 10, time.Minute},
+		{bittorrent.None, 10, 2 * time.Minute},
+		{bittorrent.Started, 0, 3 * time.Minute},
+		{bittorrent.Completed, 0, 3 * time.Minute},
+		{bittorrent.Completed, 10, 2 * time.Minute},
+		{bittorrent.None, 0, 3 * time.Minute},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{Event: tt.event, Left: tt.left, Flags: bittorrent.PeerFlagCrypto}
+		attrs := h.attributes(context.Background(), req)
+		require.Equal(t, tt.expected, attrs.TTL)
+		require.Equal(t, bittorrent.PeerFlagCrypto, attrs.Flags)
+	}
+
+	// Started falls back to Leecher.
+	h.ttl.Started = 0
+	attrs := h.attributes(context.Background(), &bittorrent.AnnounceRequest{Event: bittorrent.Started, Left: 10})
+	require.Equal(t, 2*time.Minute, attrs.TTL)
+
+	// The scheme of the frontend is the origin.
+	ctx := context.WithValue(context.Background(), bittorrent.SchemeKey, bittorrent.SchemeUDP)
+	attrs = h.attributes(ctx, &bittorrent.AnnounceRequest{Left: 10})
+	require.Equal(t, bittorrent.SchemeUDP, attrs.Origin)
+
+	// The address of the connection is the source if it differs.
+	peerIP := bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4}
+	proxyIP := bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}
+	ctx = context.WithValue(context.Background(), frontend.RemoteIPKey, proxyIP)
+	attrs = h.attributes(ctx, &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{IP: peerIP}})
+	require.Equal(t, proxyIP, attrs.SourceIP)
+	ctx = context.WithValue(context.Background(), frontend.RemoteIPKey, peerIP)
+	attrs = h.attributes(ctx, &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{IP: peerIP}})
+	require.Nil(t, attrs.SourceIP.IP)
+
+	// The reported totals are passed on.
+	attrs = h.attributes(context.Background(), &bittorrent.AnnounceRequest{Left: 10, Uploaded: 1, Downloaded: 2})
+	require.Equal(t, uint64(1), attrs.Uploaded)
+	require.Equal(t, uint64(2), attrs.Downloaded)
+
+	// Overrides replace the TTL of all roles.
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	h.ttlOverrides = parsePeerTTLOverrides(map[string]time.Duration{
+		"3030303030303030303030303030303030303031": 5 * time.Second,
+		"nonsense": time.Hour,
+	})
+	require.Equal(t, 1, len(h.ttlOverrides))
+	for _, left := range []uint64{0, 10} {
+		attrs = h.attributes(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih, Left: left})
+		require.Equal(t, 5*time.Second, attrs.TTL)
+	}
+	attrs = h.attributes(context.Background(), &bittorrent.AnnounceRequest{Left: 0})
+	require.Equal(t, 3*time.Minute, attrs.TTL)
+}
+
+func TestSwarmInteractionEvents(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+
+	type announce struct {
+		event bittorrent.Event
+		left  uint64
+	}
+
+	var table = []struct {
+		name      string
+		announces []announce
+		seeders   uint32
+		leechers  uint32
+	}{
+		{"stopped first", []announce{{bittorrent.Stopped, 10}}, 0, 0},
+		{"stopped seeder", []announce{{bittorrent.Started, 0}, {bittorrent.Stopped, 10}}, 0, 0},
+		{"started seeder", []announce{{bittorrent.Started, 0}}, 1, 0},
+		{"completed", []announce{{bittorrent.Started, 10}, {bittorrent.Completed, 0}}, 1, 0},
+		{"completed first", []announce{{bittorrent.Completed, 0}}, 1, 0},
+		{"completed with left", []announce{{bittorrent.Started, 10}, {bittorrent.Completed, 5}}, 0, 1},
+		{"completed with left first", []announce{{bittorrent.Completed, 5}}, 0, 1},
+		{"completed twice", []announce{{bittorrent.Completed, 0}, {bittorrent.Completed, 0}}, 1, 0},
+		// The seeder entry is only removed by stopped or expiry.
+		{"left grows", []announce{{bittorrent.Started, 0}, {bittorrent.None, 10}}, 1, 1},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := memory.New(memory.Config{})
+			require.Nil(t, err)
+			defer func() { <-ps.Stop() }()
+
+			h := &swarmInteractionHook{store: ps}
+			for _, a := range tt.announces {
+				req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: a.event, Left: a.left, Peer: peer}
+				_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+				require.Nil(t, err)
+			}
+
+			scrape := ps.ScrapeSwarm(ih, bittorrent.IPv4)
+			require.Equal(t, tt.seeders, scrape.Complete)
+			require.Equal(t, tt.leechers, scrape.Incomplete)
+		})
+	}
+}
+
+// transitions returns the current value of the swarm transition counter of
+// transition for af.
+func transitions(t *testing.T, transition, af string) float64 {
+	var m dto.Metric
+	require.Nil(t, PromSwarmTransitionsTotal.WithLabelValues(transition, af).Write(&m))
+	return m.GetCounter().GetValue()
+}
+
+func TestSwarmTransitions(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v4 := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	v6 := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000002"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6},
+	}
+
+	type delta struct {
+		transition string
+		af         string
+	}
+
+	var table = []struct {
+		event    bittorrent.Event
+		left     uint64
+		peer     bittorrent.Peer
+		expected []delta
+	}{
+		{bittorrent.Started, 10, v4, []delta{{transitionNewLeecher, "IPv4"}}},
+		// Regular announces are no transitions.
+		{bittorrent.None, 10, v4, nil},
+		{bittorrent.Completed, 0, v4, []delta{{transitionGraduation, "IPv4"}}},
+		{bittorrent.None, 0, v4, nil},
+		{bittorrent.Stopped, 0, v4, []delta{{transitionStopped, "IPv4"}}},
+		// Stopping an unknown peer is no transition.
+		{bittorrent.Stopped, 0, v4, nil},
+		{bittorrent.Started, 0, v6, []delta{{transitionNewSeeder, "IPv6"}}},
+	}
+
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+	h := &swarmInteractionHook{store: ps}
+
+	all := []string{transitionNewLeecher, transitionNewSeeder, transitionGraduation, transitionStopped}
+	for _, tt := range table {
+		before := make(map[delta]float64)
+		for _, transition := range all {
+			for _, af := range []string{"IPv4", "IPv6"} {
+				before[delta{transition, af}] = transitions(t, transition, af)
+			}
+		}
+
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: tt.event, Left: tt.left, Peer: tt.peer}
+		_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+
+		for d, value := range before {
+			expected := value
+			for _, e := range tt.expected {
+				if e == d {
+					expected++
+				}
+			}
+			require.Equal(t, expected, transitions(t, d.transition, d.af))
+		}
+	}
+}
+
+func TestSanitizeNumWantOverrides(t *testing.T) {
+	big := bittorrent.InfoHashFromString("00000000000000000001")
+	small := bittorrent.InfoHashFromString("00000000000000000002")
+	other := bittorrent.InfoHashFromString("00000000000000000003")
+
+	h := &sanitizationHook{
+		config: newRuntimeConfig(RuntimeConfig{MaxNumWant: 50, DefaultNumWant: 25}),
+		numWantOverrides: parseNumWantOverrides(map[string]uint32{
+			"3030303030303030303030303030303030303031": 200,
+			"3030303030303030303030303030303030303032": 10,
+			"invalid": 1,
+		}),
+	}
+	require.Equal(t, 2, len(h.numWantOverrides))
+
+	var table = []struct {
+		infoHash  bittorrent.InfoHash
+		numWant   uint32
+		specified bool
+		expected  uint32
+	}{
+		{big, 0, false, 200},
+		{big, 100, true, 100},
+		{big, 500, true, 200},
+		{small, 0, false, 10},
+		{small, 50, true, 10},
+		{other, 0, false, 25},
+		{other, 100, true, 50},
+
+		// An explicit zero is kept.
+		{big, 0, true, 0},
+		{other, 0, true, 0},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash:         tt.infoHash,
+			NumWant:          tt.numWant,
+			NumWantSpecified: tt.specified,
+			Peer:             bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("1.2.3.4")}},
+		}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, req.NumWant)
+	}
+}
+
+func TestSanitizeTransferAmounts(t *testing.T) {
+	h := &sanitizationHook{}
+
+	var table = []struct {
+		uploaded   uint64
+		downloaded uint64
+		left       uint64
+		err        error
+	}{
+		{0, 0, 0, nil},
+		{1 << 40, 1 << 40, math.MaxInt64, nil},
+		{math.MaxUint64, 0, 0, ErrInvalidTransferAmount},
+		{0, math.MaxUint64, 0, ErrInvalidTransferAmount},
+		{0, 0, math.MaxUint64, ErrInvalidTransferAmount},
+
+		// A negative int64 sent via UDP.
+		{0, 0, math.MaxInt64 + 1, ErrInvalidTransferAmount},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{
+			Uploaded:   tt.uploaded,
+			Downloaded: tt.downloaded,
+			Left:       tt.left,
+			Peer:       bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("1.2.3.4")}},
+		}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.err, err)
+	}
+}
+
+func TestSanitizeScrapeInfoHashes(t *testing.T) {
+	h := &sanitizationHook{config: newRuntimeConfig(RuntimeConfig{MaxScrapeInfoHashes: 2, RejectScrapeInfoHashes: 3})}
+
+	var table = []struct {
+		count    int
+		expected int
+		err      error
+	}{
+		{1, 1, nil},
+		{2, 2, nil},
+		{3, 2, nil},
+		{4, 4, ErrTooManyInfoHashes},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.ScrapeRequest{InfoHashes: make([]bittorrent.InfoHash, tt.count)}
+		_, err := h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+		require.Equal(t, tt.err, err)
+		require.Equal(t, tt.expected, len(req.InfoHashes))
+	}
+}
+
+func TestSanitizeScrapeDuplicates(t *testing.T) {
+	h := &sanitizationHook{
+		config:                 newRuntimeConfig(RuntimeConfig{MaxScrapeInfoHashes: 10, RejectScrapeInfoHashes: 10}),
+		rejectScrapeDuplicates: 1,
+	}
+
+	ih1 := bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000002")
+
+	var table = []struct {
+		infoHashes []bittorrent.InfoHash
+		err        error
+	}{
+		{[]bittorrent.InfoHash{ih1, ih2}, nil},
+		{[]bittorrent.InfoHash{ih1, ih2, ih1}, nil},
+		{[]bittorrent.InfoHash{ih1, ih2, ih1, ih2}, ErrTooManyDuplicateInfoHashes},
+		{[]bittorrent.InfoHash{ih1, ih1, ih1}, ErrTooManyDuplicateInfoHashes},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.ScrapeRequest{InfoHashes: tt.infoHashes}
+		_, err := h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+		require.Equal(t, tt.err, err)
+	}
+}
+
+// scrapeCountingStore counts the calls of ScrapeSwarm.
+type scrapeCountingStore struct {
+	storage.PeerStore
+	scrapes int
+}
+
+func (s *scrapeCountingStore) ScrapeSwarm(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) bittorrent.Scrape {
+	s.scrapes++
+	return s.PeerStore.ScrapeSwarm(infoHash, af)
+}
+
+func TestDeduplicateScrapes(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih1 := bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000002")
+	require.Nil(t, ps.PutSeeder(ih1, bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}))
+
+	for _, deduplicate := range []bool{false, true} {
+		store := &scrapeCountingStore{PeerStore: ps}
+		h := &responseHook{store: store, deduplicateScrapes: deduplicate}
+		req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih1, ih2, ih1}}
+		resp := &bittorrent.ScrapeResponse{}
+		_, err = h.HandleScrape(context.Background(), req, resp)
+		require.Nil(t, err)
+
+		// The order of the response is preserved either way.
+		require.Equal(t, []bittorrent.Scrape{
+			{InfoHash: ih1, Complete: 1},
+			{InfoHash: ih2},
+			{InfoHash: ih1, Complete: 1},
+		}, resp.Files)
+		if deduplicate {
+			require.Equal(t, 2, store.scrapes)
+		} else {
+			require.Equal(t, 3, store.scrapes)
+		}
+	}
+}
+
+func TestScrapeCache(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih1 := bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000002")
+	ih3 := bittorrent.InfoHashFromString("00000000000000000003")
+
+	level := 0.0
+	cache := newScrapeCache(ScrapeCacheConfig{Size: 2, Threshold: 0.5, MaxStaleness: time.Hour})
+	cache.level = func() float64 { return level }
+
+	store := &scrapeCountingStore{PeerStore: ps}
+	h := &responseHook{store: store, scrapeCache: cache}
+	scrape := func(ihs ...bittorrent.InfoHash) {
+		_, err := h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: ihs}, &bittorrent.ScrapeResponse{})
+		require.Nil(t, err)
+	}
+
+	// Below the threshold the cache is bypassed.
+	scrape(ih1, ih1)
+	require.Equal(t, 2, store.scrapes)
+	require.Equal(t, 0, cache.lru.Len())
+
+	// Above the threshold repeated scrapes are answered from the cache.
+	level = 0.9
+	scrape(ih1, ih1, ih2)
+	require.Equal(t, 4, store.scrapes)
+
+	// ih3 evicts the least recently used ih1.
+	scrape(ih2, ih3, ih1)
+	require.Equal(t, 6, store.scrapes)
+	require.Equal(t, 2, cache.lru.Len())
+
+	// Stale entries are refreshed.
+	cache.maxStaleness = -time.Nanosecond
+	scrape(ih1)
+	require.Equal(t, 7, store.scrapes)
+}
+
+// failingStore fails all calls of AnnouncePeers.
+type failingStore struct {
+	storage.PeerStore
+}
+
+var errStoreFailed = errors.New("storage failed")
+
+func (s failingStore) AnnouncePeers(infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return nil, errStoreFailed
+}
+
+func TestStoreErrors(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	req := &bittorrent.AnnounceRequest{InfoHash: bittorrent.InfoHashFromString("00000000000000000001"), Left: 10, NumWant: 50, Peer: peer}
+
+	h := &responseHook{store: failingStore{ps}}
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{Interval: time.Hour})
+	require.Equal(t, errStoreFailed, err)
+
+	h.storeErrors = StoreErrorConfig{FailSoft: true}
+	resp := &bittorrent.AnnounceResponse{Interval: time.Hour, MinInterval: time.Hour}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, defaultStoreErrorInterval, resp.Interval)
+	require.Equal(t, defaultStoreErrorInterval, resp.MinInterval)
+	require.Nil(t, resp.IPv4Peers)
+}
+
+// failingScrapeStore fails the Scrapes of one infohash.
+type failingScrapeStore struct {
+	storage.PeerStore
+	failing bittorrent.InfoHash
+}
+
+func (s failingScrapeStore) TryScrapeSwarm(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) (bittorrent.Scrape, error) {
+	if infoHash == s.failing {
+		return bittorrent.Scrape{}, errStoreFailed
+	}
+	return s.ScrapeSwarm(infoHash, af), nil
+}
+
+func TestScrapeErrors(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	healthy := bittorrent.InfoHashFromString("00000000000000000001")
+	failing := bittorrent.InfoHashFromString("00000000000000000002")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Nil(t, ps.PutSeeder(healthy, peer))
+
+	scrape := func(mode, scheme string) ([]bittorrent.Scrape, error) {
+		h := &responseHook{store: failingScrapeStore{ps, failing}, scrapeErrors: StoreErrorConfig{Scrapes: mode}.scrapeErrors()}
+		ctx := context.WithValue(context.Background(), bittorrent.SchemeKey, scheme)
+		resp := &bittorrent.ScrapeResponse{}
+		_, err := h.HandleScrape(ctx, &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{failing, healthy}}, resp)
+		return resp.Files, err
+	}
+
+	_, err = scrape("", bittorrent.SchemeHTTP)
+	require.Equal(t, errStoreFailed, err)
+
+	files, err := scrape(ScrapeErrorsOmit, bittorrent.SchemeHTTP)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Scrape{{InfoHash: healthy, Complete: 1}}, files)
+
+	// UDP responses keep the position of failed infohashes.
+	files, err = scrape(ScrapeErrorsOmit, bittorrent.SchemeUDP)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Scrape{{InfoHash: failing}, {InfoHash: healthy, Complete: 1}}, files)
+
+	files, err = scrape(ScrapeErrorsMark, bittorrent.SchemeHTTP)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Scrape{{InfoHash: failing, Failed: true}, {InfoHash: healthy, Complete: 1}}, files)
+}
+
+func TestPeerStatus(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Nil(t, ps.PutSeeder(ih, peer))
+
+	h := &responseHook{store: ps}
+
+	var table = []struct {
+		peerID   string
+		err      int
+		response string
+	}{
+		{"-TR2940-000000000001", 0, "seeder 1.2.3.4:6881"},
+		{"-TR2940-000000000002", 1, "peer not found"},
+		{"short", 1, "invalid peer_id"},
+	}
+
+	for _, tt := range table {
+		params, err := bittorrent.ParseURLData("/api?peer_id=" + tt.peerID)
+		require.Nil(t, err)
+
+		req := &bittorrent.ApiRequest{InfoHashes: []bittorrent.InfoHash{ih}, Method: "peer-status", Params: params}
+		resp := &bittorrent.ApiResponse{}
+		_, err = h.HandleApi(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(resp.Files))
+		require.Equal(t, tt.err, resp.Files[0].Error)
+		require.True(t, strings.HasPrefix(resp.Files[0].Response, tt.response), resp.Files[0].Response)
+	}
+}
+
+func TestStatsClients(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(id string, n byte) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(id),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, 3, n).To4(), AddressFamily: bittorrent.IPv4},
+		}
+	}
+	require.Nil(t, ps.PutSeeder(ih, peer("-TR2940-000000000001", 1)))
+	require.Nil(t, ps.PutSeeder(ih, peer("-TR2940-000000000002", 2)))
+	require.Nil(t, ps.PutLeecher(ih, peer("-TR2940-000000000003", 3)))
+	require.Nil(t, ps.PutLeecher(ih, peer("-qB4250-000000000004", 4)))
+
+	h := &responseHook{store: ps}
+	unknown := bittorrent.InfoHashFromString("00000000000000000002")
+
+	var table = []struct {
+		query    string
+		infoHash bittorrent.InfoHash
+		response string
+	}{
+		{"", ih, "complete=2 incomplete=2"},
+		{"clients=0", ih, "complete=2 incomplete=2"},
+		{"clients=1", ih, `complete=2 incomplete=2 clients="TR2940":2/1,"qB4250":0/1`},
+		{"clients=1", unknown, "complete=0 incomplete=0 clients="},
+	}
+
+	for _, tt := range table {
+		params, err := bittorrent.ParseURLData("/api?" + tt.query)
+		require.Nil(t, err)
+
+		req := &bittorrent.ApiRequest{InfoHashes: []bittorrent.InfoHash{tt.infoHash}, Method: "stats", Params: params}
+		resp := &bittorrent.ApiResponse{}
+		_, err = h.HandleApi(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(resp.Files))
+		require.Equal(t, 0, resp.Files[0].Error)
+		require.Equal(t, tt.response, resp.Files[0].Response)
+		require.Equal(t, "ipv4_seeders=2 ipv4_leechers=2 ipv6_seeders=0 ipv6_leechers=0", resp.Response)
+	}
+}
+
+func TestScrapeBanned(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	bannedIH := bittorrent.InfoHashFromString("00000000000000000002")
+	for _, infoHash := range []bittorrent.InfoHash{ih, bannedIH} {
+		require.Nil(t, ps.PutSeeder(infoHash, bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+		}))
+	}
+
+	h := &responseHook{store: ps}
+	ctx := context.WithValue(context.Background(), BannedInfoHashesKey, map[bittorrent.InfoHash]struct{}{bannedIH: {}})
+	req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih, bannedIH}}
+	resp := &bittorrent.ScrapeResponse{}
+	_, err = h.HandleScrape(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Scrape{
+		{InfoHash: ih, Complete: 1},
+		{InfoHash: bannedIH, Banned: true},
+	}, resp.Files)
+}
+
+func TestMergeAddressFamilies(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}))
+	require.Nil(t, ps.PutLeecher(ih, bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000002"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("2001:db8::1"), AddressFamily: bittorrent.IPv6},
+	}))
+
+	v4 := bittorrent.Scrape{InfoHash: ih, Complete: 1}
+	v6 := bittorrent.Scrape{InfoHash: ih, Incomplete: 1}
+	var table = []struct {
+		h        *responseHook
+		expected bittorrent.Scrape
+	}{
+		{&responseHook{store: ps}, v4},
+		{&responseHook{store: ps, mergeAddressFamilies: true}, bittorrent.Scrape{InfoHash: ih, Complete: 1, Incomplete: 1}},
+		{
+			&responseHook{store: ps, mergeAddressFamilies: true, familyBreakdown: true},
+			bittorrent.Scrape{InfoHash: ih, Complete: 1, Incomplete: 1, Breakdown: []bittorrent.Scrape{v4, v6}},
+		},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.ScrapeRequest{AddressFamily: bittorrent.IPv4, InfoHashes: []bittorrent.InfoHash{ih}}
+		resp := &bittorrent.ScrapeResponse{}
+		_, err = tt.h.HandleScrape(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, []bittorrent.Scrape{tt.expected}, resp.Files)
+	}
+
+	// Announces still only return peers of their own address family.
+	h := &responseHook{store: ps, mergeAddressFamilies: true}
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		NumWant:  50,
+		Left:     1,
+		Peer: bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString("-TR2940-000000000003"),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.5").To4(), AddressFamily: bittorrent.IPv4},
+		},
+	}
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), resp.Complete)
+	require.Equal(t, uint32(1), resp.Incomplete)
+	require.Equal(t, 1, len(resp.IPv4Peers))
+	require.Equal(t, 0, len(resp.IPv6Peers))
+
+	// The breakdown is appended to the stats.
+	h = &responseHook{store: ps, familyBreakdown: true}
+	statsResp := &bittorrent.ApiResponse{}
+	_, err = h.HandleApi(context.Background(), &bittorrent.ApiRequest{InfoHashes: []bittorrent.InfoHash{ih}, Method: "stats"}, statsResp)
+	require.Nil(t, err)
+	require.Equal(t, "complete=1 incomplete=1 ipv4_complete=1 ipv4_incomplete=0 ipv6_complete=0 ipv6_incomplete=1", statsResp.Files[0].Response)
+}
+
+func TestScrapeLinkedInfoHashes(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	linkedIH := bittorrent.InfoHashFromString("00000000000000000002")
+	require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}))
+
+	h := &responseHook{store: ps}
+	ctx := context.WithValue(context.Background(), LinkedInfoHashesKey, map[bittorrent.InfoHash]bittorrent.InfoHash{linkedIH: ih})
+	req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih, linkedIH}}
+	resp := &bittorrent.ScrapeResponse{}
+	_, err = h.HandleScrape(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Scrape{
+		{InfoHash: ih, Complete: 1},
+		{InfoHash: linkedIH, Complete: 1},
+	}, resp.Files)
+}
+
+func TestMaxScrapeFiles(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	infoHashes := []bittorrent.InfoHash{
+		bittorrent.InfoHashFromString("00000000000000000001"),
+		bittorrent.InfoHashFromString("00000000000000000002"),
+		bittorrent.InfoHashFromString("00000000000000000003"),
+	}
+
+	var table = []struct {
+		maxScrapeFiles uint32
+		expected       int
+	}{
+		{0, 3},
+		{2, 2},
+		{3, 3},
+		{5, 3},
+	}
+
+	for _, tt := range table {
+		h := &responseHook{store: ps, config: newRuntimeConfig(RuntimeConfig{MaxScrapeFiles: tt.maxScrapeFiles})}
+		req := &bittorrent.ScrapeRequest{InfoHashes: infoHashes}
+		resp := &bittorrent.ScrapeResponse{}
+		_, err = h.HandleScrape(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Len(t, resp.Files, tt.expected)
+		for i, scrape := range resp.Files {
+			require.Equal(t, infoHashes[i], scrape.InfoHash)
+		}
+	}
+}
+
+func TestEvictIP(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Nil(t, ps.PutSeeder(ih, peer))
+
+	h := &swarmInteractionHook{store: ps}
+
+	var table = []struct {
+		ip       string
+		err      int
+		response string
+	}{
+		{"1.2.3.4", 0, "deleted=1"},
+		{"1.2.3.4", 0, "deleted=0"},
+		{"nonsense", 1, "invalid ip"},
+	}
+
+	for _, tt := range table {
+		params, err := bittorrent.ParseURLData("/api?ip=" + tt.ip)
+		require.Nil(t, err)
+
+		req := &bittorrent.ApiRequest{Method: "evict-ip", Params: params}
+		resp := &bittorrent.ApiResponse{}
+		_, err = h.HandleApi(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, tt.err, resp.Error)
+		require.Equal(t, tt.response, resp.Response)
+	}
+
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+}
+
+func TestKick(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	moved := peer
+	moved.Port = 6882
+	require.Nil(t, ps.PutSeeder(ih, peer))
+	require.Nil(t, ps.PutLeecher(ih, moved))
+
+	h := &swarmInteractionHook{store: ps}
+
+	var table = []struct {
+		peerID   string
+		err      int
+		response string
+	}{
+		{"-TR2940-000000000001", 0, "removed=true"},
+		{"-TR2940-000000000001", 0, "removed=false"},
+		{"nonsense", 1, "invalid peer_id"},
+	}
+
+	for _, tt := range table {
+		params, err := bittorrent.ParseURLData("/api?peer_id=" + tt.peerID)
+		require.Nil(t, err)
+
+		req := &bittorrent.ApiRequest{Method: "kick", InfoHashes: []bittorrent.InfoHash{ih}, Params: params}
+		resp := &bittorrent.ApiResponse{}
+		_, err = h.HandleApi(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, []bittorrent.Api{{InfoHash: ih, Error: tt.err, Response: tt.response}}, resp.Files)
+	}
+
+	scrape := ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+}
+
+func TestReadOnly(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	seeder := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	leecher := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000002"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.5").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+
+	hooks := []Hook{&swarmInteractionHook{store: ps, readOnly: true}, &responseHook{store: ps}}
+
+	// The leecher receives the existing seeder without being stored.
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 10, NumWant: 50, Peer: leecher}
+	resp := &bittorrent.AnnounceResponse{}
+	for _, h := range hooks {
+		_, err = h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+	}
+	require.Equal(t, []bittorrent.Peer{seeder}, resp.IPv4Peers)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+
+	// Stopped events don't remove peers.
+	req = &bittorrent.AnnounceRequest{InfoHash: ih, Event: bittorrent.Stopped, Peer: seeder}
+	_, err = hooks[0].HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+
+	// Neither do api methods.
+	for _, method := range []string{"delete", "evict-ip", "kick"} {
+		params, err := bittorrent.ParseURLData("/api?ip=1.2.3.4")
+		require.Nil(t, err)
+
+		apiResp := &bittorrent.ApiResponse{}
+		_, err = hooks[0].HandleApi(context.Background(), &bittorrent.ApiRequest{Method: method, InfoHashes: []bittorrent.InfoHash{ih}, Params: params}, apiResp)
+		require.Nil(t, err)
+		require.Equal(t, 1, apiResp.Error)
+	}
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+
+	// Mutating api methods don't reach any hook, e.g. the ones of nya.
+	called := false
+	l, err := NewLogic(Config{AnnounceInterval: time.Minute, ReadOnly: true}, ps, []Hook{apiHookFunc(func(req *bittorrent.ApiRequest) { called = true })}, nil)
+	require.Nil(t, err)
+	for _, method := range []string{"ban", "unban", "delete"} {
+		apiResp, err := l.HandleApi(context.Background(), &bittorrent.ApiRequest{Method: method, InfoHashes: []bittorrent.InfoHash{ih}})
+		require.Nil(t, err)
+		require.Equal(t, 1, apiResp.Error)
+	}
+	require.False(t, called)
+
+	_, err = l.HandleApi(context.Background(), &bittorrent.ApiRequest{Method: "stats"})
+	require.Nil(t, err)
+	require.True(t, called)
+}
+
+// apiHookFunc is a Hook that calls itself for api requests.
+type apiHookFunc func(req *bittorrent.ApiRequest)
+
+func (f apiHookFunc) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func (f apiHookFunc) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func (f apiHookFunc) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	f(req)
+	return ctx, nil
+}
+
+func TestPeersOnStopped(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	seeder := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	leecher := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000002"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.5").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+
+	for _, peersOnStopped := range []bool{false, true} {
+		hooks := []Hook{&swarmInteractionHook{store: ps}, &responseHook{store: ps, peersOnStopped: peersOnStopped}}
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: bittorrent.Stopped, Left: 10, NumWant: 50, Peer: leecher}
+		resp := &bittorrent.AnnounceResponse{}
+
+		ctx := context.Background()
+		for _, h := range hooks {
+			ctx, err = h.HandleAnnounce(ctx, req, resp)
+			require.Nil(t, err)
+		}
+
+		require.Equal(t, uint32(1), resp.Complete)
+		if peersOnStopped {
+			require.Equal(t, []bittorrent.Peer{seeder}, resp.IPv4Peers)
+		} else {
+			require.Nil(t, resp.IPv4Peers)
+		}
+	}
+}
+
+func TestExplicitZeroNumWant(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	seeder := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	leecher := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000002"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.5").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+
+	hooks := []Hook{
+		&sanitizationHook{config: newRuntimeConfig(RuntimeConfig{MaxNumWant: 50, DefaultNumWant: 25})},
+		&swarmInteractionHook{store: ps},
+		&responseHook{store: ps},
+	}
+
+	var table = []struct {
+		numWant   uint32
+		specified bool
+		expected  int
+	}{
+		{0, false, 1},
+		{0, true, 0},
+		{10, true, 1},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 10, NumWant: tt.numWant, NumWantSpecified: tt.specified, Peer: leecher}
+		resp := &bittorrent.AnnounceResponse{}
+		for _, h := range hooks {
+			_, err = h.HandleAnnounce(context.Background(), req, resp)
+			require.Nil(t, err)
+		}
+
+		require.Equal(t, tt.expected, len(resp.IPv4Peers))
+
+		// The scrape data is always included.
+		require.Equal(t, uint32(1), resp.Complete)
+	}
+}
+
+func TestMaxSeedersForSeeders(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(n byte) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString("-TR2940-00000000000" + string('0'+n)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, 3, n).To4(), AddressFamily: bittorrent.IPv4},
+		}
+	}
+	announcer := peer(1)
+	require.Nil(t, ps.PutSeeder(ih, announcer))
+	require.Nil(t, ps.PutSeeder(ih, peer(2)))
+	require.Nil(t, ps.PutSeeder(ih, peer(3)))
+	require.Nil(t, ps.PutSeeder(ih, peer(4)))
+	require.Nil(t, ps.PutLeecher(ih, peer(5)))
+
+	var table = []struct {
+		maxSeeders uint32
+		numWant    uint32
+		expected   int
+	}{
+		// By default, seeders only receive leechers.
+		{0, 50, 1},
+		{2, 50, 3},
+		{10, 50, 4},
+		{10, 2, 2},
+	}
+
+	for _, tt := range table {
+		h := &responseHook{store: ps, maxSeedersForSeeders: tt.maxSeeders}
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: tt.numWant, Peer: announcer}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err = h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+
+		require.Equal(t, tt.expected, len(resp.IPv4Peers))
+		require.True(t, containsPeer(resp.IPv4Peers, peer(5)))
+		require.False(t, containsPeer(resp.IPv4Peers, announcer))
+	}
+}
+
+func TestShufflePeers(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	for i := 0; i < 20; i++ {
+		require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-%012d", i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, 3, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}))
+	}
+
+	announcer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-announcer000"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.IPv4(1, 2, 4, 1).To4(), AddressFamily: bittorrent.IPv4},
+	}
+	h := &responseHook{store: ps}
+
+	announce := func() []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 50, Left: 1, Peer: announcer}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, 20, len(resp.IPv4Peers))
+		return resp.IPv4Peers
+	}
+
+	// The same client announcing to the same swarm receives the same peers,
+	// but not always in the same order.
+	first := announce()
+	varied := false
+	for i := 0; i < 10 && !varied; i++ {
+		peers := announce()
+		for _, p := range first {
+			require.True(t, containsPeer(peers, p))
+		}
+		varied = !reflect.DeepEqual(first, peers)
+	}
+	require.True(t, varied)
+}
+
+func TestShufflePeersByInfoHash(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	for i := 0; i < 20; i++ {
+		require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-%012d", i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, 3, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}))
+	}
+
+	h := &responseHook{store: ps, shuffler: newPeerShuffler(PeerShuffleConfig{Seed: ShuffleSeedInfoHash, Window: time.Hour})}
+
+	announce := func(i int) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 50, Left: 1, Peer: bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-announcer%03d", i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, 4, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, 20, len(resp.IPv4Peers))
+		return resp.IPv4Peers
+	}
+
+	// All clients of the swarm receive the peers in the same order.
+	first := announce(0)
+	for i := 1; i < 10; i++ {
+		require.Equal(t, first, announce(i))
+	}
+
+	// The order is still shuffled.
+	sorted := append([]bittorrent.Peer(nil), first...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].IP.IP, sorted[j].IP.IP) < 0 })
+	require.NotEqual(t, sorted, first)
+
+	require.Nil(t, newPeerShuffler(PeerShuffleConfig{}))
+	require.Nil(t, newPeerShuffler(PeerShuffleConfig{Seed: ShuffleSeedRequest}))
+	require.Nil(t, newPeerShuffler(PeerShuffleConfig{Seed: "unknown"}))
+}
+
+func TestInjectPeers(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	newPeer := func(id, ip string) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(id),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+		}
+	}
+	seedBox := newPeer("-TR2940-000000000001", "1.2.3.1")
+	seeder := newPeer("-TR2940-000000000002", "1.2.3.2")
+	leecher := newPeer("-TR2940-000000000003", "1.2.3.3")
+	require.Nil(t, ps.PutSeeder(ih, seedBox))
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+
+	injectedSeedBox := seedBox
+	injectedSeedBox.ID = bittorrent.PeerID{}
+	injected := []bittorrent.Peer{
+		injectedSeedBox,
+		{Port: 6881, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}},
+	}
+
+	h := &responseHook{store: ps}
+	ctx := context.WithValue(context.Background(), InjectedPeersKey, injected)
+
+	var table = []struct {
+		numWant  uint32
+		expected []bittorrent.Peer
+	}{
+		// The seed box is returned once, first, and not in the ID it
+		// announced with.
+		{10, []bittorrent.Peer{injectedSeedBox, seeder}},
+		{1, []bittorrent.Peer{injectedSeedBox}},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 10, NumWant: tt.numWant, Peer: leecher}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err = h.HandleAnnounce(ctx, req, resp)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, resp.IPv4Peers)
+		require.Nil(t, resp.IPv6Peers)
+	}
+}
+
+func TestPeerPadding(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	for i := 0; i < 2; i++ {
+		require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-%012d", i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, 3, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}))
+	}
+
+	announcer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-announcer000"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.IPv4(1, 2, 4, 1).To4(), AddressFamily: bittorrent.IPv4},
+	}
+	authenticated := context.WithValue(context.Background(), frontend.UserIDKey, "user")
+
+	var table = []struct {
+		cfg      PeerPaddingConfig
+		ctx      context.Context
+		expected int
+	}{
+		{PeerPaddingConfig{}, context.Background(), 2},
+		{PeerPaddingConfig{Enabled: true}, context.Background(), 10},
+		{PeerPaddingConfig{Enabled: true, Mode: PaddingModeRepeat}, context.Background(), 10},
+		// Private trackers are not padded by default.
+		{PeerPaddingConfig{Enabled: true}, authenticated, 2},
+		{PeerPaddingConfig{Enabled: true, PadAuthenticated: true}, authenticated, 10},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%#v", tt.cfg), func(t *testing.T) {
+			h := &responseHook{store: ps, padder: newPeerPadder(tt.cfg)}
+			req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 10, Left: 1, Peer: announcer}
+			resp := &bittorrent.AnnounceResponse{}
+			_, err := h.HandleAnnounce(tt.ctx, req, resp)
+			require.Nil(t, err)
+
+			require.Equal(t, tt.expected, len(resp.IPv4Peers))
+			require.Equal(t, uint32(2), resp.Complete)
+
+			if tt.cfg.Mode == "" {
+				for i, p := range resp.IPv4Peers {
+					require.False(t, containsEndpoint(resp.IPv4Peers[:i], p))
+					if p.IP.IP[0] != 1 {
+						require.True(t, p.IP.Equal(net.IPv4(192, 0, 2, p.IP.IP[3])))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRepeatPeers(t *testing.T) {
+	a := bittorrent.Peer{Port: 1, IP: bittorrent.IP{IP: net.IPv4(1, 2, 3, 4).To4(), AddressFamily: bittorrent.IPv4}}
+	b := bittorrent.Peer{Port: 2, IP: bittorrent.IP{IP: net.IPv4(1, 2, 3, 4).To4(), AddressFamily: bittorrent.IPv4}}
+
+	// Duplicate endpoints are not repeated more often than the others.
+	require.Equal(t, []bittorrent.Peer{a, b, a, b, a}, repeatPeers([]bittorrent.Peer{a, a, b}, 5))
+	require.Equal(t, []bittorrent.Peer{}, repeatPeers([]bittorrent.Peer{}, 5))
+}
+
+func TestFamilyFallback(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v6Seeder := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6},
+	}
+	require.Nil(t, ps.PutSeeder(ih, v6Seeder))
+
+	announcer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000002"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+
+	httpCtx := context.WithValue(context.Background(), bittorrent.SchemeKey, bittorrent.SchemeHTTP)
+	udpCtx := context.WithValue(context.Background(), bittorrent.SchemeKey, bittorrent.SchemeUDP)
+
+	var table = []struct {
+		cfg       FamilyFallbackConfig
+		ctx       context.Context
+		query     string
+		warning   string
+		ipv6Peers []bittorrent.Peer
+	}{
+		{FamilyFallbackConfig{}, httpCtx, "", "", nil},
+		{FamilyFallbackConfig{Enabled: true}, httpCtx, "", defaultFamilyFallbackMessage, nil},
+		{FamilyFallbackConfig{Enabled: true, WarningMessage: "use ipv6"}, httpCtx, "", "use ipv6", nil},
+
+		// Dual-stack clients receive the peers of the other address family.
+		{FamilyFallbackConfig{Enabled: true}, httpCtx, "ipv6=fc00::2", defaultFamilyFallbackMessage, nil},
+		{FamilyFallbackConfig{Enabled: true, DualStackPeers: true}, httpCtx, "ipv6=fc00::2", "", []bittorrent.Peer{v6Seeder}},
+		{FamilyFallbackConfig{Enabled: true, DualStackPeers: true}, httpCtx, "ipv6=%5Bfc00::2%5D:6881", "", []bittorrent.Peer{v6Seeder}},
+		{FamilyFallbackConfig{Enabled: true, DualStackPeers: true}, httpCtx, "ipv6=1.2.3.5", defaultFamilyFallbackMessage, nil},
+
+		// Only the HTTP frontend can return them.
+		{FamilyFallbackConfig{Enabled: true, DualStackPeers: true}, udpCtx, "ipv6=fc00::2", defaultFamilyFallbackMessage, nil},
+		{FamilyFallbackConfig{Enabled: true, DualStackPeers: true}, context.Background(), "ipv6=fc00::2", defaultFamilyFallbackMessage, nil},
+	}
+
+	for _, tt := range table {
+		params, err := bittorrent.ParseURLData("/announce?" + tt.query)
+		require.Nil(t, err)
+
+		h := &responseHook{store: ps, familyFallback: newFamilyFallback(tt.cfg)}
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 10, NumWant: 50, Peer: announcer, Params: params}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err = h.HandleAnnounce(tt.ctx, req, resp)
+		require.Nil(t, err)
+		require.Equal(t, tt.warning, resp.WarningMessage, tt.query)
+		require.Equal(t, tt.ipv6Peers, resp.IPv6Peers, tt.query)
+		require.Equal(t, []bittorrent.Peer{announcer}, resp.IPv4Peers)
+	}
+
+	// Swarms without any peers are not affected.
+	h := &responseHook{store: ps, familyFallback: newFamilyFallback(FamilyFallbackConfig{Enabled: true})}
+	req := &bittorrent.AnnounceRequest{InfoHash: bittorrent.InfoHashFromString("00000000000000000002"), Left: 10, NumWant: 50, Peer: announcer}
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, "", resp.WarningMessage)
+}
+
+func TestDualStackSplit(t *testing.T) {
+	var table = []struct {
+		split    string
+		numWant  int
+		native   int
+		other    int
+		expected [2]int
+	}{
+		{"70/30", 10, 20, 20, [2]int{7, 3}},
+		{"70/30", 10, 5, 20, [2]int{5, 5}},
+		{"70/30", 10, 20, 1, [2]int{9, 1}},
+		{"70/30", 10, 2, 1, [2]int{2, 1}},
+		{"0/100", 10, 20, 20, [2]int{0, 10}},
+		{"50/50", 5, 20, 20, [2]int{3, 2}},
+		{DualStackSplitPreferNative, 10, 20, 20, [2]int{10, 0}},
+		{DualStackSplitPreferNative, 10, 4, 20, [2]int{4, 6}},
+
+		// Invalid splits use prefer_native.
+		{"70/20", 10, 4, 20, [2]int{4, 6}},
+		{"70", 10, 4, 20, [2]int{4, 6}},
+	}
+
+	for _, tt := range table {
+		f := newFamilyFallback(FamilyFallbackConfig{Enabled: true, DualStackPeers: true, DualStackSplit: tt.split})
+		n, o := f.divide(tt.numWant, tt.native, tt.other)
+		require.Equal(t, tt.expected, [2]int{n, o}, tt)
+	}
+
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	for i := 0; i < 10; i++ {
+		require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-%012d", i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 1, 1, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}))
+	}
+	for i := 0; i < 2; i++ {
+		require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-1%011d", i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.ParseIP(fmt.Sprintf("fc00::%d", i+1)), AddressFamily: bittorrent.IPv6},
+		}))
+	}
+
+	httpCtx := context.WithValue(context.Background(), bittorrent.SchemeKey, bittorrent.SchemeHTTP)
+	announcer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-200000000000"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+
+	var announces = []struct {
+		split    string
+		query    string
+		numWant  uint32
+		expected [2]int
+	}{
+		{"", "ipv6=fc00::100", 5, [2]int{5, 0}},
+		{"60/40", "", 5, [2]int{5, 0}},
+		{"60/40", "ipv6=fc00::100", 5, [2]int{3, 2}},
+		{"20/80", "ipv6=fc00::100", 5, [2]int{3, 2}},
+		{DualStackSplitPreferNative, "ipv6=fc00::100", 5, [2]int{5, 0}},
+		{DualStackSplitPreferNative, "ipv6=fc00::100", 12, [2]int{10, 2}},
+	}
+
+	for _, tt := range announces {
+		params, err := bittorrent.ParseURLData("/announce?" + tt.query)
+		require.Nil(t, err)
+
+		h := &responseHook{store: ps, familyFallback: newFamilyFallback(FamilyFallbackConfig{Enabled: true, DualStackPeers: true, DualStackSplit: tt.split})}
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 10, NumWant: tt.numWant, Peer: announcer, Params: params}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err = h.HandleAnnounce(httpCtx, req, resp)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, [2]int{len(resp.IPv4Peers), len(resp.IPv6Peers)}, tt)
+	}
+
+	// UDP clients only receive the peers of their address family.
+	params, err := bittorrent.ParseURLData("/announce?ipv6=fc00::100")
+	require.Nil(t, err)
+	h := &responseHook{store: ps, familyFallback: newFamilyFallback(FamilyFallbackConfig{Enabled: true, DualStackPeers: true, DualStackSplit: "60/40"})}
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 10, NumWant: 5, Peer: announcer, Params: params}
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(context.WithValue(context.Background(), bittorrent.SchemeKey, bittorrent.SchemeUDP), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, [2]int{5, 0}, [2]int{len(resp.IPv4Peers), len(resp.IPv6Peers)})
+}
+
+func TestExcludeAnnouncer(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	announcer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	other := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000002"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.5").To4(), AddressFamily: bittorrent.IPv4},
+	}
+
+	// The announcer is still a seeder, under its previous address and with
+	// a previous peer ID.
+	previousAddress := announcer
+	previousAddress.IP = bittorrent.IP{IP: net.ParseIP("1.2.3.6").To4(), AddressFamily: bittorrent.IPv4}
+	previousID := announcer
+	previousID.ID = bittorrent.PeerIDFromString("-TR2940-000000000003")
+	for _, p := range []bittorrent.Peer{announcer, previousAddress, previousID, other} {
+		require.Nil(t, ps.PutSeeder(ih, p))
+	}
+
+	announce := func(h *responseHook) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 10, NumWant: 50, Peer: announcer}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		return resp.IPv4Peers
+	}
+
+	require.Len(t, announce(&responseHook{store: ps}), 4)
+	require.Equal(t, []bittorrent.Peer{other}, announce(&responseHook{store: ps, excludeAnnouncer: true}))
+
+	// The announcer still receives itself if it is the only peer.
+	require.Nil(t, ps.DeleteSeeder(ih, other))
+	require.Equal(t, []bittorrent.Peer{announcer}, announce(&responseHook{store: ps, excludeAnnouncer: true}))
+}
+
+// announceCountingStore counts the calls of AnnouncePeers.
+type announceCountingStore struct {
+	storage.PeerStore
+	announces int
+}
+
+func (s *announceCountingStore) AnnouncePeers(infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	s.announces++
+	return s.PeerStore.AnnouncePeers(infoHash, seeder, numWant, p)
+}
+
+func TestAnnounceCache(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	var peers []bittorrent.Peer
+	for i := 0; i < 10; i++ {
+		p := bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-00000000000%d", i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, 3, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}
+		require.Nil(t, ps.PutLeecher(ih, p))
+		peers = append(peers, p)
+	}
+
+	rc := newRuntimeConfig(RuntimeConfig{MaxNumWant: 20})
+	store := &announceCountingStore{PeerStore: ps}
+	cache := newAnnounceCache(AnnounceCacheConfig{Size: 10, TTL: time.Hour})
+	h := &responseHook{store: store, config: rc, announceCache: cache}
+	announce := func(p bittorrent.Peer, left uint64, numWant uint32) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: left, NumWant: numWant, Peer: p}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		return resp.IPv4Peers
+	}
+
+	// Every announcer receives the other peers, but never itself.
+	for _, p := range peers {
+		received := announce(p, 10, 50)
+		require.Len(t, received, 9)
+		require.False(t, containsPeer(received, p))
+	}
+	require.Equal(t, 1, store.announces)
+
+	// Subsets are limited to numwant.
+	require.Len(t, announce(peers[0], 10, 3), 3)
+	require.Equal(t, 1, store.announces)
+
+	// Seeders are cached separately.
+	announce(peers[0], 0, 50)
+	require.Equal(t, 2, store.announces)
+
+	// Stale entries are refreshed.
+	cache.ttl = -time.Nanosecond
+	announce(peers[0], 10, 50)
+	require.Equal(t, 3, store.announces)
+}
+
+func TestAnnounceCachePriority(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(i int) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-0000000000%02d", i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(1, 2, 3, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}
+	}
+	var seeders []bittorrent.Peer
+	for i := 0; i < 3; i++ {
+		require.Nil(t, ps.PutSeeder(ih, peer(i)))
+		seeders = append(seeders, peer(i))
+	}
+	for i := 3; i < 13; i++ {
+		require.Nil(t, ps.PutLeecher(ih, peer(i)))
+	}
+	unreachable := peer(13)
+	require.Nil(t, ps.(storage.PeerAttributeStore).PutSeederWithAttributes(ih, unreachable, storage.PeerAttributes{Flags: bittorrent.PeerFlagUnreachable}))
+
+	rc := newRuntimeConfig(RuntimeConfig{MaxNumWant: 20})
+	h := &responseHook{store: ps, config: rc, announceCache: newAnnounceCache(AnnounceCacheConfig{Size: 10, TTL: time.Hour})}
+	announce := func(numWant uint32) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 10, NumWant: numWant, Peer: peer(20)}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		return resp.IPv4Peers
+	}
+
+	// Leechers receive the seeders first and unreachable peers last, like
+	// they would from the storage.
+	for i := 0; i < 20; i++ {
+		received := announce(3)
+		require.Len(t, received, 3)
+		for _, p := range seeders {
+			require.True(t, containsPeer(received, p))
+		}
+		require.False(t, containsPeer(announce(13), unreachable))
+	}
+	require.True(t, containsPeer(announce(14), unreachable))
+}
+
+func TestAnnounceCacheConcurrentMisses(t *testing.T) {
+	cache := newAnnounceCache(AnnounceCacheConfig{Size: 10, TTL: time.Hour})
+	key := announceCacheKey{infoHash: bittorrent.InfoHashFromString("00000000000000000001")}
+	peers := []bittorrent.Peer{{Port: 1}}
+
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(numWant int) ([]bittorrent.Peer, []int, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return peers, nil, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			received, _, err := cache.peers(key, 1, time.Now(), fetch)
+			require.Nil(t, err)
+			require.Equal(t, peers, received)
+		}()
+	}
+
+	// Give the misses time to wait for the first fetch.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+}
+
+type originStore map[string]storage.PeerCounts
+
+func (s originStore) PeerOriginCounts() map[string]storage.PeerCounts { return s }
+
+func TestOriginCounts(t *testing.T) {
+	require.Equal(t, "", originCounts(originStore(nil)))
+	require.Equal(t, "origins=http:10/5,udp:2/1,unknown:0/1", originCounts(originStore{
+		"udp":                 {Seeders: 2, Leechers: 1},
+		"http":                {Seeders: 10, Leechers: 5},
+		storage.UnknownOrigin: {Leechers: 1},
+	}))
+}
+
+func TestCompactFallback(t *testing.T) {
+	require.Nil(t, newCompactFallback(CompactFallbackConfig{Clients: []string{"short"}}))
+
+	old := bittorrent.PeerIDFromString("-UT1800-000000000001")
+	current := bittorrent.PeerIDFromString("-TR2940-000000000001")
+	v4 := []bittorrent.Peer{{IP: bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4}}}
+	v6 := []bittorrent.Peer{{IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}}}
+
+	var table = []struct {
+		mode    string
+		id      bittorrent.PeerID
+		v6      []bittorrent.Peer
+		compact bool
+		omitted bool
+		err     error
+	}{
+		{"", old, v6, false, false, nil},
+		{CompactFallbackOmitIPv6, old, v6, true, true, nil},
+		{CompactFallbackReject, old, v6, true, false, ErrCompactIPv6Unsupported},
+		// Other clients and responses without IPv6 peers stay compact.
+		{CompactFallbackNonCompact, current, v6, true, false, nil},
+		{CompactFallbackNonCompact, old, nil, true, false, nil},
+	}
+
+	httpCtx := context.WithValue(context.Background(), bittorrent.SchemeKey, bittorrent.SchemeHTTP)
+	udpCtx := context.WithValue(context.Background(), bittorrent.SchemeKey, bittorrent.SchemeUDP)
+	for _, tt := range table {
+		f := newCompactFallback(CompactFallbackConfig{Clients: []string{"UT1800"}, Mode: tt.mode})
+		req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: tt.id}}
+		resp := &bittorrent.AnnounceResponse{Compact: true, IPv4Peers: v4, IPv6Peers: tt.v6}
+		require.Equal(t, tt.err, f.apply(httpCtx, req, resp), tt)
+		require.Equal(t, tt.compact, resp.Compact, tt)
+		require.Equal(t, tt.omitted, tt.v6 != nil && resp.IPv6Peers == nil, tt)
+		require.Equal(t, v4, resp.IPv4Peers, tt)
+
+		// Responses of the UDP frontend are never changed.
+		resp = &bittorrent.AnnounceResponse{Compact: true, IPv4Peers: v4, IPv6Peers: tt.v6}
+		require.Nil(t, f.apply(udpCtx, req, resp), tt)
+		require.True(t, resp.Compact, tt)
+		require.Equal(t, tt.v6, resp.IPv6Peers, tt)
+	}
+}
+
+func TestShardStats(t *testing.T) {
+	require.Equal(t, "shards=0", shardStats(nil, 10))
+	require.Equal(t, "shards=4 max_peers=10 mean_peers=3 hot=2:ipv6:1/8/2:12ms/40,0:ipv4:2/1/1:1ms/3", shardStats([]storage.ShardStats{
+		{AddressFamily: bittorrent.IPv4, Swarms: 2, Seeders: 1, Leechers: 1, Locks: 3, LockWait: time.Millisecond},
+		{AddressFamily: bittorrent.IPv4},
+		{AddressFamily: bittorrent.IPv6, Swarms: 1, Seeders: 8, Leechers: 2, Locks: 40, LockWait: 12 * time.Millisecond},
+		{AddressFamily: bittorrent.IPv6, Swarms: 1, Seeders: 1},
+	}, 2))
+}
+
+func TestLimitSize(t *testing.T) {
+	v4 := make([]bittorrent.Peer, 10)
+	v6 := make([]bittorrent.Peer, 10)
+	for i := range v4 {
+		v4[i] = bittorrent.Peer{Port: uint16(i + 1), IP: bittorrent.IP{IP: net.IPv4(1, 2, 3, byte(i)).To4(), AddressFamily: bittorrent.IPv4}}
+		v6[i] = bittorrent.Peer{Port: uint16(i + 1), IP: bittorrent.IP{IP: net.ParseIP(fmt.Sprintf("2001:db8::%d", i+1)), AddressFamily: bittorrent.IPv6}}
+	}
+	req := &bittorrent.AnnounceRequest{Peer: v4[0]}
+
+	var table = []struct {
+		scheme  string
+		max     int
+		ipv4    int
+		ipv6    int
+		compact bool
+	}{
+		{bittorrent.SchemeHTTP, 0, 10, 10, true},
+		{bittorrent.SchemeHTTP, 128 + 10*6 + 10*18, 10, 10, true},
+
+		// IPv6 peers are dropped first.
+		{bittorrent.SchemeHTTP, 128 + 10*6 + 5*18, 10, 5, true},
+		{bittorrent.SchemeHTTP, 128 + 5*6, 5, 0, true},
+
+		// UDP responses only contain the peers of the announcer's
+		// address family.
+		{bittorrent.SchemeUDP, 20 + 10*6, 10, 10, true},
+		{bittorrent.SchemeUDP, 20 + 3*6, 3, 10, true},
+
+		// Non-compact peers are larger.
+		{bittorrent.SchemeHTTP, 128 + 10*6 + 10*18, 4, 0, false},
+	}
+
+	for _, tt := range table {
+		h := &responseHook{maxResponseSize: tt.max}
+		resp := &bittorrent.AnnounceResponse{Compact: tt.compact, IPv4Peers: v4, IPv6Peers: v6}
+		h.limitSize(context.WithValue(context.Background(), bittorrent.SchemeKey, tt.scheme), req, resp)
+		require.Equal(t, tt.ipv4, len(resp.IPv4Peers), tt)
+		require.Equal(t, tt.ipv6, len(resp.IPv6Peers), tt)
+	}
+}
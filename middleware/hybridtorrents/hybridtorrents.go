@@ -0,0 +1,215 @@
+// Package hybridtorrents implements a Hook that unifies the swarms of the v1
+// and v2 infohashes of BEP 52 hybrid torrents.
+package hybridtorrents
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Defaults of the configuration.
+const (
+	defaultLinkLifetime = 2 * time.Hour
+	defaultMaxLinks     = 100000
+	gcInterval          = time.Minute
+)
+
+// Errors of the configuration.
+var (
+	ErrInvalidLinkLifetime = errors.New("link_lifetime must not be negative")
+	ErrInvalidMaxLinks     = errors.New("max_links must not be negative")
+)
+
+// Config represents the configuration for the hybrid torrents middleware.
+type Config struct {
+	// LinkLifetime is the duration a link between two infohashes is kept
+	// after the last Announce that included or used it.
+	// If zero, a default of 2h is used.
+	LinkLifetime time.Duration `yaml:"link_lifetime"`
+
+	// MaxLinks is the maximum number of linked infohashes that are kept.
+	// Beyond that, the links used least recently are forgotten.
+	// If zero, a default of 100000 is used.
+	MaxLinks int `yaml:"max_links"`
+
+	// RequireAuthenticated specifies whether only Announces of
+	// authenticated clients can link infohashes.
+	RequireAuthenticated bool `yaml:"require_authenticated"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"linkLifetime":         cfg.LinkLifetime,
+		"maxLinks":             cfg.MaxLinks,
+		"requireAuthenticated": cfg.RequireAuthenticated,
+	}
+}
+
+type hook struct {
+	cfg Config
+
+	// links maps the linked infohashes to the swarms they belong to.
+	links *expiring.Map
+}
+
+// NewHook returns an instance of the hybrid torrents middleware.
+//
+// Of two linked infohashes, the lower one identifies the swarm. Announces and
+// Scrapes of the other one are redirected to it.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.LinkLifetime < 0 {
+		return nil, ErrInvalidLinkLifetime
+	}
+	if cfg.MaxLinks < 0 {
+		return nil, ErrInvalidMaxLinks
+	}
+
+	if cfg.LinkLifetime == 0 {
+		cfg.LinkLifetime = defaultLinkLifetime
+	}
+	if cfg.MaxLinks == 0 {
+		cfg.MaxLinks = defaultMaxLinks
+	}
+
+	return &hook{
+		cfg:   cfg,
+		links: expiring.New(cfg.MaxLinks, gcInterval),
+	}, nil
+}
+
+// link is the value of a linked infohash in the links.
+type link struct {
+	// swarm is the lower of both infohashes, which identifies the swarm.
+	swarm bittorrent.InfoHash
+
+	// partner is the other infohash of the link.
+	partner bittorrent.InfoHash
+}
+
+// key returns the key of infoHash in the links.
+func key(infoHash bittorrent.InfoHash) string {
+	return string(infoHash[:])
+}
+
+// link links the infohashes a and b at now.
+//
+// Both infohashes are mapped to the swarm and to each other, so that an
+// infohash that is already linked keeps its link until it expires. Otherwise,
+// Announces could redirect existing links.
+// Both entries are checked and updated at once, so that concurrent Announces
+// can't create conflicting links.
+func (h *hook) link(a, b bittorrent.InfoHash, now time.Time) {
+	if a == b {
+		return
+	}
+
+	swarm := a
+	if bytes.Compare(b[:], a[:]) < 0 {
+		swarm = b
+	}
+
+	expires := now.Add(h.cfg.LinkLifetime)
+	h.links.UpdatePair(key(a), key(b), now, func(ea expiring.Entry, okA bool, eb expiring.Entry, okB bool) (expiring.Entry, expiring.Entry) {
+		if (okA && ea.Value.(link).partner != b) || (okB && eb.Value.(link).partner != a) {
+			return ea, eb
+		}
+		return expiring.Entry{Value: link{swarm: swarm, partner: b}, Expires: expires},
+			expiring.Entry{Value: link{swarm: swarm, partner: a}, Expires: expires}
+	})
+}
+
+// swarm returns the swarm infoHash is linked to at now, if any.
+//
+// If refresh is set, the lifetime of the link is extended for both of its
+// infohashes, so that the swarm is not split again while either of them is
+// used.
+func (h *hook) swarm(infoHash bittorrent.InfoHash, now time.Time, refresh bool) (swarm bittorrent.InfoHash, linked bool) {
+	e, ok := h.links.Get(key(infoHash), now)
+	if !ok {
+		return infoHash, false
+	}
+	l := e.Value.(link)
+	if !refresh {
+		return l.swarm, true
+	}
+
+	swarm = infoHash
+	expires := now.Add(h.cfg.LinkLifetime)
+	h.links.UpdatePair(key(infoHash), key(l.partner), now, func(ea expiring.Entry, okA bool, eb expiring.Entry, okB bool) (expiring.Entry, expiring.Entry) {
+		// The link may have expired or been replaced since it was read.
+		if !okA || ea.Value.(link) != l {
+			return ea, eb
+		}
+		swarm, linked = l.swarm, true
+
+		ea.Expires = expires
+		if okB && eb.Value.(link).partner == infoHash {
+			eb.Expires = expires
+		}
+		return ea, eb
+	})
+	return
+}
+
+// authenticated reports whether the request of ctx was authenticated.
+func authenticated(ctx context.Context) bool {
+	_, ok := frontend.UserID(ctx)
+	return ok || ctx.Value(middleware.AuthenticatedKey) != nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	now := time.Now()
+
+	if req.LinkedInfoHash != nil && (!h.cfg.RequireAuthenticated || authenticated(ctx)) {
+		h.link(req.InfoHash, *req.LinkedInfoHash, now)
+	}
+
+	if swarm, ok := h.swarm(req.InfoHash, now, true); ok && swarm != req.InfoHash {
+		log.Debug("redirecting announce to linked swarm", log.RequestFields(ctx, log.Fields{
+			"infoHash": req.InfoHash,
+			"swarm":    swarm,
+		}))
+		req.InfoHash = swarm
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	now := time.Now()
+
+	var linked map[bittorrent.InfoHash]bittorrent.InfoHash
+	for _, infoHash := range req.InfoHashes {
+		swarm, ok := h.swarm(infoHash, now, false)
+		if !ok || swarm == infoHash {
+			continue
+		}
+		if linked == nil {
+			linked = make(map[bittorrent.InfoHash]bittorrent.InfoHash)
+		}
+		linked[infoHash] = swarm
+	}
+
+	if linked == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, middleware.LinkedInfoHashesKey, linked), nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests refer to the swarms they name.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	return h.links.Stop()
+}
@@ -0,0 +1,128 @@
+package hybridtorrents
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+var (
+	v1 = bittorrent.InfoHashFromString("00000000000000000001")
+	v2 = bittorrent.InfoHashFromString("00000000000000000002")
+	ih = bittorrent.InfoHashFromString("00000000000000000003")
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{}, nil},
+		{Config{LinkLifetime: time.Hour, MaxLinks: 10}, nil},
+		{Config{LinkLifetime: -time.Hour}, ErrInvalidLinkLifetime},
+		{Config{MaxLinks: -1}, ErrInvalidMaxLinks},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+		if h != nil {
+			<-h.(*hook).Stop()
+		}
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	announce := func(ctx context.Context, infoHash bittorrent.InfoHash, linked *bittorrent.InfoHash) bittorrent.InfoHash {
+		req := &bittorrent.AnnounceRequest{InfoHash: infoHash, LinkedInfoHash: linked}
+		_, err := h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		return req.InfoHash
+	}
+
+	// Unlinked infohashes are not changed.
+	require.Equal(t, v2, announce(context.Background(), v2, nil))
+
+	// A hybrid announce links both infohashes to the lower one.
+	v1Copy := v1
+	require.Equal(t, v1, announce(context.Background(), v2, &v1Copy))
+	require.Equal(t, v1, announce(context.Background(), v2, nil))
+	require.Equal(t, v1, announce(context.Background(), v1, nil))
+
+	// Existing links can't be redirected.
+	v2Copy := v2
+	require.Equal(t, ih, announce(context.Background(), ih, &v2Copy))
+	require.Equal(t, v1, announce(context.Background(), v2, nil))
+	v0 := bittorrent.InfoHashFromString("00000000000000000000")
+	require.Equal(t, v1, announce(context.Background(), v1, &v0))
+	require.Equal(t, v0, announce(context.Background(), v0, nil))
+
+}
+
+func TestRequireAuthenticated(t *testing.T) {
+	h, err := NewHook(Config{RequireAuthenticated: true})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	v1Copy := v1
+	req := &bittorrent.AnnounceRequest{InfoHash: v2, LinkedInfoHash: &v1Copy}
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, v2, req.InfoHash)
+
+	ctx := context.WithValue(context.Background(), middleware.AuthenticatedKey, true)
+	_, err = h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, v1, req.InfoHash)
+}
+
+func TestHandleScrape(t *testing.T) {
+	h, err := NewHook(Config{})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	ctx, err := h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{v1, v2}}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+	require.Nil(t, ctx.Value(middleware.LinkedInfoHashesKey))
+
+	h.(*hook).link(v1, v2, time.Now())
+	ctx, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{v1, v2, ih}}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+	require.Equal(t, map[bittorrent.InfoHash]bittorrent.InfoHash{v2: v1}, ctx.Value(middleware.LinkedInfoHashesKey))
+}
+
+func TestLinkExpiry(t *testing.T) {
+	h, err := NewHook(Config{LinkLifetime: time.Minute, MaxLinks: 16})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	now := time.Now()
+	h.(*hook).link(v1, v2, now)
+	swarm, ok := h.(*hook).swarm(v2, now.Add(30*time.Second), true)
+	require.True(t, ok)
+	require.Equal(t, v1, swarm)
+
+	// Using the link extends its lifetime.
+	_, ok = h.(*hook).swarm(v2, now.Add(80*time.Second), false)
+	require.True(t, ok)
+
+	_, ok = h.(*hook).swarm(v2, now.Add(2*time.Minute), false)
+	require.False(t, ok)
+
+	// Using either infohash extends the lifetime of both.
+	h.(*hook).link(v1, v2, now)
+	_, ok = h.(*hook).swarm(v1, now.Add(30*time.Second), true)
+	require.True(t, ok)
+	swarm, ok = h.(*hook).swarm(v2, now.Add(80*time.Second), false)
+	require.True(t, ok)
+	require.Equal(t, v1, swarm)
+}
@@ -0,0 +1,199 @@
+// Package infohashlimit implements a Hook that limits the number of distinct
+// infohashes announced from the same IP address or network.
+package infohashlimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Defaults of the configuration.
+const (
+	defaultWindow           = time.Hour
+	defaultMaxIPs           = 100000
+	defaultIPv4PrefixLength = 32
+	defaultIPv6PrefixLength = 64
+)
+
+// ErrTooManyInfoHashes is returned when a network announces a new infohash
+// after it already announced the maximum number of infohashes in the window.
+var ErrTooManyInfoHashes = bittorrent.NewClientError("too_many_infohashes_from_network", "too many torrents announced from your network")
+
+// Errors of the configuration.
+var (
+	ErrInvalidMaxInfoHashes = errors.New("max_infohashes must be positive")
+	ErrInvalidWindow        = errors.New("window must not be negative")
+	ErrInvalidMaxIPs        = errors.New("max_ips must not be negative")
+	ErrInvalidPrefixLength  = errors.New("prefix lengths must be at most 32 for IPv4 and 128 for IPv6")
+)
+
+// Config represents the configuration for the infohash limit middleware.
+type Config struct {
+	// MaxInfoHashes is the maximum number of distinct infohashes announced
+	// from the same network within the window.
+	MaxInfoHashes int `yaml:"max_infohashes"`
+
+	// Window is the duration an infohash is counted after the last Announce
+	// to it from the network.
+	// If zero, a default of 1h is used.
+	Window time.Duration `yaml:"window"`
+
+	// MaxIPs is the maximum number of networks whose infohashes are
+	// tracked. Beyond that, the networks that announced least recently are
+	// forgotten.
+	// If zero, a default of 100000 is used.
+	MaxIPs int `yaml:"max_ips"`
+
+	// IPv4PrefixLength and IPv6PrefixLength are the lengths of the prefixes
+	// that define a network, e.g. 24 to count the infohashes of a /24.
+	// If zero, every IPv4 address and every /64, which is usually assigned
+	// to a single host, is its own network. A prefix length of zero, i.e. a
+	// single network spanning all addresses, can't be configured.
+	IPv4PrefixLength int `yaml:"ipv4_prefix_length"`
+	IPv6PrefixLength int `yaml:"ipv6_prefix_length"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"maxInfoHashes":    cfg.MaxInfoHashes,
+		"window":           cfg.Window,
+		"maxIPs":           cfg.MaxIPs,
+		"ipv4PrefixLength": cfg.IPv4PrefixLength,
+		"ipv6PrefixLength": cfg.IPv6PrefixLength,
+		"softReject":       cfg.SoftReject.Enabled,
+	}
+}
+
+type hook struct {
+	cfg  Config
+	ipv4 net.IPMask
+	ipv6 net.IPMask
+
+	// networks holds the infohashes of the known networks along with the
+	// time in unix nanoseconds they expire, as a
+	// map[bittorrent.InfoHash]int64. At most MaxInfoHashes infohashes are
+	// held per network. A network expires with its last infohash.
+	networks *expiring.Map
+}
+
+// NewHook returns an instance of the infohash limit middleware.
+//
+// The infohashes of every network are tallied in memory, so the window starts
+// anew after a restart.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.MaxInfoHashes <= 0 {
+		return nil, ErrInvalidMaxInfoHashes
+	}
+	if cfg.Window < 0 {
+		return nil, ErrInvalidWindow
+	}
+	if cfg.MaxIPs < 0 {
+		return nil, ErrInvalidMaxIPs
+	}
+
+	// Zero is the unset value, so it can't be honored as a /0.
+	if cfg.IPv4PrefixLength == 0 {
+		cfg.IPv4PrefixLength = defaultIPv4PrefixLength
+	}
+	if cfg.IPv6PrefixLength == 0 {
+		cfg.IPv6PrefixLength = defaultIPv6PrefixLength
+	}
+	if cfg.IPv4PrefixLength < 0 || cfg.IPv4PrefixLength > 32 || cfg.IPv6PrefixLength < 0 || cfg.IPv6PrefixLength > 128 {
+		return nil, ErrInvalidPrefixLength
+	}
+
+	if cfg.Window == 0 {
+		cfg.Window = defaultWindow
+	}
+	if cfg.MaxIPs == 0 {
+		cfg.MaxIPs = defaultMaxIPs
+	}
+
+	return &hook{
+		cfg:      cfg,
+		ipv4:     net.CIDRMask(cfg.IPv4PrefixLength, 32),
+		ipv6:     net.CIDRMask(cfg.IPv6PrefixLength, 128),
+		networks: expiring.New(cfg.MaxIPs, cfg.Window/2),
+	}, nil
+}
+
+// network returns the key of the network of ip.
+func (h *hook) network(ip bittorrent.IP) string {
+	if ip.AddressFamily == bittorrent.IPv4 {
+		return string(ip.IP.To4().Mask(h.ipv4))
+	}
+	return string(ip.IP.To16().Mask(h.ipv6))
+}
+
+// admit counts infoHash as announced from network at now.
+//
+// Infohashes the network announced within the window are always admitted.
+// New infohashes are only admitted while the network is below the limit.
+func (h *hook) admit(network string, infoHash bittorrent.InfoHash, now time.Time) (admitted bool) {
+	h.networks.Update(network, now, func(n expiring.Entry, ok bool) expiring.Entry {
+		infoHashes, _ := n.Value.(map[bittorrent.InfoHash]int64)
+		if !ok {
+			infoHashes = make(map[bittorrent.InfoHash]int64)
+		}
+
+		cutoff := now.UnixNano()
+		if expires, ok := infoHashes[infoHash]; !ok || expires <= cutoff {
+			for ih, expires := range infoHashes {
+				if expires <= cutoff {
+					delete(infoHashes, ih)
+				}
+			}
+
+			if len(infoHashes) >= h.cfg.MaxInfoHashes {
+				return n
+			}
+		}
+
+		expires := now.Add(h.cfg.Window)
+		infoHashes[infoHash] = expires.UnixNano()
+		admitted = true
+		return expiring.Entry{Value: infoHashes, Expires: expires}
+	})
+	return
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Event == bittorrent.Stopped {
+		// Stopping doesn't join a swarm, so it is neither counted nor limited.
+		return ctx, nil
+	}
+
+	if !h.admit(h.network(req.IP), req.InfoHash, time.Now()) {
+		log.Debug("rejecting announce beyond infohash limit", log.RequestFields(ctx, log.Fields{
+			"infoHash": req.InfoHash,
+			"ip":       req.IP,
+		}))
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrTooManyInfoHashes)
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't join swarms.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests don't join swarms.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	return h.networks.Stop()
+}
@@ -0,0 +1,105 @@
+package infohashlimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func infoHash(b byte) bittorrent.InfoHash {
+	var ih bittorrent.InfoHash
+	ih[len(ih)-1] = b
+	return ih
+}
+
+func announce(h middleware.Hook, event bittorrent.Event, ih bittorrent.InfoHash, ip string) error {
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: event}
+	req.Peer.IP = bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4}
+	_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	return err
+}
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{MaxInfoHashes: 1}, nil},
+		{Config{MaxInfoHashes: 1, Window: time.Minute, MaxIPs: 10, IPv4PrefixLength: 24, IPv6PrefixLength: 64}, nil},
+		{Config{}, ErrInvalidMaxInfoHashes},
+		{Config{MaxInfoHashes: 1, Window: -time.Minute}, ErrInvalidWindow},
+		{Config{MaxInfoHashes: 1, MaxIPs: -1}, ErrInvalidMaxIPs},
+		{Config{MaxInfoHashes: 1, IPv6PrefixLength: 129}, ErrInvalidPrefixLength},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+		if err == nil {
+			<-h.(*hook).Stop()
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	h, err := NewHook(Config{MaxInfoHashes: 2, IPv4PrefixLength: 24})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	require.Nil(t, announce(h, bittorrent.Started, infoHash(1), "10.0.0.1"))
+	require.Nil(t, announce(h, bittorrent.Started, infoHash(2), "10.0.0.2"))
+	require.Equal(t, ErrTooManyInfoHashes, announce(h, bittorrent.Started, infoHash(3), "10.0.0.3"))
+
+	// Known infohashes, stopped events and other networks are accepted.
+	require.Nil(t, announce(h, bittorrent.None, infoHash(1), "10.0.0.3"))
+	require.Nil(t, announce(h, bittorrent.Stopped, infoHash(3), "10.0.0.3"))
+	require.Nil(t, announce(h, bittorrent.Started, infoHash(3), "10.0.1.3"))
+}
+
+func TestDefaultIPv6Network(t *testing.T) {
+	h, err := NewHook(Config{MaxInfoHashes: 1})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	// Rotating addresses within a /64 doesn't escape the limit.
+	hk := h.(*hook)
+	now := time.Now()
+	require.True(t, hk.admit(hk.network(bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}), infoHash(1), now))
+	require.False(t, hk.admit(hk.network(bittorrent.IP{IP: net.ParseIP("fc00::2:1"), AddressFamily: bittorrent.IPv6}), infoHash(2), now))
+	require.True(t, hk.admit(hk.network(bittorrent.IP{IP: net.ParseIP("fc00:0:0:1::1"), AddressFamily: bittorrent.IPv6}), infoHash(2), now))
+}
+
+func TestWindow(t *testing.T) {
+	h, err := NewHook(Config{MaxInfoHashes: 1})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	hk := h.(*hook)
+	network := hk.network(bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4})
+	now := time.Now()
+
+	require.True(t, hk.admit(network, infoHash(1), now))
+	require.False(t, hk.admit(network, infoHash(2), now.Add(time.Hour-time.Second)))
+	require.True(t, hk.admit(network, infoHash(2), now.Add(time.Hour)))
+}
+
+func TestMaxIPs(t *testing.T) {
+	h, err := NewHook(Config{MaxInfoHashes: 1, MaxIPs: 1})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	hk := h.(*hook)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		network := hk.network(bittorrent.IP{IP: net.IPv4(10, 0, 0, byte(i)).To4(), AddressFamily: bittorrent.IPv4})
+		require.True(t, hk.admit(network, infoHash(1), now))
+	}
+
+	require.True(t, hk.networks.Len() <= 16)
+}
@@ -0,0 +1,155 @@
+// Package infohashratelimit implements a Hook that limits the rate of
+// Announces per infohash across all peers.
+package infohashratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/ratelimit"
+)
+
+// Defaults of the configuration.
+const (
+	defaultMaxInfoHashes = 10000
+	defaultRetryIn       = time.Minute
+	gcInterval           = time.Minute
+)
+
+// ErrRateLimited is returned for Announces to a swarm that exceeds its
+// announce rate.
+var ErrRateLimited = bittorrent.NewClientError("infohash_rate_limited", "too many announces for this torrent, retry later")
+
+// Errors of the configuration.
+var (
+	ErrInvalidRate          = errors.New("rate must be positive")
+	ErrInvalidMaxInfoHashes = errors.New("max_infohashes must not be negative")
+)
+
+// Config represents the configuration for the infohash rate limit
+// middleware.
+type Config struct {
+	// Rate is the number of Announces per second that are accepted per
+	// infohash on average.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is the number of Announces per infohash that are accepted in
+	// excess of the Rate.
+	// If zero, the Rate rounded up is used.
+	Burst int `yaml:"burst"`
+
+	// MaxInfoHashes is the maximum number of infohashes whose rate is
+	// tracked. Beyond that, the tracking of the infohashes announced least
+	// recently is reset.
+	// If zero, a default of 10000 is used.
+	MaxInfoHashes int `yaml:"max_infohashes"`
+
+	// SoftReject configures how Announces beyond the rate are rejected.
+	// If neither soft rejection nor a retry_in is configured, clients are
+	// advised to retry after 1m.
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"rate":          cfg.Rate,
+		"burst":         cfg.Burst,
+		"maxInfoHashes": cfg.MaxInfoHashes,
+		"softReject":    cfg.SoftReject.Enabled,
+		"retryIn":       cfg.SoftReject.RetryIn,
+	}
+}
+
+type hook struct {
+	cfg Config
+
+	// refill is the duration an unused bucket takes to become full.
+	refill time.Duration
+
+	// buckets holds the *ratelimit.Limiter of every tracked infohash until
+	// it is full again, so that it can be forgotten.
+	buckets *expiring.Map
+}
+
+// NewHook returns an instance of the infohash rate limit middleware.
+//
+// The buckets are only kept in memory and are per instance, so the effective
+// limit of a tracker running on multiple instances is the sum of theirs.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.Rate <= 0 {
+		return nil, ErrInvalidRate
+	}
+
+	if cfg.MaxInfoHashes < 0 {
+		return nil, ErrInvalidMaxInfoHashes
+	}
+
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate))
+	}
+	if cfg.MaxInfoHashes == 0 {
+		cfg.MaxInfoHashes = defaultMaxInfoHashes
+	}
+	if !cfg.SoftReject.Enabled && cfg.SoftReject.RetryIn <= 0 {
+		cfg.SoftReject.RetryIn = defaultRetryIn
+	}
+
+	return &hook{
+		cfg:     cfg,
+		refill:  time.Duration(float64(cfg.Burst) / cfg.Rate * float64(time.Second)),
+		buckets: expiring.New(cfg.MaxInfoHashes, gcInterval),
+	}, nil
+}
+
+// allow reports whether an Announce to the swarm identified by infoHash may
+// happen at now.
+func (h *hook) allow(infoHash bittorrent.InfoHash, now time.Time) bool {
+	var limiter *ratelimit.Limiter
+	h.buckets.Update(string(infoHash[:]), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		if ok {
+			limiter = e.Value.(*ratelimit.Limiter)
+		} else {
+			limiter = ratelimit.New(h.cfg.Rate, h.cfg.Burst)
+		}
+		return expiring.Entry{Value: limiter, Expires: now.Add(h.refill)}
+	})
+
+	return limiter.AllowAt(now)
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Peers leaving the swarm are always accepted, so that it shrinks.
+	if req.Event == bittorrent.Stopped {
+		return ctx, nil
+	}
+
+	if !h.allow(req.InfoHash, time.Now()) {
+		log.Debug("infohash rate limited", log.RequestFields(ctx, log.Fields{
+			"infoHash": req.InfoHash,
+		}))
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrRateLimited)
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't interact with swarms.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests don't interact with swarms.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	return h.buckets.Stop()
+}
@@ -0,0 +1,111 @@
+package infohashratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{Rate: 10}, nil},
+		{Config{Rate: 0.5, Burst: 5, MaxInfoHashes: 100}, nil},
+		{Config{}, ErrInvalidRate},
+		{Config{Rate: -1}, ErrInvalidRate},
+		{Config{Rate: 1, MaxInfoHashes: -1}, ErrInvalidMaxInfoHashes},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+		if err == nil {
+			<-h.(*hook).Stop()
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	h, err := NewHook(Config{Rate: 1, Burst: 2})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	ih1 := bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000002")
+	now := time.Now()
+
+	require.True(t, h.(*hook).allow(ih1, now))
+	require.True(t, h.(*hook).allow(ih1, now))
+	require.False(t, h.(*hook).allow(ih1, now))
+
+	// Other infohashes are not affected.
+	require.True(t, h.(*hook).allow(ih2, now))
+
+	// A second refills a single token.
+	now = now.Add(time.Second)
+	require.True(t, h.(*hook).allow(ih1, now))
+	require.False(t, h.(*hook).allow(ih1, now))
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{Rate: 0.001})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	req := &bittorrent.AnnounceRequest{InfoHash: bittorrent.InfoHashFromString("00000000000000000001")}
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Equal(t, bittorrent.RetryError{ClientError: ErrRateLimited, RetryIn: defaultRetryIn}, err)
+
+	// Stopped announces are always accepted.
+	req.Event = bittorrent.Stopped
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
+
+func TestMaxInfoHashes(t *testing.T) {
+	h, err := NewHook(Config{Rate: 1, MaxInfoHashes: 16})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	now := time.Now()
+
+	require.True(t, h.(*hook).allow(ih, now))
+	require.False(t, h.(*hook).allow(ih, now))
+
+	// Announces to other swarms make room for their buckets.
+	for i := 0; i < 100; i++ {
+		other := ih
+		other[0] = byte(i)
+		other[1] = 1
+		h.(*hook).allow(other, now)
+	}
+	require.True(t, h.(*hook).buckets.Len() <= 16)
+
+	// The bucket of the infohash announced least recently was reset.
+	require.True(t, h.(*hook).allow(ih, now))
+}
+
+func TestExpiry(t *testing.T) {
+	h, err := NewHook(Config{Rate: 1, Burst: 10})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	now := time.Now()
+	h.(*hook).allow(ih, now)
+
+	_, ok := h.(*hook).buckets.Get(string(ih[:]), now.Add(5*time.Second))
+	require.True(t, ok)
+	_, ok = h.(*hook).buckets.Get(string(ih[:]), now.Add(10*time.Second))
+	require.False(t, ok)
+}
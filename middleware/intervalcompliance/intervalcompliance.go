@@ -0,0 +1,177 @@
+// Package intervalcompliance implements a Hook that penalizes peers that
+// announce more frequently than the interval they were issued.
+package intervalcompliance
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Policies for Announces that are sent too early.
+const (
+	PolicyReject = "reject"
+	PolicyFlag   = "flag"
+)
+
+// gcInterval is the interval at which peers that are allowed to announce are
+// forgotten.
+const gcInterval = time.Minute
+
+// ErrAnnounceTooEarly is returned when a peer announces before the interval
+// it was issued has passed.
+var ErrAnnounceTooEarly = bittorrent.NewClientError("announce_too_early", "announced before the min interval passed")
+
+// ErrInvalidPolicy is returned for a config with an unknown Policy.
+var ErrInvalidPolicy = errors.New("policy must be reject or flag")
+
+// ErrInvalidTolerance is returned for a config with an invalid Tolerance.
+var ErrInvalidTolerance = errors.New("invalid tolerance")
+
+// Config represents the configuration for the interval compliance middleware.
+type Config struct {
+	// Tolerance is the fraction of the issued interval a peer may announce
+	// early, e.g. 0.1 to accept announces after 90% of the interval.
+	Tolerance float64 `yaml:"tolerance"`
+
+	// Policy specifies how Announces that are sent too early are handled.
+	// They are either rejected or flagged as suspected abuse via
+	// middleware.SuspectedAbuseKey.
+	// If empty, they are flagged.
+	Policy string `yaml:"policy"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"tolerance":  cfg.Tolerance,
+		"policy":     cfg.Policy,
+		"softReject": cfg.SoftReject.Enabled,
+	}
+}
+
+// peerKey identifies a peer in a swarm.
+type peerKey struct {
+	infoHash bittorrent.InfoHash
+	peerID   bittorrent.PeerID
+}
+
+func (k peerKey) String() string {
+	return string(k.infoHash[:]) + string(k.peerID[:])
+}
+
+type hook struct {
+	cfg Config
+
+	// peers holds the times before which the known peers must not announce
+	// again.
+	peers *expiring.Map
+}
+
+// NewHook returns an instance of the interval compliance middleware.
+//
+// The issued intervals are only kept in memory, so the first Announce of a
+// peer after a restart is always accepted.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	switch cfg.Policy {
+	case "":
+		cfg.Policy = PolicyFlag
+	case PolicyReject, PolicyFlag:
+	default:
+		return nil, ErrInvalidPolicy
+	}
+
+	if cfg.Tolerance < 0 || cfg.Tolerance >= 1 {
+		return nil, ErrInvalidTolerance
+	}
+
+	return &hook{
+		cfg:   cfg,
+		peers: expiring.New(0, gcInterval),
+	}, nil
+}
+
+// record reports whether the peer identified by k announced before it was
+// allowed to at now.
+//
+// Unless the peer was early and force is false, the next allowed Announce is
+// set to next.
+func (h *hook) record(k peerKey, now, next time.Time, force bool) (early bool) {
+	h.peers.Update(k.String(), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		early = ok
+		if !early || force {
+			e.Expires = next
+		}
+		return e
+	})
+	return early
+}
+
+// forget removes the peer identified by k from the known peers.
+func (h *hook) forget(k peerKey) {
+	h.peers.Delete(k.String())
+}
+
+// issuedInterval returns the interval a peer must wait before announcing
+// again after receiving resp.
+func issuedInterval(resp *bittorrent.AnnounceResponse) time.Duration {
+	if resp.MinInterval > 0 {
+		return resp.MinInterval
+	}
+	return resp.Interval
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	k := peerKey{req.InfoHash, req.Peer.ID}
+
+	interval := issuedInterval(resp)
+	if req.Event == bittorrent.Stopped || interval <= 0 {
+		h.forget(k)
+		return ctx, nil
+	}
+
+	now := time.Now()
+	next := now.Add(time.Duration(float64(interval) * (1 - h.cfg.Tolerance)))
+
+	// Started and completed events end or start a session at any time.
+	if req.Event == bittorrent.Started || req.Event == bittorrent.Completed {
+		h.record(k, now, next, true)
+		return ctx, nil
+	}
+
+	if !h.record(k, now, next, h.cfg.Policy == PolicyFlag) {
+		return ctx, nil
+	}
+
+	log.Debug("announce before the issued interval passed", log.RequestFields(ctx, log.Fields{
+		"infoHash": req.InfoHash,
+		"peerID":   req.Peer.ID,
+	}))
+
+	if h.cfg.Policy == PolicyFlag {
+		return context.WithValue(ctx, middleware.SuspectedAbuseKey, struct{}{}), nil
+	}
+
+	return h.cfg.SoftReject.Reject(ctx, resp, ErrAnnounceTooEarly)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't have an interval.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are trusted.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	return h.peers.Stop()
+}
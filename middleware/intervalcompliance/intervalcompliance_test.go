@@ -0,0 +1,103 @@
+package intervalcompliance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func announce(event bittorrent.Event, peerID string) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHashFromString("00000000000000000001"),
+		Event:    event,
+		Peer:     bittorrent.Peer{ID: bittorrent.PeerIDFromString(peerID)},
+	}
+}
+
+func response() *bittorrent.AnnounceResponse {
+	return &bittorrent.AnnounceResponse{Interval: time.Hour, MinInterval: time.Hour}
+}
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{}, nil},
+		{Config{Policy: PolicyReject, Tolerance: 0.5}, nil},
+		{Config{Policy: "invalid"}, ErrInvalidPolicy},
+		{Config{Tolerance: -0.1}, ErrInvalidTolerance},
+		{Config{Tolerance: 1}, ErrInvalidTolerance},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+		if err == nil {
+			<-h.(*hook).Stop()
+		}
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{Policy: PolicyReject})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	var table = []struct {
+		event    bittorrent.Event
+		peerID   string
+		expected error
+	}{
+		// The first announce of a peer is always accepted.
+		{bittorrent.None, "-TR2940-000000000001", nil},
+		{bittorrent.None, "-TR2940-000000000001", ErrAnnounceTooEarly},
+
+		// Completed and stopped events may be sent at any time.
+		{bittorrent.Completed, "-TR2940-000000000001", nil},
+		{bittorrent.None, "-TR2940-000000000001", ErrAnnounceTooEarly},
+		{bittorrent.Stopped, "-TR2940-000000000001", nil},
+		{bittorrent.None, "-TR2940-000000000001", nil},
+
+		{bittorrent.Started, "-TR2940-000000000002", nil},
+		{bittorrent.Started, "-TR2940-000000000002", nil},
+		{bittorrent.None, "-TR2940-000000000002", ErrAnnounceTooEarly},
+	}
+
+	for _, tt := range table {
+		_, err := h.HandleAnnounce(context.Background(), announce(tt.event, tt.peerID), response())
+		require.Equal(t, tt.expected, err)
+	}
+}
+
+func TestTolerance(t *testing.T) {
+	h, err := NewHook(Config{Policy: PolicyReject, Tolerance: 0.1})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	k := peerKey{bittorrent.InfoHashFromString("00000000000000000001"), bittorrent.PeerIDFromString("-TR2940-000000000001")}
+	now := time.Now()
+	next := now.Add(54 * time.Minute)
+	require.False(t, h.(*hook).record(k, now, next, false))
+
+	// A rejected announce does not postpone the next allowed one.
+	require.True(t, h.(*hook).record(k, now.Add(53*time.Minute), now.Add(2*time.Hour), false))
+	require.False(t, h.(*hook).record(k, now.Add(55*time.Minute), now.Add(2*time.Hour), false))
+}
+
+func TestPolicyFlag(t *testing.T) {
+	h, err := NewHook(Config{})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	for _, flagged := range []bool{false, true, true} {
+		ctx, err := h.HandleAnnounce(context.Background(), announce(bittorrent.None, "-TR2940-000000000001"), response())
+		require.Nil(t, err)
+		require.Equal(t, flagged, ctx.Value(middleware.SuspectedAbuseKey) != nil)
+	}
+}
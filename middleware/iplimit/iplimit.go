@@ -0,0 +1,265 @@
+// Package iplimit implements a Hook that limits the number of peers from the
+// same IP address or network in a swarm.
+package iplimit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Policies for Announces of peers beyond the limit.
+const (
+	PolicyReject = "reject"
+	PolicyEvict  = "evict"
+)
+
+// defaultPeerLifetime is the default of the PeerLifetime.
+const defaultPeerLifetime = time.Hour
+
+// ErrTooManyPeers is returned when a peer announces to a swarm that already
+// has the maximum number of peers from its network.
+var ErrTooManyPeers = bittorrent.NewClientError("too_many_peers_from_network", "too many peers from your network in this swarm")
+
+// Errors of the configuration.
+var (
+	ErrInvalidMaxPeers     = errors.New("max_peers must be positive")
+	ErrInvalidPrefixLength = errors.New("prefix lengths must be at most 32 for IPv4 and 128 for IPv6")
+	ErrInvalidPolicy       = errors.New("policy must be reject or evict")
+)
+
+// Config represents the configuration for the ip limit middleware.
+type Config struct {
+	// MaxPeers is the maximum number of peers from the same network in a
+	// swarm.
+	MaxPeers int `yaml:"max_peers"`
+
+	// IPv4PrefixLength and IPv6PrefixLength are the lengths of the prefixes
+	// that define a network, e.g. 24 to limit the peers of a /24.
+	// If zero, every address is its own network. A prefix length of zero,
+	// i.e. a single network spanning all addresses, can't be configured.
+	IPv4PrefixLength int `yaml:"ipv4_prefix_length"`
+	IPv6PrefixLength int `yaml:"ipv6_prefix_length"`
+
+	// PeerLifetime is the duration a peer is counted after its last
+	// announce. It should match the peer lifetime of the storage.
+	// If zero, a default of 1h is used.
+	PeerLifetime time.Duration `yaml:"peer_lifetime"`
+
+	// Policy specifies how Announces of new peers beyond the limit are
+	// handled. They are either rejected, or the peer of the network that
+	// announced least recently is evicted from the swarm in their favor.
+	// If empty, they are rejected.
+	Policy string `yaml:"policy"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"maxPeers":         cfg.MaxPeers,
+		"ipv4PrefixLength": cfg.IPv4PrefixLength,
+		"ipv6PrefixLength": cfg.IPv6PrefixLength,
+		"peerLifetime":     cfg.PeerLifetime,
+		"policy":           cfg.Policy,
+		"softReject":       cfg.SoftReject.Enabled,
+	}
+}
+
+// networkKey identifies a network in a swarm.
+type networkKey struct {
+	infoHash bittorrent.InfoHash
+	network  string
+}
+
+// entry is the last announced Peer of a peer ID and the time in unix
+// nanoseconds it expires.
+type entry struct {
+	peer    bittorrent.Peer
+	expires int64
+}
+
+func (k networkKey) String() string {
+	return string(k.infoHash[:]) + k.network
+}
+
+type hook struct {
+	cfg   Config
+	store storage.PeerStore
+	ipv4  net.IPMask
+	ipv6  net.IPMask
+
+	// networks holds the peers of the known networks, at most MaxPeers per
+	// network, as a map[bittorrent.PeerID]entry. A network expires with
+	// its last peer.
+	networks *expiring.Map
+}
+
+// NewHook returns an instance of the ip limit middleware that evicts peers
+// from the given PeerStore.
+//
+// The peers of every network are tallied in memory, so peers registered
+// before a restart are not counted until they announce again.
+func NewHook(cfg Config, store storage.PeerStore) (middleware.Hook, error) {
+	if cfg.MaxPeers <= 0 {
+		return nil, ErrInvalidMaxPeers
+	}
+
+	// Zero is the unset value, so it can't be honored as a /0.
+	if cfg.IPv4PrefixLength == 0 {
+		cfg.IPv4PrefixLength = 32
+	}
+	if cfg.IPv6PrefixLength == 0 {
+		cfg.IPv6PrefixLength = 128
+	}
+	if cfg.IPv4PrefixLength < 0 || cfg.IPv4PrefixLength > 32 || cfg.IPv6PrefixLength < 0 || cfg.IPv6PrefixLength > 128 {
+		return nil, ErrInvalidPrefixLength
+	}
+
+	switch cfg.Policy {
+	case "":
+		cfg.Policy = PolicyReject
+	case PolicyReject, PolicyEvict:
+	default:
+		return nil, ErrInvalidPolicy
+	}
+
+	if cfg.PeerLifetime <= 0 {
+		cfg.PeerLifetime = defaultPeerLifetime
+	}
+
+	return &hook{
+		cfg:      cfg,
+		store:    store,
+		ipv4:     net.CIDRMask(cfg.IPv4PrefixLength, 32),
+		ipv6:     net.CIDRMask(cfg.IPv6PrefixLength, 128),
+		networks: expiring.New(0, cfg.PeerLifetime/2),
+	}, nil
+}
+
+// networkKey returns the key of the network of ip in the swarm identified by
+// infoHash.
+func (h *hook) networkKey(infoHash bittorrent.InfoHash, ip bittorrent.IP) networkKey {
+	if ip.AddressFamily == bittorrent.IPv4 {
+		return networkKey{infoHash, string(ip.IP.To4().Mask(h.ipv4))}
+	}
+	return networkKey{infoHash, string(ip.IP.To16().Mask(h.ipv6))}
+}
+
+// admit counts p as a peer of the network identified by k.
+//
+// If the network is full, p is only admitted with the evict policy. In that
+// case, the peer it replaces is returned.
+func (h *hook) admit(k networkKey, p bittorrent.Peer, now time.Time) (admitted bool, evicted *bittorrent.Peer) {
+	h.networks.Update(k.String(), now, func(n expiring.Entry, ok bool) expiring.Entry {
+		peers, _ := n.Value.(map[bittorrent.PeerID]entry)
+		if !ok {
+			peers = make(map[bittorrent.PeerID]entry)
+		}
+
+		cutoff := now.UnixNano()
+		if e, ok := peers[p.ID]; !ok || e.expires <= cutoff {
+			for id, e := range peers {
+				if e.expires <= cutoff {
+					delete(peers, id)
+				}
+			}
+
+			if len(peers) >= h.cfg.MaxPeers {
+				if h.cfg.Policy != PolicyEvict {
+					return n
+				}
+
+				var oldest bittorrent.PeerID
+				first := true
+				for id, e := range peers {
+					if first || e.expires < peers[oldest].expires {
+						oldest, first = id, false
+					}
+				}
+				evictedPeer := peers[oldest].peer
+				evicted = &evictedPeer
+				delete(peers, oldest)
+			}
+		}
+
+		expires := now.Add(h.cfg.PeerLifetime)
+		peers[p.ID] = entry{peer: p, expires: expires.UnixNano()}
+		admitted = true
+		return expiring.Entry{Value: peers, Expires: expires}
+	})
+	return
+}
+
+// forget removes the peer with the given ID from the network identified by k.
+func (h *hook) forget(k networkKey, id bittorrent.PeerID) {
+	h.networks.Update(k.String(), time.Now(), func(n expiring.Entry, ok bool) expiring.Entry {
+		if !ok {
+			return n
+		}
+
+		peers := n.Value.(map[bittorrent.PeerID]entry)
+		delete(peers, id)
+		if len(peers) == 0 {
+			return expiring.Entry{}
+		}
+		return n
+	})
+}
+
+// evict removes p from the swarm identified by infoHash, whatever its role.
+func (h *hook) evict(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) {
+	for _, del := range []func(bittorrent.InfoHash, bittorrent.Peer) error{h.store.DeleteSeeder, h.store.DeleteLeecher} {
+		if err := del(infoHash, p); err != nil && err != storage.ErrResourceDoesNotExist {
+			log.Error("failed to evict peer", log.RequestFields(ctx, log.Fields{
+				"infoHash": infoHash,
+				"peer":     p,
+			}), log.Err(err))
+		}
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	k := h.networkKey(req.InfoHash, req.IP)
+	if req.Event == bittorrent.Stopped {
+		h.forget(k, req.Peer.ID)
+		return ctx, nil
+	}
+
+	admitted, evicted := h.admit(k, req.Peer, time.Now())
+	if !admitted {
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrTooManyPeers)
+	}
+
+	if evicted != nil {
+		log.Debug("evicting peer beyond ip limit", log.RequestFields(ctx, log.Fields{
+			"infoHash": req.InfoHash,
+			"peer":     *evicted,
+		}))
+		h.evict(ctx, req.InfoHash, *evicted)
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't register peers.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests don't register peers.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	return h.networks.Stop()
+}
@@ -0,0 +1,87 @@
+package iplimit
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+var ih = bittorrent.InfoHashFromString("00000000000000000001")
+
+func peer(id, ip string) bittorrent.Peer {
+	return bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString(id),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+	}
+}
+
+func announce(h middleware.Hook, event bittorrent.Event, p bittorrent.Peer) error {
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: event, Peer: p}
+	_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	return err
+}
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{MaxPeers: 1}, nil},
+		{Config{MaxPeers: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 64, Policy: PolicyEvict}, nil},
+		{Config{}, ErrInvalidMaxPeers},
+		{Config{MaxPeers: 1, IPv4PrefixLength: 33}, ErrInvalidPrefixLength},
+		{Config{MaxPeers: 1, Policy: "flag"}, ErrInvalidPolicy},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg, nil)
+		require.Equal(t, tt.expected, err)
+		if err == nil {
+			<-h.(*hook).Stop()
+		}
+	}
+}
+
+func TestReject(t *testing.T) {
+	h, err := NewHook(Config{MaxPeers: 2, IPv4PrefixLength: 24}, nil)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	require.Nil(t, announce(h, bittorrent.Started, peer("-TR2940-000000000001", "10.0.0.1")))
+	require.Nil(t, announce(h, bittorrent.Started, peer("-TR2940-000000000002", "10.0.0.2")))
+	require.Equal(t, ErrTooManyPeers, announce(h, bittorrent.Started, peer("-TR2940-000000000003", "10.0.0.3")))
+
+	// Known peers and peers of other networks are accepted.
+	require.Nil(t, announce(h, bittorrent.None, peer("-TR2940-000000000001", "10.0.0.1")))
+	require.Nil(t, announce(h, bittorrent.Started, peer("-TR2940-000000000003", "10.0.1.3")))
+
+	// Stopping frees a slot.
+	require.Nil(t, announce(h, bittorrent.Stopped, peer("-TR2940-000000000002", "10.0.0.2")))
+	require.Nil(t, announce(h, bittorrent.Started, peer("-TR2940-000000000003", "10.0.0.3")))
+}
+
+func TestEvict(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	h, err := NewHook(Config{MaxPeers: 1, Policy: PolicyEvict}, ps)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	first := peer("-TR2940-000000000001", "10.0.0.1")
+	second := peer("-TR2940-000000000002", "10.0.0.1")
+
+	require.Nil(t, announce(h, bittorrent.Started, first))
+	require.Nil(t, ps.PutLeecher(ih, first))
+
+	require.Nil(t, announce(h, bittorrent.Started, second))
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+}
@@ -0,0 +1,90 @@
+// Package ipprivacy implements a Hook that provides a privacy-masked copy of
+// the IP of announcing peers to downstream middleware.
+package ipprivacy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Defaults of the configuration.
+const (
+	defaultIPv4PrefixLength = 24
+	defaultIPv6PrefixLength = 48
+)
+
+// ErrInvalidPrefixLength is returned for a config with a prefix length outside
+// of the address length.
+var ErrInvalidPrefixLength = errors.New("prefix lengths must be at most 32 for IPv4 and 128 for IPv6")
+
+// Config represents the configuration for the ip privacy middleware.
+type Config struct {
+	// IPv4PrefixLength is the number of leading bits of IPv4 addresses that
+	// are kept. If zero, a default of 24 is used.
+	IPv4PrefixLength int `yaml:"ipv4_prefix_length"`
+
+	// IPv6PrefixLength is the number of leading bits of IPv6 addresses that
+	// are kept. If zero, a default of 48 is used.
+	IPv6PrefixLength int `yaml:"ipv6_prefix_length"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"ipv4PrefixLength": cfg.IPv4PrefixLength,
+		"ipv6PrefixLength": cfg.IPv6PrefixLength,
+	}
+}
+
+type hook struct {
+	v4Mask net.IPMask
+	v6Mask net.IPMask
+}
+
+// NewHook returns an instance of the ip privacy middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.IPv4PrefixLength == 0 {
+		cfg.IPv4PrefixLength = defaultIPv4PrefixLength
+	}
+	if cfg.IPv6PrefixLength == 0 {
+		cfg.IPv6PrefixLength = defaultIPv6PrefixLength
+	}
+
+	if cfg.IPv4PrefixLength < 0 || cfg.IPv4PrefixLength > 32 || cfg.IPv6PrefixLength < 0 || cfg.IPv6PrefixLength > 128 {
+		return nil, ErrInvalidPrefixLength
+	}
+
+	return &hook{
+		v4Mask: net.CIDRMask(cfg.IPv4PrefixLength, 32),
+		v6Mask: net.CIDRMask(cfg.IPv6PrefixLength, 128),
+	}, nil
+}
+
+// mask returns a copy of ip truncated to the configured prefix length.
+func (h *hook) mask(ip bittorrent.IP) bittorrent.IP {
+	if ip.AddressFamily == bittorrent.IPv4 {
+		return bittorrent.IP{IP: ip.Mask(h.v4Mask), AddressFamily: ip.AddressFamily}
+	}
+	return bittorrent.IP{IP: ip.Mask(h.v6Mask), AddressFamily: ip.AddressFamily}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// The IP of the request is left untouched, so peers can still connect
+	// to each other.
+	return context.WithValue(ctx, middleware.MaskedIPKey, h.mask(req.Peer.IP)), nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't carry a peer IP.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests don't carry a peer IP.
+	return ctx, nil
+}
@@ -0,0 +1,52 @@
+package ipprivacy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{IPv4PrefixLength: 33})
+	require.Equal(t, ErrInvalidPrefixLength, err)
+
+	_, err = NewHook(Config{IPv6PrefixLength: -1})
+	require.Equal(t, ErrInvalidPrefixLength, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		ip       string
+		expected string
+	}{
+		{Config{}, "10.11.12.13", "10.11.12.0"},
+		{Config{IPv4PrefixLength: 16}, "10.11.12.13", "10.11.0.0"},
+		{Config{IPv4PrefixLength: 32}, "10.11.12.13", "10.11.12.13"},
+		{Config{}, "2001:db8:1:2::1", "2001:db8:1::"},
+		{Config{IPv6PrefixLength: 64}, "2001:db8:1:2::1", "2001:db8:1:2::"},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Nil(t, err)
+
+		ip := bittorrent.IP{IP: net.ParseIP(tt.ip), AddressFamily: bittorrent.IPv6}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = bittorrent.IP{IP: ip4, AddressFamily: bittorrent.IPv4}
+		}
+		req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{IP: ip}}
+
+		ctx, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, middleware.LoggableIP(ctx, req.Peer.IP).String())
+
+		// The IP used for the swarm is unchanged.
+		require.Equal(t, tt.ip, req.Peer.IP.String())
+	}
+}
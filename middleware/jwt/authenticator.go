@@ -0,0 +1,88 @@
+package jwt
+
+import (
+	"context"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrMissingSubject is returned when a valid JWT does not identify a user.
+var ErrMissingSubject = bittorrent.NewClientError("jwt_without_subject", "unapproved request: jwt without subject")
+
+// AuthenticatorConfig represents all the values required by the JWT
+// Authenticator to fetch JWKs and verify JWTs.
+type AuthenticatorConfig struct {
+	Issuer            string        `yaml:"issuer"`
+	Audience          string        `yaml:"audience"`
+	JWKSetURL         string        `yaml:"jwk_set_url"`
+	JWKUpdateInterval time.Duration `yaml:"jwk_set_update_interval"`
+
+	// Required specifies whether requests without a JWT are rejected.
+	Required bool `yaml:"required"`
+}
+
+// LogFields implements log.Fielder for an AuthenticatorConfig.
+func (cfg AuthenticatorConfig) LogFields() log.Fields {
+	return log.Fields{
+		"issuer":            cfg.Issuer,
+		"audience":          cfg.Audience,
+		"JWKSetURL":         cfg.JWKSetURL,
+		"JWKUpdateInterval": cfg.JWKUpdateInterval,
+		"required":          cfg.Required,
+	}
+}
+
+type authenticator struct {
+	*hook
+	required bool
+}
+
+// NewAuthenticator returns a frontend.Authenticator that verifies JWTs and
+// uses their "sub" claim as the UserID.
+//
+// The JWT is read from the token of the Credentials, e.g. the HTTP
+// Authorization header, or the "jwt" parameter of the request.
+// The returned Authenticator implements stop.Stopper.
+func NewAuthenticator(cfg AuthenticatorConfig) (frontend.Authenticator, error) {
+	log.Debug("creating new JWT authenticator", cfg)
+	h, err := newHook(Config{
+		Issuer:            cfg.Issuer,
+		Audience:          cfg.Audience,
+		JWKSetURL:         cfg.JWKSetURL,
+		JWKUpdateInterval: cfg.JWKUpdateInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &authenticator{hook: h, required: cfg.Required}, nil
+}
+
+func (a *authenticator) Authenticate(ctx context.Context, creds frontend.Credentials) (context.Context, error) {
+	token := creds.Token
+	if token == "" && creds.Params != nil {
+		token, _ = creds.Params.String("jwt")
+	}
+
+	if token == "" {
+		if a.required {
+			return ctx, ErrMissingJWT
+		}
+		return ctx, nil
+	}
+
+	claims, err := verifyJWT(ctx, []byte(token), a.cfg.Issuer, a.cfg.Audience, a.publicKeys)
+	if err != nil {
+		return ctx, ErrInvalidJWT
+	}
+
+	sub, ok := claims.Subject()
+	if !ok || sub == "" {
+		return ctx, ErrMissingSubject
+	}
+
+	return context.WithValue(ctx, frontend.UserIDKey, sub), nil
+}
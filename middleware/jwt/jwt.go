@@ -29,10 +29,10 @@ import (
 
 var (
 	// ErrMissingJWT is returned when a JWT is missing from a request.
-	ErrMissingJWT = bittorrent.ClientError("unapproved request: missing jwt")
+	ErrMissingJWT = bittorrent.NewClientError("missing_jwt", "unapproved request: missing jwt")
 
 	// ErrInvalidJWT is returned when a JWT fails to verify.
-	ErrInvalidJWT = bittorrent.ClientError("unapproved request: invalid jwt")
+	ErrInvalidJWT = bittorrent.NewClientError("invalid_jwt", "unapproved request: invalid jwt")
 )
 
 // Config represents all the values required by this middleware to fetch JWKs
@@ -42,6 +42,8 @@ type Config struct {
 	Audience          string        `yaml:"audience"`
 	JWKSetURL         string        `yaml:"jwk_set_url"`
 	JWKUpdateInterval time.Duration `yaml:"jwk_set_update_interval"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
 }
 
 // LogFields implements log.Fielder for a Config.
@@ -51,6 +53,7 @@ func (cfg Config) LogFields() log.Fields {
 		"audience":          cfg.Audience,
 		"JWKSetURL":         cfg.JWKSetURL,
 		"JWKUpdateInterval": cfg.JWKUpdateInterval,
+		"softReject":        cfg.SoftReject.Enabled,
 	}
 }
 
@@ -63,6 +66,10 @@ type hook struct {
 // NewHook returns an instance of the JWT middleware.
 func NewHook(cfg Config) (middleware.Hook, error) {
 	log.Debug("creating new JWT middleware", cfg)
+	return newHook(cfg)
+}
+
+func newHook(cfg Config) (*hook, error) {
 	h := &hook{
 		cfg:        cfg,
 		publicKeys: map[string]crypto.PublicKey{},
@@ -138,16 +145,16 @@ func (h *hook) Stop() <-chan error {
 
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
 	if req.Params == nil {
-		return ctx, ErrMissingJWT
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrMissingJWT)
 	}
 
 	jwtParam, ok := req.Params.String("jwt")
 	if !ok {
-		return ctx, ErrMissingJWT
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrMissingJWT)
 	}
 
-	if err := validateJWT(req.InfoHash, []byte(jwtParam), h.cfg.Issuer, h.cfg.Audience, h.publicKeys); err != nil {
-		return ctx, ErrInvalidJWT
+	if err := validateJWT(ctx, req.InfoHash, []byte(jwtParam), h.cfg.Issuer, h.cfg.Audience, h.publicKeys); err != nil {
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrInvalidJWT)
 	}
 
 	return ctx, nil
@@ -163,65 +170,76 @@ func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *
 	return ctx, nil
 }
 
-func validateJWT(ih bittorrent.InfoHash, jwtBytes []byte, cfgIss, cfgAud string, publicKeys map[string]crypto.PublicKey) error {
-	parsedJWT, err := jws.ParseJWT(jwtBytes)
+func validateJWT(ctx context.Context, ih bittorrent.InfoHash, jwtBytes []byte, cfgIss, cfgAud string, publicKeys map[string]crypto.PublicKey) error {
+	claims, err := verifyJWT(ctx, jwtBytes, cfgIss, cfgAud, publicKeys)
 	if err != nil {
 		return err
 	}
 
+	ihHex := hex.EncodeToString(ih[:])
+	if ihClaim, ok := claims.Get("infohash").(string); !ok || ihClaim != ihHex {
+		log.Debug("unequal or missing infohash when validating JWT", log.RequestFields(ctx, log.Fields{
+			"exists":  ok,
+			"claim":   ihClaim,
+			"request": ihHex,
+		}))
+		return errors.New("claim \"infohash\" is invalid")
+	}
+
+	return nil
+}
+
+// verifyJWT verifies the signature and the standard claims of a JWT and
+// returns its claims.
+func verifyJWT(ctx context.Context, jwtBytes []byte, cfgIss, cfgAud string, publicKeys map[string]crypto.PublicKey) (jwt.Claims, error) {
+	parsedJWT, err := jws.ParseJWT(jwtBytes)
+	if err != nil {
+		return nil, err
+	}
+
 	claims := parsedJWT.Claims()
 	if iss, ok := claims.Issuer(); !ok || iss != cfgIss {
-		log.Debug("unequal or missing issuer when validating JWT", log.Fields{
+		log.Debug("unequal or missing issuer when validating JWT", log.RequestFields(ctx, log.Fields{
 			"exists": ok,
 			"claim":  iss,
 			"config": cfgIss,
-		})
-		return jwt.ErrInvalidISSClaim
+		}))
+		return nil, jwt.ErrInvalidISSClaim
 	}
 
 	if auds, ok := claims.Audience(); !ok || !in(cfgAud, auds) {
-		log.Debug("unequal or missing audience when validating JWT", log.Fields{
+		log.Debug("unequal or missing audience when validating JWT", log.RequestFields(ctx, log.Fields{
 			"exists": ok,
 			"claim":  strings.Join(auds, ","),
 			"config": cfgAud,
-		})
-		return jwt.ErrInvalidAUDClaim
-	}
-
-	ihHex := hex.EncodeToString(ih[:])
-	if ihClaim, ok := claims.Get("infohash").(string); !ok || ihClaim != ihHex {
-		log.Debug("unequal or missing infohash when validating JWT", log.Fields{
-			"exists":  ok,
-			"claim":   ihClaim,
-			"request": ihHex,
-		})
-		return errors.New("claim \"infohash\" is invalid")
+		}))
+		return nil, jwt.ErrInvalidAUDClaim
 	}
 
 	parsedJWS := parsedJWT.(jws.JWS)
 	kid, ok := parsedJWS.Protected().Get("kid").(string)
 	if !ok {
-		log.Debug("missing kid when validating JWT", log.Fields{
+		log.Debug("missing kid when validating JWT", log.RequestFields(ctx, log.Fields{
 			"exists": ok,
 			"claim":  kid,
-		})
-		return errors.New("invalid kid")
+		}))
+		return nil, errors.New("invalid kid")
 	}
 	publicKey, ok := publicKeys[kid]
 	if !ok {
-		log.Debug("missing public key forkid when validating JWT", log.Fields{
+		log.Debug("missing public key forkid when validating JWT", log.RequestFields(ctx, log.Fields{
 			"kid": kid,
-		})
-		return errors.New("signed by unknown kid")
+		}))
+		return nil, errors.New("signed by unknown kid")
 	}
 
 	err = parsedJWS.Verify(publicKey, jc.SigningMethodRS256)
 	if err != nil {
-		log.Debug("failed to verify signature of JWT", log.Err(err))
-		return err
+		log.Debug("failed to verify signature of JWT", log.RequestFields(ctx, log.Err(err)))
+		return nil, err
 	}
 
-	return nil
+	return claims, nil
 }
 
 func in(x string, xs []string) bool {
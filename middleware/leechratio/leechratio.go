@@ -0,0 +1,165 @@
+// Package leechratio implements a Hook that refuses new leechers while the
+// whole tracker has too many leechers per seeder.
+package leechratio
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// defaultRefreshInterval is the interval at which the peer counts are read
+// if none is configured.
+const defaultRefreshInterval = 10 * time.Second
+
+// ErrTooManyLeechers is returned when a new leecher announces while the
+// tracker has too many leechers per seeder.
+var ErrTooManyLeechers = bittorrent.NewClientError("too_many_leechers", "too many leechers, try again later")
+
+// ErrInvalidMaxRatio is returned for a config with an invalid MaxRatio.
+var ErrInvalidMaxRatio = errors.New("invalid max_ratio")
+
+// ErrCountsNotSupported is returned if the PeerStore does not maintain the
+// total numbers of its peers.
+var ErrCountsNotSupported = errors.New("storage does not count peers")
+
+// Config represents the configuration for the leech ratio middleware.
+type Config struct {
+	// MaxRatio is the number of leechers per seeder across all swarms
+	// above which new leechers are refused.
+	MaxRatio float64 `yaml:"max_ratio"`
+
+	// MinPeers is the number of peers the tracker must hold before the
+	// ratio is enforced, so that a nearly empty tracker, e.g. after a
+	// restart, does not refuse leechers.
+	MinPeers uint64 `yaml:"min_peers"`
+
+	// RefreshInterval is the interval at which the peer counts are read
+	// from the PeerStore.
+	// If zero, a default of 10s is used.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"maxRatio":        cfg.MaxRatio,
+		"minPeers":        cfg.MinPeers,
+		"refreshInterval": cfg.RefreshInterval,
+		"softReject":      cfg.SoftReject.Enabled,
+	}
+}
+
+type hook struct {
+	cfg     Config
+	store   storage.PeerCountStore
+	exceed  atomic.Value
+	closing chan struct{}
+}
+
+// NewHook returns an instance of the leech ratio middleware that reads the
+// numbers of peers of both address families from the given PeerStore.
+func NewHook(cfg Config, store storage.PeerStore) (middleware.Hook, error) {
+	if cfg.MaxRatio <= 0 {
+		return nil, ErrInvalidMaxRatio
+	}
+
+	cs, ok := store.(storage.PeerCountStore)
+	if !ok {
+		return nil, ErrCountsNotSupported
+	}
+
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultRefreshInterval
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		store:   cs,
+		closing: make(chan struct{}),
+	}
+	h.refresh()
+
+	go func() {
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-time.After(cfg.RefreshInterval):
+				h.refresh()
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// refresh reads the peer counts and records whether they exceed the
+// configured ratio.
+func (h *hook) refresh() {
+	var seeders, leechers uint64
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		counts := h.store.PeerCounts(af)
+		seeders += counts.Seeders
+		leechers += counts.Leechers
+	}
+
+	h.exceed.Store(h.exceeds(seeders, leechers))
+}
+
+// exceeds reports whether the given numbers of peers exceed the configured
+// ratio. A tracker without seeders exceeds any ratio.
+func (h *hook) exceeds(seeders, leechers uint64) bool {
+	if seeders+leechers < h.cfg.MinPeers || leechers == 0 {
+		return false
+	}
+
+	return float64(leechers) > h.cfg.MaxRatio*float64(seeders)
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Only leechers joining a swarm are checked, seeders and existing
+	// leechers are always accepted.
+	if req.Left == 0 || req.Event != bittorrent.Started {
+		return ctx, nil
+	}
+
+	if exceed, _ := h.exceed.Load().(bool); !exceed {
+		return ctx, nil
+	}
+
+	return h.cfg.SoftReject.Reject(ctx, resp, ErrTooManyLeechers)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't add leechers.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests don't add leechers.
+	return ctx, nil
+}
+
+// Stop stops refreshing the peer counts.
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+
+	close(h.closing)
+	c := make(chan error)
+	close(c)
+	return c
+}
@@ -0,0 +1,84 @@
+package leechratio
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+var ih = bittorrent.InfoHashFromString("01234567890123456789")
+
+func peer(ip string) bittorrent.Peer {
+	p := bittorrent.Peer{ID: bittorrent.PeerIDFromString("-TR2940-000000000001"), Port: 6881}
+	if v4 := net.ParseIP(ip).To4(); v4 != nil {
+		p.IP = bittorrent.IP{IP: v4, AddressFamily: bittorrent.IPv4}
+	} else {
+		p.IP = bittorrent.IP{IP: net.ParseIP(ip), AddressFamily: bittorrent.IPv6}
+	}
+	return p
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	_, err = NewHook(Config{}, ps)
+	require.Equal(t, ErrInvalidMaxRatio, err)
+
+	// Seeders of both address families count.
+	require.Nil(t, ps.PutSeeder(ih, peer("fc00::1")))
+	require.Nil(t, ps.PutLeecher(ih, peer("1.1.1.1")))
+	require.Nil(t, ps.PutLeecher(ih, peer("1.1.1.2")))
+
+	h, err := NewHook(Config{MaxRatio: 2}, ps)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	announce := func(event bittorrent.Event, left uint64) error {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: event, Left: left}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		return err
+	}
+	require.Nil(t, announce(bittorrent.Started, 10))
+
+	require.Nil(t, ps.PutLeecher(ih, peer("1.1.1.3")))
+	h.(*hook).refresh()
+	require.Equal(t, ErrTooManyLeechers, announce(bittorrent.Started, 10))
+
+	// Seeders and existing leechers are always accepted.
+	require.Nil(t, announce(bittorrent.Started, 0))
+	require.Nil(t, announce(bittorrent.None, 10))
+
+	h.(*hook).cfg.SoftReject = middleware.SoftRejectConfig{Enabled: true}
+	ctx, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih, Event: bittorrent.Started, Left: 10}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+}
+
+func TestExceeds(t *testing.T) {
+	h := &hook{cfg: Config{MaxRatio: 1.5, MinPeers: 10}}
+
+	var table = []struct {
+		seeders  uint64
+		leechers uint64
+		expected bool
+	}{
+		// Nearly empty trackers aren't limited.
+		{0, 9, false},
+		{0, 10, true},
+		{4, 6, false},
+		{4, 7, true},
+		{10, 0, false},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, h.exceeds(tt.seeders, tt.leechers), tt)
+	}
+}
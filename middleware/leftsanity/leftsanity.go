@@ -0,0 +1,133 @@
+// Package leftsanity implements a Hook that validates the amount of bytes left
+// reported by clients on started events against known torrent sizes.
+package leftsanity
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrImplausibleLeft is returned when a started event reports a value for
+// left that does not match the size of the torrent.
+var ErrImplausibleLeft = bittorrent.NewClientError("implausible_left", "implausible left for started event")
+
+// ErrInvalidTolerance is returned for a config with an invalid Tolerance.
+var ErrInvalidTolerance = errors.New("invalid tolerance")
+
+type implausibleLeft struct{}
+
+// ImplausibleLeftKey is the key under which the hook stores whether an
+// Announce was found to report an implausible value for left.
+// The value is of type bool and only set for implausible Announces that were
+// not rejected.
+var ImplausibleLeftKey = implausibleLeft{}
+
+// Config represents the configuration for the leftsanity middleware.
+type Config struct {
+	// Sizes maps hex-encoded infohashes to the size of their torrent in
+	// bytes.
+	// Announces for infohashes not contained are not validated.
+	Sizes map[string]uint64 `yaml:"sizes"`
+
+	// Tolerance is the relative deviation from the size of a torrent that
+	// is still considered plausible, e.g. 0.1 for 10%.
+	// Note that clients resuming a download send a started event with less
+	// than the full size left; use a Tolerance of 1 to only catch values
+	// exceeding the torrent size drastically.
+	Tolerance float64 `yaml:"tolerance"`
+
+	// Reject specifies whether Announces with implausible values are
+	// rejected. If false, they are only flagged via ImplausibleLeftKey.
+	Reject bool `yaml:"reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"sizes":     len(cfg.Sizes),
+		"tolerance": cfg.Tolerance,
+		"reject":    cfg.Reject,
+	}
+}
+
+type hook struct {
+	sizes     map[bittorrent.InfoHash]uint64
+	tolerance float64
+	reject    bool
+}
+
+// NewHook returns an instance of the leftsanity middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.Tolerance < 0 || cfg.Tolerance > 1 {
+		return nil, ErrInvalidTolerance
+	}
+
+	h := &hook{
+		sizes:     make(map[bittorrent.InfoHash]uint64, len(cfg.Sizes)),
+		tolerance: cfg.Tolerance,
+		reject:    cfg.Reject,
+	}
+
+	for ihString, size := range cfg.Sizes {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			return nil, errors.New("infohash " + ihString + " must be 40 hex characters")
+		}
+		h.sizes[bittorrent.InfoHashFromBytes(ihBytes)] = size
+	}
+
+	return h, nil
+}
+
+// plausible reports whether left lies within the tolerated range around size.
+func (h *hook) plausible(left, size uint64) bool {
+	delta := uint64(float64(size) * h.tolerance)
+
+	if left > size && left-size > delta {
+		return false
+	}
+
+	if left < size && size-left > delta {
+		return false
+	}
+
+	return true
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Event != bittorrent.Started {
+		return ctx, nil
+	}
+
+	size, ok := h.sizes[req.InfoHash]
+	if !ok || h.plausible(req.Left, size) {
+		return ctx, nil
+	}
+
+	log.Debug("implausible left for started event", log.RequestFields(ctx, log.Fields{
+		"infoHash": req.InfoHash,
+		"left":     req.Left,
+		"size":     size,
+	}))
+
+	if h.reject {
+		return ctx, ErrImplausibleLeft
+	}
+
+	return context.WithValue(ctx, ImplausibleLeftKey, true), nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't report any progress.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api doesn't report any progress.
+	return ctx, nil
+}
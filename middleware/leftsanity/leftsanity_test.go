@@ -0,0 +1,72 @@
+package leftsanity
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const testInfoHash = "0102030405060708090a0b0c0d0e0f1011121314"
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{Tolerance: -0.1})
+	require.Equal(t, ErrInvalidTolerance, err)
+
+	_, err = NewHook(Config{Tolerance: 1.1})
+	require.Equal(t, ErrInvalidTolerance, err)
+
+	_, err = NewHook(Config{Sizes: map[string]uint64{"abc": 1}})
+	require.NotNil(t, err)
+
+	_, err = NewHook(Config{Sizes: map[string]uint64{testInfoHash: 1}})
+	require.Nil(t, err)
+}
+
+var announceTests = []struct {
+	event    bittorrent.Event
+	left     uint64
+	expected error
+}{
+	{bittorrent.Started, 1000, nil},
+	{bittorrent.Started, 1050, nil},
+	{bittorrent.Started, 950, nil},
+	{bittorrent.Started, 1200, ErrImplausibleLeft},
+	{bittorrent.Started, 10, ErrImplausibleLeft},
+	{bittorrent.None, 10, nil},
+	{bittorrent.Completed, 0, nil},
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ih := bittorrent.InfoHashFromBytes([]byte("\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13\x14"))
+
+	for _, reject := range []bool{true, false} {
+		h, err := NewHook(Config{
+			Sizes:     map[string]uint64{testInfoHash: 1000},
+			Tolerance: 0.1,
+			Reject:    reject,
+		})
+		require.Nil(t, err)
+
+		for _, tt := range announceTests {
+			req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: tt.event, Left: tt.left}
+			ctx, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+			if reject {
+				require.Equal(t, tt.expected, err)
+				require.Nil(t, ctx.Value(ImplausibleLeftKey))
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, tt.expected != nil, ctx.Value(ImplausibleLeftKey) != nil)
+			}
+		}
+	}
+
+	// Unknown infohashes are never validated.
+	h, err := NewHook(Config{Reject: true})
+	require.Nil(t, err)
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: bittorrent.Started, Left: 1}
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
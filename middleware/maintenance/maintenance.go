@@ -0,0 +1,127 @@
+// Package maintenance implements a Hook that turns clients away during
+// maintenance windows.
+package maintenance
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrMaintenance is returned for requests during maintenance.
+var ErrMaintenance = bittorrent.NewClientError("maintenance", "tracker is under maintenance, try again later")
+
+// ErrInvalidWindow is returned for a config with a maintenance window that
+// cannot be parsed or that ends before it starts.
+var ErrInvalidWindow = errors.New("maintenance window must have an RFC 3339 start before its end")
+
+// Config represents the configuration for the maintenance middleware.
+type Config struct {
+	// Enabled specifies whether maintenance is active.
+	// If Windows is empty, maintenance is active for as long as it is
+	// enabled, otherwise only during the windows.
+	Enabled bool `yaml:"enabled"`
+
+	// Windows are the scheduled maintenance windows.
+	Windows []WindowConfig `yaml:"windows"`
+
+	// RejectScrapes specifies whether scrapes are rejected during
+	// maintenance as well. Scrapes are never rejected softly, but are
+	// advised to retry after SoftReject.RetryIn, if set.
+	RejectScrapes bool `yaml:"reject_scrapes"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// WindowConfig is a maintenance window.
+type WindowConfig struct {
+	// Start is the beginning of the window in RFC 3339 format.
+	Start string `yaml:"start"`
+
+	// End is the end of the window in RFC 3339 format.
+	End string `yaml:"end"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"enabled":       cfg.Enabled,
+		"windows":       len(cfg.Windows),
+		"rejectScrapes": cfg.RejectScrapes,
+		"softReject":    cfg.SoftReject.Enabled,
+	}
+}
+
+// window is a parsed WindowConfig.
+type window struct {
+	start, end time.Time
+}
+
+type hook struct {
+	cfg     Config
+	windows []window
+	now     func() time.Time
+}
+
+// NewHook returns an instance of the maintenance middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	h := &hook{cfg: cfg, now: time.Now}
+
+	for _, w := range cfg.Windows {
+		start, err := time.Parse(time.RFC3339, w.Start)
+		if err != nil {
+			return nil, ErrInvalidWindow
+		}
+		end, err := time.Parse(time.RFC3339, w.End)
+		if err != nil || !start.Before(end) {
+			return nil, ErrInvalidWindow
+		}
+		h.windows = append(h.windows, window{start, end})
+	}
+
+	return h, nil
+}
+
+// active returns whether maintenance is currently active.
+func (h *hook) active() bool {
+	if !h.cfg.Enabled {
+		return false
+	}
+	if len(h.windows) == 0 {
+		return true
+	}
+
+	now := h.now()
+	for _, w := range h.windows {
+		if !now.Before(w.start) && now.Before(w.end) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.active() {
+		return ctx, nil
+	}
+
+	return h.cfg.SoftReject.Reject(ctx, resp, ErrMaintenance)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if !h.cfg.RejectScrapes || !h.active() {
+		return ctx, nil
+	}
+
+	return ctx, h.cfg.SoftReject.RejectScrape(ErrMaintenance)
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Operators must still be able to use the Api during maintenance.
+	return ctx, nil
+}
@@ -0,0 +1,102 @@
+package maintenance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+var testWindow = WindowConfig{Start: "2020-01-01T02:00:00Z", End: "2020-01-01T04:00:00Z"}
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{}, nil},
+		{Config{Enabled: true, Windows: []WindowConfig{testWindow}}, nil},
+		{Config{Enabled: true, Windows: []WindowConfig{{Start: "2020-01-01", End: testWindow.End}}}, ErrInvalidWindow},
+		{Config{Enabled: true, Windows: []WindowConfig{{Start: testWindow.Start}}}, ErrInvalidWindow},
+		{Config{Enabled: true, Windows: []WindowConfig{{Start: testWindow.End, End: testWindow.Start}}}, ErrInvalidWindow},
+	}
+
+	for _, tt := range table {
+		_, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		now      string
+		expected error
+	}{
+		{Config{}, "2020-01-01T03:00:00Z", nil},
+		{Config{Enabled: true}, "2020-01-01T03:00:00Z", ErrMaintenance},
+		{Config{Windows: []WindowConfig{testWindow}}, "2020-01-01T03:00:00Z", nil},
+		{Config{Enabled: true, Windows: []WindowConfig{testWindow}}, "2020-01-01T01:59:59Z", nil},
+		{Config{Enabled: true, Windows: []WindowConfig{testWindow}}, "2020-01-01T02:00:00Z", ErrMaintenance},
+		{Config{Enabled: true, Windows: []WindowConfig{testWindow}}, "2020-01-01T03:59:59Z", ErrMaintenance},
+		{Config{Enabled: true, Windows: []WindowConfig{testWindow}}, "2020-01-01T04:00:00Z", nil},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Nil(t, err)
+		now, err := time.Parse(time.RFC3339, tt.now)
+		require.Nil(t, err)
+		h.(*hook).now = func() time.Time { return now }
+
+		_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err, tt.now)
+	}
+}
+
+func TestSoftReject(t *testing.T) {
+	h, err := NewHook(Config{
+		Enabled:    true,
+		SoftReject: middleware.SoftRejectConfig{Enabled: true, Interval: 3 * time.Hour},
+	})
+	require.Nil(t, err)
+
+	resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute}
+	ctx, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{}, resp)
+	require.Nil(t, err)
+	require.Equal(t, 3*time.Hour, resp.Interval)
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+}
+
+func TestHandleScrape(t *testing.T) {
+	for _, rejectScrapes := range []bool{false, true} {
+		h, err := NewHook(Config{Enabled: true, RejectScrapes: rejectScrapes})
+		require.Nil(t, err)
+
+		_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{}, &bittorrent.ScrapeResponse{})
+		if rejectScrapes {
+			require.Equal(t, ErrMaintenance, err)
+		} else {
+			require.Nil(t, err)
+		}
+	}
+}
+
+func TestHandleScrapeRetryIn(t *testing.T) {
+	// Scrapes are never rejected softly, but still carry the retry hint.
+	for _, soft := range []bool{false, true} {
+		h, err := NewHook(Config{
+			Enabled:       true,
+			RejectScrapes: true,
+			SoftReject:    middleware.SoftRejectConfig{Enabled: soft, RetryIn: time.Hour},
+		})
+		require.Nil(t, err)
+
+		_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{}, &bittorrent.ScrapeResponse{})
+		require.Equal(t, bittorrent.RetryError{ClientError: ErrMaintenance, RetryIn: time.Hour}, err)
+	}
+}
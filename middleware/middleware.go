@@ -4,6 +4,8 @@ package middleware
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
@@ -13,47 +15,341 @@ import (
 	"github.com/chihaya/chihaya/storage"
 )
 
+// Default limits for the number of infohashes in a scrape, used if none are
+// configured.
+const (
+	defaultMaxScrapeInfoHashes    = 50
+	defaultRejectScrapeInfoHashes = 1000
+)
+
 // Config holds the configuration common across all middleware.
 type Config struct {
 	AnnounceInterval    time.Duration `yaml:"announce_interval"`
 	MaxNumWant          uint32        `yaml:"max_numwant"`
 	DefaultNumWant      uint32        `yaml:"default_numwant"`
 	MaxScrapeInfoHashes uint32        `yaml:"max_scrape_infohashes"`
+
+	// MinAnnounceInterval is the minimum interval communicated to clients,
+	// which middleware must not undercut when shortening the interval.
+	// If zero or above the AnnounceInterval, the AnnounceInterval is used.
+	MinAnnounceInterval time.Duration `yaml:"min_announce_interval"`
+
+	// NumWantOverrides maps hex-encoded infohashes to the number of peers
+	// handed out for them, replacing both MaxNumWant and DefaultNumWant.
+	NumWantOverrides map[string]uint32 `yaml:"numwant_overrides"`
+
+	// RejectScrapeInfoHashes is the number of infohashes above which a
+	// scrape is rejected instead of truncated to MaxScrapeInfoHashes.
+	// If zero, a default of 1000 or MaxScrapeInfoHashes, whichever is
+	// greater, is used.
+	RejectScrapeInfoHashes uint32 `yaml:"reject_scrape_infohashes"`
+
+	// MaxScrapeFiles is the maximum number of files returned in a scrape
+	// response, independent of the number of requested infohashes.
+	// Zero means no limit.
+	MaxScrapeFiles uint32 `yaml:"max_scrape_files"`
+
+	// DeduplicateScrapes specifies whether infohashes repeated within a
+	// scrape are answered from a single lookup in the storage.
+	DeduplicateScrapes bool `yaml:"deduplicate_scrapes"`
+
+	// RejectScrapeDuplicates is the number of repeated infohashes above
+	// which a scrape is rejected. Zero means no limit.
+	RejectScrapeDuplicates uint32 `yaml:"reject_scrape_duplicates"`
+
+	// ScrapeCache configures a cache of Scrapes that is used instead of the
+	// storage while the tracker is under load.
+	ScrapeCache ScrapeCacheConfig `yaml:"scrape_cache"`
+
+	// AnnounceCache configures a cache of the peers returned for announces,
+	// which is shared by the announces of a swarm within a short window.
+	AnnounceCache AnnounceCacheConfig `yaml:"announce_cache"`
+
+	// PeerTTL are the lifetimes of peers passed to the storage as a hint,
+	// if the storage supports it.
+	PeerTTL PeerTTLConfig `yaml:"peer_ttl"`
+
+	// PeerTTLOverrides maps hex-encoded infohashes to the lifetime of
+	// their peers, replacing PeerTTL for all roles, e.g. short lifetimes
+	// for fast-churning live torrents.
+	PeerTTLOverrides map[string]time.Duration `yaml:"peer_ttl_overrides"`
+
+	// PeersOnStopped specifies whether announces with a stopped event
+	// still receive peers. By default they only receive swarm statistics.
+	PeersOnStopped bool `yaml:"peers_on_stopped"`
+
+	// MaxSeedersForSeeders is the maximum number of seeders returned to a
+	// seeder in addition to the leechers, if the leechers do not fill
+	// numwant. By default seeders only receive leechers.
+	MaxSeedersForSeeders uint32 `yaml:"max_seeders_for_seeders"`
+
+	// PreferLongLivedPeers specifies whether peers that announced more
+	// often are preferred in announce responses, if the storage counts
+	// announces. Restrictions by peer flags take precedence.
+	PreferLongLivedPeers bool `yaml:"prefer_long_lived_peers"`
+
+	// ExcludeAnnouncer specifies whether announce responses never contain a
+	// peer with the peer ID or the endpoint of the announcer, e.g. entries
+	// it left under a previous address or port, or the entry of its other
+	// role. The storage only excludes the announcer's current entry.
+	ExcludeAnnouncer bool `yaml:"exclude_announcer"`
+
+	// MaxResponseSize is the maximum estimated size of announce responses
+	// in bytes. Peers are dropped from larger responses until they fit,
+	// IPv6 peers first. Unlike numwant, it bounds the bytes sent, which
+	// also depend on the format and address family of the peers.
+	// Zero disables the limit.
+	MaxResponseSize int `yaml:"max_response_size"`
+
+	// MergeAddressFamilies specifies whether scrapes and the counts of
+	// announce responses report the seeders and leechers of both address
+	// families combined. Announces still return peers of the address
+	// family of the announcer only.
+	MergeAddressFamilies bool `yaml:"merge_address_families"`
+
+	// AddressFamilyBreakdown specifies whether merged scrapes and the
+	// "stats" api method additionally report the counts per address
+	// family.
+	AddressFamilyBreakdown bool `yaml:"address_family_breakdown"`
+
+	// FamilyFallback configures the responses to announces from an address
+	// family without peers in a swarm with peers of the other one.
+	FamilyFallback FamilyFallbackConfig `yaml:"family_fallback"`
+
+	// CompactFallback configures the responses to clients that request
+	// compact responses but can't parse compact IPv6 peers.
+	CompactFallback CompactFallbackConfig `yaml:"compact_fallback"`
+
+	// PeerPadding configures the padding of announce responses to numwant
+	// peers, which hides the size of small swarms.
+	PeerPadding PeerPaddingConfig `yaml:"peer_padding"`
+
+	// PeerShuffle configures the seed of the shuffle of the peers of
+	// announce responses, e.g. to make them cacheable.
+	PeerShuffle PeerShuffleConfig `yaml:"peer_shuffle"`
+
+	// StoreErrors configures how unexpected errors of the storage are
+	// handled when generating announce and scrape responses.
+	StoreErrors StoreErrorConfig `yaml:"store_errors"`
+
+	// ReadOnly freezes the state of the swarms: announces are answered
+	// from the existing peers without storing the announcing peer, and
+	// api methods that change swarms or torrents are refused.
+	ReadOnly bool `yaml:"read_only"`
+}
+
+// PeerTTLConfig holds the lifetimes of peers depending on their last
+// Announce.
+// A zero value selects the default peer lifetime of the storage.
+type PeerTTLConfig struct {
+	// Started is the lifetime of leechers that sent a started event.
+	// If zero, Leecher is used.
+	Started time.Duration `yaml:"started"`
+
+	// Leecher is the lifetime of leechers.
+	Leecher time.Duration `yaml:"leecher"`
+
+	// Seeder is the lifetime of seeders.
+	Seeder time.Duration `yaml:"seeder"`
+}
+
+// defaultStoreErrorInterval is the interval of the responses to announces
+// that failed softly because of the storage, if none is configured.
+const defaultStoreErrorInterval = time.Minute
+
+// Handling of the infohashes of a Scrape whose swarm could not be scraped
+// because of the storage.
+const (
+	// ScrapeErrorsFail fails the whole Scrape with the error of the
+	// storage.
+	ScrapeErrorsFail = "fail"
+
+	// ScrapeErrorsOmit leaves the infohashes out of the response. UDP
+	// responses are matched to the infohashes by their position, so they
+	// contain zeroed counts instead.
+	ScrapeErrorsOmit = "omit"
+
+	// ScrapeErrorsMark answers the infohashes with zeroed counts and marks
+	// them as failed, which is written as the key "failed" by the HTTP
+	// frontend.
+	ScrapeErrorsMark = "mark"
+)
+
+// StoreErrorConfig holds the configuration of how unexpected errors of the
+// storage are handled when generating announce and scrape responses.
+//
+// Only PeerStores implementing storage.FallibleScrapeStore report errors of
+// Scrapes.
+type StoreErrorConfig struct {
+	// FailSoft specifies whether announces that failed because of the
+	// storage are answered with a valid response without peers, instead of
+	// an error, so that clients retry soon.
+	FailSoft bool `yaml:"fail_soft"`
+
+	// Interval is the interval of the responses to announces that failed
+	// softly.
+	// If zero, a default of 1m is used.
+	Interval time.Duration `yaml:"interval"`
+
+	// Scrapes is one of ScrapeErrorsFail, ScrapeErrorsOmit and
+	// ScrapeErrorsMark.
+	// If empty, ScrapeErrorsFail is used.
+	Scrapes string `yaml:"scrapes"`
+}
+
+// scrapeErrors returns the configured handling of scrape errors.
+//
+// Unknown values fall back to ScrapeErrorsFail with a warning.
+func (cfg StoreErrorConfig) scrapeErrors() string {
+	switch cfg.Scrapes {
+	case "":
+		return ScrapeErrorsFail
+	case ScrapeErrorsFail, ScrapeErrorsOmit, ScrapeErrorsMark:
+		return cfg.Scrapes
+	}
+
+	log.Warn("unknown handling of scrape errors, using fail", log.Fields{"scrapes": cfg.Scrapes})
+	return ScrapeErrorsFail
 }
 
 var _ frontend.TrackerLogic = &Logic{}
 
+// ErrInvalidDefaultNumWant is returned for a config with a default numwant
+// above its max numwant.
+var ErrInvalidDefaultNumWant = errors.New("default_numwant must not be greater than max_numwant")
+
 // NewLogic creates a new instance of a TrackerLogic that executes the provided
 // middleware hooks.
-func NewLogic(cfg Config, peerStore storage.PeerStore, preHooks, postHooks []Hook) *Logic {
+//
+// The parameters that can be changed at runtime are validated like updates
+// via the "config" api method.
+func NewLogic(cfg Config, peerStore storage.PeerStore, preHooks, postHooks []Hook) (*Logic, error) {
+	if cfg.MaxScrapeInfoHashes == 0 {
+		cfg.MaxScrapeInfoHashes = defaultMaxScrapeInfoHashes
+	}
+	if cfg.RejectScrapeInfoHashes == 0 {
+		cfg.RejectScrapeInfoHashes = defaultRejectScrapeInfoHashes
+		if cfg.MaxScrapeInfoHashes > cfg.RejectScrapeInfoHashes {
+			cfg.RejectScrapeInfoHashes = cfg.MaxScrapeInfoHashes
+		}
+	}
+
+	initial := RuntimeConfig{
+		AnnounceInterval:       cfg.AnnounceInterval,
+		MaxNumWant:             cfg.MaxNumWant,
+		DefaultNumWant:         cfg.DefaultNumWant,
+		MaxScrapeInfoHashes:    cfg.MaxScrapeInfoHashes,
+		RejectScrapeInfoHashes: cfg.RejectScrapeInfoHashes,
+		MaxScrapeFiles:         cfg.MaxScrapeFiles,
+	}
+	if err := initial.validate(); err != nil {
+		return nil, err
+	}
+	rc := newRuntimeConfig(initial)
+
 	l := &Logic{
-		announceInterval: cfg.AnnounceInterval,
-		peerStore:        peerStore,
-		preHooks:         []Hook{&sanitizationHook{cfg.MaxNumWant, cfg.DefaultNumWant, cfg.MaxScrapeInfoHashes}},
-		postHooks:        postHooks,
+		config:      rc,
+		minInterval: cfg.MinAnnounceInterval,
+		readOnly:    cfg.ReadOnly,
+		peerStore:   peerStore,
+		preHooks: []Hook{&sanitizationHook{
+			config:                 rc,
+			rejectScrapeDuplicates: cfg.RejectScrapeDuplicates,
+			numWantOverrides:       parseNumWantOverrides(cfg.NumWantOverrides),
+		}},
+		postHooks: postHooks,
 	}
 
 	l.preHooks = append(l.preHooks, preHooks...)
-	l.preHooks = append(l.preHooks, &swarmInteractionHook{store: peerStore})
-	l.preHooks = append(l.preHooks, &responseHook{store: peerStore})
+	l.preHooks = append(l.preHooks, &swarmInteractionHook{
+		store:        peerStore,
+		ttl:          cfg.PeerTTL,
+		ttlOverrides: parsePeerTTLOverrides(cfg.PeerTTLOverrides),
+		readOnly:     cfg.ReadOnly,
+	})
+	l.preHooks = append(l.preHooks, &responseHook{
+		store:                peerStore,
+		peersOnStopped:       cfg.PeersOnStopped,
+		maxSeedersForSeeders: cfg.MaxSeedersForSeeders,
+		config:               rc,
+		deduplicateScrapes:   cfg.DeduplicateScrapes,
+		scrapeCache:          newScrapeCache(cfg.ScrapeCache),
+		announceCache:        newAnnounceCache(cfg.AnnounceCache),
+		storeErrors:          cfg.StoreErrors,
+		scrapeErrors:         cfg.StoreErrors.scrapeErrors(),
+		preferLongLivedPeers: cfg.PreferLongLivedPeers,
+		excludeAnnouncer:     cfg.ExcludeAnnouncer,
+		maxResponseSize:      cfg.MaxResponseSize,
+		padder:               newPeerPadder(cfg.PeerPadding),
+		shuffler:             newPeerShuffler(cfg.PeerShuffle),
+		mergeAddressFamilies: cfg.MergeAddressFamilies,
+		familyBreakdown:      cfg.AddressFamilyBreakdown,
+		familyFallback:       newFamilyFallback(cfg.FamilyFallback),
+		compactFallback:      newCompactFallback(cfg.CompactFallback),
+	})
 
-	return l
+	return l, nil
+}
+
+// parseNumWantOverrides parses the keys of the configured numwant overrides.
+//
+// Invalid infohashes are skipped with a warning.
+func parseNumWantOverrides(overrides map[string]uint32) map[bittorrent.InfoHash]uint32 {
+	parsed := make(map[bittorrent.InfoHash]uint32, len(overrides))
+	for ihString, numWant := range overrides {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			log.Warn("ignoring numwant override for invalid infohash", log.Fields{"infoHash": ihString})
+			continue
+		}
+		parsed[bittorrent.InfoHashFromBytes(ihBytes)] = numWant
+	}
+
+	return parsed
+}
+
+// parsePeerTTLOverrides parses the keys of the configured peer TTL overrides.
+//
+// Invalid infohashes and lifetimes are skipped with a warning.
+func parsePeerTTLOverrides(overrides map[string]time.Duration) map[bittorrent.InfoHash]time.Duration {
+	parsed := make(map[bittorrent.InfoHash]time.Duration, len(overrides))
+	for ihString, ttl := range overrides {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			log.Warn("ignoring peer ttl override for invalid infohash", log.Fields{"infoHash": ihString})
+			continue
+		}
+		if ttl <= 0 {
+			log.Warn("ignoring non-positive peer ttl override", log.Fields{"infoHash": ihString, "ttl": ttl})
+			continue
+		}
+		parsed[bittorrent.InfoHashFromBytes(ihBytes)] = ttl
+	}
+
+	return parsed
 }
 
 // Logic is an implementation of the TrackerLogic that functions by
 // executing a series of middleware hooks.
 type Logic struct {
-	announceInterval time.Duration
-	peerStore        storage.PeerStore
-	preHooks         []Hook
-	postHooks        []Hook
+	config      *runtimeConfig
+	minInterval time.Duration
+	readOnly    bool
+	peerStore   storage.PeerStore
+	preHooks    []Hook
+	postHooks   []Hook
 }
 
 // HandleAnnounce generates a response for an Announce.
 func (l *Logic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (_ context.Context, resp *bittorrent.AnnounceResponse, err error) {
+	interval := l.config.load().AnnounceInterval
+	minInterval := interval
+	if l.minInterval > 0 && l.minInterval < interval {
+		minInterval = l.minInterval
+	}
 	resp = &bittorrent.AnnounceResponse{
-		Interval:    l.announceInterval,
-		MinInterval: l.announceInterval,
+		Interval:    interval,
+		MinInterval: minInterval,
 		Compact:     req.Compact,
 	}
 	for _, h := range l.preHooks {
@@ -62,7 +358,7 @@ func (l *Logic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequ
 		}
 	}
 
-	log.Debug("generated announce response", resp)
+	log.Debug("generated announce response", log.RequestFields(ctx, resp))
 	return ctx, resp, nil
 }
 
@@ -72,7 +368,7 @@ func (l *Logic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 	var err error
 	for _, h := range l.postHooks {
 		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
-			log.Error("post-announce hooks failed", log.Err(err))
+			log.Error("post-announce hooks failed", log.RequestFields(ctx, log.Err(err)))
 			return
 		}
 	}
@@ -89,7 +385,7 @@ func (l *Logic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest)
 		}
 	}
 
-	log.Debug("generated scrape response", resp)
+	log.Debug("generated scrape response", log.RequestFields(ctx, resp))
 	return ctx, resp, nil
 }
 
@@ -98,13 +394,21 @@ func (l *Logic) HandleApi(ctx context.Context, req *bittorrent.ApiRequest) (resp
 	resp = &bittorrent.ApiResponse{
 		Files: make([]bittorrent.Api, 0, len(req.InfoHashes)),
 	}
+
+	// Hooks run in order, so the method must be refused before any of them
+	// gets to change the state.
+	if _, mutating := mutatingApiMethods[req.Method]; mutating && l.readOnly {
+		refuseReadOnly(resp)
+		return resp, nil
+	}
+
 	for _, h := range l.preHooks {
 		if ctx, err = h.HandleApi(ctx, req, resp); err != nil {
 			return nil, err
 		}
 	}
 
-	log.Debug("generated scrape response", resp)
+	log.Debug("generated scrape response", log.RequestFields(ctx, resp))
 	return resp, nil
 }
 
@@ -114,7 +418,7 @@ func (l *Logic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest,
 	var err error
 	for _, h := range l.postHooks {
 		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
-			log.Error("post-scrape hooks failed", log.Err(err))
+			log.Error("post-scrape hooks failed", log.RequestFields(ctx, log.Err(err)))
 			return
 		}
 	}
@@ -23,6 +23,10 @@ func (h *nopHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeReques
 	return ctx, nil
 }
 
+func (h *nopHook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	return ctx, nil
+}
+
 type hookList []Hook
 
 func (hooks hookList) handleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (resp *bittorrent.AnnounceResponse, err error) {
@@ -83,7 +87,7 @@ func BenchmarkHookOverhead(b *testing.B) {
 
 	var sanHooks hookList
 	for i := 1; i < 4; i++ {
-		sanHooks = append(sanHooks, &sanitizationHook{maxNumWant: 50})
+		sanHooks = append(sanHooks, &sanitizationHook{config: newRuntimeConfig(RuntimeConfig{MaxNumWant: 50})})
 		b.Run(fmt.Sprintf("%dsanitation-v4", i), func(b *testing.B) {
 			benchHookListV4(b, sanHooks)
 		})
@@ -0,0 +1,116 @@
+// Package minseeders implements a Hook that refuses new leechers on a torrent
+// until a minimum number of seeders is present.
+package minseeders
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// defaultRetryIn is the delay after which refused leechers are advised to
+// retry if neither soft rejection nor a retry_in is configured.
+const defaultRetryIn = 10 * time.Minute
+
+// ErrNotEnoughSeeders is returned when a new leecher announces for a torrent
+// with fewer seeders than required.
+var ErrNotEnoughSeeders = bittorrent.NewClientError("not_enough_seeders", "not enough seeders yet, try again later")
+
+// Config represents the configuration for the minseeders middleware.
+type Config struct {
+	// MinSeeders is the number of seeders required for torrents not
+	// contained in Torrents. Zero accepts leechers unconditionally.
+	MinSeeders uint32 `yaml:"min_seeders"`
+
+	// Torrents maps hex-encoded infohashes to the number of seeders
+	// required for them.
+	Torrents map[string]uint32 `yaml:"torrents"`
+
+	// SoftReject configures how leechers are refused.
+	// If neither soft rejection nor a retry_in is configured, they are
+	// advised to retry after 10m.
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"minSeeders": cfg.MinSeeders,
+		"torrents":   len(cfg.Torrents),
+		"softReject": cfg.SoftReject.Enabled,
+		"retryIn":    cfg.SoftReject.RetryIn,
+	}
+}
+
+type hook struct {
+	store      storage.PeerStore
+	minSeeders uint32
+	torrents   map[bittorrent.InfoHash]uint32
+	softReject middleware.SoftRejectConfig
+}
+
+// NewHook returns an instance of the minseeders middleware that reads the
+// number of seeders from the given PeerStore.
+func NewHook(cfg Config, store storage.PeerStore) (middleware.Hook, error) {
+	if !cfg.SoftReject.Enabled && cfg.SoftReject.RetryIn <= 0 {
+		cfg.SoftReject.RetryIn = defaultRetryIn
+	}
+
+	h := &hook{
+		store:      store,
+		minSeeders: cfg.MinSeeders,
+		torrents:   make(map[bittorrent.InfoHash]uint32, len(cfg.Torrents)),
+		softReject: cfg.SoftReject,
+	}
+
+	for ihString, minSeeders := range cfg.Torrents {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			return nil, errors.New("infohash " + ihString + " must be 40 hex characters")
+		}
+		h.torrents[bittorrent.InfoHashFromBytes(ihBytes)] = minSeeders
+	}
+
+	return h, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Only leechers joining the swarm are checked, seeders and existing
+	// leechers are always accepted.
+	if req.Left == 0 || req.Event != bittorrent.Started {
+		return ctx, nil
+	}
+
+	minSeeders, ok := h.torrents[req.InfoHash]
+	if !ok {
+		minSeeders = h.minSeeders
+	}
+	if minSeeders == 0 {
+		return ctx, nil
+	}
+
+	// Seeders of both address families can serve the new leecher.
+	seeders := h.store.ScrapeSwarm(req.InfoHash, bittorrent.IPv4).Complete +
+		h.store.ScrapeSwarm(req.InfoHash, bittorrent.IPv6).Complete
+	if seeders >= minSeeders {
+		return ctx, nil
+	}
+
+	return h.softReject.Reject(ctx, resp, ErrNotEnoughSeeders)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't require any protection.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api doesn't require any protection.
+	return ctx, nil
+}
@@ -0,0 +1,66 @@
+package minseeders
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("01234567890123456789")
+	ih2 = bittorrent.InfoHashFromString("abcdefghijklmnopqrst")
+)
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	seeder := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6},
+	}
+	require.Nil(t, ps.PutSeeder(ih1, seeder))
+
+	h, err := NewHook(Config{
+		MinSeeders: 1,
+		Torrents:   map[string]uint32{fmt.Sprintf("%x", ih2[:]): 2},
+	}, ps)
+	require.Nil(t, err)
+
+	var table = []struct {
+		infoHash bittorrent.InfoHash
+		event    bittorrent.Event
+		left     uint64
+		expected error
+	}{
+		// Seeders of the other address family count as well.
+		{ih1, bittorrent.Started, 10, nil},
+		{ih2, bittorrent.Started, 10, bittorrent.RetryError{ClientError: ErrNotEnoughSeeders, RetryIn: defaultRetryIn}},
+		// Seeders and existing leechers are always accepted.
+		{ih2, bittorrent.Started, 0, nil},
+		{ih2, bittorrent.None, 10, nil},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{InfoHash: tt.infoHash, Event: tt.event, Left: tt.left}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err)
+	}
+
+	h, err = NewHook(Config{MinSeeders: 1, SoftReject: middleware.SoftRejectConfig{Enabled: true}}, ps)
+	require.Nil(t, err)
+
+	req := &bittorrent.AnnounceRequest{InfoHash: ih2, Event: bittorrent.Started, Left: 10}
+	ctx, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+}
@@ -0,0 +1,106 @@
+// Package monitors implements a Hook that detects Announces of clients that
+// only monitor a swarm, e.g. to track its statistics, without any intent to
+// download.
+package monitors
+
+import (
+	"context"
+	"errors"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Actions for Announces of monitors.
+const (
+	ActionRegister = "register"
+	ActionSkip     = "skip"
+)
+
+// ErrInvalidAction is returned for a config with an unknown Action.
+var ErrInvalidAction = errors.New("action must be register or skip")
+
+type monitor struct{}
+
+// MonitorKey is the key under which the hook marks Announces classified as
+// sent by a monitor.
+// The value is of type struct{}.
+var MonitorKey = monitor{}
+
+// Config represents the configuration for the monitor detection middleware.
+type Config struct {
+	// MaxNumWant is the highest numwant of Announces that are classified as
+	// sent by a monitor. Only Announces that explicitly specify numwant are
+	// classified.
+	MaxNumWant uint32 `yaml:"max_numwant"`
+
+	// IncludeSeeders specifies whether Announces with nothing left to
+	// download are classified as well.
+	IncludeSeeders bool `yaml:"include_seeders"`
+
+	// Action specifies how Announces of monitors are handled. They are
+	// either registered in the swarm like any other Announce or not at all.
+	// In both cases, they are marked via MonitorKey.
+	// If empty, they are registered.
+	Action string `yaml:"action"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"maxNumWant":     cfg.MaxNumWant,
+		"includeSeeders": cfg.IncludeSeeders,
+		"action":         cfg.Action,
+	}
+}
+
+type hook struct {
+	cfg Config
+}
+
+// NewHook returns an instance of the monitor detection middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	switch cfg.Action {
+	case "":
+		cfg.Action = ActionRegister
+	case ActionRegister, ActionSkip:
+	default:
+		return nil, ErrInvalidAction
+	}
+
+	return &hook{cfg: cfg}, nil
+}
+
+// isMonitor classifies req as sent by a monitor: a regular Announce that
+// does not want any peers.
+func (h *hook) isMonitor(req *bittorrent.AnnounceRequest) bool {
+	if req.Event != bittorrent.None || !req.NumWantSpecified || req.NumWant > h.cfg.MaxNumWant {
+		return false
+	}
+
+	return req.Left > 0 || h.cfg.IncludeSeeders
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.isMonitor(req) {
+		return ctx, nil
+	}
+
+	ctx = context.WithValue(ctx, MonitorKey, struct{}{})
+	if h.cfg.Action == ActionSkip {
+		ctx = context.WithValue(ctx, middleware.SkipSwarmInteractionKey, struct{}{})
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't affect the swarm.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis don't affect the swarm.
+	return ctx, nil
+}
@@ -0,0 +1,57 @@
+package monitors
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Nil(t, err)
+
+	_, err = NewHook(Config{Action: ActionSkip})
+	require.Nil(t, err)
+
+	_, err = NewHook(Config{Action: "drop"})
+	require.Equal(t, ErrInvalidAction, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	var table = []struct {
+		cfg       Config
+		req       bittorrent.AnnounceRequest
+		monitor   bool
+		skipSwarm bool
+	}{
+		{Config{}, bittorrent.AnnounceRequest{NumWantSpecified: true, Left: 1}, true, false},
+		{Config{Action: ActionSkip}, bittorrent.AnnounceRequest{NumWantSpecified: true, Left: 1}, true, true},
+
+		// Announces wanting peers or carrying an event are regular.
+		{Config{}, bittorrent.AnnounceRequest{NumWant: 1, NumWantSpecified: true, Left: 1}, false, false},
+		{Config{MaxNumWant: 1}, bittorrent.AnnounceRequest{NumWant: 1, NumWantSpecified: true, Left: 1}, true, false},
+		{Config{}, bittorrent.AnnounceRequest{Left: 1}, false, false},
+		{Config{}, bittorrent.AnnounceRequest{Event: bittorrent.Started, NumWantSpecified: true, Left: 1}, false, false},
+
+		// Seeders are only classified if configured.
+		{Config{}, bittorrent.AnnounceRequest{NumWantSpecified: true}, false, false},
+		{Config{IncludeSeeders: true}, bittorrent.AnnounceRequest{NumWantSpecified: true}, true, false},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%#v", tt), func(t *testing.T) {
+			h, err := NewHook(tt.cfg)
+			require.Nil(t, err)
+
+			ctx, err := h.HandleAnnounce(context.Background(), &tt.req, &bittorrent.AnnounceResponse{})
+			require.Nil(t, err)
+			require.Equal(t, tt.monitor, ctx.Value(MonitorKey) != nil)
+			require.Equal(t, tt.skipSwarm, ctx.Value(middleware.SkipSwarmInteractionKey) != nil)
+		})
+	}
+}
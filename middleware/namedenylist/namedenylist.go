@@ -0,0 +1,120 @@
+// Package namedenylist implements a Hook that rejects announces for torrents
+// whose names from an external metadata provider match a denylist.
+package namedenylist
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/metadata"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrDeniedTorrent is returned for announces of torrents whose name is
+// denied.
+var ErrDeniedTorrent = bittorrent.NewClientError("denied_torrent", "torrent is not allowed")
+
+// ErrNoPatterns is returned for a config without any patterns.
+var ErrNoPatterns = errors.New("no patterns configured")
+
+// Config represents the configuration for the torrent name denylist
+// middleware.
+type Config struct {
+	Metadata metadata.Config `yaml:"metadata"`
+
+	// Patterns are regular expressions matching denied torrent names.
+	Patterns []string `yaml:"patterns"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	fields := cfg.Metadata.LogFields()
+	fields["patterns"] = len(cfg.Patterns)
+	fields["softReject"] = cfg.SoftReject.Enabled
+	return fields
+}
+
+type hook struct {
+	cfg      Config
+	provider metadata.Provider
+	patterns []*regexp.Regexp
+}
+
+// NewHook returns an instance of the torrent name denylist middleware.
+//
+// Announces of torrents whose names can't be looked up are never rejected.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	provider, err := metadata.New(cfg.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return newHook(cfg, provider)
+}
+
+func newHook(cfg Config, provider metadata.Provider) (*hook, error) {
+	if len(cfg.Patterns) == 0 {
+		return nil, ErrNoPatterns
+	}
+
+	h := &hook{cfg: cfg, provider: provider}
+	for _, pattern := range cfg.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.New("invalid pattern " + pattern + ": " + err.Error())
+		}
+		h.patterns = append(h.patterns, re)
+	}
+
+	return h, nil
+}
+
+// denies reports whether name matches one of the patterns.
+func (h *hook) denies(name string) bool {
+	for _, re := range h.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	name, err := h.provider.Name(req.InfoHash)
+	switch err {
+	case nil:
+	case metadata.ErrUnknownInfoHash:
+		return ctx, nil
+	case metadata.ErrSourceUnavailable:
+		// The source was not queried, its failure was logged already.
+		return ctx, nil
+	default:
+		// The metadata source being unavailable must not take down all
+		// swarms, so announces are accepted.
+		log.Warn("failed to look up torrent metadata", log.RequestFields(ctx, log.Fields{
+			"infoHash": req.InfoHash,
+		}), log.Err(err))
+		return ctx, nil
+	}
+
+	if !h.denies(name) {
+		return ctx, nil
+	}
+
+	return h.cfg.SoftReject.Reject(ctx, resp, ErrDeniedTorrent)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't add peers to swarms.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are not restricted.
+	return ctx, nil
+}
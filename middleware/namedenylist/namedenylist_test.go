@@ -0,0 +1,74 @@
+package namedenylist
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/metadata"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 = bittorrent.InfoHashFromString("00000000000000000002")
+	ih3 = bittorrent.InfoHashFromString("00000000000000000003")
+)
+
+type mapProvider struct {
+	names map[bittorrent.InfoHash]string
+	err   error
+}
+
+func (p *mapProvider) Name(infoHash bittorrent.InfoHash) (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+	name, ok := p.names[infoHash]
+	if !ok {
+		return "", metadata.ErrUnknownInfoHash
+	}
+	return name, nil
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := newHook(Config{}, &mapProvider{})
+	require.Equal(t, ErrNoPatterns, err)
+
+	_, err = newHook(Config{Patterns: []string{"("}}, &mapProvider{})
+	require.NotNil(t, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	p := &mapProvider{names: map[bittorrent.InfoHash]string{
+		ih1: "Some Linux Distribution",
+		ih2: "Some Leaked Movie 1080p",
+	}}
+	h, err := newHook(Config{Patterns: []string{`(?i)leaked`, `^Forbidden`}}, p)
+	require.Nil(t, err)
+
+	announce := func(infoHash bittorrent.InfoHash) error {
+		req := &bittorrent.AnnounceRequest{InfoHash: infoHash}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		return err
+	}
+
+	require.Nil(t, announce(ih1))
+	require.Equal(t, ErrDeniedTorrent, announce(ih2))
+
+	// Unknown torrents and unavailable metadata are accepted.
+	require.Nil(t, announce(ih3))
+	p.err = errors.New("unavailable")
+	require.Nil(t, announce(ih2))
+	p.err = metadata.ErrSourceUnavailable
+	require.Nil(t, announce(ih2))
+	p.err = nil
+
+	h.cfg.SoftReject = middleware.SoftRejectConfig{Enabled: true}
+	ctx, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih2}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+}
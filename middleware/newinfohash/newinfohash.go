@@ -0,0 +1,313 @@
+// Package newinfohash implements a Hook that notifies a webhook of the first
+// announce of an infohash, e.g. so that a seedbox can start seeding new
+// torrents.
+package newinfohash
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Defaults of the configuration.
+const (
+	defaultTimeout       = 5 * time.Second
+	defaultMaxRetries    = 5
+	defaultRetryBackoff  = time.Second
+	defaultMaxBackoff    = time.Minute
+	defaultQueueSize     = 1000
+	defaultWorkers       = 2
+	defaultRenotifyAfter = time.Hour
+	defaultMaxInfoHashes = 100000
+)
+
+// ErrNoURL is returned for a config without a URL.
+var ErrNoURL = errors.New("no webhook url configured")
+
+// Config represents the configuration for the new infohash middleware.
+type Config struct {
+	// URL is the URL of the webhook, which receives a POST request with a
+	// JSON object of the hex-encoded infohash and the time of the
+	// announce for every new infohash.
+	URL string `yaml:"url"`
+
+	// Timeout is the timeout of a request to the webhook.
+	// If zero, a default of 5s is used.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxRetries is the number of times a failed request is retried.
+	// If zero, a default of 5 is used.
+	MaxRetries int `yaml:"max_retries"`
+
+	// RetryBackoff is the delay before the first retry, which doubles with
+	// every retry up to MaxBackoff.
+	// If zero, a default of 1s is used.
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+
+	// MaxBackoff is the maximum delay between retries.
+	// If zero, a default of 1m is used.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	// QueueSize is the maximum number of pending notifications. New
+	// infohashes are dropped while the queue is full.
+	// If zero, a default of 1000 is used.
+	QueueSize int `yaml:"queue_size"`
+
+	// Workers is the number of notifications sent at the same time.
+	// If zero, a default of 2 is used.
+	Workers int `yaml:"workers"`
+
+	// RenotifyAfter is the duration after a notification during which the
+	// same infohash is not notified again, e.g. if its swarm expired and
+	// was announced again. Infohashes whose swarm had peers are not checked
+	// again for the same duration.
+	// If zero, a default of 1h is used.
+	RenotifyAfter time.Duration `yaml:"renotify_after"`
+
+	// MaxInfoHashes is the maximum number of checked infohashes that are
+	// remembered. Beyond that, the ones checked least recently are
+	// forgotten.
+	// If zero, a default of 100000 is used.
+	MaxInfoHashes int `yaml:"max_infohashes"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"url":           cfg.URL,
+		"timeout":       cfg.Timeout,
+		"maxRetries":    cfg.MaxRetries,
+		"retryBackoff":  cfg.RetryBackoff,
+		"maxBackoff":    cfg.MaxBackoff,
+		"queueSize":     cfg.QueueSize,
+		"workers":       cfg.Workers,
+		"renotifyAfter": cfg.RenotifyAfter,
+		"maxInfoHashes": cfg.MaxInfoHashes,
+	}
+}
+
+// notification is the body of a request to the webhook.
+type notification struct {
+	InfoHash string    `json:"infohash"`
+	Time     time.Time `json:"time"`
+}
+
+type hook struct {
+	cfg     Config
+	store   storage.PeerStore
+	client  *http.Client
+	queue   chan notification
+	closing chan struct{}
+	wg      sync.WaitGroup
+
+	// infoHashes holds the checked infohashes until they are checked
+	// again, so that the storage is not scraped on every announce.
+	infoHashes *expiring.Map
+}
+
+// NewHook returns an instance of the new infohash middleware.
+//
+// An infohash is new if its swarm has no peers in either address family when
+// it is announced, so it must run before the swarm interaction, i.e. as a
+// prehook.
+func NewHook(cfg Config, store storage.PeerStore) (middleware.Hook, error) {
+	if cfg.URL == "" {
+		return nil, ErrNoURL
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = defaultMaxRetries
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultMaxBackoff
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.RenotifyAfter <= 0 {
+		cfg.RenotifyAfter = defaultRenotifyAfter
+	}
+	if cfg.MaxInfoHashes <= 0 {
+		cfg.MaxInfoHashes = defaultMaxInfoHashes
+	}
+
+	h := &hook{
+		cfg:        cfg,
+		store:      store,
+		client:     &http.Client{Timeout: cfg.Timeout},
+		queue:      make(chan notification, cfg.QueueSize),
+		closing:    make(chan struct{}),
+		infoHashes: expiring.New(cfg.MaxInfoHashes, cfg.RenotifyAfter),
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for {
+				select {
+				case <-h.closing:
+					return
+				case n := <-h.queue:
+					if err := h.send(n); err != nil {
+						log.Error("failed to notify webhook of new infohash", log.Fields{"infoHash": n.InfoHash}, log.Err(err))
+					}
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+// isNew reports whether the swarm identified by infoHash has no peers.
+func (h *hook) isNew(infoHash bittorrent.InfoHash) bool {
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		if s := h.store.ScrapeSwarm(infoHash, af); s.Complete+s.Incomplete > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checked reports whether infoHash was checked within the last RenotifyAfter.
+func (h *hook) checked(infoHash bittorrent.InfoHash, now time.Time) bool {
+	_, ok := h.infoHashes.Get(string(infoHash[:]), now)
+	return ok
+}
+
+// remember records the check of infoHash at now and reports whether it was
+// not checked within the last RenotifyAfter, e.g. by a concurrent announce.
+func (h *hook) remember(infoHash bittorrent.InfoHash, now time.Time) (remembered bool) {
+	h.infoHashes.Update(string(infoHash[:]), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		if ok {
+			return e
+		}
+		remembered = true
+		return expiring.Entry{Expires: now.Add(h.cfg.RenotifyAfter)}
+	})
+	return
+}
+
+// send posts n to the webhook, retrying with an exponential backoff until it
+// succeeds, the retries are exhausted or the hook is stopped.
+//
+// Responses with a status of 4xx other than 429 are not retried, as the
+// webhook rejected the notification.
+func (h *hook) send(n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	backoff := h.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := h.post(body)
+		if err == nil || !retry || attempt >= h.cfg.MaxRetries {
+			return err
+		}
+
+		log.Debug("retrying webhook notification", log.Fields{"infoHash": n.InfoHash, "in": backoff}, log.Err(err))
+		select {
+		case <-h.closing:
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > h.cfg.MaxBackoff {
+			backoff = h.cfg.MaxBackoff
+		}
+	}
+}
+
+// post posts body to the webhook once and reports whether a failure may be
+// retried.
+func (h *hook) post(body []byte) (retry bool, err error) {
+	resp, err := h.client.Post(h.cfg.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return false, errors.New("webhook rejected notification with status " + strconv.Itoa(resp.StatusCode))
+	}
+	return true, errors.New("unexpected webhook response status " + strconv.Itoa(resp.StatusCode))
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Stopped peers don't join the swarm.
+	now := time.Now()
+	if req.Event == bittorrent.Stopped || h.checked(req.InfoHash, now) {
+		return ctx, nil
+	}
+
+	isNew := h.isNew(req.InfoHash)
+	if !h.remember(req.InfoHash, now) || !isNew {
+		return ctx, nil
+	}
+
+	n := notification{InfoHash: hex.EncodeToString(req.InfoHash[:]), Time: now}
+	select {
+	case h.queue <- n:
+	default:
+		log.Warn("webhook queue full, dropping new infohash", log.Fields{"infoHash": n.InfoHash})
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't create swarms.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests don't create swarms.
+	return ctx, nil
+}
+
+// Stop stops the hook, dropping pending notifications and cancelling their
+// retries.
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+
+	c := make(chan error)
+	go func() {
+		close(h.closing)
+		<-h.infoHashes.Stop()
+		h.wg.Wait()
+		close(c)
+	}()
+	return c
+}
@@ -0,0 +1,150 @@
+package newinfohash
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func TestHandleAnnounce(t *testing.T) {
+	received := make(chan notification, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&n))
+		received <- n
+	}))
+	defer srv.Close()
+
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	_, err = NewHook(Config{}, ps)
+	require.Equal(t, ErrNoURL, err)
+
+	h, err := NewHook(Config{URL: srv.URL}, ps)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	ih := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	announce := func(ih bittorrent.InfoHash, event bittorrent.Event) {
+		_, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih, Event: event, Peer: peer}, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+
+	// Stopped peers don't create swarms.
+	announce(ih, bittorrent.Stopped)
+
+	announce(ih, bittorrent.Started)
+	select {
+	case n := <-received:
+		require.Equal(t, "6161616161616161616161616161616161616161", n.InfoHash)
+	case <-time.After(time.Second):
+		t.Fatal("webhook was not notified")
+	}
+
+	// Swarms that were notified recently are not notified again.
+	announce(ih, bittorrent.Started)
+
+	// Swarms with peers are not new.
+	other := bittorrent.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+	require.Nil(t, ps.PutLeecher(other, peer))
+	announce(other, bittorrent.None)
+
+	// They are not checked again until renotify_after.
+	require.Nil(t, ps.DeleteLeecher(other, peer))
+	announce(other, bittorrent.Started)
+
+	select {
+	case n := <-received:
+		t.Fatalf("unexpected notification of %s", n.InfoHash)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// countingStore counts the Scrapes of a PeerStore.
+type countingStore struct {
+	storage.PeerStore
+	scrapes int
+}
+
+func (s *countingStore) ScrapeSwarm(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) bittorrent.Scrape {
+	s.scrapes++
+	return s.PeerStore.ScrapeSwarm(infoHash, af)
+}
+
+func TestCheckOnce(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+	store := &countingStore{PeerStore: ps}
+
+	h, err := NewHook(Config{URL: "http://127.0.0.1:0"}, store)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	ih := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Nil(t, ps.PutSeeder(ih, peer))
+
+	// Established swarms are only scraped by the first announce.
+	for i := 0; i < 3; i++ {
+		_, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih, Peer: peer}, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+	require.Equal(t, 1, store.scrapes)
+}
+
+func TestRetry(t *testing.T) {
+	statuses := make(chan int, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(<-statuses)
+	}))
+	defer srv.Close()
+
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	h, err := NewHook(Config{URL: srv.URL, MaxRetries: 2, RetryBackoff: time.Millisecond}, ps)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	n := notification{InfoHash: "aa"}
+
+	// Server errors are retried.
+	statuses <- http.StatusInternalServerError
+	statuses <- http.StatusTooManyRequests
+	statuses <- http.StatusOK
+	require.Nil(t, h.(*hook).send(n))
+
+	// Retries are exhausted eventually.
+	for i := 0; i < 3; i++ {
+		statuses <- http.StatusBadGateway
+	}
+	require.NotNil(t, h.(*hook).send(n))
+
+	// Rejections are not retried.
+	statuses <- http.StatusBadRequest
+	require.NotNil(t, h.(*hook).send(n))
+	require.Equal(t, 0, len(statuses))
+}
@@ -0,0 +1,162 @@
+// Package numwantbackpressure implements a Hook that decreases the number of
+// peers returned in announces while the tracker is under memory pressure or
+// load.
+package numwantbackpressure
+
+import (
+	"context"
+	"errors"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/load"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// sampleInterval is the interval in which the memory usage is sampled.
+// Reading it stops the world, so it is not read per request.
+const sampleInterval = time.Second
+
+// ErrInvalidThreshold is returned for a config with an invalid Threshold.
+var ErrInvalidThreshold = errors.New("invalid threshold")
+
+// Config represents the configuration for the numwant backpressure
+// middleware.
+type Config struct {
+	// Threshold is the pressure, between 0 and 1, above which numwant is
+	// decreased.
+	Threshold float64 `yaml:"threshold"`
+
+	// MinNumWant is the numwant used at full pressure.
+	// Announces requesting fewer peers are not altered.
+	MinNumWant uint32 `yaml:"min_numwant"`
+
+	// MemoryLimit is the size of the heap in bytes that is considered full
+	// memory pressure.
+	// Zero disables the memory signal, so only the load is used.
+	MemoryLimit uint64 `yaml:"memory_limit"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"threshold":   cfg.Threshold,
+		"minNumWant":  cfg.MinNumWant,
+		"memoryLimit": cfg.MemoryLimit,
+	}
+}
+
+type hook struct {
+	cfg   Config
+	level func() float64
+
+	// memoryLevel holds the bits of a float64 and must be accessed
+	// atomically!
+	memoryLevel uint64
+	closing     chan struct{}
+}
+
+// NewHook returns an instance of the numwant backpressure middleware.
+//
+// The pressure is the higher of the load read from the Limiters registered
+// with the load package and the fraction of MemoryLimit in use by the heap.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.Threshold < 0 || cfg.Threshold >= 1 {
+		return nil, ErrInvalidThreshold
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+	h.level = h.pressure
+
+	if cfg.MemoryLimit > 0 {
+		h.sampleMemory()
+		go func() {
+			for {
+				select {
+				case <-h.closing:
+					return
+				case <-time.After(sampleInterval):
+					h.sampleMemory()
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+// sampleMemory updates the memory level from the current size of the heap.
+func (h *hook) sampleMemory() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	level := float64(stats.HeapAlloc) / float64(h.cfg.MemoryLimit)
+	if level > 1 {
+		level = 1
+	}
+
+	atomic.StoreUint64(&h.memoryLevel, math.Float64bits(level))
+}
+
+// pressure returns the higher of the load and the memory level.
+func (h *hook) pressure() float64 {
+	level := load.Level()
+	if memoryLevel := math.Float64frombits(atomic.LoadUint64(&h.memoryLevel)); memoryLevel > level {
+		level = memoryLevel
+	}
+
+	return level
+}
+
+// numWant scales numWant down to the given pressure.
+func (h *hook) numWant(numWant uint32, level float64) uint32 {
+	if numWant <= h.cfg.MinNumWant {
+		return numWant
+	}
+
+	factor := (level - h.cfg.Threshold) / (1 - h.cfg.Threshold)
+	return numWant - uint32(factor*float64(numWant-h.cfg.MinNumWant))
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	level := h.level()
+	if level <= h.cfg.Threshold {
+		return ctx, nil
+	}
+
+	req.NumWant = h.numWant(req.NumWant, level)
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't return peers.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis don't return peers.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(chan error)
+	go func() {
+		close(h.closing)
+		close(c)
+	}()
+	return c
+}
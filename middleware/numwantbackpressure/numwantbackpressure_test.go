@@ -0,0 +1,70 @@
+package numwantbackpressure
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{Threshold: 0.5, MinNumWant: 10}, nil},
+		{Config{Threshold: 0, MemoryLimit: 1 << 30}, nil},
+		{Config{Threshold: -0.1}, ErrInvalidThreshold},
+		{Config{Threshold: 1}, ErrInvalidThreshold},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+		if err == nil {
+			<-h.(*hook).Stop()
+		}
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	var table = []struct {
+		level    float64
+		numWant  uint32
+		expected uint32
+	}{
+		{0, 50, 50},
+		{0.5, 50, 50},
+		{0.75, 50, 30},
+		{1, 50, 10},
+		// Announces below MinNumWant are never raised.
+		{1, 5, 5},
+		{1, 0, 0},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%#v", tt), func(t *testing.T) {
+			h, err := NewHook(Config{Threshold: 0.5, MinNumWant: 10})
+			require.Nil(t, err)
+			defer func() { <-h.(*hook).Stop() }()
+			h.(*hook).level = func() float64 { return tt.level }
+
+			req := &bittorrent.AnnounceRequest{NumWant: tt.numWant}
+			_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, req.NumWant)
+		})
+	}
+}
+
+func TestMemoryPressure(t *testing.T) {
+	// Any heap exceeds a limit of one byte.
+	h, err := NewHook(Config{MemoryLimit: 1})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	require.Equal(t, float64(1), h.(*hook).pressure())
+}
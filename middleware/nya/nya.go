@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"strconv"
 	"sync"
 	"time"
@@ -16,7 +17,21 @@ import (
 )
 
 var (
-	ErrUnregisteredTorrent = bittorrent.ClientError("torrent not found")
+	ErrUnregisteredTorrent = bittorrent.NewClientError("unregistered_torrent", "torrent not found")
+	ErrBannedTorrent       = bittorrent.NewClientError("banned_torrent", "torrent is banned")
+)
+
+// Responses to scrapes of banned or deleted torrents.
+const (
+	// BannedScrapesZero answers with zeroed stats, like for unknown torrents.
+	BannedScrapesZero = "zero"
+
+	// BannedScrapesError rejects the scrape with ErrBannedTorrent.
+	BannedScrapesError = "error"
+
+	// BannedScrapesFlag answers with zeroed stats and marks the torrent as
+	// banned.
+	BannedScrapesFlag = "flag"
 )
 
 type Config struct {
@@ -27,6 +42,10 @@ type Config struct {
 	StatsQueryInterval time.Duration `yaml:"stats_query_interval"`
 	BannedFlag         int32         `yaml:"banned_flag"`
 	NyaaAuth           string        `yaml:"nyaa_auth"`
+
+	// BannedScrapes is one of BannedScrapesZero (the default),
+	// BannedScrapesError and BannedScrapesFlag.
+	BannedScrapes string `yaml:"banned_scrapes"`
 }
 
 type Torrent struct {
@@ -59,6 +78,14 @@ func NewContext(cfg Config) (*Context, error) {
 		cfg.StatsQueryTries = 1
 	}
 
+	switch cfg.BannedScrapes {
+	case "":
+		cfg.BannedScrapes = BannedScrapesZero
+	case BannedScrapesZero, BannedScrapesError, BannedScrapesFlag:
+	default:
+		return nil, errors.New("banned_scrapes must be zero, error or flag")
+	}
+
 	return &Context{
 		Cfg:      cfg,
 		db:       db,
@@ -102,6 +129,16 @@ func (ctx *Context) LookupTorrent(info bittorrent.InfoHash) (Torrent, error) {
 	}
 }
 
+// IsBanned reports whether the torrent is banned or deleted, as opposed to
+// merely unknown.
+func (ctx *Context) IsBanned(info bittorrent.InfoHash) (bool, error) {
+	torrent, err := ctx.LookupTorrent(info)
+	if err == ErrUnregisteredTorrent {
+		return torrent.Banned || torrent.Delete, nil
+	}
+	return false, err
+}
+
 func (ctx *Context) RecordStats(info bittorrent.InfoHash, seeds uint32, leechers uint32, completed bool) {
 	ctx.lock.Lock()
 	torrent, exists := ctx.torrents[info]
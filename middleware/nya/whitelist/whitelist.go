@@ -68,7 +68,31 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 }
 
 func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
-	return ctx, nil
+	if nya.Ctx.Cfg.BannedScrapes == nya.BannedScrapesZero {
+		return ctx, nil
+	}
+
+	banned := make(map[bittorrent.InfoHash]struct{})
+	for _, infoHash := range req.InfoHashes {
+		isBanned, err := nya.Ctx.IsBanned(infoHash)
+		if err != nil {
+			return ctx, err
+		}
+		if !isBanned {
+			continue
+		}
+
+		if nya.Ctx.Cfg.BannedScrapes == nya.BannedScrapesError {
+			return ctx, nya.ErrBannedTorrent
+		}
+		banned[infoHash] = struct{}{}
+	}
+
+	if len(banned) == 0 {
+		return ctx, nil
+	}
+
+	return context.WithValue(ctx, middleware.BannedInfoHashesKey, banned), nil
 }
 
 func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
@@ -0,0 +1,233 @@
+// Package operatormessage implements a Hook that sends a message of the
+// operator to clients as the warning message of announce responses.
+package operatormessage
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// maxMessageFileSize is the maximum size of a message file in bytes.
+const maxMessageFileSize = 64 << 10
+
+// Errors of the configuration.
+var (
+	ErrNoMessage         = errors.New("no message or message_file configured")
+	ErrInvalidPercentage = errors.New("percentage must be between 0 and 100")
+)
+
+// Config represents the configuration for the operator message middleware.
+type Config struct {
+	// Message is the message sent to clients.
+	Message string `yaml:"message"`
+
+	// MessageFile is the path to a file containing the message, which
+	// takes precedence over Message. Leading and trailing whitespace is
+	// removed. An empty file sends no message.
+	MessageFile string `yaml:"message_file"`
+
+	// ReloadInterval is the interval in which MessageFile is checked for
+	// modifications and reloaded. Zero disables reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// InfoHashes is a list of hex-encoded infohashes whose announces
+	// receive the message. If empty, announces of all infohashes receive
+	// it.
+	InfoHashes []string `yaml:"infohashes"`
+
+	// Percentage is the percentage of clients that receive the message.
+	// A client is selected by its peer ID, so it either receives the
+	// message on all its announces or on none.
+	// If zero, all clients receive the message.
+	Percentage float64 `yaml:"percentage"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"message":        cfg.Message,
+		"messageFile":    cfg.MessageFile,
+		"reloadInterval": cfg.ReloadInterval,
+		"infoHashes":     len(cfg.InfoHashes),
+		"percentage":     cfg.Percentage,
+	}
+}
+
+type hook struct {
+	cfg        Config
+	infoHashes map[bittorrent.InfoHash]struct{}
+	threshold  uint64
+	message    atomic.Value // string
+	modTime    time.Time
+	closing    chan struct{}
+}
+
+// NewHook returns an instance of the operator message middleware.
+//
+// The message is appended to the warning message set by earlier middleware,
+// if any.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.Message == "" && cfg.MessageFile == "" {
+		return nil, ErrNoMessage
+	}
+	if cfg.Percentage < 0 || cfg.Percentage > 100 {
+		return nil, ErrInvalidPercentage
+	}
+
+	if cfg.Percentage == 0 {
+		cfg.Percentage = 100
+	}
+
+	h := &hook{
+		cfg:        cfg,
+		infoHashes: make(map[bittorrent.InfoHash]struct{}, len(cfg.InfoHashes)),
+		threshold:  uint64(cfg.Percentage / 100 * (1 << 24)),
+		closing:    make(chan struct{}),
+	}
+
+	for _, ihString := range cfg.InfoHashes {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			return nil, errors.New("infohash " + ihString + " must be 40 hex characters")
+		}
+		h.infoHashes[bittorrent.InfoHashFromBytes(ihBytes)] = struct{}{}
+	}
+
+	h.message.Store(cfg.Message)
+	if cfg.MessageFile != "" {
+		if err := h.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.MessageFile != "" && cfg.ReloadInterval > 0 {
+		go func() {
+			for {
+				select {
+				case <-h.closing:
+					return
+				case <-time.After(cfg.ReloadInterval):
+					if err := h.reload(); err != nil {
+						log.Error("failed to reload operator message", log.Err(err))
+					}
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+// load reads the message from the message file and replaces the current
+// message with it.
+func (h *hook) load() error {
+	f, err := os.Open(h.cfg.MessageFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > maxMessageFileSize {
+		return errors.New("message file exceeds 64 KiB")
+	}
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	message := strings.TrimSpace(string(b))
+	h.message.Store(message)
+	h.modTime = fi.ModTime()
+	log.Debug("loaded operator message", log.Fields{"message": message})
+
+	return nil
+}
+
+// reload loads the message again if the message file was modified.
+//
+// If the message file cannot be read, the current message is kept.
+func (h *hook) reload() error {
+	fi, err := os.Stat(h.cfg.MessageFile)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	return h.load()
+}
+
+// targets reports whether req receives the message.
+func (h *hook) targets(req *bittorrent.AnnounceRequest) bool {
+	if len(h.infoHashes) > 0 {
+		if _, ok := h.infoHashes[req.InfoHash]; !ok {
+			return false
+		}
+	}
+
+	if h.threshold >= 1<<24 {
+		return true
+	}
+
+	f := fnv.New64a()
+	f.Write(req.Peer.ID[:])
+	return f.Sum64()%(1<<24) < h.threshold
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	message := h.message.Load().(string)
+	if message == "" || !h.targets(req) {
+		return ctx, nil
+	}
+
+	if resp.WarningMessage == "" {
+		resp.WarningMessage = message
+	} else {
+		resp.WarningMessage += " " + message
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrape responses have no warning message.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api responses have no warning message.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(chan error)
+	go func() {
+		close(h.closing)
+		close(c)
+	}()
+	return c
+}
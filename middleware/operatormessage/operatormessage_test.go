@@ -0,0 +1,97 @@
+package operatormessage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func announce(t *testing.T, h *hook, req *bittorrent.AnnounceRequest, warning string) string {
+	resp := &bittorrent.AnnounceResponse{WarningMessage: warning}
+	_, err := h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	return resp.WarningMessage
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrNoMessage, err)
+	_, err = NewHook(Config{Message: "hello", Percentage: 101})
+	require.Equal(t, ErrInvalidPercentage, err)
+	_, err = NewHook(Config{Message: "hello", InfoHashes: []string{"nonsense"}})
+	require.NotNil(t, err)
+
+	ih := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	other := bittorrent.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+	h, err := NewHook(Config{Message: "maintenance tonight", InfoHashes: []string{fmt.Sprintf("%x", ih[:])}})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	require.Equal(t, "maintenance tonight", announce(t, h.(*hook), &bittorrent.AnnounceRequest{InfoHash: ih}, ""))
+	require.Equal(t, "", announce(t, h.(*hook), &bittorrent.AnnounceRequest{InfoHash: other}, ""))
+
+	// Earlier warning messages are kept.
+	require.Equal(t, "no peers maintenance tonight", announce(t, h.(*hook), &bittorrent.AnnounceRequest{InfoHash: ih}, "no peers"))
+}
+
+func TestPercentage(t *testing.T) {
+	h, err := NewHook(Config{Message: "hello", Percentage: 50})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	received := 0
+	for i := 0; i < 1000; i++ {
+		req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: bittorrent.PeerIDFromString(fmt.Sprintf("-TR2940-%012d", i))}}
+		message := announce(t, h.(*hook), req, "")
+
+		// Clients are selected consistently.
+		require.Equal(t, message, announce(t, h.(*hook), req, ""))
+		if message != "" {
+			received++
+		}
+	}
+
+	require.True(t, received > 400 && received < 600)
+}
+
+func TestReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "operatormessage")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("  first message\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	h, err := NewHook(Config{Message: "ignored", MessageFile: f.Name()})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	require.Equal(t, "first message", announce(t, h.(*hook), &bittorrent.AnnounceRequest{}, ""))
+
+	require.Nil(t, ioutil.WriteFile(f.Name(), []byte("second message\n"), 0644))
+	require.Nil(t, os.Chtimes(f.Name(), time.Now(), time.Now().Add(time.Minute)))
+	require.Nil(t, h.(*hook).reload())
+	require.Equal(t, "second message", announce(t, h.(*hook), &bittorrent.AnnounceRequest{}, ""))
+
+	// Empty files send no message.
+	require.Nil(t, ioutil.WriteFile(f.Name(), nil, 0644))
+	require.Nil(t, os.Chtimes(f.Name(), time.Now(), time.Now().Add(2*time.Minute)))
+	require.Nil(t, h.(*hook).reload())
+	require.Equal(t, "", announce(t, h.(*hook), &bittorrent.AnnounceRequest{}, ""))
+
+	// Unreadable files keep the current message.
+	require.Nil(t, ioutil.WriteFile(f.Name(), []byte("third message\n"), 0644))
+	require.Nil(t, os.Chtimes(f.Name(), time.Now(), time.Now().Add(3*time.Minute)))
+	require.Nil(t, h.(*hook).reload())
+	require.Nil(t, os.Remove(f.Name()))
+	require.NotNil(t, h.(*hook).reload())
+	require.Equal(t, "third message", announce(t, h.(*hook), &bittorrent.AnnounceRequest{}, ""))
+}
@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Modes of padding the peers of announce responses.
+const (
+	// PaddingModeDecoy pads with peers at addresses reserved for
+	// documentation, which are never routed.
+	// Because these prefixes are well known, decoys are easy to spot and
+	// drop for any client or observer that looks for them.
+	PaddingModeDecoy = "decoy"
+
+	// PaddingModeRepeat pads by repeating the distinct peers of the
+	// response. Clients that drop duplicates see the real number of peers.
+	PaddingModeRepeat = "repeat"
+)
+
+// Prefixes of the addresses of decoy peers, TEST-NET-1 of RFC 5737 and the
+// documentation prefix of RFC 3849.
+var (
+	decoyIPv4Prefix = net.IPv4(192, 0, 2, 0).To4()
+	decoyIPv6Prefix = net.IP{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+)
+
+// PeerPaddingConfig holds the configuration of the padding of the peers of
+// announce responses, which hides the size of small swarms from clients.
+//
+// Scrape data, including the counts in announce responses, is never padded.
+type PeerPaddingConfig struct {
+	// Enabled specifies whether announce responses are padded to numwant
+	// peers.
+	Enabled bool `yaml:"enabled"`
+
+	// Mode is either PaddingModeDecoy or PaddingModeRepeat.
+	// If empty, PaddingModeDecoy is used.
+	Mode string `yaml:"mode"`
+
+	// PadAuthenticated specifies whether announces of authenticated
+	// clients, i.e. those of private trackers, are padded, too.
+	PadAuthenticated bool `yaml:"pad_authenticated"`
+}
+
+// peerPadder pads the peers of announce responses.
+//
+// A nil *peerPadder never pads.
+type peerPadder struct {
+	repeat           bool
+	padAuthenticated bool
+}
+
+// newPeerPadder creates a peerPadder for cfg.
+//
+// If padding is disabled, nil is returned.
+func newPeerPadder(cfg PeerPaddingConfig) *peerPadder {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	switch cfg.Mode {
+	case "", PaddingModeDecoy, PaddingModeRepeat:
+	default:
+		log.Warn("unknown peer padding mode, using decoy", log.Fields{"mode": cfg.Mode})
+	}
+
+	return &peerPadder{
+		repeat:           cfg.Mode == PaddingModeRepeat,
+		padAuthenticated: cfg.PadAuthenticated,
+	}
+}
+
+// pad pads peers to the numwant of req.
+//
+// Announces of authenticated clients are only padded if configured.
+func (p *peerPadder) pad(ctx context.Context, req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) []bittorrent.Peer {
+	if p == nil || len(peers) >= int(req.NumWant) {
+		return peers
+	}
+
+	if !p.padAuthenticated {
+		if _, ok := frontend.UserID(ctx); ok || ctx.Value(AuthenticatedKey) != nil {
+			return peers
+		}
+	}
+
+	if p.repeat {
+		return repeatPeers(peers, int(req.NumWant))
+	}
+	return appendDecoys(req, peers, int(req.NumWant))
+}
+
+// repeatPeers repeats the distinct endpoints of peers until there are
+// numWant.
+//
+// peers is deduplicated first, so that every endpoint is repeated equally
+// often.
+func repeatPeers(peers []bittorrent.Peer, numWant int) []bittorrent.Peer {
+	distinct := make([]bittorrent.Peer, 0, len(peers))
+	for _, p := range peers {
+		if !containsEndpoint(distinct, p) {
+			distinct = append(distinct, p)
+		}
+	}
+
+	n := len(distinct)
+	if n == 0 {
+		return peers
+	}
+
+	for i := 0; len(distinct) < numWant; i++ {
+		distinct = append(distinct, distinct[i%n])
+	}
+	return distinct
+}
+
+// appendDecoys appends decoy peers of the address family of req until there
+// are numWant peers.
+//
+// The decoys differ between announces, so that they cannot be told apart from
+// the real peers by comparing responses.
+func appendDecoys(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer, numWant int) []bittorrent.Peer {
+	s0, s1 := random.DeriveEntropyFromRequest(req)
+	s0 ^= uint64(time.Now().UnixNano())
+
+	// Give up on collisions of random endpoints eventually.
+	for attempts := 2 * (numWant - len(peers)); len(peers) < numWant && attempts > 0; attempts-- {
+		var v uint64
+		v, s0, s1 = random.GenerateAndAdvance(s0, s1)
+
+		decoy := bittorrent.Peer{
+			IP:   bittorrent.IP{AddressFamily: req.IP.AddressFamily},
+			Port: 1024 + uint16(v%(65536-1024)),
+		}
+
+		switch req.IP.AddressFamily {
+		case bittorrent.IPv4:
+			ip := make(net.IP, net.IPv4len)
+			copy(ip, decoyIPv4Prefix)
+			ip[3] = byte(v >> 16)
+			decoy.IP.IP = ip
+		default:
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, decoyIPv6Prefix)
+			binary.BigEndian.PutUint64(ip[8:], v)
+			decoy.IP.IP = ip
+		}
+
+		for i := 0; i < len(decoy.ID); i += 8 {
+			v, s0, s1 = random.GenerateAndAdvance(s0, s1)
+			var b [8]byte
+			binary.BigEndian.PutUint64(b[:], v)
+			copy(decoy.ID[i:], b[:])
+		}
+
+		if containsEndpoint(peers, decoy) {
+			continue
+		}
+		peers = append(peers, decoy)
+	}
+
+	return peers
+}
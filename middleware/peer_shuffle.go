@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Seeds of the shuffle of the peers of announce responses.
+const (
+	// ShuffleSeedRequest seeds the shuffle per request, so the order differs
+	// between all responses.
+	ShuffleSeedRequest = "request"
+
+	// ShuffleSeedInfoHash seeds the shuffle by the infohash, optionally
+	// combined with the current time window, so all responses of a swarm
+	// list its peers in the same order.
+	ShuffleSeedInfoHash = "infohash"
+)
+
+// PeerShuffleConfig holds the configuration of the shuffle of the peers of
+// announce responses.
+//
+// Seeding by request distributes the load of new connections evenly across
+// the peers of a swarm, but no two responses are alike. Seeding by infohash
+// makes the responses of a swarm identical as long as the swarm doesn't
+// change, so that a cache in front of the tracker can serve them, but every
+// client of the swarm tries the same peers first until the window ends.
+type PeerShuffleConfig struct {
+	// Seed is either ShuffleSeedRequest or ShuffleSeedInfoHash.
+	// If empty, ShuffleSeedRequest is used.
+	Seed string `yaml:"seed"`
+
+	// Window is the duration for which the order of a swarm is stable, if
+	// seeded by infohash. The order changes at multiples of Window since
+	// the unix epoch, so it should match the lifetime of cached responses.
+	// If zero, the order of a swarm never changes.
+	Window time.Duration `yaml:"window"`
+}
+
+// peerShuffler shuffles the peers of announce responses with a seed derived
+// from the infohash.
+//
+// A nil *peerShuffler shuffles with a seed per request.
+type peerShuffler struct {
+	window time.Duration
+}
+
+// newPeerShuffler creates a peerShuffler for cfg.
+//
+// If the shuffle is seeded by request, nil is returned.
+func newPeerShuffler(cfg PeerShuffleConfig) *peerShuffler {
+	switch cfg.Seed {
+	case "", ShuffleSeedRequest:
+		return nil
+	case ShuffleSeedInfoHash:
+	default:
+		log.Warn("unknown peer shuffle seed, using request", log.Fields{"seed": cfg.Seed})
+		return nil
+	}
+
+	if cfg.Window < 0 {
+		log.Warn("negative peer shuffle window, using none", log.Fields{"window": cfg.Window})
+		cfg.Window = 0
+	}
+
+	return &peerShuffler{window: cfg.Window}
+}
+
+// shuffle shuffles peers in place.
+//
+// The peers are sorted first, because the storage returns them in an
+// arbitrary order, so that the same peers always end up in the same order.
+// The response still differs between clients if they receive different
+// subsets of the swarm, e.g. because it exceeds numwant or because the
+// announcer itself is left out.
+func (s *peerShuffler) shuffle(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) {
+	if s == nil {
+		shufflePeers(req, peers)
+		return
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		if c := bytes.Compare(peers[i].IP.IP, peers[j].IP.IP); c != 0 {
+			return c < 0
+		}
+		if peers[i].Port != peers[j].Port {
+			return peers[i].Port < peers[j].Port
+		}
+		return bytes.Compare(peers[i].ID[:], peers[j].ID[:]) < 0
+	})
+
+	s0 := binary.BigEndian.Uint64(req.InfoHash[:8])
+	s1 := binary.BigEndian.Uint64(req.InfoHash[8:16])
+	if s.window > 0 {
+		// Spread consecutive windows across the state.
+		s1 ^= uint64(time.Now().UnixNano()/int64(s.window)) * 0x9e3779b97f4a7c15
+	}
+	if s0|s1 == 0 {
+		// The generator never leaves the all-zero state.
+		s1 = 1
+	}
+
+	var j int
+	for i := len(peers) - 1; i > 0; i-- {
+		j, s0, s1 = random.Intn(s0, s1, i+1)
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+}
@@ -0,0 +1,148 @@
+// Package cidr implements a binary trie for looking up IP addresses in a set
+// of CIDR ranges.
+package cidr
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrMixedAddressFamily is returned when a range of the wrong address family
+// is inserted into a Trie.
+var ErrMixedAddressFamily = errors.New("range does not match the address family of the trie")
+
+type node struct {
+	children [2]*node
+	terminal bool
+}
+
+// Trie is a set of CIDR ranges of a single address family.
+//
+// A Trie is not safe for concurrent modification, but may be queried
+// concurrently once it is no longer modified.
+type Trie struct {
+	root  node
+	ipLen int
+	size  int
+}
+
+// NewIPv4 creates an empty Trie for IPv4 ranges.
+func NewIPv4() *Trie {
+	return &Trie{ipLen: net.IPv4len}
+}
+
+// NewIPv6 creates an empty Trie for IPv6 ranges.
+func NewIPv6() *Trie {
+	return &Trie{ipLen: net.IPv6len}
+}
+
+// normalize returns ip in the representation of the address family of the
+// Trie or nil if it belongs to another address family.
+func (t *Trie) normalize(ip net.IP) net.IP {
+	if t.ipLen == net.IPv4len {
+		return ip.To4()
+	}
+
+	if len(ip) != net.IPv6len || ip.To4() != nil {
+		return nil
+	}
+	return ip
+}
+
+// Insert adds a range to the Trie.
+func (t *Trie) Insert(ipNet *net.IPNet) error {
+	ip := t.normalize(ipNet.IP)
+	ones, bits := ipNet.Mask.Size()
+	if ip == nil || bits != t.ipLen*8 {
+		return ErrMixedAddressFamily
+	}
+
+	n := &t.root
+	for i := 0; i < ones; i++ {
+		if n.terminal {
+			// A shorter prefix covers this range already.
+			return nil
+		}
+
+		bit := ip[i/8] >> uint(7-i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &node{}
+		}
+		n = n.children[bit]
+	}
+
+	if n.terminal {
+		return nil
+	}
+
+	// Longer prefixes are covered by this range now.
+	t.size += 1 - n.children[0].terminals() - n.children[1].terminals()
+	n.terminal = true
+	n.children = [2]*node{}
+
+	return nil
+}
+
+// terminals returns the number of terminal nodes in the subtree of n.
+func (n *node) terminals() int {
+	if n == nil {
+		return 0
+	}
+	if n.terminal {
+		return 1
+	}
+	return n.children[0].terminals() + n.children[1].terminals()
+}
+
+// Contains reports whether ip is contained in any range of the Trie.
+//
+// IPs of the other address family are never contained.
+func (t *Trie) Contains(ip net.IP) bool {
+	ip = t.normalize(ip)
+	if ip == nil {
+		return false
+	}
+
+	n := &t.root
+	for i := 0; i < t.ipLen*8; i++ {
+		if n.terminal {
+			return true
+		}
+
+		n = n.children[ip[i/8]>>uint(7-i%8)&1]
+		if n == nil {
+			return false
+		}
+	}
+
+	return n.terminal
+}
+
+// Len returns the number of ranges in the Trie, excluding ranges that are
+// covered by another inserted range.
+func (t *Trie) Len() int {
+	return t.size
+}
+
+// ParseRange parses a range in CIDR notation.
+// A single IP address is treated as a range with a full-length prefix.
+func ParseRange(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid IP address: " + s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	return ipNet, nil
+}
@@ -0,0 +1,84 @@
+package cidr
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrie(t *testing.T) {
+	v4, v6 := NewIPv4(), NewIPv6()
+	for _, r := range []string{"10.0.0.0/8", "192.168.1.0/24", "10.1.0.0/16", "1.2.3.4"} {
+		ipNet, err := ParseRange(r)
+		require.Nil(t, err)
+		require.Nil(t, v4.Insert(ipNet))
+	}
+	for _, r := range []string{"2001:db8::/32", "fc00::1"} {
+		ipNet, err := ParseRange(r)
+		require.Nil(t, err)
+		require.Nil(t, v6.Insert(ipNet))
+	}
+
+	// 10.1.0.0/16 is covered by 10.0.0.0/8.
+	require.Equal(t, 3, v4.Len())
+	require.Equal(t, 2, v6.Len())
+
+	var table = []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.255.0.1", true},
+		{"11.0.0.1", false},
+		{"192.168.1.200", true},
+		{"192.168.2.1", false},
+		{"1.2.3.4", true},
+		{"1.2.3.5", false},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+		{"fc00::1", true},
+		{"fc00::2", false},
+	}
+
+	for _, tt := range table {
+		ip := net.ParseIP(tt.ip)
+		require.Equal(t, tt.expected, v4.Contains(ip) || v6.Contains(ip), tt.ip)
+	}
+
+	// Address families must not be mixed.
+	require.False(t, v6.Contains(net.ParseIP("10.0.0.1")))
+	ipNet, err := ParseRange("2001:db8::/32")
+	require.Nil(t, err)
+	require.Equal(t, ErrMixedAddressFamily, v4.Insert(ipNet))
+}
+
+func TestTrieLen(t *testing.T) {
+	v4 := NewIPv4()
+	var table = []struct {
+		r        string
+		expected int
+	}{
+		{"192.168.1.0/24", 1},
+		{"192.168.2.0/24", 2},
+		{"192.168.1.0/24", 2},
+		{"192.168.1.128/25", 2},
+		// Ranges covering previously inserted ones replace them.
+		{"192.168.0.0/16", 1},
+		{"10.0.0.1", 2},
+	}
+
+	for _, tt := range table {
+		ipNet, err := ParseRange(tt.r)
+		require.Nil(t, err)
+		require.Nil(t, v4.Insert(ipNet))
+		require.Equal(t, tt.expected, v4.Len(), tt.r)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	_, err := ParseRange("not an ip")
+	require.NotNil(t, err)
+
+	_, err = ParseRange("10.0.0.0/33")
+	require.NotNil(t, err)
+}
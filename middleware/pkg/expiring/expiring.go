@@ -0,0 +1,247 @@
+// Package expiring implements a concurrency-safe map whose entries expire,
+// for the state middleware keeps in memory.
+package expiring
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+const shardCount = 16
+
+// Entry is an entry of a Map.
+type Entry struct {
+	Value interface{}
+
+	// Expires is the time after which the entry is removed.
+	Expires time.Time
+}
+
+// element is an element of the list of a shard.
+type element struct {
+	key   string
+	entry Entry
+}
+
+// shard holds the entries of a part of the keys, ordered from the least to
+// the most recently updated one.
+type shard struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// Map maps strings to Entries that expire.
+//
+// If the number of entries is limited, the least recently updated entries are
+// removed first to make room for new ones. Entries that are updated regularly,
+// e.g. the counter of an abuser, are therefore not removed by flooding the Map
+// with new keys.
+type Map struct {
+	maxShard int
+	shards   [shardCount]*shard
+	closing  chan struct{}
+}
+
+// New creates a Map that holds up to maxEntries entries and removes expired
+// entries every gcInterval.
+//
+// If maxEntries is zero, the number of entries is not limited. If gcInterval
+// is zero, expired entries are only removed to make room for new ones.
+func New(maxEntries int, gcInterval time.Duration) *Map {
+	m := &Map{closing: make(chan struct{})}
+	if maxEntries > 0 {
+		m.maxShard = maxEntries / shardCount
+		if m.maxShard < 1 {
+			m.maxShard = 1
+		}
+	}
+	for i := range m.shards {
+		m.shards[i] = &shard{entries: make(map[string]*list.Element), order: list.New()}
+	}
+
+	if gcInterval <= 0 {
+		return m
+	}
+
+	go func() {
+		for {
+			select {
+			case <-m.closing:
+				return
+			case <-time.After(gcInterval):
+				m.collectGarbage(time.Now())
+			}
+		}
+	}()
+
+	return m
+}
+
+// shardIndex returns the index of the shard of key, using the FNV-1a hash of
+// the whole key.
+func shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % shardCount)
+}
+
+// get returns the entry of key at now, if it exists and did not expire.
+// The shard must be locked.
+func (s *shard) get(key string, now time.Time) (Entry, bool) {
+	e, ok := s.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+
+	entry := e.Value.(*element).entry
+	if !entry.Expires.After(now) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// set stores entry under key or removes key if entry expired at now.
+// The shard must be locked.
+func (m *Map) set(s *shard, key string, entry Entry, now time.Time) {
+	e, ok := s.entries[key]
+	if !entry.Expires.After(now) {
+		if ok {
+			s.order.Remove(e)
+			delete(s.entries, key)
+		}
+		return
+	}
+
+	if ok {
+		e.Value.(*element).entry = entry
+		s.order.MoveToBack(e)
+		return
+	}
+
+	if m.maxShard > 0 && len(s.entries) >= m.maxShard {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*element).key)
+	}
+	s.entries[key] = s.order.PushBack(&element{key: key, entry: entry})
+}
+
+// Get returns the entry of key at now, if it exists and did not expire.
+func (m *Map) Get(key string, now time.Time) (Entry, bool) {
+	s := m.shards[shardIndex(key)]
+	s.Lock()
+	defer s.Unlock()
+
+	return s.get(key, now)
+}
+
+// Set stores value under key until expires.
+func (m *Map) Set(key string, value interface{}, expires time.Time) {
+	s := m.shards[shardIndex(key)]
+	s.Lock()
+	defer s.Unlock()
+
+	m.set(s, key, Entry{Value: value, Expires: expires}, time.Time{})
+}
+
+// Update replaces the entry of key with the one returned by fn.
+//
+// fn is called with the entry of key at now and whether it exists and did not
+// expire, while no other update of key can happen. If the returned entry
+// expired at now, key is removed instead, so returning a zero Entry deletes
+// the key.
+func (m *Map) Update(key string, now time.Time, fn func(entry Entry, ok bool) Entry) {
+	s := m.shards[shardIndex(key)]
+	s.Lock()
+	defer s.Unlock()
+
+	entry, ok := s.get(key, now)
+	m.set(s, key, fn(entry, ok), now)
+}
+
+// UpdatePair replaces the entries of the keys a and b with the ones returned
+// by fn, like Update, while no other update of either key can happen.
+//
+// The shards of both keys are locked in a fixed order, so that concurrent
+// updates of the same pair can't deadlock. If a and b are equal, the first
+// entry returned by fn is stored.
+func (m *Map) UpdatePair(a, b string, now time.Time, fn func(a Entry, okA bool, b Entry, okB bool) (Entry, Entry)) {
+	i, j := shardIndex(a), shardIndex(b)
+	if i > j {
+		i, j = j, i
+	}
+	m.shards[i].Lock()
+	defer m.shards[i].Unlock()
+	if i != j {
+		m.shards[j].Lock()
+		defer m.shards[j].Unlock()
+	}
+
+	sa, sb := m.shards[shardIndex(a)], m.shards[shardIndex(b)]
+	entryA, okA := sa.get(a, now)
+	entryB, okB := sb.get(b, now)
+	entryA, entryB = fn(entryA, okA, entryB, okB)
+
+	if a != b {
+		m.set(sb, b, entryB, now)
+	}
+	m.set(sa, a, entryA, now)
+}
+
+// Delete removes key.
+func (m *Map) Delete(key string) {
+	s := m.shards[shardIndex(key)]
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		s.order.Remove(e)
+		delete(s.entries, key)
+	}
+}
+
+// Len returns the number of entries, including expired ones that were not
+// removed yet.
+func (m *Map) Len() (n int) {
+	for _, s := range m.shards {
+		s.Lock()
+		n += len(s.entries)
+		s.Unlock()
+	}
+	return
+}
+
+// collectGarbage removes all entries that expired at now.
+func (m *Map) collectGarbage(now time.Time) {
+	for _, s := range m.shards {
+		s.Lock()
+		for key, e := range s.entries {
+			if !e.Value.(*element).entry.Expires.After(now) {
+				s.order.Remove(e)
+				delete(s.entries, key)
+			}
+		}
+		s.Unlock()
+	}
+}
+
+// Stop stops removing expired entries.
+func (m *Map) Stop() <-chan error {
+	select {
+	case <-m.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+
+	close(m.closing)
+	c := make(chan error)
+	close(c)
+	return c
+}
@@ -0,0 +1,122 @@
+package expiring
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+func TestMap(t *testing.T) {
+	m := New(0, time.Hour)
+	defer m.Stop()
+	now := time.Now()
+
+	m.Set("a", 1, now.Add(time.Minute))
+	e, ok := m.Get("a", now)
+	require.True(t, ok)
+	require.Equal(t, 1, e.Value)
+
+	_, ok = m.Get("a", now.Add(time.Minute))
+	require.False(t, ok, "expired entries must not be returned")
+
+	m.Update("a", now, func(e Entry, ok bool) Entry {
+		require.True(t, ok)
+		e.Value = e.Value.(int) + 1
+		return e
+	})
+	e, _ = m.Get("a", now)
+	require.Equal(t, 2, e.Value)
+
+	m.Update("a", now, func(e Entry, ok bool) Entry { return Entry{} })
+	_, ok = m.Get("a", now)
+	require.False(t, ok, "returning a zero Entry must delete the key")
+	require.Equal(t, 0, m.Len())
+
+	m.Set("b", nil, now.Add(time.Minute))
+	m.Delete("b")
+	require.Equal(t, 0, m.Len())
+
+	m.Set("c", nil, now.Add(time.Minute))
+	m.Set("d", nil, now.Add(time.Hour))
+	m.collectGarbage(now.Add(2 * time.Minute))
+	require.Equal(t, 1, m.Len())
+}
+
+func TestUpdatePair(t *testing.T) {
+	m := New(0, 0)
+	defer m.Stop()
+	now := time.Now()
+
+	m.Set("a", 1, now.Add(time.Minute))
+	m.UpdatePair("a", "b", now, func(a Entry, okA bool, b Entry, okB bool) (Entry, Entry) {
+		require.True(t, okA)
+		require.False(t, okB)
+		return Entry{Value: 2, Expires: a.Expires}, Entry{Value: 3, Expires: a.Expires}
+	})
+	e, _ := m.Get("a", now)
+	require.Equal(t, 2, e.Value)
+	e, _ = m.Get("b", now)
+	require.Equal(t, 3, e.Value)
+
+	m.UpdatePair("a", "a", now, func(a Entry, okA bool, b Entry, okB bool) (Entry, Entry) {
+		require.Equal(t, a, b)
+		return Entry{Value: 4, Expires: a.Expires}, Entry{}
+	})
+	e, _ = m.Get("a", now)
+	require.Equal(t, 4, e.Value)
+}
+
+func TestMapEvictsOldest(t *testing.T) {
+	m := New(shardCount, time.Hour)
+	defer m.Stop()
+	now := time.Now()
+
+	// Find three keys in the same shard, which holds a single entry.
+	var keys []string
+	for i := 0; len(keys) < 3; i++ {
+		k := string(rune('a' + i))
+		if shardIndex(k) == shardIndex("a") {
+			keys = append(keys, k)
+		}
+	}
+
+	m.Set(keys[0], nil, now.Add(time.Minute))
+	m.Set(keys[1], nil, now.Add(time.Minute))
+	_, ok := m.Get(keys[0], now)
+	require.False(t, ok)
+	_, ok = m.Get(keys[1], now)
+	require.True(t, ok)
+	require.Equal(t, 1, m.Len())
+}
+
+func TestMapEvictsLeastRecentlyUpdated(t *testing.T) {
+	m := New(2*shardCount, time.Hour)
+	defer m.Stop()
+	now := time.Now()
+
+	var keys []string
+	for i := 0; len(keys) < 3; i++ {
+		k := string(rune('a' + i))
+		if shardIndex(k) == shardIndex("a") {
+			keys = append(keys, k)
+		}
+	}
+
+	m.Set(keys[0], nil, now.Add(time.Minute))
+	m.Set(keys[1], nil, now.Add(time.Minute))
+	m.Set(keys[0], nil, now.Add(time.Minute))
+	m.Set(keys[2], nil, now.Add(time.Minute))
+	_, ok := m.Get(keys[0], now)
+	require.True(t, ok, "updated entries must be kept")
+	_, ok = m.Get(keys[1], now)
+	require.False(t, ok)
+}
+
+func TestStop(t *testing.T) {
+	m := New(0, time.Hour)
+	require.Nil(t, <-m.Stop())
+	require.Equal(t, stop.AlreadyStopped, m.Stop())
+}
@@ -0,0 +1,356 @@
+// Package metadata implements providers of torrent metadata from external
+// sources, such as the names of torrents.
+package metadata
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/middleware/pkg/singleflight"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrUnknownInfoHash is returned by a Provider if it has no metadata for an
+// infohash.
+var ErrUnknownInfoHash = errors.New("unknown infohash")
+
+// ErrSourceUnavailable is returned by a Cache instead of querying a source
+// that failed repeatedly.
+var ErrSourceUnavailable = errors.New("metadata source unavailable")
+
+// ErrNoSource is returned for a config without a file or URL.
+var ErrNoSource = errors.New("no metadata file or url configured")
+
+// Defaults of the configuration.
+const (
+	defaultTimeout          = 2 * time.Second
+	defaultCacheTTL         = 10 * time.Minute
+	defaultMaxCacheEntries  = 100000
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// Provider provides metadata of torrents.
+type Provider interface {
+	// Name returns the name of the torrent identified by infoHash.
+	//
+	// If the infohash is unknown, ErrUnknownInfoHash is returned.
+	Name(infoHash bittorrent.InfoHash) (string, error)
+}
+
+// Config represents the configuration of a Provider.
+//
+// Exactly one of File and URL must be set.
+type Config struct {
+	// File is the path to a file containing one hex-encoded infohash and
+	// name per line, separated by whitespace. It is read once.
+	File string `yaml:"file"`
+
+	// URL is queried for the metadata of a torrent, with {infohash}
+	// replaced by the hex-encoded infohash. The body of a successful
+	// response is the name of the torrent, 404 marks unknown infohashes.
+	URL string `yaml:"url"`
+
+	// Timeout is the timeout for requests to URL.
+	// If zero, a default of 2s is used.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// CacheTTL is the duration metadata looked up via URL is cached for.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+
+	// FailureCacheTTL is the duration failed lookups via URL are cached
+	// for, so that an unavailable source is not queried for every request.
+	// Zero disables caching failures.
+	FailureCacheTTL time.Duration `yaml:"failure_cache_ttl"`
+
+	// MaxCacheEntries is the maximum number of lookups via URL that are
+	// cached. Beyond that, the ones used least recently are dropped.
+	// If zero, a default of 100000 is used.
+	MaxCacheEntries int `yaml:"max_cache_entries"`
+
+	// BreakerThreshold is the number of consecutive failed lookups via URL
+	// after which the source is no longer queried for any infohash until
+	// BreakerCooldown has passed.
+	// If zero, a default of 5 is used.
+	BreakerThreshold int `yaml:"breaker_threshold"`
+
+	// BreakerCooldown is the duration lookups via URL are skipped for once
+	// BreakerThreshold is reached. Then, a single lookup probes whether the
+	// source recovered.
+	// If zero, a default of 30s is used.
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"file":             cfg.File,
+		"url":              cfg.URL,
+		"timeout":          cfg.Timeout,
+		"cacheTTL":         cfg.CacheTTL,
+		"failureCacheTTL":  cfg.FailureCacheTTL,
+		"maxCacheEntries":  cfg.MaxCacheEntries,
+		"breakerThreshold": cfg.BreakerThreshold,
+		"breakerCooldown":  cfg.BreakerCooldown,
+	}
+}
+
+// New creates a Provider from the given config.
+func New(cfg Config) (Provider, error) {
+	switch {
+	case cfg.File != "" && cfg.URL != "":
+		return nil, errors.New("only one of metadata file and url may be configured")
+	case cfg.File != "":
+		return newFileProvider(cfg.File)
+	case cfg.URL != "":
+		timeout := cfg.Timeout
+		if timeout <= 0 {
+			timeout = defaultTimeout
+		}
+		ttl := cfg.CacheTTL
+		if ttl <= 0 {
+			ttl = defaultCacheTTL
+		}
+		maxEntries := cfg.MaxCacheEntries
+		if maxEntries <= 0 {
+			maxEntries = defaultMaxCacheEntries
+		}
+
+		c := NewCache(&httpProvider{
+			url:    cfg.URL,
+			client: &http.Client{Timeout: timeout},
+		}, ttl, maxEntries)
+		c.failureTTL = cfg.FailureCacheTTL
+		if cfg.BreakerThreshold > 0 {
+			c.breaker.threshold = cfg.BreakerThreshold
+		}
+		if cfg.BreakerCooldown > 0 {
+			c.breaker.cooldown = cfg.BreakerCooldown
+		}
+		return c, nil
+	default:
+		return nil, ErrNoSource
+	}
+}
+
+type fileProvider struct {
+	names map[bittorrent.InfoHash]string
+}
+
+func newFileProvider(path string) (*fileProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &fileProvider{names: make(map[bittorrent.InfoHash]string)}
+	if err := p.parse(f); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *fileProvider) parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ihString, name := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			ihString, name = line[:i], strings.TrimSpace(line[i:])
+		}
+
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			return errors.New("infohash " + ihString + " must be 40 hex characters")
+		}
+
+		p.names[bittorrent.InfoHashFromBytes(ihBytes)] = name
+	}
+
+	return scanner.Err()
+}
+
+func (p *fileProvider) Name(infoHash bittorrent.InfoHash) (string, error) {
+	name, ok := p.names[infoHash]
+	if !ok {
+		return "", ErrUnknownInfoHash
+	}
+	return name, nil
+}
+
+type httpProvider struct {
+	url    string
+	client *http.Client
+}
+
+func (p *httpProvider) Name(infoHash bittorrent.InfoHash) (string, error) {
+	url := strings.Replace(p.url, "{infohash}", hex.EncodeToString(infoHash[:]), -1)
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", ErrUnknownInfoHash
+	default:
+		return "", errors.New("unexpected metadata response status: " + resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+type cacheEntry struct {
+	name string
+	err  error
+}
+
+// breaker keeps a failing Provider from being queried for any infohash.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow reports whether the provider may be queried as if the current time
+// was now. Once the cooldown of an open breaker has passed, a single lookup is
+// allowed to probe the provider.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if now.Before(b.openUntil) {
+		return false
+	}
+
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// record records the outcome of a lookup made at now.
+func (b *breaker) record(failed bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.failures >= b.threshold {
+			log.Info("metadata source recovered")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures == b.threshold {
+		log.Warn("metadata source failing, skipping lookups", log.Fields{
+			"failures": b.failures,
+			"cooldown": b.cooldown,
+		})
+	}
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// Cache caches the metadata returned by a Provider.
+//
+// Unknown infohashes are cached as well, other errors only if a failure TTL
+// is configured. Concurrent lookups of the same infohash query the Provider
+// once. After repeated failures, the Provider is not queried for a cooldown
+// and ErrSourceUnavailable is returned instead.
+type Cache struct {
+	provider   Provider
+	ttl        time.Duration
+	failureTTL time.Duration
+	entries    *expiring.Map
+	flights    singleflight.Group
+	breaker    breaker
+}
+
+// NewCache creates a Cache that keeps the metadata returned by provider for
+// the duration ttl.
+//
+// At most maxEntries lookups are cached. If more are made, the ones used least
+// recently are dropped.
+func NewCache(provider Provider, ttl time.Duration, maxEntries int) *Cache {
+	return &Cache{
+		provider: provider,
+		ttl:      ttl,
+		entries:  expiring.New(maxEntries, 0),
+		breaker: breaker{
+			threshold: defaultBreakerThreshold,
+			cooldown:  defaultBreakerCooldown,
+		},
+	}
+}
+
+// Name implements Provider.
+func (c *Cache) Name(infoHash bittorrent.InfoHash) (string, error) {
+	return c.NameAt(infoHash, time.Now())
+}
+
+// NameAt returns the name of the torrent identified by infoHash as if the
+// current time was now.
+func (c *Cache) NameAt(infoHash bittorrent.InfoHash, now time.Time) (string, error) {
+	key := string(infoHash[:])
+	if e, ok := c.entries.Get(key, now); ok {
+		entry := e.Value.(cacheEntry)
+		return entry.name, entry.err
+	}
+
+	name, err, _ := c.flights.Do(key, func() (interface{}, error) {
+		return c.lookup(infoHash, now)
+	})
+	return name.(string), err
+}
+
+// lookup queries the provider for infoHash and caches the result.
+func (c *Cache) lookup(infoHash bittorrent.InfoHash, now time.Time) (string, error) {
+	if !c.breaker.allow(now) {
+		return "", ErrSourceUnavailable
+	}
+
+	name, err := c.provider.Name(infoHash)
+	failed := err != nil && err != ErrUnknownInfoHash
+	c.breaker.record(failed, now)
+
+	ttl := c.ttl
+	if failed {
+		if c.failureTTL <= 0 {
+			return "", err
+		}
+		name, ttl = "", c.failureTTL
+	}
+
+	c.entries.Set(string(infoHash[:]), cacheEntry{name: name, err: err}, now.Add(ttl))
+	return name, err
+}
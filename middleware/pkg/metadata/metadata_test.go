@@ -0,0 +1,200 @@
+package metadata
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("01234567890123456789")
+	ih2 = bittorrent.InfoHashFromString("abcdefghijklmnopqrst")
+)
+
+func TestFileProvider(t *testing.T) {
+	p := &fileProvider{names: make(map[bittorrent.InfoHash]string)}
+	err := p.parse(strings.NewReader("# comment\n\n3031323334353637383930313233343536373839\tSome Torrent Name\n"))
+	require.Nil(t, err)
+
+	name, err := p.Name(ih1)
+	require.Nil(t, err)
+	require.Equal(t, "Some Torrent Name", name)
+
+	_, err = p.Name(ih2)
+	require.Equal(t, ErrUnknownInfoHash, err)
+
+	err = p.parse(strings.NewReader("nothex name\n"))
+	require.NotNil(t, err)
+}
+
+func TestHTTPProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/3031323334353637383930313233343536373839" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("Some Torrent Name\n"))
+	}))
+	defer srv.Close()
+
+	p, err := New(Config{URL: srv.URL + "/{infohash}"})
+	require.Nil(t, err)
+
+	name, err := p.Name(ih1)
+	require.Nil(t, err)
+	require.Equal(t, "Some Torrent Name", name)
+
+	_, err = p.Name(ih2)
+	require.Equal(t, ErrUnknownInfoHash, err)
+}
+
+type countingProvider struct {
+	calls int
+	err   error
+}
+
+func (p *countingProvider) Name(infoHash bittorrent.InfoHash) (string, error) {
+	p.calls++
+	if p.err != nil {
+		return "", p.err
+	}
+	if infoHash == ih2 {
+		return "", ErrUnknownInfoHash
+	}
+	return "name", nil
+}
+
+func TestCache(t *testing.T) {
+	p := &countingProvider{}
+	c := NewCache(p, time.Minute, 100)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		name, err := c.NameAt(ih1, now)
+		require.Nil(t, err)
+		require.Equal(t, "name", name)
+
+		_, err = c.NameAt(ih2, now)
+		require.Equal(t, ErrUnknownInfoHash, err)
+	}
+	require.Equal(t, 2, p.calls)
+
+	_, err := c.NameAt(ih1, now.Add(2*time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 3, p.calls)
+
+	// Errors other than unknown infohashes are not cached.
+	p.err = errors.New("unavailable")
+	_, err = c.NameAt(ih1, now.Add(4*time.Minute))
+	require.Equal(t, p.err, err)
+	_, err = c.NameAt(ih1, now.Add(4*time.Minute))
+	require.Equal(t, p.err, err)
+	require.Equal(t, 5, p.calls)
+
+	// Unless a failure TTL is configured.
+	c.failureTTL = time.Second
+	_, err = c.NameAt(ih1, now.Add(4*time.Minute))
+	require.Equal(t, p.err, err)
+	_, err = c.NameAt(ih1, now.Add(4*time.Minute))
+	require.Equal(t, p.err, err)
+	require.Equal(t, 6, p.calls)
+
+	p.err = nil
+	name, err := c.NameAt(ih1, now.Add(4*time.Minute+2*time.Second))
+	require.Nil(t, err)
+	require.Equal(t, "name", name)
+	require.Equal(t, 7, p.calls)
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	p := &countingProvider{}
+	c := NewCache(p, time.Minute, 16)
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		_, err := c.NameAt(bittorrent.InfoHash{byte(i)}, now)
+		require.Nil(t, err)
+	}
+	require.True(t, c.entries.Len() <= 16)
+}
+
+type blockingProvider struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (p *blockingProvider) Name(infoHash bittorrent.InfoHash) (string, error) {
+	atomic.AddInt32(&p.calls, 1)
+	<-p.release
+	return "name", nil
+}
+
+func TestCacheConcurrentMisses(t *testing.T) {
+	p := &blockingProvider{release: make(chan struct{})}
+	c := NewCache(p, time.Minute, 100)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name, err := c.NameAt(ih1, now)
+			require.Nil(t, err)
+			require.Equal(t, "name", name)
+		}()
+	}
+
+	// Give the lookups time to pile up behind the first one.
+	time.Sleep(50 * time.Millisecond)
+	close(p.release)
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&p.calls))
+}
+
+func TestCacheBreaker(t *testing.T) {
+	p := &countingProvider{err: errors.New("unavailable")}
+	c := NewCache(p, time.Minute, 100)
+	c.breaker.threshold = 2
+	c.breaker.cooldown = time.Minute
+	now := time.Now()
+
+	// Failures of different infohashes open the breaker for all of them.
+	_, err := c.NameAt(ih1, now)
+	require.Equal(t, p.err, err)
+	_, err = c.NameAt(ih2, now)
+	require.Equal(t, p.err, err)
+	_, err = c.NameAt(bittorrent.InfoHash{1}, now)
+	require.Equal(t, ErrSourceUnavailable, err)
+	require.Equal(t, 2, p.calls)
+
+	// After the cooldown, a single lookup probes the source.
+	_, err = c.NameAt(ih1, now.Add(2*time.Minute))
+	require.Equal(t, p.err, err)
+	_, err = c.NameAt(ih1, now.Add(2*time.Minute))
+	require.Equal(t, ErrSourceUnavailable, err)
+	require.Equal(t, 3, p.calls)
+
+	// A successful probe closes the breaker.
+	p.err = nil
+	_, err = c.NameAt(ih1, now.Add(4*time.Minute))
+	require.Nil(t, err)
+	_, err = c.NameAt(bittorrent.InfoHash{1}, now.Add(4*time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 5, p.calls)
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	p, err := New(Config{URL: "http://localhost/{infohash}"})
+	require.Nil(t, err)
+	require.Equal(t, defaultTimeout, p.(*Cache).provider.(*httpProvider).client.Timeout)
+}
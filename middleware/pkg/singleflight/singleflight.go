@@ -0,0 +1,54 @@
+// Package singleflight implements the deduplication of concurrent calls with
+// the same key, e.g. to keep concurrent cache misses from querying the same
+// source more than once.
+package singleflight
+
+import "sync"
+
+// call is a call of a function that is running or finished.
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// Group deduplicates the concurrent calls of functions by key.
+//
+// The zero value is ready to use.
+type Group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Do calls fn and returns its results, unless a call with the same key is
+// running already, in which case it waits for that call and returns its
+// results instead.
+//
+// shared reports whether the results were returned to more than one caller.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.value, c.err, true
+	}
+
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// The call is removed even if fn panics, so that later calls don't wait
+	// for it forever.
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+
+	c.value, c.err = fn()
+	return c.value, c.err, false
+}
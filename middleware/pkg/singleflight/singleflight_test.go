@@ -0,0 +1,59 @@
+package singleflight
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDo(t *testing.T) {
+	var g Group
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var calls int32
+
+	var wg sync.WaitGroup
+	results := make(chan interface{}, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, _ := g.Do("key", func() (interface{}, error) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					close(started)
+				}
+				<-release
+				return 42, nil
+			})
+			require.Nil(t, err)
+			results <- v
+		}()
+
+		// The first call must be running before the others are made.
+		if i == 0 {
+			<-started
+		}
+	}
+
+	// Give the other calls time to wait for the first one.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for v := range results {
+		require.Equal(t, 42, v)
+	}
+
+	// Finished calls are not shared.
+	err := errors.New("failed")
+	_, got, shared := g.Do("key", func() (interface{}, error) { return nil, err })
+	require.Equal(t, err, got)
+	require.False(t, shared)
+}
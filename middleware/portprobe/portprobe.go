@@ -0,0 +1,418 @@
+// Package portprobe implements a Hook that probes whether peers accept TCP
+// connections at their announced port and flags peers that do not as
+// unreachable, so that they are deprioritized in announce responses.
+package portprobe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/cidr"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/ratelimit"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Defaults of the configuration.
+const (
+	defaultRate           = 10
+	defaultTimeout        = 3 * time.Second
+	defaultProbeInterval  = 30 * time.Minute
+	defaultWorkers        = 4
+	defaultMaxEndpoints   = 100000
+	defaultMaxProbesPerIP = 16
+)
+
+// reservedRanges are the ranges that are not routed on the public internet,
+// e.g. private networks, CGNAT and documentation ranges. They are never
+// probed unless they are allowed explicitly, so that announcers cannot make
+// the tracker connect to hosts of its own network.
+var reservedRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.88.99.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"::ffff:0:0/96",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"100::/64",
+	"2001::/23",
+	"2001:db8::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Errors of the configuration.
+var (
+	ErrInvalidRate          = errors.New("rate must not be negative")
+	ErrInvalidTimeout       = errors.New("timeout must not be negative")
+	ErrInvalidProbeInterval = errors.New("probe_interval must not be negative")
+	ErrInvalidWorkers       = errors.New("workers must not be negative")
+	ErrInvalidMaxEndpoints  = errors.New("max_endpoints must not be negative")
+	ErrInvalidMaxProbes     = errors.New("max_probes_per_ip must not be negative")
+)
+
+// Config represents the configuration for the port probe middleware.
+type Config struct {
+	// Rate is the maximum number of probes per second. Endpoints beyond
+	// that are probed on a later announce.
+	// If zero, a default of 10 is used.
+	Rate float64 `yaml:"rate"`
+
+	// Timeout is the timeout of a probe, after which the endpoint is
+	// unreachable.
+	// If zero, a default of 3s is used.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// ProbeInterval is the duration for which the result of a probe is
+	// kept before the endpoint is probed again.
+	// If zero, a default of 30m is used.
+	ProbeInterval time.Duration `yaml:"probe_interval"`
+
+	// Workers is the number of probes running at the same time.
+	// If zero, a default of 4 is used.
+	Workers int `yaml:"workers"`
+
+	// MaxEndpoints is the maximum number of endpoints whose results are
+	// kept. Beyond that, the endpoints that announced least recently are
+	// forgotten.
+	// If zero, a default of 100000 is used.
+	MaxEndpoints int `yaml:"max_endpoints"`
+
+	// MaxProbesPerIP is the maximum number of probes scheduled for the
+	// announces received from the same address within the ProbeInterval,
+	// so that a single client can't use up the Rate, e.g. by announcing
+	// many endpoints via the ip parameter.
+	// If zero, a default of 16 is used.
+	MaxProbesPerIP int `yaml:"max_probes_per_ip"`
+
+	// AllowedNetworks is a list of ranges in CIDR notation that are probed
+	// even though they are reserved, e.g. for a tracker serving a private
+	// network. Private, CGNAT, loopback, link-local, multicast and other
+	// reserved ranges are never probed otherwise.
+	AllowedNetworks []string `yaml:"allowed_networks"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"rate":            cfg.Rate,
+		"timeout":         cfg.Timeout,
+		"probeInterval":   cfg.ProbeInterval,
+		"workers":         cfg.Workers,
+		"maxEndpoints":    cfg.MaxEndpoints,
+		"maxProbesPerIP":  cfg.MaxProbesPerIP,
+		"allowedNetworks": cfg.AllowedNetworks,
+	}
+}
+
+// networks is a set of ranges of both address families.
+type networks struct {
+	v4 *cidr.Trie
+	v6 *cidr.Trie
+
+	// mapped holds the IPv4 parts of IPv4-mapped IPv6 ranges, which only
+	// match IPv6 addresses that were not normalized to IPv4.
+	mapped *cidr.Trie
+}
+
+// newNetworks parses ranges in CIDR notation into a set.
+func newNetworks(ranges []string) (networks, error) {
+	n := networks{v4: cidr.NewIPv4(), v6: cidr.NewIPv6(), mapped: cidr.NewIPv4()}
+	for _, r := range ranges {
+		ipNet, err := cidr.ParseRange(r)
+		if err != nil {
+			return networks{}, errors.New("invalid range " + r + ": " + err.Error())
+		}
+
+		ones, bits := ipNet.Mask.Size()
+		switch {
+		case ipNet.IP.To4() != nil && bits == 8*net.IPv6len && ones >= 96:
+			err = n.mapped.Insert(&net.IPNet{IP: ipNet.IP.To4(), Mask: net.CIDRMask(ones-96, 32)})
+		case ipNet.IP.To4() != nil:
+			err = n.v4.Insert(ipNet)
+		default:
+			err = n.v6.Insert(ipNet)
+		}
+		if err != nil {
+			return networks{}, errors.New("invalid range " + r + ": " + err.Error())
+		}
+	}
+	return n, nil
+}
+
+func (n networks) contains(ip bittorrent.IP) bool {
+	switch {
+	case ip.AddressFamily == bittorrent.IPv4:
+		return n.v4.Contains(ip.IP)
+	case len(ip.IP) == net.IPv6len && ip.IP.To4() != nil:
+		return n.mapped.Contains(ip.IP)
+	default:
+		return n.v6.Contains(ip.IP)
+	}
+}
+
+// result is the result of the last probe of an endpoint.
+type result struct {
+	unreachable bool
+
+	// next is the time after which the endpoint is probed again.
+	next time.Time
+}
+
+type hook struct {
+	cfg     Config
+	limiter *ratelimit.Limiter
+	queue   chan bittorrent.Peer
+	closing chan struct{}
+
+	// endpoints holds the result of every probed endpoint. Results are
+	// kept for another ProbeInterval after their next probe is due, so
+	// that they are used until that probe finishes.
+	endpoints *expiring.Map
+
+	// probe reports whether the endpoint of p accepts TCP connections.
+	probe func(p bittorrent.Peer) bool
+
+	reserved networks
+	allowed  networks
+
+	// sources holds the number of probes scheduled for the announces of
+	// every address in the current ProbeInterval.
+	sources *expiring.Map
+}
+
+// NewHook returns an instance of the port probe middleware.
+//
+// Probes run in the background, so the first announces of an endpoint are
+// never flagged.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	switch {
+	case cfg.Rate < 0:
+		return nil, ErrInvalidRate
+	case cfg.Timeout < 0:
+		return nil, ErrInvalidTimeout
+	case cfg.ProbeInterval < 0:
+		return nil, ErrInvalidProbeInterval
+	case cfg.Workers < 0:
+		return nil, ErrInvalidWorkers
+	case cfg.MaxEndpoints < 0:
+		return nil, ErrInvalidMaxEndpoints
+	case cfg.MaxProbesPerIP < 0:
+		return nil, ErrInvalidMaxProbes
+	}
+
+	reserved, err := newNetworks(reservedRanges)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := newNetworks(cfg.AllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Rate == 0 {
+		cfg.Rate = defaultRate
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.ProbeInterval == 0 {
+		cfg.ProbeInterval = defaultProbeInterval
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.MaxEndpoints == 0 {
+		cfg.MaxEndpoints = defaultMaxEndpoints
+	}
+	if cfg.MaxProbesPerIP == 0 {
+		cfg.MaxProbesPerIP = defaultMaxProbesPerIP
+	}
+
+	h := &hook{
+		cfg:       cfg,
+		limiter:   ratelimit.New(cfg.Rate, int(cfg.Rate)),
+		queue:     make(chan bittorrent.Peer, cfg.Workers),
+		closing:   make(chan struct{}),
+		endpoints: expiring.New(cfg.MaxEndpoints, cfg.ProbeInterval),
+		reserved:  reserved,
+		allowed:   allowed,
+		sources:   expiring.New(cfg.MaxEndpoints, cfg.ProbeInterval),
+	}
+	h.probe = h.dial
+
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-h.closing:
+					return
+				case p := <-h.queue:
+					h.record(p, !h.probe(p), time.Now())
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+// endpoint returns the key of the endpoint of p.
+func endpoint(p bittorrent.Peer) string {
+	b := make([]byte, 2+len(p.IP.IP))
+	binary.BigEndian.PutUint16(b, p.Port)
+	copy(b[2:], p.IP.IP)
+	return string(b)
+}
+
+// probeable reports whether the endpoint of p may be probed.
+//
+// Reserved addresses are only probed if they are allowed, so that the tracker
+// cannot be made to connect to itself or its local network.
+func (h *hook) probeable(p bittorrent.Peer) bool {
+	return p.Port != 0 && (!h.reserved.contains(p.IP) || h.allowed.contains(p.IP))
+}
+
+// allowSource counts a probe for the announces received from source at now
+// and reports whether it is below the MaxProbesPerIP.
+func (h *hook) allowSource(source bittorrent.IP, now time.Time) (allowed bool) {
+	h.sources.Update(string(source.IP), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		if !ok {
+			e = expiring.Entry{Value: 0, Expires: now.Add(h.cfg.ProbeInterval)}
+		}
+		if e.Value.(int) >= h.cfg.MaxProbesPerIP {
+			return e
+		}
+
+		allowed = true
+		e.Value = e.Value.(int) + 1
+		return e
+	})
+	return
+}
+
+// dial reports whether the endpoint of p accepts a TCP connection within the
+// timeout.
+func (h *hook) dial(p bittorrent.Peer) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port))), h.cfg.Timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// check returns whether the endpoint of p was unreachable at its last probe
+// and schedules a probe if the last one expired at now.
+//
+// A probe is only scheduled if the rate allows it, source, the address the
+// announce was received from, has not exceeded its probes and the queue of
+// the workers has room, so that probes never delay announces.
+func (h *hook) check(p bittorrent.Peer, source bittorrent.IP, now time.Time) (unreachable bool) {
+	h.endpoints.Update(endpoint(p), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		var r result
+		if ok {
+			r = e.Value.(result)
+		}
+		unreachable = r.unreachable
+
+		if ok && r.next.After(now) {
+			return e
+		}
+
+		if !h.probeable(p) || !h.allowSource(source, now) || !h.limiter.AllowAt(now) {
+			return e
+		}
+
+		select {
+		case h.queue <- p:
+		default:
+			return e
+		}
+
+		// Keep the previous result until the probe finishes, but don't
+		// schedule it again.
+		return h.result(r.unreachable, now)
+	})
+	return
+}
+
+// result returns the entry of the result of a probe finished at now.
+func (h *hook) result(unreachable bool, now time.Time) expiring.Entry {
+	next := now.Add(h.cfg.ProbeInterval)
+	return expiring.Entry{
+		Value:   result{unreachable: unreachable, next: next},
+		Expires: next.Add(h.cfg.ProbeInterval),
+	}
+}
+
+// record stores the result of a probe of the endpoint of p finished at now.
+func (h *hook) record(p bittorrent.Peer, unreachable bool, now time.Time) {
+	h.endpoints.Update(endpoint(p), now, func(expiring.Entry, bool) expiring.Entry {
+		return h.result(unreachable, now)
+	})
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Event == bittorrent.Stopped {
+		// Stopped peers are removed from the swarm anyway.
+		return ctx, nil
+	}
+
+	source, ok := frontend.ClientIP(ctx)
+	if !ok {
+		source = req.IP
+	}
+
+	if h.check(req.Peer, source, time.Now()) {
+		req.Flags |= bittorrent.PeerFlagUnreachable
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes have no endpoint.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests have no endpoint.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+
+	close(h.closing)
+	<-h.sources.Stop()
+	return h.endpoints.Stop()
+}
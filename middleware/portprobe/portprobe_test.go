@@ -0,0 +1,188 @@
+package portprobe
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func peer(ip string, port uint16) bittorrent.Peer {
+	return bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		IP:   bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+		Port: port,
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{Rate: 1000})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	probed := make(chan bittorrent.Peer, 2)
+	h.(*hook).probe = func(p bittorrent.Peer) bool {
+		probed <- p
+		return p.Port == 6881
+	}
+
+	announce := func(p bittorrent.Peer) bittorrent.PeerFlags {
+		req := &bittorrent.AnnounceRequest{Peer: p}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		return req.Flags
+	}
+
+	reachable := peer("1.2.3.4", 6881)
+	unreachable := peer("1.2.3.4", 6882)
+
+	// The first announces are never flagged, as the probes run in the
+	// background.
+	require.Equal(t, bittorrent.PeerFlags(0), announce(reachable))
+	require.Equal(t, bittorrent.PeerFlags(0), announce(unreachable))
+	<-probed
+	<-probed
+
+	flagged := false
+	for i := 0; i < 100 && !flagged; i++ {
+		flagged = announce(unreachable) == bittorrent.PeerFlagUnreachable
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, flagged)
+	require.Equal(t, bittorrent.PeerFlags(0), announce(reachable))
+
+	// Endpoints are only probed again after the probe interval.
+	select {
+	case p := <-probed:
+		t.Fatalf("unexpected probe of %v", p)
+	default:
+	}
+
+	// Local and private addresses are never probed.
+	require.Equal(t, bittorrent.PeerFlags(0), announce(peer("127.0.0.1", 6881)))
+	require.Equal(t, bittorrent.PeerFlags(0), announce(peer("10.0.0.1", 6881)))
+	require.Equal(t, bittorrent.PeerFlags(0), announce(peer("100.64.0.1", 6881)))
+	select {
+	case p := <-probed:
+		t.Fatalf("unexpected probe of %v", p)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h, err := NewHook(Config{Rate: 1, Workers: 10})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	probed := make(chan bittorrent.Peer, 10)
+	h.(*hook).probe = func(p bittorrent.Peer) bool {
+		probed <- p
+		return true
+	}
+
+	now := time.Now()
+	for port := uint16(1); port <= 10; port++ {
+		h.(*hook).check(peer("1.2.3.4", port), bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4}, now)
+	}
+
+	<-probed
+	select {
+	case p := <-probed:
+		t.Fatalf("unexpected probe of %v", p)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestProbeable(t *testing.T) {
+	h, err := NewHook(Config{AllowedNetworks: []string{"192.168.1.0/24"}})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	var table = []struct {
+		ip        string
+		probeable bool
+	}{
+		{"1.2.3.4", true},
+		{"2606:4700::1", true},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.2.1", false},
+		{"100.64.0.1", false},
+		{"198.51.100.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"2001:db8::1", false},
+		{"::ffff:10.1.2.3", false},
+		// NAT64 addresses can point to internal IPv4 hosts.
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::102:304", false},
+		// Allowed networks are probed even though they are reserved.
+		{"192.168.1.1", true},
+	}
+
+	for _, tt := range table {
+		p := peer(tt.ip, 6881)
+		if ip := net.ParseIP(tt.ip); ip.To4() == nil {
+			p.IP = bittorrent.IP{IP: ip, AddressFamily: bittorrent.IPv6}
+		}
+		require.Equal(t, tt.probeable, h.(*hook).probeable(p), tt.ip)
+	}
+
+	// IPv4-mapped addresses that were not normalized are never probed.
+	p := peer("1.2.3.4", 6881)
+	p.IP = bittorrent.IP{IP: net.ParseIP("::ffff:1.2.3.4"), AddressFamily: bittorrent.IPv6}
+	require.False(t, h.(*hook).probeable(p))
+
+	_, err = NewHook(Config{AllowedNetworks: []string{"192.168.1.0/33"}})
+	require.NotNil(t, err)
+}
+
+func TestMaxProbesPerIP(t *testing.T) {
+	h, err := NewHook(Config{Rate: 1000, Workers: 10, MaxProbesPerIP: 2})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	probed := make(chan bittorrent.Peer, 10)
+	h.(*hook).probe = func(p bittorrent.Peer) bool {
+		probed <- p
+		return true
+	}
+
+	now := time.Now()
+	source := bittorrent.IP{IP: net.ParseIP("1.2.3.4").To4(), AddressFamily: bittorrent.IPv4}
+	for port := uint16(1); port <= 10; port++ {
+		h.(*hook).check(peer("5.6.7.8", port), source, now)
+	}
+	<-probed
+	<-probed
+
+	// Other announcers still get their endpoints probed.
+	other := bittorrent.IP{IP: net.ParseIP("4.3.2.1").To4(), AddressFamily: bittorrent.IPv4}
+	h.(*hook).check(peer("4.3.2.1", 1), other, now)
+	require.Equal(t, peer("4.3.2.1", 1), <-probed)
+
+	select {
+	case p := <-probed:
+		t.Fatalf("unexpected probe of %v", p)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+
+	h, err := NewHook(Config{Timeout: time.Second})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	require.True(t, h.(*hook).dial(peer("127.0.0.1", uint16(port))))
+
+	require.Nil(t, l.Close())
+	require.False(t, h.(*hook).dial(peer("127.0.0.1", uint16(port))))
+}
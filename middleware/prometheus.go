@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func init() {
+	prometheus.MustRegister(PromSwarmTransitionsTotal, PromScrapeFilesTruncatedTotal, PromScrapeCacheHitsTotal, PromAnnounceCacheHitsTotal, PromScrapeFailuresTotal, PromAnnounceResponsesTrimmedTotal, PromCompactFallbacksTotal)
+}
+
+// Swarm transitions recorded by the swarm interaction middleware.
+const (
+	transitionNewLeecher = "new_leecher"
+	transitionNewSeeder  = "new_seeder"
+	transitionGraduation = "graduation"
+	transitionStopped    = "stopped"
+)
+
+// PromSwarmTransitionsTotal is a counter of the transitions of peers in
+// swarms caused by announces, labeled by the type of transition and the
+// address family of the peer.
+//
+// Expiries of peers are recorded by the storage in
+// storage.PromPeersExpiredTotal.
+var PromSwarmTransitionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_swarm_transitions_total",
+		Help: "The number of peers that joined, graduated or left a swarm",
+	},
+	[]string{"transition", "address_family"},
+)
+
+// PromScrapeFilesTruncatedTotal is a counter of the files dropped from scrape
+// responses because they exceeded the configured maximum number of files.
+var PromScrapeFilesTruncatedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "chihaya_scrape_files_truncated_total",
+		Help: "The number of files dropped from scrape responses",
+	},
+)
+
+// PromAnnounceCacheHitsTotal is a counter of the peer lists of announces
+// answered from the announce cache instead of the storage.
+var PromAnnounceCacheHitsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "chihaya_announce_cache_hits_total",
+		Help: "The number of peer lists answered from the announce cache",
+	},
+)
+
+// PromScrapeCacheHitsTotal is a counter of the Scrapes answered from the
+// scrape cache instead of the storage.
+var PromScrapeCacheHitsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "chihaya_scrape_cache_hits_total",
+		Help: "The number of scraped files answered from the scrape cache",
+	},
+)
+
+// PromScrapeFailuresTotal is a counter of the files of scrape responses whose
+// swarm could not be scraped because of the storage.
+var PromScrapeFailuresTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "chihaya_scrape_failures_total",
+		Help: "The number of scraped files that failed because of the storage",
+	},
+)
+
+// PromAnnounceResponsesTrimmedTotal is a counter of the announce responses
+// whose peers were trimmed because they exceeded the configured maximum
+// response size.
+var PromAnnounceResponsesTrimmedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "chihaya_announce_responses_trimmed_total",
+		Help: "The number of announce responses trimmed to the maximum response size",
+	},
+)
+
+// PromCompactFallbacksTotal is a counter of the compact responses with IPv6
+// peers adapted for clients that can't parse them, labeled by the configured
+// mode.
+var PromCompactFallbacksTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_compact_fallbacks_total",
+		Help: "The number of compact responses adapted for clients without compact IPv6 support",
+	},
+	[]string{"mode"},
+)
+
+// recordTransition increments the counter of the given transition for the
+// address family of af.
+func recordTransition(transition string, af bittorrent.AddressFamily) {
+	afString := "IPv4"
+	if af == bittorrent.IPv6 {
+		afString = "IPv6"
+	}
+
+	PromSwarmTransitionsTotal.WithLabelValues(transition, afString).Inc()
+}
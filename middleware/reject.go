@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// defaultSoftRejectInterval is the interval communicated to softly rejected
+// clients if none is configured.
+const defaultSoftRejectInterval = 2 * time.Hour
+
+// SoftRejectConfig is the configuration for hooks that are able to reject an
+// Announce "softly".
+//
+// Instead of failing the Announce, a softly rejected client receives a valid
+// response without any peers and with a long interval, which causes most
+// clients to back off instead of retrying aggressively.
+type SoftRejectConfig struct {
+	// Enabled specifies whether rejections should be soft.
+	Enabled bool `yaml:"enabled"`
+
+	// Interval is the interval communicated to softly rejected clients.
+	Interval time.Duration `yaml:"interval"`
+
+	// WarningMessage is an optional message sent to softly rejected
+	// clients.
+	WarningMessage string `yaml:"warning_message"`
+
+	// RetryIn is the delay after which clients are advised to retry if
+	// soft rejection is disabled.
+	// Zero omits the hint.
+	RetryIn time.Duration `yaml:"retry_in"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg SoftRejectConfig) LogFields() log.Fields {
+	return log.Fields{
+		"enabled":        cfg.Enabled,
+		"interval":       cfg.Interval,
+		"warningMessage": cfg.WarningMessage,
+		"retryIn":        cfg.RetryIn,
+	}
+}
+
+// Reject rejects an Announce with the provided error.
+//
+// If soft rejection is disabled, err is returned unchanged, or wrapped in a
+// bittorrent.RetryError if RetryIn is set and err is a ClientError. Otherwise the
+// response is turned into an empty response with a long interval and the
+// returned context causes the swarm interaction and response middleware to
+// skip.
+func (cfg SoftRejectConfig) Reject(ctx context.Context, resp *bittorrent.AnnounceResponse, err error) (context.Context, error) {
+	if !cfg.Enabled {
+		return ctx, cfg.RejectScrape(err)
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultSoftRejectInterval
+	}
+
+	log.Debug("softly rejecting announce", log.RequestFields(ctx, log.Err(err)))
+
+	resp.Interval = interval
+	resp.MinInterval = interval
+	resp.IPv4Peers = nil
+	resp.IPv6Peers = nil
+	resp.WarningMessage = cfg.WarningMessage
+
+	ctx = context.WithValue(ctx, SkipSwarmInteractionKey, struct{}{})
+	return context.WithValue(ctx, SkipResponseHookKey, struct{}{}), nil
+}
+
+// RejectScrape rejects a Scrape with the provided error.
+//
+// Scrapes can't be rejected softly, so regardless of Enabled, err is returned
+// unchanged, or wrapped in a bittorrent.RetryError if RetryIn is set and err is
+// a ClientError.
+func (cfg SoftRejectConfig) RejectScrape(err error) error {
+	if clientErr, ok := err.(bittorrent.ClientError); ok && cfg.RetryIn > 0 {
+		return bittorrent.RetryError{ClientError: clientErr, RetryIn: cfg.RetryIn}
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var errTestReject = bittorrent.ClientError("rejected")
+
+func TestSoftRejectDisabled(t *testing.T) {
+	ctx := context.Background()
+	resp := &bittorrent.AnnounceResponse{Interval: time.Minute}
+
+	nCtx, err := SoftRejectConfig{}.Reject(ctx, resp, errTestReject)
+	require.Equal(t, errTestReject, err)
+	require.Equal(t, ctx, nCtx)
+	require.Equal(t, time.Minute, resp.Interval)
+}
+
+func TestSoftRejectRetryIn(t *testing.T) {
+	cfg := SoftRejectConfig{RetryIn: 10 * time.Minute}
+
+	_, err := cfg.Reject(context.Background(), &bittorrent.AnnounceResponse{}, errTestReject)
+	require.Equal(t, bittorrent.RetryError{ClientError: errTestReject, RetryIn: 10 * time.Minute}, err)
+	require.True(t, bittorrent.IsClientError(err))
+	require.Equal(t, errTestReject.Error(), err.Error())
+}
+
+func TestSoftRejectEnabled(t *testing.T) {
+	cfg := SoftRejectConfig{
+		Enabled:        true,
+		Interval:       3 * time.Hour,
+		WarningMessage: "go away",
+	}
+	resp := &bittorrent.AnnounceResponse{
+		Interval:  time.Minute,
+		IPv4Peers: []bittorrent.Peer{{Port: 1}},
+	}
+
+	ctx, err := cfg.Reject(context.Background(), resp, errTestReject)
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(SkipSwarmInteractionKey))
+	require.NotNil(t, ctx.Value(SkipResponseHookKey))
+	require.Equal(t, 3*time.Hour, resp.Interval)
+	require.Equal(t, 3*time.Hour, resp.MinInterval)
+	require.Equal(t, "go away", resp.WarningMessage)
+	require.Nil(t, resp.IPv4Peers)
+
+	cfg.Interval = 0
+	_, err = cfg.Reject(context.Background(), resp, errTestReject)
+	require.Nil(t, err)
+	require.Equal(t, defaultSoftRejectInterval, resp.Interval)
+}
@@ -0,0 +1,316 @@
+// Package remoteblocklist implements a Hook that rejects requests of blocked
+// IPs and for blocked infohashes, as listed by a blocklist that is fetched from
+// a URL periodically.
+package remoteblocklist
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/cidr"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Defaults of the configuration.
+const (
+	defaultRefreshInterval = 10 * time.Minute
+	defaultTimeout         = 10 * time.Second
+)
+
+// maxBlocklistSize is the maximum size of a blocklist in bytes.
+var maxBlocklistSize int64 = 64 << 20
+
+var (
+	// ErrBlockedIP is returned for requests from a blocked IP.
+	ErrBlockedIP = bittorrent.NewClientError("blocked_ip", "your IP is blocked")
+
+	// ErrBlockedInfoHash is returned for Announces of a blocked infohash.
+	ErrBlockedInfoHash = bittorrent.NewClientError("blocked_infohash", "torrent is blocked")
+)
+
+// ErrNoURL is returned for a config without a URL.
+var ErrNoURL = errors.New("no url configured")
+
+// Config represents the configuration for the remote blocklist middleware.
+type Config struct {
+	// URL is the URL of the blocklist. The blocklist contains one IP,
+	// range in CIDR notation or infohash in hex per line. Empty lines and
+	// lines starting with # are ignored.
+	URL string `yaml:"url"`
+
+	// RefreshInterval is the interval in which the blocklist is fetched
+	// again. Unmodified blocklists are not transferred again if the server
+	// supports ETag or Last-Modified.
+	// If zero, a default of 10m is used.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// Timeout is the timeout of a fetch of the blocklist.
+	// If zero, a default of 10s is used.
+	Timeout time.Duration `yaml:"timeout"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"url":             cfg.URL,
+		"refreshInterval": cfg.RefreshInterval,
+		"timeout":         cfg.Timeout,
+		"softReject":      cfg.SoftReject.Enabled,
+	}
+}
+
+// blocklist holds the blocked ranges of both address families and the blocked
+// infohashes.
+type blocklist struct {
+	v4         *cidr.Trie
+	v6         *cidr.Trie
+	infoHashes map[bittorrent.InfoHash]struct{}
+}
+
+func newBlocklist() *blocklist {
+	return &blocklist{
+		v4:         cidr.NewIPv4(),
+		v6:         cidr.NewIPv6(),
+		infoHashes: make(map[bittorrent.InfoHash]struct{}),
+	}
+}
+
+// insert adds an entry of the blocklist to b.
+//
+// Entries of 40 hex characters are infohashes, all others IPs or ranges.
+func (b *blocklist) insert(entry string) error {
+	if len(entry) == 40 {
+		if ihBytes, err := hex.DecodeString(entry); err == nil {
+			b.infoHashes[bittorrent.InfoHashFromBytes(ihBytes)] = struct{}{}
+			return nil
+		}
+	}
+
+	ipNet, err := cidr.ParseRange(entry)
+	if err != nil {
+		return errors.New("invalid entry " + entry + ": " + err.Error())
+	}
+
+	if ipNet.IP.To4() != nil {
+		return b.v4.Insert(ipNet)
+	}
+	return b.v6.Insert(ipNet)
+}
+
+func (b *blocklist) blocksIP(ip bittorrent.IP) bool {
+	if ip.AddressFamily == bittorrent.IPv4 {
+		return b.v4.Contains(ip.IP)
+	}
+	return b.v6.Contains(ip.IP)
+}
+
+func (b *blocklist) blocksInfoHash(infoHash bittorrent.InfoHash) bool {
+	_, ok := b.infoHashes[infoHash]
+	return ok
+}
+
+func parseBlocklist(r io.Reader) (*blocklist, error) {
+	b := newBlocklist()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := b.insert(line); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, scanner.Err()
+}
+
+type hook struct {
+	cfg       Config
+	client    *http.Client
+	blocklist atomic.Value // *blocklist
+
+	// etag and lastModified are the validators of the current blocklist.
+	// They are only accessed by fetch.
+	etag         string
+	lastModified string
+
+	closing chan struct{}
+}
+
+// NewHook returns an instance of the remote blocklist middleware.
+//
+// The initial fetch of the blocklist must succeed, so that the tracker never
+// runs without it. If a later fetch fails, the current blocklist is kept.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.URL == "" {
+		return nil, ErrNoURL
+	}
+
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultRefreshInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		closing: make(chan struct{}),
+	}
+
+	if err := h.fetch(); err != nil {
+		return nil, errors.New("failed to fetch initial blocklist: " + err.Error())
+	}
+
+	go func() {
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-time.After(cfg.RefreshInterval):
+				if err := h.fetch(); err != nil {
+					log.Error("failed to refresh remote blocklist", log.Fields{"url": cfg.URL}, log.Err(err))
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// fetch fetches the blocklist and replaces the current blocklist with it, if
+// it was modified.
+//
+// If the new blocklist is invalid, the current blocklist is kept.
+func (h *hook) fetch() error {
+	req, err := http.NewRequest(http.MethodGet, h.cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	if h.etag != "" {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+	if h.lastModified != "" {
+		req.Header.Set("If-Modified-Since", h.lastModified)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if h.blocklist.Load() != nil {
+			return nil
+		}
+		return errors.New("unexpected blocklist response status: " + resp.Status)
+	default:
+		return errors.New("unexpected blocklist response status: " + resp.Status)
+	}
+
+	// A blocklist cut at the limit could end in a truncated entry, e.g. a
+	// shorter prefix length, so larger blocklists are rejected as a whole.
+	body := &io.LimitedReader{R: resp.Body, N: maxBlocklistSize + 1}
+	b, err := parseBlocklist(body)
+	if body.N == 0 {
+		return errors.New("blocklist exceeds " + strconv.FormatInt(maxBlocklistSize, 10) + " bytes")
+	}
+	if err != nil {
+		return err
+	}
+
+	h.blocklist.Store(b)
+	h.etag = resp.Header.Get("ETag")
+	h.lastModified = resp.Header.Get("Last-Modified")
+	log.Debug("fetched remote blocklist", log.Fields{
+		"ipv4Ranges": b.v4.Len(),
+		"ipv6Ranges": b.v6.Len(),
+		"infoHashes": len(b.infoHashes),
+	})
+
+	return nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	b := h.blocklist.Load().(*blocklist)
+
+	switch {
+	case b.blocksIP(req.IP):
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrBlockedIP)
+	case b.blocksInfoHash(req.InfoHash):
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrBlockedInfoHash)
+	}
+
+	return ctx, nil
+}
+
+// HandleScrape rejects Scrapes from blocked IPs and marks blocked infohashes
+// as banned.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	b := h.blocklist.Load().(*blocklist)
+
+	if ip, ok := frontend.ClientIP(ctx); ok && b.blocksIP(ip) {
+		return ctx, ErrBlockedIP
+	}
+
+	var banned map[bittorrent.InfoHash]struct{}
+	for _, infoHash := range req.InfoHashes {
+		if !b.blocksInfoHash(infoHash) {
+			continue
+		}
+
+		if banned == nil {
+			// Keep the infohashes banned by earlier middleware.
+			previous, _ := ctx.Value(middleware.BannedInfoHashesKey).(map[bittorrent.InfoHash]struct{})
+			banned = make(map[bittorrent.InfoHash]struct{}, len(previous)+1)
+			for infoHash := range previous {
+				banned[infoHash] = struct{}{}
+			}
+		}
+		banned[infoHash] = struct{}{}
+	}
+
+	if banned == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, middleware.BannedInfoHashesKey, banned), nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are authenticated.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(chan error)
+	go func() {
+		close(h.closing)
+		close(c)
+	}()
+	return c
+}
@@ -0,0 +1,163 @@
+package remoteblocklist
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+var (
+	blockedIH = bittorrent.InfoHashFromString("01234567890123456789")
+	allowedIH = bittorrent.InfoHashFromString("98765432109876543210")
+)
+
+// server serves a blocklist with an ETag and counts the fetches that
+// transferred it.
+type server struct {
+	sync.Mutex
+	body      string
+	status    int
+	transfers int
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+
+	etag := `"` + hex.EncodeToString([]byte(s.body)) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.transfers++
+	w.Header().Set("ETag", etag)
+	w.Write([]byte(s.body))
+}
+
+func (s *server) set(body string, status int) {
+	s.Lock()
+	s.body, s.status = body, status
+	s.Unlock()
+}
+
+func announce(h middleware.Hook, infoHash bittorrent.InfoHash, ip string) error {
+	req := &bittorrent.AnnounceRequest{InfoHash: infoHash}
+	req.Peer.IP = bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4}
+	_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	return err
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrNoURL, err)
+
+	s := &server{body: "10.0.0.0/8\n€invalid\n"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	_, err = NewHook(Config{URL: ts.URL})
+	require.NotNil(t, err)
+
+	s.set("", http.StatusInternalServerError)
+	_, err = NewHook(Config{URL: ts.URL})
+	require.NotNil(t, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	s := &server{body: "# abusers\n10.0.0.0/8\n\n192.168.1.1\n" + "3031323334353637383930313233343536373839\n"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	h, err := NewHook(Config{URL: ts.URL})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	require.Equal(t, ErrBlockedIP, announce(h, allowedIH, "10.1.2.3"))
+	require.Equal(t, ErrBlockedIP, announce(h, allowedIH, "192.168.1.1"))
+	require.Equal(t, ErrBlockedInfoHash, announce(h, blockedIH, "192.168.1.2"))
+	require.Nil(t, announce(h, allowedIH, "192.168.1.2"))
+}
+
+func TestHandleScrape(t *testing.T) {
+	s := &server{body: "10.0.0.0/8\n3031323334353637383930313233343536373839\n"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	h, err := NewHook(Config{URL: ts.URL})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	scrape := func(ctx context.Context) (context.Context, error) {
+		req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{blockedIH, allowedIH}}
+		return h.HandleScrape(ctx, req, &bittorrent.ScrapeResponse{})
+	}
+
+	ip, _ := bittorrent.NormalizeIP(net.ParseIP("10.0.0.1"))
+	_, err = scrape(context.WithValue(context.Background(), frontend.ClientIPKey, ip))
+	require.Equal(t, ErrBlockedIP, err)
+
+	// Infohashes banned by earlier middleware stay banned.
+	earlier := bittorrent.InfoHashFromString("00000000000000000001")
+	ctx := context.WithValue(context.Background(), middleware.BannedInfoHashesKey, map[bittorrent.InfoHash]struct{}{earlier: {}})
+	ctx, err = scrape(ctx)
+	require.Nil(t, err)
+	require.Equal(t, map[bittorrent.InfoHash]struct{}{blockedIH: {}, earlier: {}}, ctx.Value(middleware.BannedInfoHashesKey))
+}
+
+func TestFetch(t *testing.T) {
+	s := &server{body: "10.0.0.0/8\n"}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	hk, err := NewHook(Config{URL: ts.URL})
+	require.Nil(t, err)
+	defer func() { <-hk.(*hook).Stop() }()
+	h := hk.(*hook)
+
+	// Unmodified blocklists are not transferred again.
+	require.Nil(t, h.fetch())
+	require.Equal(t, 1, s.transfers)
+
+	s.set("172.16.0.0/12\n", 0)
+	require.Nil(t, h.fetch())
+	require.Equal(t, 2, s.transfers)
+	require.Nil(t, announce(h, allowedIH, "10.0.0.1"))
+	require.Equal(t, ErrBlockedIP, announce(h, allowedIH, "172.16.0.1"))
+
+	// Invalid blocklists and failures keep the current blocklist.
+	s.set("172.16.0.0/33\n", 0)
+	require.NotNil(t, h.fetch())
+	require.Equal(t, ErrBlockedIP, announce(h, allowedIH, "172.16.0.1"))
+
+	s.set("", http.StatusServiceUnavailable)
+	require.NotNil(t, h.fetch())
+	require.Equal(t, ErrBlockedIP, announce(h, allowedIH, "172.16.0.1"))
+
+	// Blocklists beyond the size limit are not cut into a different one.
+	defer func(size int64) { maxBlocklistSize = size }(maxBlocklistSize)
+	maxBlocklistSize = int64(len("10.0.0.0/16\n")) - 2
+	s.set("10.0.0.0/16\n", 0)
+	require.NotNil(t, h.fetch())
+	require.Equal(t, ErrBlockedIP, announce(h, allowedIH, "172.16.0.1"))
+	require.Nil(t, announce(h, allowedIH, "10.128.0.1"))
+
+	maxBlocklistSize = int64(len("10.0.0.0/16\n"))
+	require.Nil(t, h.fetch())
+	require.Equal(t, ErrBlockedIP, announce(h, allowedIH, "10.0.0.1"))
+}
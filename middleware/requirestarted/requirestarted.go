@@ -0,0 +1,229 @@
+// Package requirestarted implements a Hook that checks the first Announce of a
+// peer in a swarm, so that a completed or stopped event is never the first one
+// seen of a session, or that every session begins with the started event.
+package requirestarted
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Policies for Announces of unknown peers.
+const (
+	PolicyReject    = "reject"
+	PolicyFlag      = "flag"
+	PolicyDowngrade = "downgrade"
+)
+
+// Defaults of the configuration.
+const (
+	defaultPeerLifetime = time.Hour
+)
+
+// ErrStartedRequired is returned when a peer that is not known to the swarm
+// announces without the started event.
+var ErrStartedRequired = bittorrent.NewClientError("started_required", "first announce must carry the started event")
+
+// ErrInvalidPolicy is returned for a config with an unknown Policy.
+var ErrInvalidPolicy = errors.New("policy must be reject, flag or downgrade")
+
+// ErrInvalidEvent is returned for a config with an unknown event or the
+// started event in Events.
+var ErrInvalidEvent = errors.New("events must be none, completed or stopped")
+
+// Config represents the configuration for the require started middleware.
+type Config struct {
+	// PeerLifetime is the duration a peer is remembered after its last
+	// announce. It should exceed the announce interval.
+	// If zero, a default of 1h is used.
+	PeerLifetime time.Duration `yaml:"peer_lifetime"`
+
+	// GracePeriod is the duration after startup during which unknown peers
+	// are accepted and remembered, so sessions that were started before a
+	// restart are not rejected.
+	// If zero, PeerLifetime is used.
+	GracePeriod time.Duration `yaml:"grace_period"`
+
+	// Events are the events that are checked on Announces of unknown
+	// peers. Unknown peers announcing other events are accepted and
+	// remembered.
+	// If empty, completed and stopped are checked, so sessions may begin
+	// mid-way, but not with an event indicating a replay or spoof.
+	Events []string `yaml:"events"`
+
+	// Policy specifies how checked Announces of unknown peers are
+	// handled. They are either rejected, flagged as suspected abuse via
+	// middleware.SuspectedAbuseKey or downgraded: completed is handled
+	// like an Announce without an event, stopped is answered without
+	// removing the peer from the swarm and Announces without an event are
+	// accepted.
+	// If empty, they are rejected.
+	Policy string `yaml:"policy"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"peerLifetime": cfg.PeerLifetime,
+		"gracePeriod":  cfg.GracePeriod,
+		"events":       cfg.Events,
+		"policy":       cfg.Policy,
+		"softReject":   cfg.SoftReject.Enabled,
+	}
+}
+
+// peerKey identifies a peer in a swarm.
+type peerKey struct {
+	infoHash bittorrent.InfoHash
+	peerID   bittorrent.PeerID
+}
+
+func (k peerKey) String() string {
+	return string(k.infoHash[:]) + string(k.peerID[:])
+}
+
+type hook struct {
+	cfg      Config
+	events   map[bittorrent.Event]struct{}
+	graceEnd time.Time
+	peers    *expiring.Map
+}
+
+// NewHook returns an instance of the require started middleware.
+//
+// Known peers are only kept in memory. After a restart, all peers are
+// accepted for the GracePeriod.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	switch cfg.Policy {
+	case "":
+		cfg.Policy = PolicyReject
+	case PolicyReject, PolicyFlag, PolicyDowngrade:
+	default:
+		return nil, ErrInvalidPolicy
+	}
+
+	events := map[bittorrent.Event]struct{}{bittorrent.Completed: {}, bittorrent.Stopped: {}}
+	if len(cfg.Events) > 0 {
+		events = make(map[bittorrent.Event]struct{}, len(cfg.Events))
+		for _, name := range cfg.Events {
+			event, err := bittorrent.NewEvent(name)
+			if err != nil || event == bittorrent.Started {
+				return nil, ErrInvalidEvent
+			}
+			events[event] = struct{}{}
+		}
+	}
+
+	if cfg.PeerLifetime <= 0 {
+		cfg.PeerLifetime = defaultPeerLifetime
+	}
+	if cfg.GracePeriod <= 0 {
+		cfg.GracePeriod = cfg.PeerLifetime
+	}
+
+	return &hook{
+		cfg:      cfg,
+		events:   events,
+		graceEnd: time.Now().Add(cfg.GracePeriod),
+		peers:    expiring.New(0, cfg.PeerLifetime/2),
+	}, nil
+}
+
+// seen reports whether the peer identified by k is known and, if it is,
+// extends its lifetime.
+func (h *hook) seen(k peerKey, now time.Time) (known bool) {
+	h.peers.Update(k.String(), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		known = ok
+		if !ok {
+			return e
+		}
+		e.Expires = now.Add(h.cfg.PeerLifetime)
+		return e
+	})
+	return
+}
+
+// remember adds the peer identified by k to the known peers.
+func (h *hook) remember(k peerKey, now time.Time) {
+	h.peers.Set(k.String(), nil, now.Add(h.cfg.PeerLifetime))
+}
+
+// forget removes the peer identified by k from the known peers.
+func (h *hook) forget(k peerKey) {
+	h.peers.Delete(k.String())
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	k := peerKey{req.InfoHash, req.Peer.ID}
+	now := time.Now()
+
+	_, checked := h.events[req.Event]
+
+	switch {
+	case req.Event == bittorrent.Started:
+		h.remember(k, now)
+		return ctx, nil
+	case req.Event == bittorrent.Stopped:
+		// Stopping ends the session, whether it is accepted or not.
+		known := h.seen(k, now)
+		h.forget(k)
+		if known || !checked || now.Before(h.graceEnd) {
+			return ctx, nil
+		}
+	case h.seen(k, now):
+		return ctx, nil
+	case !checked || now.Before(h.graceEnd):
+		// Fail open after a restart: the peer may have started its
+		// session before.
+		h.remember(k, now)
+		return ctx, nil
+	}
+
+	switch h.cfg.Policy {
+	case PolicyFlag:
+		return context.WithValue(ctx, middleware.SuspectedAbuseKey, struct{}{}), nil
+	case PolicyDowngrade:
+		return h.downgrade(ctx, req, k, now), nil
+	}
+
+	return h.cfg.SoftReject.Reject(ctx, resp, ErrStartedRequired)
+}
+
+// downgrade accepts the Announce of the unknown peer identified by k in a way
+// that a replayed or spoofed event can't affect the swarm.
+//
+// Completed is handled like an Announce without an event, so it does not count
+// as a completion, and the peer is remembered like any other peer in the
+// middle of its session. Stopped is answered without removing the peer from
+// the swarm.
+func (h *hook) downgrade(ctx context.Context, req *bittorrent.AnnounceRequest, k peerKey, now time.Time) context.Context {
+	if req.Event == bittorrent.Stopped {
+		return context.WithValue(ctx, middleware.SkipSwarmInteractionKey, struct{}{})
+	}
+
+	req.Event = bittorrent.None
+	h.remember(k, now)
+	return ctx
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't belong to a session.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are trusted.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	return h.peers.Stop()
+}
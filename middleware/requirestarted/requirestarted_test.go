@@ -0,0 +1,187 @@
+package requirestarted
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func announce(event bittorrent.Event, peerID string) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHashFromString("00000000000000000001"),
+		Event:    event,
+		Peer:     bittorrent.Peer{ID: bittorrent.PeerIDFromString(peerID)},
+	}
+}
+
+// newHook creates a hook whose grace period already ended.
+func newHook(t *testing.T, cfg Config) *hook {
+	h, err := NewHook(cfg)
+	require.Nil(t, err)
+	h.(*hook).graceEnd = time.Now()
+	return h.(*hook)
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{Policy: "invalid"})
+	require.Equal(t, ErrInvalidPolicy, err)
+
+	for _, events := range [][]string{{"started"}, {"invalid"}} {
+		_, err = NewHook(Config{Events: events})
+		require.Equal(t, ErrInvalidEvent, err)
+	}
+
+	h, err := NewHook(Config{})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+	require.Equal(t, PolicyReject, h.(*hook).cfg.Policy)
+	require.Equal(t, defaultPeerLifetime, h.(*hook).cfg.GracePeriod)
+}
+
+// checkAll checks all events, so that every session must begin with started.
+var checkAll = Config{Events: []string{"none", "completed", "stopped"}}
+
+func TestHandleAnnounce(t *testing.T) {
+	h := newHook(t, checkAll)
+	defer func() { <-h.Stop() }()
+
+	var table = []struct {
+		event    bittorrent.Event
+		peerID   string
+		expected error
+	}{
+		// Unknown peers must start their session.
+		{bittorrent.None, "-TR2940-000000000001", ErrStartedRequired},
+		{bittorrent.Completed, "-TR2940-000000000001", ErrStartedRequired},
+		{bittorrent.Started, "-TR2940-000000000001", nil},
+		{bittorrent.None, "-TR2940-000000000001", nil},
+		{bittorrent.Completed, "-TR2940-000000000001", nil},
+
+		// Stopping ends the session.
+		{bittorrent.Stopped, "-TR2940-000000000001", nil},
+		{bittorrent.None, "-TR2940-000000000001", ErrStartedRequired},
+		{bittorrent.Stopped, "-TR2940-000000000001", ErrStartedRequired},
+	}
+
+	for _, tt := range table {
+		_, err := h.HandleAnnounce(context.Background(), announce(tt.event, tt.peerID), &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err)
+	}
+
+	// Peers are known per swarm.
+	req := announce(bittorrent.Started, "-TR2940-000000000003")
+	_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	req = announce(bittorrent.None, "-TR2940-000000000003")
+	req.InfoHash = bittorrent.InfoHashFromString("00000000000000000002")
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrStartedRequired, err)
+}
+
+func TestGracePeriod(t *testing.T) {
+	h, err := NewHook(checkAll)
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	// Right after startup, ongoing sessions are accepted and remembered.
+	_, err = h.HandleAnnounce(context.Background(), announce(bittorrent.None, "-TR2940-000000000001"), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+
+	h.(*hook).graceEnd = time.Now()
+	_, err = h.HandleAnnounce(context.Background(), announce(bittorrent.None, "-TR2940-000000000001"), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), announce(bittorrent.None, "-TR2940-000000000002"), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrStartedRequired, err)
+}
+
+func TestPolicyFlag(t *testing.T) {
+	h := newHook(t, Config{Events: checkAll.Events, Policy: PolicyFlag})
+	defer func() { <-h.Stop() }()
+
+	ctx, err := h.HandleAnnounce(context.Background(), announce(bittorrent.None, "-TR2940-000000000001"), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SuspectedAbuseKey))
+
+	ctx, err = h.HandleAnnounce(context.Background(), announce(bittorrent.Started, "-TR2940-000000000001"), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Nil(t, ctx.Value(middleware.SuspectedAbuseKey))
+}
+
+func TestDefaultEvents(t *testing.T) {
+	h := newHook(t, Config{})
+	defer func() { <-h.Stop() }()
+
+	var table = []struct {
+		event    bittorrent.Event
+		peerID   string
+		expected error
+	}{
+		// Sessions must not begin with completed or stopped.
+		{bittorrent.Completed, "-TR2940-000000000001", ErrStartedRequired},
+		{bittorrent.Stopped, "-TR2940-000000000001", ErrStartedRequired},
+
+		// Unchecked events begin the session.
+		{bittorrent.None, "-TR2940-000000000001", nil},
+		{bittorrent.Completed, "-TR2940-000000000001", nil},
+		{bittorrent.Stopped, "-TR2940-000000000001", nil},
+		{bittorrent.Stopped, "-TR2940-000000000001", ErrStartedRequired},
+	}
+
+	for _, tt := range table {
+		_, err := h.HandleAnnounce(context.Background(), announce(tt.event, tt.peerID), &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err, tt)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	h := newHook(t, Config{Events: []string{"completed"}})
+	defer func() { <-h.Stop() }()
+
+	// Unchecked events are accepted from unknown peers.
+	_, err := h.HandleAnnounce(context.Background(), announce(bittorrent.Stopped, "-TR2940-000000000001"), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), announce(bittorrent.Completed, "-TR2940-000000000001"), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrStartedRequired, err)
+}
+
+func TestPolicyDowngrade(t *testing.T) {
+	h := newHook(t, Config{Policy: PolicyDowngrade})
+	defer func() { <-h.Stop() }()
+
+	// Stopped leaves the swarm untouched.
+	req := announce(bittorrent.Stopped, "-TR2940-000000000001")
+	ctx, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+
+	// Completed doesn't count as a completion, but begins the session.
+	req = announce(bittorrent.Completed, "-TR2940-000000000001")
+	ctx, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.None, req.Event)
+	require.Nil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+
+	req = announce(bittorrent.Stopped, "-TR2940-000000000001")
+	ctx, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Nil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+}
+
+func TestExpiry(t *testing.T) {
+	h := newHook(t, Config{PeerLifetime: time.Minute})
+	defer func() { <-h.Stop() }()
+
+	k := peerKey{bittorrent.InfoHashFromString("00000000000000000001"), bittorrent.PeerIDFromString("-TR2940-000000000001")}
+	now := time.Now()
+	h.remember(k, now)
+	require.True(t, h.seen(k, now.Add(59*time.Second)))
+
+	// Seeing the peer extends its lifetime.
+	require.True(t, h.seen(k, now.Add(time.Minute+30*time.Second)))
+	require.False(t, h.seen(k, now.Add(3*time.Minute)))
+}
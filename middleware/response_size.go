@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Estimated sizes in bytes of the parts of announce responses.
+const (
+	// udpAnnounceOverhead is the size of a BEP 15 announce response
+	// without peers.
+	udpAnnounceOverhead = 20
+
+	// httpAnnounceOverhead is the size of a bencoded announce response
+	// without peers and warning message, with counts and intervals of up
+	// to ten digits, plus the keys and length prefixes of the peer lists.
+	httpAnnounceOverhead = 128
+
+	// httpWarningOverhead is the size of the key and length prefix of the
+	// warning message of a bencoded announce response.
+	httpWarningOverhead = 24
+)
+
+// peerSize returns the size of p in an announce response in bytes.
+//
+// Peers in the non-compact format are bencoded dictionaries of their peer ID,
+// IP and port.
+func peerSize(p bittorrent.Peer, compact bool) int {
+	if compact {
+		if p.IP.AddressFamily == bittorrent.IPv6 {
+			return 18
+		}
+		return 6
+	}
+
+	// d2:ip<n>:<ip>4:porti<port>e7:peer id20:<id>e
+	ip := p.IP.String()
+	return 5 + len(strconv.Itoa(len(ip))) + 1 + len(ip) + 7 + len(strconv.Itoa(int(p.Port))) + 1 + 12 + 20 + 1
+}
+
+// limitSize drops peers from resp until its estimated size is at most the
+// configured maximum. IPv6 peers are dropped first, because they are larger.
+//
+// UDP responses only contain the peers of the address family of req, so the
+// peers of the other one are not counted.
+func (h *responseHook) limitSize(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	if h.maxResponseSize <= 0 {
+		return
+	}
+
+	v4, v6 := &resp.IPv4Peers, &resp.IPv6Peers
+	compact := resp.Compact
+	size := httpAnnounceOverhead
+	if resp.WarningMessage != "" {
+		size += httpWarningOverhead + len(resp.WarningMessage)
+	}
+
+	if scheme, _ := bittorrent.Scheme(ctx); scheme == bittorrent.SchemeUDP {
+		compact = true
+		size = udpAnnounceOverhead
+		if req.IP.AddressFamily == bittorrent.IPv6 {
+			v4 = nil
+		} else {
+			v6 = nil
+		}
+	}
+
+	for _, peers := range []*[]bittorrent.Peer{v4, v6} {
+		if peers == nil {
+			continue
+		}
+		for _, p := range *peers {
+			size += peerSize(p, compact)
+		}
+	}
+
+	trimmed := false
+	for _, peers := range []*[]bittorrent.Peer{v6, v4} {
+		for peers != nil && size > h.maxResponseSize && len(*peers) > 0 {
+			last := len(*peers) - 1
+			size -= peerSize((*peers)[last], compact)
+			*peers = (*peers)[:last]
+			trimmed = true
+		}
+	}
+
+	if trimmed {
+		PromAnnounceResponsesTrimmedTotal.Inc()
+	}
+}
@@ -0,0 +1,100 @@
+// Package roleinterval implements a Hook that sends different announce
+// intervals to seeders and leechers.
+package roleinterval
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// ErrInvalidInterval is returned for a config with a negative interval.
+var ErrInvalidInterval = errors.New("invalid interval")
+
+// ErrNoIntervals is returned for a config that does not change any interval.
+var ErrNoIntervals = errors.New("neither seeder_interval nor leecher_interval configured")
+
+// Config represents the configuration for the roleinterval middleware.
+type Config struct {
+	// SeederInterval is the interval sent to seeders.
+	// Zero leaves the interval of seeders unchanged.
+	SeederInterval time.Duration `yaml:"seeder_interval"`
+
+	// LeecherInterval is the interval sent to leechers.
+	// Zero leaves the interval of leechers unchanged.
+	LeecherInterval time.Duration `yaml:"leecher_interval"`
+
+	// ModifyMinInterval specifies whether min_interval should be changed
+	// proportionally as well.
+	ModifyMinInterval bool `yaml:"modify_min_interval"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"seederInterval":    cfg.SeederInterval,
+		"leecherInterval":   cfg.LeecherInterval,
+		"modifyMinInterval": cfg.ModifyMinInterval,
+	}
+}
+
+func checkConfig(cfg Config) error {
+	if cfg.SeederInterval < 0 || cfg.LeecherInterval < 0 {
+		return ErrInvalidInterval
+	}
+
+	if cfg.SeederInterval == 0 && cfg.LeecherInterval == 0 {
+		return ErrNoIntervals
+	}
+
+	return nil
+}
+
+type hook struct {
+	cfg Config
+}
+
+// NewHook returns an instance of the roleinterval middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if err := checkConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	return &hook{cfg: cfg}, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	interval := h.cfg.LeecherInterval
+	if req.Left == 0 {
+		interval = h.cfg.SeederInterval
+	}
+	if interval == 0 {
+		return ctx, nil
+	}
+
+	if h.cfg.ModifyMinInterval && resp.Interval > 0 {
+		resp.MinInterval = time.Duration(float64(resp.MinInterval) * float64(interval) / float64(resp.Interval))
+	}
+	// The minimum interval must never exceed the interval, otherwise
+	// clients following the interval would be rejected.
+	if resp.MinInterval > interval {
+		resp.MinInterval = interval
+	}
+	resp.Interval = interval
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't have an interval.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis don't have an interval.
+	return ctx, nil
+}
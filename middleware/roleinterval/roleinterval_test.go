@@ -0,0 +1,63 @@
+package roleinterval
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{SeederInterval: time.Hour}, nil},
+		{Config{LeecherInterval: 15 * time.Minute}, nil},
+		{Config{SeederInterval: time.Hour, LeecherInterval: 15 * time.Minute}, nil},
+		{Config{}, ErrNoIntervals},
+		{Config{SeederInterval: -time.Hour}, ErrInvalidInterval},
+		{Config{SeederInterval: time.Hour, LeecherInterval: -time.Minute}, ErrInvalidInterval},
+	}
+
+	for _, tt := range table {
+		_, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	var table = []struct {
+		cfg         Config
+		left        uint64
+		interval    time.Duration
+		minInterval time.Duration
+	}{
+		// Seeders and leechers receive their configured interval.
+		{Config{SeederInterval: time.Hour, LeecherInterval: 15 * time.Minute}, 0, time.Hour, 20 * time.Minute},
+		{Config{SeederInterval: time.Hour, LeecherInterval: 15 * time.Minute}, 1, 15 * time.Minute, 15 * time.Minute},
+
+		// Unconfigured roles are left unchanged.
+		{Config{SeederInterval: time.Hour}, 1, 30 * time.Minute, 20 * time.Minute},
+		{Config{LeecherInterval: 15 * time.Minute}, 0, 30 * time.Minute, 20 * time.Minute},
+
+		// The minimum interval is scaled proportionally.
+		{Config{SeederInterval: time.Hour, ModifyMinInterval: true}, 0, time.Hour, 40 * time.Minute},
+		{Config{LeecherInterval: 15 * time.Minute, ModifyMinInterval: true}, 1, 15 * time.Minute, 10 * time.Minute},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Nil(t, err)
+
+		req := &bittorrent.AnnounceRequest{Left: tt.left}
+		resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute, MinInterval: 20 * time.Minute}
+		_, err = h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, tt.interval, resp.Interval)
+		require.Equal(t, tt.minInterval, resp.MinInterval)
+	}
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// RuntimeConfig holds the parameters of the Logic that can be changed at
+// runtime via the "config" api method.
+//
+// Changes are lost on reload, which restores the configured values.
+type RuntimeConfig struct {
+	AnnounceInterval       time.Duration
+	MaxNumWant             uint32
+	DefaultNumWant         uint32
+	MaxScrapeInfoHashes    uint32
+	RejectScrapeInfoHashes uint32
+	MaxScrapeFiles         uint32
+}
+
+// String renders the RuntimeConfig as it is echoed by the "config" api method,
+// e.g. announce_interval=30m0s max_numwant=50 default_numwant=25 ...
+func (rc RuntimeConfig) String() string {
+	return fmt.Sprintf("announce_interval=%s max_numwant=%d default_numwant=%d max_scrape_infohashes=%d reject_scrape_infohashes=%d max_scrape_files=%d",
+		rc.AnnounceInterval,
+		rc.MaxNumWant,
+		rc.DefaultNumWant,
+		rc.MaxScrapeInfoHashes,
+		rc.RejectScrapeInfoHashes,
+		rc.MaxScrapeFiles,
+	)
+}
+
+// validate checks that rc can be applied.
+func (rc RuntimeConfig) validate() error {
+	if rc.AnnounceInterval <= 0 {
+		return errors.New("announce_interval must be positive")
+	}
+
+	if rc.DefaultNumWant > rc.MaxNumWant {
+		return ErrInvalidDefaultNumWant
+	}
+
+	if rc.MaxScrapeInfoHashes == 0 {
+		return errors.New("max_scrape_infohashes must be positive")
+	}
+
+	if rc.RejectScrapeInfoHashes < rc.MaxScrapeInfoHashes {
+		return errors.New("reject_scrape_infohashes must not be lower than max_scrape_infohashes")
+	}
+
+	return nil
+}
+
+// runtimeConfig holds the current RuntimeConfig of a Logic, which is read by
+// its hooks for every request and swapped atomically on changes.
+//
+// A nil *runtimeConfig holds the zero RuntimeConfig.
+type runtimeConfig struct {
+	// updateM serializes updates, so that concurrent updates of different
+	// parameters are not lost.
+	updateM sync.Mutex
+	v       atomic.Value
+}
+
+func newRuntimeConfig(rc RuntimeConfig) *runtimeConfig {
+	c := &runtimeConfig{}
+	c.v.Store(rc)
+	return c
+}
+
+// load returns the current RuntimeConfig.
+func (c *runtimeConfig) load() RuntimeConfig {
+	if c == nil {
+		return RuntimeConfig{}
+	}
+
+	return c.v.Load().(RuntimeConfig)
+}
+
+// update applies the parameters of params to the current RuntimeConfig and
+// returns the resulting RuntimeConfig.
+//
+// If any parameter is invalid, no parameter is applied.
+func (c *runtimeConfig) update(params bittorrent.Params) (RuntimeConfig, error) {
+	c.updateM.Lock()
+	defer c.updateM.Unlock()
+
+	current := c.load()
+	if params == nil {
+		return current, nil
+	}
+
+	rc := current
+	if s, ok := params.String("announce_interval"); ok {
+		interval, err := time.ParseDuration(s)
+		if err != nil {
+			return current, errors.New("invalid announce_interval")
+		}
+		rc.AnnounceInterval = interval
+	}
+
+	for _, p := range []struct {
+		key   string
+		field *uint32
+	}{
+		{"max_numwant", &rc.MaxNumWant},
+		{"default_numwant", &rc.DefaultNumWant},
+		{"max_scrape_infohashes", &rc.MaxScrapeInfoHashes},
+		{"reject_scrape_infohashes", &rc.RejectScrapeInfoHashes},
+		{"max_scrape_files", &rc.MaxScrapeFiles},
+	} {
+		s, ok := params.String(p.key)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return current, errors.New("invalid " + p.key)
+		}
+		*p.field = uint32(n)
+	}
+
+	if rc == current {
+		return current, nil
+	}
+
+	if err := rc.validate(); err != nil {
+		return current, err
+	}
+
+	c.v.Store(rc)
+	log.Info("changed runtime config", log.Fields{"config": rc.String()})
+
+	return rc, nil
+}
+
+// handleApi answers the "config" api method, which changes the parameters
+// given in the query, if any, and echoes the effective RuntimeConfig.
+func (c *runtimeConfig) handleApi(params bittorrent.Params, resp *bittorrent.ApiResponse) {
+	rc, err := c.update(params)
+	if err != nil {
+		resp.Error = 1
+		resp.Response = err.Error()
+		return
+	}
+
+	resp.Response = rc.String()
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestRuntimeConfigApi(t *testing.T) {
+	rc := newRuntimeConfig(RuntimeConfig{
+		AnnounceInterval:       30 * time.Minute,
+		MaxNumWant:             50,
+		DefaultNumWant:         25,
+		MaxScrapeInfoHashes:    50,
+		RejectScrapeInfoHashes: 1000,
+	})
+	h := &sanitizationHook{config: rc}
+
+	var table = []struct {
+		query    string
+		err      int
+		response string
+	}{
+		{"", 0, "announce_interval=30m0s max_numwant=50 default_numwant=25 max_scrape_infohashes=50 reject_scrape_infohashes=1000 max_scrape_files=0"},
+		{"announce_interval=20m&max_numwant=30", 0, "announce_interval=20m0s max_numwant=30 default_numwant=25 max_scrape_infohashes=50 reject_scrape_infohashes=1000 max_scrape_files=0"},
+
+		// Invalid changes are not applied at all.
+		{"max_numwant=10&announce_interval=0s", 1, "announce_interval must be positive"},
+		{"max_numwant=10&default_numwant=-1", 1, "invalid default_numwant"},
+		{"max_scrape_infohashes=2000", 1, "reject_scrape_infohashes must not be lower than max_scrape_infohashes"},
+		{"default_numwant=40", 1, "default_numwant must not be greater than max_numwant"},
+		{"max_numwant=20", 1, "default_numwant must not be greater than max_numwant"},
+		{"", 0, "announce_interval=20m0s max_numwant=30 default_numwant=25 max_scrape_infohashes=50 reject_scrape_infohashes=1000 max_scrape_files=0"},
+	}
+
+	for _, tt := range table {
+		params, err := bittorrent.ParseURLData("/api?auth=secret&method=config&" + tt.query)
+		require.Nil(t, err)
+
+		resp := &bittorrent.ApiResponse{}
+		_, err = h.HandleApi(context.Background(), &bittorrent.ApiRequest{Method: "config", Params: params}, resp)
+		require.Nil(t, err)
+		require.Equal(t, tt.err, resp.Error)
+		require.Equal(t, tt.response, resp.Response)
+	}
+
+	// Hooks read the effective config.
+	req := &bittorrent.AnnounceRequest{NumWant: 50, Peer: bittorrent.Peer{IP: bittorrent.IP{IP: []byte{1, 2, 3, 4}}}}
+	_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, uint32(30), req.NumWant)
+
+	l := &Logic{config: rc}
+	_, resp, err := l.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{})
+	require.Nil(t, err)
+	require.Equal(t, 20*time.Minute, resp.Interval)
+}
+
+func TestNewLogicNumWant(t *testing.T) {
+	_, err := NewLogic(Config{AnnounceInterval: time.Minute, MaxNumWant: 20, DefaultNumWant: 25}, nil, nil, nil)
+	require.Equal(t, ErrInvalidDefaultNumWant, err)
+
+	_, err = NewLogic(Config{AnnounceInterval: time.Minute, MaxNumWant: 25, DefaultNumWant: 25}, nil, nil, nil)
+	require.Nil(t, err)
+}
+
+func TestNewLogicScrapeInfoHashes(t *testing.T) {
+	// The default reject limit does not undercut a higher max.
+	l, err := NewLogic(Config{AnnounceInterval: time.Minute, MaxScrapeInfoHashes: 2000}, nil, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2000), l.config.load().RejectScrapeInfoHashes)
+
+	l, err = NewLogic(Config{AnnounceInterval: time.Minute}, nil, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, uint32(defaultRejectScrapeInfoHashes), l.config.load().RejectScrapeInfoHashes)
+
+	// Invalid configs are rejected like updates via the api.
+	_, err = NewLogic(Config{AnnounceInterval: time.Minute, MaxScrapeInfoHashes: 100, RejectScrapeInfoHashes: 50}, nil, nil, nil)
+	require.NotNil(t, err)
+	_, err = NewLogic(Config{}, nil, nil, nil)
+	require.NotNil(t, err)
+}
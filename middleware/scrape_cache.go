@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/load"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// defaultScrapeCacheMaxStaleness is the maximum age of a cached Scrape if
+// none is configured.
+const defaultScrapeCacheMaxStaleness = 5 * time.Second
+
+// ScrapeCacheConfig holds the configuration of the cache of Scrapes that is
+// used while the tracker is under load.
+type ScrapeCacheConfig struct {
+	// Size is the maximum number of cached Scrapes. The least recently
+	// used Scrapes are evicted first.
+	// Zero disables the cache.
+	Size int `yaml:"size"`
+
+	// Threshold is the load level, between 0 and 1, above which scrapes are
+	// answered from the cache. Below it the cache is bypassed.
+	Threshold float64 `yaml:"threshold"`
+
+	// MaxStaleness is the maximum age of a cached Scrape.
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+}
+
+type scrapeCacheKey struct {
+	infoHash bittorrent.InfoHash
+	af       bittorrent.AddressFamily
+}
+
+type scrapeCacheEntry struct {
+	key     scrapeCacheKey
+	scrape  bittorrent.Scrape
+	created time.Time
+}
+
+// scrapeCache is an LRU cache of Scrapes that is only used while the load
+// reported by the load package exceeds a threshold.
+//
+// A nil *scrapeCache is never active.
+type scrapeCache struct {
+	threshold    float64
+	maxStaleness time.Duration
+	level        func() float64
+
+	sync.Mutex
+	size    int
+	entries map[scrapeCacheKey]*list.Element
+	lru     *list.List
+}
+
+// newScrapeCache creates a scrapeCache for cfg.
+//
+// If the cache is disabled, nil is returned.
+func newScrapeCache(cfg ScrapeCacheConfig) *scrapeCache {
+	if cfg.Size <= 0 {
+		return nil
+	}
+
+	if cfg.MaxStaleness <= 0 {
+		cfg.MaxStaleness = defaultScrapeCacheMaxStaleness
+	}
+
+	return &scrapeCache{
+		threshold:    cfg.Threshold,
+		maxStaleness: cfg.MaxStaleness,
+		level:        load.Level,
+		size:         cfg.Size,
+		entries:      make(map[scrapeCacheKey]*list.Element, cfg.Size),
+		lru:          list.New(),
+	}
+}
+
+// active reports whether the cache should be used at the current load.
+func (c *scrapeCache) active() bool {
+	return c != nil && c.level() > c.threshold
+}
+
+// scrape returns the Scrape of the swarm identified by infoHash and af from
+// the cache, or from store if it is not cached or too old.
+//
+// Failed Scrapes are not cached.
+func (c *scrapeCache) scrape(store storage.PeerStore, infoHash bittorrent.InfoHash, af bittorrent.AddressFamily, now time.Time) (bittorrent.Scrape, error) {
+	key := scrapeCacheKey{infoHash, af}
+
+	c.Lock()
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*scrapeCacheEntry)
+		if now.Sub(entry.created) <= c.maxStaleness {
+			c.lru.MoveToFront(e)
+			c.Unlock()
+			PromScrapeCacheHitsTotal.Inc()
+			return entry.scrape, nil
+		}
+	}
+	c.Unlock()
+
+	// The store is queried without holding the lock, so concurrent misses
+	// for the same swarm may query it more than once.
+	scrape, err := scrapeSwarm(store, infoHash, af)
+	if err != nil {
+		return scrape, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value = &scrapeCacheEntry{key: key, scrape: scrape, created: now}
+		c.lru.MoveToFront(e)
+		return scrape, nil
+	}
+
+	c.entries[key] = c.lru.PushFront(&scrapeCacheEntry{key: key, scrape: scrape, created: now})
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*scrapeCacheEntry).key)
+	}
+
+	return scrape, nil
+}
@@ -0,0 +1,96 @@
+// Package scrapecontrol implements a Hook that disables Scrapes or restricts
+// them to authenticated clients.
+package scrapecontrol
+
+import (
+	"context"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+var (
+	// ErrScrapeDisabled is returned for Scrapes if scraping is disabled.
+	ErrScrapeDisabled = bittorrent.NewClientError("scrape_disabled", "scrape is disabled")
+
+	// ErrScrapeUnauthenticated is returned for Scrapes of unauthenticated
+	// clients if scraping requires authentication.
+	ErrScrapeUnauthenticated = bittorrent.NewClientError("scrape_unauthenticated", "scrape requires authentication")
+)
+
+// Config represents the configuration for the scrapecontrol middleware.
+type Config struct {
+	// Disabled specifies whether all Scrapes are refused.
+	Disabled bool `yaml:"disabled"`
+
+	// RequireAuth specifies whether Scrapes are refused unless the
+	// frontend authenticated the client or an earlier middleware marked
+	// them via middleware.AuthenticatedKey.
+	RequireAuth bool `yaml:"require_auth"`
+
+	// EmptyResponse specifies whether refused Scrapes are answered with
+	// empty swarm statistics instead of an error.
+	EmptyResponse bool `yaml:"empty_response"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"disabled":      cfg.Disabled,
+		"requireAuth":   cfg.RequireAuth,
+		"emptyResponse": cfg.EmptyResponse,
+	}
+}
+
+type hook struct {
+	cfg Config
+}
+
+// NewHook returns an instance of the scrapecontrol middleware.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	return &hook{cfg: cfg}, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Announces are not altered.
+	return ctx, nil
+}
+
+// authenticated reports whether the client of a request was authenticated.
+func authenticated(ctx context.Context) bool {
+	if _, ok := frontend.UserID(ctx); ok {
+		return true
+	}
+	return ctx.Value(middleware.AuthenticatedKey) != nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	var err error
+	switch {
+	case h.cfg.Disabled:
+		err = ErrScrapeDisabled
+	case h.cfg.RequireAuth && !authenticated(ctx):
+		err = ErrScrapeUnauthenticated
+	default:
+		return ctx, nil
+	}
+
+	if !h.cfg.EmptyResponse {
+		return ctx, err
+	}
+
+	// Answer every infohash to keep the response in the order of the
+	// request, as required for UDP.
+	for _, infoHash := range req.InfoHashes {
+		resp.Files = append(resp.Files, bittorrent.Scrape{InfoHash: infoHash})
+	}
+
+	return context.WithValue(ctx, middleware.SkipResponseHookKey, struct{}{}), nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis are not altered.
+	return ctx, nil
+}
@@ -0,0 +1,53 @@
+package scrapecontrol
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+var ih = bittorrent.InfoHashFromString("01234567890123456789")
+
+func TestHandleScrape(t *testing.T) {
+	authCtx := context.WithValue(context.Background(), middleware.AuthenticatedKey, true)
+	userCtx := context.WithValue(context.Background(), frontend.UserIDKey, "42")
+
+	var table = []struct {
+		cfg      Config
+		ctx      context.Context
+		expected error
+	}{
+		{Config{}, context.Background(), nil},
+		{Config{Disabled: true}, context.Background(), ErrScrapeDisabled},
+		{Config{Disabled: true}, authCtx, ErrScrapeDisabled},
+		{Config{RequireAuth: true}, context.Background(), ErrScrapeUnauthenticated},
+		{Config{RequireAuth: true}, authCtx, nil},
+		{Config{RequireAuth: true}, userCtx, nil},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Nil(t, err)
+
+		req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih}}
+		_, err = h.HandleScrape(tt.ctx, req, &bittorrent.ScrapeResponse{})
+		require.Equal(t, tt.expected, err)
+	}
+}
+
+func TestEmptyResponse(t *testing.T) {
+	h, err := NewHook(Config{Disabled: true, EmptyResponse: true})
+	require.Nil(t, err)
+
+	req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih, ih}}
+	resp := &bittorrent.ScrapeResponse{}
+	ctx, err := h.HandleScrape(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipResponseHookKey))
+	require.Equal(t, []bittorrent.Scrape{{InfoHash: ih}, {InfoHash: ih}}, resp.Files)
+}
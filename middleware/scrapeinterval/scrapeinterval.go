@@ -0,0 +1,145 @@
+// Package scrapeinterval implements a Hook that advises clients of a minimum
+// interval between Scrapes and optionally rejects Scrapes of clients that
+// scrape more often.
+package scrapeinterval
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// defaultMaxIPs is the default of the MaxIPs.
+const defaultMaxIPs = 100000
+
+// ErrScrapeTooFrequent is returned for Scrapes of clients that scraped less
+// than the minimum interval ago.
+var ErrScrapeTooFrequent = bittorrent.NewClientError("scrape_too_frequent", "scraping too frequently")
+
+// Errors of the configuration.
+var (
+	ErrInvalidInterval = errors.New("interval must be positive")
+	ErrInvalidMaxIPs   = errors.New("max_ips must not be negative")
+)
+
+// Config represents the configuration for the min scrape interval
+// middleware.
+type Config struct {
+	// Interval is the minimum interval between two Scrapes of a client.
+	// It is sent to the clients as the min_request_interval flag, if the
+	// protocol supports it.
+	Interval time.Duration `yaml:"interval"`
+
+	// Reject specifies whether Scrapes of clients that scraped less than
+	// Interval ago are rejected. Otherwise, they are only advised of the
+	// interval.
+	Reject bool `yaml:"reject"`
+
+	// MaxIPs is the maximum number of clients whose last Scrape is kept.
+	// Beyond that, the clients that scraped least recently are forgotten.
+	// If zero, a default of 100000 is used.
+	MaxIPs int `yaml:"max_ips"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"interval": cfg.Interval,
+		"reject":   cfg.Reject,
+		"maxIPs":   cfg.MaxIPs,
+	}
+}
+
+type hook struct {
+	cfg Config
+
+	// clients holds the known clients until they can scrape again, if
+	// Reject is set.
+	clients *expiring.Map
+}
+
+// NewHook returns an instance of the min scrape interval middleware.
+//
+// Clients are identified by the address the frontend received their Scrape
+// from. Scrapes without one are never rejected. Unless Reject is set, the
+// Scrapes of clients are not recorded.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.Interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	if cfg.MaxIPs < 0 {
+		return nil, ErrInvalidMaxIPs
+	}
+
+	if cfg.MaxIPs == 0 {
+		cfg.MaxIPs = defaultMaxIPs
+	}
+
+	h := &hook{cfg: cfg}
+	if cfg.Reject {
+		h.clients = expiring.New(cfg.MaxIPs, cfg.Interval)
+	}
+	return h, nil
+}
+
+// allow records a Scrape of client at now and reports whether the client
+// scraped at least Interval ago.
+//
+// Rejected Scrapes are not recorded, so that the client can scrape again
+// Interval after its last accepted Scrape.
+func (h *hook) allow(client string, now time.Time) (allowed bool) {
+	h.clients.Update(client, now, func(e expiring.Entry, ok bool) expiring.Entry {
+		allowed = !ok
+		if !allowed {
+			return e
+		}
+		return expiring.Entry{Expires: now.Add(h.cfg.Interval)}
+	})
+	return
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Announces have their own intervals.
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	resp.MinRequestInterval = h.cfg.Interval
+	if !h.cfg.Reject {
+		return ctx, nil
+	}
+
+	ip, ok := frontend.ClientIP(ctx)
+	if !ok {
+		return ctx, nil
+	}
+
+	if !h.allow(string(ip.IP), time.Now()) {
+		log.Debug("rejecting scrape within min scrape interval", log.RequestFields(ctx, log.Fields{
+			"ip": ip,
+		}))
+		return ctx, ErrScrapeTooFrequent
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are not Scrapes.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	if h.clients == nil {
+		c := make(chan error)
+		close(c)
+		return c
+	}
+	return h.clients.Stop()
+}
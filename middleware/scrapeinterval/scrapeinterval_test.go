@@ -0,0 +1,95 @@
+package scrapeinterval
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func scrape(h middleware.Hook, ip string) (*bittorrent.ScrapeResponse, error) {
+	ctx := context.Background()
+	if ip != "" {
+		clientIP, _ := bittorrent.NormalizeIP(net.ParseIP(ip))
+		ctx = context.WithValue(ctx, frontend.ClientIPKey, clientIP)
+	}
+	resp := &bittorrent.ScrapeResponse{}
+	_, err := h.HandleScrape(ctx, &bittorrent.ScrapeRequest{}, resp)
+	return resp, err
+}
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{Interval: time.Minute}, nil},
+		{Config{Interval: time.Minute, Reject: true, MaxIPs: 10}, nil},
+		{Config{}, ErrInvalidInterval},
+		{Config{Interval: time.Minute, MaxIPs: -1}, ErrInvalidMaxIPs},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+		if err == nil {
+			<-h.(*hook).Stop()
+		}
+	}
+}
+
+func TestHandleScrape(t *testing.T) {
+	var table = []struct {
+		reject   bool
+		expected error
+	}{
+		{false, nil},
+		{true, ErrScrapeTooFrequent},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(Config{Interval: time.Minute, Reject: tt.reject})
+		require.Nil(t, err)
+
+		resp, err := scrape(h, "10.0.0.1")
+		require.Nil(t, err)
+		require.Equal(t, time.Minute, resp.MinRequestInterval)
+
+		resp, err = scrape(h, "10.0.0.1")
+		require.Equal(t, tt.expected, err)
+		require.Equal(t, time.Minute, resp.MinRequestInterval)
+
+		// Other clients and Scrapes without an address are not affected.
+		_, err = scrape(h, "fc00::1")
+		require.Nil(t, err)
+		_, err = scrape(h, "")
+		require.Nil(t, err)
+		_, err = scrape(h, "")
+		require.Nil(t, err)
+
+		// Without rejecting, Scrapes are not recorded.
+		require.Equal(t, tt.reject, h.(*hook).clients != nil)
+
+		<-h.(*hook).Stop()
+	}
+}
+
+func TestAllow(t *testing.T) {
+	h, err := NewHook(Config{Interval: time.Minute, Reject: true, MaxIPs: 1})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	hk := h.(*hook)
+	now := time.Now()
+	require.True(t, hk.allow("a", now))
+	require.False(t, hk.allow("a", now.Add(30*time.Second)))
+
+	// Rejected Scrapes don't extend the interval.
+	require.True(t, hk.allow("a", now.Add(time.Minute)))
+}
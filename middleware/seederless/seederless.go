@@ -0,0 +1,89 @@
+// Package seederless implements a Hook that lengthens the announce interval
+// of leechers in swarms without seeders.
+package seederless
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// ErrInvalidInterval is returned for a config with an invalid Interval.
+var ErrInvalidInterval = errors.New("invalid interval")
+
+// Config represents the configuration for the seederless middleware.
+type Config struct {
+	// Interval is the interval sent to leechers of swarms without seeders.
+	// It is only used if it is longer than the interval of the response.
+	Interval time.Duration `yaml:"interval"`
+
+	// ModifyMinInterval specifies whether min_interval should be increased
+	// proportionally as well.
+	ModifyMinInterval bool `yaml:"modify_min_interval"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"interval":          cfg.Interval,
+		"modifyMinInterval": cfg.ModifyMinInterval,
+	}
+}
+
+type hook struct {
+	cfg   Config
+	store storage.PeerStore
+}
+
+// NewHook returns an instance of the seederless middleware that reads the
+// number of seeders from the given PeerStore.
+func NewHook(cfg Config, store storage.PeerStore) (middleware.Hook, error) {
+	if cfg.Interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+
+	return &hook{cfg: cfg, store: store}, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Seeders and stopping leechers don't wait for seeders.
+	if req.Left == 0 || req.Event == bittorrent.Stopped {
+		return ctx, nil
+	}
+
+	if h.cfg.Interval <= resp.Interval {
+		return ctx, nil
+	}
+
+	// Seeders of both address families can serve the leecher.
+	seeders := h.store.ScrapeSwarm(req.InfoHash, bittorrent.IPv4).Complete +
+		h.store.ScrapeSwarm(req.InfoHash, bittorrent.IPv6).Complete
+	if seeders > 0 {
+		return ctx, nil
+	}
+
+	if h.cfg.ModifyMinInterval && resp.Interval > 0 {
+		resp.MinInterval = time.Duration(float64(resp.MinInterval) * float64(h.cfg.Interval) / float64(resp.Interval))
+		if resp.MinInterval > h.cfg.Interval {
+			resp.MinInterval = h.cfg.Interval
+		}
+	}
+	resp.Interval = h.cfg.Interval
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't have an interval.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Apis don't have an interval.
+	return ctx, nil
+}
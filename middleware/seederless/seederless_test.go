@@ -0,0 +1,72 @@
+package seederless
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("01234567890123456789")
+	ih2 = bittorrent.InfoHashFromString("abcdefghijklmnopqrst")
+)
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{Interval: time.Hour}, nil)
+	require.Nil(t, err)
+
+	_, err = NewHook(Config{}, nil)
+	require.Equal(t, ErrInvalidInterval, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	seeder := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 6881,
+		IP:   bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6},
+	}
+	require.Nil(t, ps.PutSeeder(ih1, seeder))
+
+	var table = []struct {
+		cfg         Config
+		infoHash    bittorrent.InfoHash
+		event       bittorrent.Event
+		left        uint64
+		interval    time.Duration
+		minInterval time.Duration
+	}{
+		// Seeders of the other address family count as well.
+		{Config{Interval: time.Hour}, ih1, bittorrent.None, 10, 30 * time.Minute, 20 * time.Minute},
+		{Config{Interval: time.Hour}, ih2, bittorrent.None, 10, time.Hour, 20 * time.Minute},
+		{Config{Interval: time.Hour, ModifyMinInterval: true}, ih2, bittorrent.None, 10, time.Hour, 40 * time.Minute},
+
+		// Seeders and stopping leechers are not affected.
+		{Config{Interval: time.Hour}, ih2, bittorrent.None, 0, 30 * time.Minute, 20 * time.Minute},
+		{Config{Interval: time.Hour}, ih2, bittorrent.Stopped, 10, 30 * time.Minute, 20 * time.Minute},
+
+		// The interval is never shortened.
+		{Config{Interval: 15 * time.Minute}, ih2, bittorrent.None, 10, 30 * time.Minute, 20 * time.Minute},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg, ps)
+		require.Nil(t, err)
+
+		req := &bittorrent.AnnounceRequest{InfoHash: tt.infoHash, Event: tt.event, Left: tt.left}
+		resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute, MinInterval: 20 * time.Minute}
+		_, err = h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, tt.interval, resp.Interval)
+		require.Equal(t, tt.minInterval, resp.MinInterval)
+	}
+}
@@ -0,0 +1,105 @@
+// Package tarpit implements a Hook that delays the responses to requests of
+// suspected abusers.
+package tarpit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Limits of the configuration.
+const (
+	maxDelay            = time.Minute
+	defaultMaxTarpitted = 100
+)
+
+// ErrInvalidDelay is returned for a config with an invalid Delay.
+var ErrInvalidDelay = errors.New("delay must be positive and at most 1m")
+
+// Config represents the configuration for the tarpit middleware.
+type Config struct {
+	// Delay is the duration responses to suspected abusers are delayed.
+	Delay time.Duration `yaml:"delay"`
+
+	// MaxTarpitted is the maximum number of requests delayed at the same
+	// time. Requests of suspected abusers exceeding it are answered
+	// without delay.
+	// If zero, a default of 100 is used.
+	MaxTarpitted int `yaml:"max_tarpitted"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"delay":        cfg.Delay,
+		"maxTarpitted": cfg.MaxTarpitted,
+	}
+}
+
+type hook struct {
+	delay time.Duration
+	slots chan struct{}
+}
+
+// NewHook returns an instance of the tarpit middleware.
+//
+// Requests are delayed if an earlier middleware marked them via
+// middleware.SuspectedAbuseKey.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.Delay <= 0 || cfg.Delay > maxDelay {
+		return nil, ErrInvalidDelay
+	}
+
+	if cfg.MaxTarpitted <= 0 {
+		cfg.MaxTarpitted = defaultMaxTarpitted
+	}
+
+	return &hook{
+		delay: cfg.Delay,
+		slots: make(chan struct{}, cfg.MaxTarpitted),
+	}, nil
+}
+
+// tarpit delays a request marked as suspicious until either the delay passed
+// or ctx is done.
+func (h *hook) tarpit(ctx context.Context) {
+	if ctx.Value(middleware.SuspectedAbuseKey) == nil {
+		return
+	}
+
+	select {
+	case h.slots <- struct{}{}:
+	default:
+		// All slots are taken, don't tie up even more goroutines.
+		return
+	}
+	defer func() { <-h.slots }()
+
+	t := time.NewTimer(h.delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.tarpit(ctx)
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	h.tarpit(ctx)
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are trusted.
+	return ctx, nil
+}
@@ -0,0 +1,76 @@
+package tarpit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{Delay: time.Second}, nil},
+		{Config{Delay: maxDelay}, nil},
+		{Config{}, ErrInvalidDelay},
+		{Config{Delay: 2 * maxDelay}, ErrInvalidDelay},
+	}
+
+	for _, tt := range table {
+		_, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{Delay: 50 * time.Millisecond})
+	require.Nil(t, err)
+
+	req := &bittorrent.AnnounceRequest{}
+	resp := &bittorrent.AnnounceResponse{}
+
+	// Regular requests are not delayed.
+	start := time.Now()
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < 50*time.Millisecond)
+
+	ctx := context.WithValue(context.Background(), middleware.SuspectedAbuseKey, struct{}{})
+	start = time.Now()
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestCancellation(t *testing.T) {
+	h, err := NewHook(Config{Delay: maxDelay})
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), middleware.SuspectedAbuseKey, struct{}{}))
+	cancel()
+
+	start := time.Now()
+	_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestMaxTarpitted(t *testing.T) {
+	h, err := NewHook(Config{Delay: maxDelay, MaxTarpitted: 1})
+	require.Nil(t, err)
+
+	// Occupy the only slot.
+	h.(*hook).slots <- struct{}{}
+
+	ctx := context.WithValue(context.Background(), middleware.SuspectedAbuseKey, struct{}{})
+	start := time.Now()
+	_, err = h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,138 @@
+package toptalkers
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// Dimensions of the count-min sketch.
+//
+// With these dimensions, an estimate exceeds the true count by more than
+// 1/1024 of all counted keys with a probability below 2%.
+const (
+	sketchDepth = 4
+	sketchWidth = 1 << 12
+)
+
+// entry is a key with its estimated count.
+type entry struct {
+	key   string
+	count uint32
+}
+
+// entryHeap is a min-heap of entries that tracks the position of each key.
+type entryHeap struct {
+	entries []entry
+	index   map[string]int
+}
+
+func (h *entryHeap) Len() int           { return len(h.entries) }
+func (h *entryHeap) Less(i, j int) bool { return h.entries[i].count < h.entries[j].count }
+
+func (h *entryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].key] = i
+	h.index[h.entries[j].key] = j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(entry)
+	h.index[e.key] = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	delete(h.index, e.key)
+	return e
+}
+
+// topK estimates the k most frequent keys of a stream in constant memory.
+//
+// The counts of all keys are estimated with a count-min sketch, and the k keys
+// with the highest estimates are kept in a min-heap. topK is not safe for
+// concurrent use.
+type topK struct {
+	k      int
+	sketch [sketchDepth][sketchWidth]uint32
+	heap   entryHeap
+}
+
+func newTopK(k int) *topK {
+	return &topK{
+		k:    k,
+		heap: entryHeap{index: make(map[string]int, k)},
+	}
+}
+
+// add counts an occurrence of key.
+func (t *topK) add(key string) {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	sum := f.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	estimate := uint32(math.MaxUint32)
+	for i := range t.sketch {
+		cell := &t.sketch[i][(h1+uint32(i)*h2)%sketchWidth]
+		if *cell < math.MaxUint32 {
+			*cell++
+		}
+		if *cell < estimate {
+			estimate = *cell
+		}
+	}
+
+	if pos, ok := t.heap.index[key]; ok {
+		t.heap.entries[pos].count = estimate
+		heap.Fix(&t.heap, pos)
+		return
+	}
+
+	if t.heap.Len() < t.k {
+		heap.Push(&t.heap, entry{key, estimate})
+		return
+	}
+
+	if estimate > t.heap.entries[0].count {
+		delete(t.heap.index, t.heap.entries[0].key)
+		t.heap.entries[0] = entry{key, estimate}
+		t.heap.index[key] = 0
+		heap.Fix(&t.heap, 0)
+	}
+}
+
+// decay halves all counts, so that past occurrences lose weight over time.
+func (t *topK) decay() {
+	for i := range t.sketch {
+		for j := range t.sketch[i] {
+			t.sketch[i][j] >>= 1
+		}
+	}
+
+	// Halving preserves the order of the heap.
+	for i := range t.heap.entries {
+		t.heap.entries[i].count >>= 1
+	}
+	for t.heap.Len() > 0 && t.heap.entries[0].count == 0 {
+		heap.Pop(&t.heap)
+	}
+}
+
+// top returns the tracked keys ordered by their estimated count, highest
+// first.
+func (t *topK) top() []entry {
+	entries := make([]entry, len(t.heap.entries))
+	copy(entries, t.heap.entries)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+		return entries[i].key < entries[j].key
+	})
+
+	return entries
+}
@@ -0,0 +1,208 @@
+// Package toptalkers implements a Hook that tracks the IPs and peer IDs
+// generating the most Announces and exposes them via the Api.
+package toptalkers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Defaults of the configuration.
+const (
+	defaultTopN     = 10
+	defaultHalfLife = 10 * time.Minute
+	maxTopN         = 1000
+)
+
+// ErrInvalidTopN is returned for a config with an invalid TopN.
+var ErrInvalidTopN = errors.New("invalid top_n")
+
+// ErrInvalidSampleRate is returned for a config with an invalid SampleRate.
+var ErrInvalidSampleRate = errors.New("invalid sample_rate")
+
+// Config represents the configuration for the toptalkers middleware.
+type Config struct {
+	// TopN is the number of IPs and peer IDs that are tracked each.
+	// If zero, a default of 10 is used.
+	TopN int `yaml:"top_n"`
+
+	// SampleRate is the fraction of Announces that are counted. The
+	// reported counts are scaled accordingly.
+	// If zero, all Announces are counted.
+	SampleRate float64 `yaml:"sample_rate"`
+
+	// HalfLife is the interval after which all counts are halved, so that
+	// the top talkers reflect recent traffic.
+	// If zero, a default of 10m is used.
+	HalfLife time.Duration `yaml:"half_life"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"topN":       cfg.TopN,
+		"sampleRate": cfg.SampleRate,
+		"halfLife":   cfg.HalfLife,
+	}
+}
+
+type hook struct {
+	cfg       Config
+	threshold int
+
+	sync.Mutex
+	ips     *topK
+	peerIDs *topK
+
+	closing chan struct{}
+}
+
+// NewHook returns an instance of the toptalkers middleware.
+//
+// The counts are only kept in memory, whose size does not depend on the
+// number of announcing peers.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.TopN == 0 {
+		cfg.TopN = defaultTopN
+	}
+	if cfg.TopN < 0 || cfg.TopN > maxTopN {
+		return nil, ErrInvalidTopN
+	}
+
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 1
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, ErrInvalidSampleRate
+	}
+
+	if cfg.HalfLife <= 0 {
+		cfg.HalfLife = defaultHalfLife
+	}
+
+	h := &hook{
+		cfg:       cfg,
+		threshold: int(cfg.SampleRate * (1 << 24)),
+		ips:       newTopK(cfg.TopN),
+		peerIDs:   newTopK(cfg.TopN),
+		closing:   make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-time.After(cfg.HalfLife):
+				h.decay()
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// decay halves the counts of all IPs and peer IDs.
+func (h *hook) decay() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.ips.decay()
+	h.peerIDs.decay()
+}
+
+// sampled reports whether req is counted.
+//
+// Unlike sampling for logs, the decision is random for every Announce, so
+// that the counts of all peers are scaled equally.
+func (h *hook) sampled(req *bittorrent.AnnounceRequest) bool {
+	if h.threshold >= 1<<24 {
+		return true
+	}
+
+	s0, s1 := random.DeriveEntropyFromRequest(req)
+	// Advance once to mix the time into the low bits.
+	_, s0, s1 = random.GenerateAndAdvance(s0^uint64(time.Now().UnixNano()), s1)
+	v, _, _ := random.Intn(s0, s1, 1<<24)
+	return v < h.threshold
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.sampled(req) {
+		return ctx, nil
+	}
+
+	// Respect privacy masking, so that operators see networks instead of
+	// IPs if configured.
+	ip := middleware.LoggableIP(ctx, req.IP)
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.ips.add(string(ip.IP))
+	h.peerIDs.add(string(req.Peer.ID[:]))
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not counted.
+	return ctx, nil
+}
+
+// HandleApi answers the top-talkers method with the tracked IPs and peer IDs
+// and their estimated number of Announces, e.g.
+// ips="10.0.0.1":120,"10.0.0.2":80 peer_ids="-TR2940-000000000001":100.
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	if req.Method != "top-talkers" {
+		return ctx, nil
+	}
+
+	h.Lock()
+	ips, peerIDs := h.ips.top(), h.peerIDs.top()
+	h.Unlock()
+
+	resp.Error = 0
+	resp.Response = "ips=" + h.format(ips, func(key string) string { return net.IP(key).String() }) +
+		" peer_ids=" + h.format(peerIDs, func(key string) string { return key })
+
+	return ctx, nil
+}
+
+// format renders entries as a comma-separated list of quoted keys and their
+// counts scaled to all Announces.
+func (h *hook) format(entries []entry, key func(string) string) string {
+	formatted := make([]string, 0, len(entries))
+	for _, e := range entries {
+		count := uint64(math.Round(float64(e.count) / h.cfg.SampleRate))
+		formatted = append(formatted, fmt.Sprintf("%q:%d", key(e.key), count))
+	}
+
+	return strings.Join(formatted, ",")
+}
+
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(chan error)
+	go func() {
+		close(h.closing)
+		close(c)
+	}()
+	return c
+}
@@ -0,0 +1,123 @@
+package toptalkers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func TestNewHook(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{}, nil},
+		{Config{TopN: maxTopN, SampleRate: 0.1}, nil},
+		{Config{TopN: -1}, ErrInvalidTopN},
+		{Config{TopN: maxTopN + 1}, ErrInvalidTopN},
+		{Config{SampleRate: -0.1}, ErrInvalidSampleRate},
+		{Config{SampleRate: 1.1}, ErrInvalidSampleRate},
+	}
+
+	for _, tt := range table {
+		h, err := NewHook(tt.cfg)
+		require.Equal(t, tt.expected, err)
+		if err == nil {
+			<-h.(*hook).Stop()
+		}
+	}
+}
+
+func TestTopK(t *testing.T) {
+	tk := newTopK(3)
+
+	// Three heavy hitters hidden in many keys that occur once.
+	for i := 0; i < 10000; i++ {
+		tk.add(fmt.Sprintf("noise%d", i))
+		switch {
+		case i%10 == 0:
+			tk.add("first")
+		case i%20 == 1:
+			tk.add("second")
+		case i%40 == 2:
+			tk.add("third")
+		}
+	}
+
+	top := tk.top()
+	require.Len(t, top, 3)
+	require.Equal(t, "first", top[0].key)
+	require.Equal(t, "second", top[1].key)
+	require.Equal(t, "third", top[2].key)
+	require.True(t, top[0].count >= 1000)
+
+	// Counts are halved until they vanish.
+	tk.decay()
+	require.Equal(t, top[0].count/2, tk.top()[0].count)
+	for i := 0; i < 32; i++ {
+		tk.decay()
+	}
+	require.Empty(t, tk.top())
+}
+
+func TestHandleApi(t *testing.T) {
+	h, err := NewHook(Config{TopN: 2})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	announce := func(ctx context.Context, id, ip string, n int) {
+		req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{
+			ID: bittorrent.PeerIDFromString(id),
+			IP: bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+		}}
+		for i := 0; i < n; i++ {
+			_, err := h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+			require.Nil(t, err)
+		}
+	}
+	announce(context.Background(), "-TR2940-000000000001", "10.0.0.1", 3)
+	announce(context.Background(), "-TR2940-000000000002", "10.0.0.2", 2)
+
+	// The masked IP is counted if set.
+	masked := bittorrent.IP{IP: net.ParseIP("10.0.1.0").To4(), AddressFamily: bittorrent.IPv4}
+	announce(context.WithValue(context.Background(), middleware.MaskedIPKey, masked), "-TR2940-000000000003", "10.0.1.1", 5)
+
+	resp := &bittorrent.ApiResponse{}
+	_, err = h.HandleApi(context.Background(), &bittorrent.ApiRequest{Method: "top-talkers"}, resp)
+	require.Nil(t, err)
+	require.Equal(t, 0, resp.Error)
+	require.Equal(t, `ips="10.0.1.0":5,"10.0.0.1":3 peer_ids="-TR2940-000000000003":5,"-TR2940-000000000001":3`, resp.Response)
+
+	// Other methods are ignored.
+	resp = &bittorrent.ApiResponse{}
+	_, err = h.HandleApi(context.Background(), &bittorrent.ApiRequest{Method: "stats"}, resp)
+	require.Nil(t, err)
+	require.Equal(t, "", resp.Response)
+}
+
+func TestSampleRate(t *testing.T) {
+	h, err := NewHook(Config{SampleRate: 0.5})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{
+		ID: bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		IP: bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+	}}
+	for i := 0; i < 10000; i++ {
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+	}
+
+	// The scaled count estimates the number of all Announces.
+	top := h.(*hook).ips.top()
+	require.Len(t, top, 1)
+	estimate := float64(top[0].count) / 0.5
+	require.True(t, estimate > 9000 && estimate < 11000)
+}
@@ -0,0 +1,166 @@
+// Package udpsession implements a Hook that detects whether an Announce
+// received via UDP continues the session of the previous Announce of the same
+// peer, based on the connection ID.
+package udpsession
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/expiring"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// defaultConnectionIDTTL matches the default of the UDP frontend.
+const defaultConnectionIDTTL = 2 * time.Minute
+
+// Continuity describes how an Announce relates to the previous Announce of
+// the same peer in a swarm.
+type Continuity int
+
+const (
+	// ContinuityUnknown is the Continuity of Announces of peers whose
+	// previous Announce is unknown or used a connection ID that expired in
+	// the meantime.
+	ContinuityUnknown Continuity = iota
+
+	// ContinuityContinued is the Continuity of Announces that use the same
+	// connection ID as the previous Announce of the peer.
+	ContinuityContinued
+
+	// ContinuityBroken is the Continuity of Announces that use a different
+	// connection ID than the previous Announce of the peer, although that
+	// one is still valid.
+	ContinuityBroken
+)
+
+type continuity struct{}
+
+// ContinuityKey is the key under which the hook stores the Continuity of an
+// Announce received via UDP.
+// The value is of type Continuity. It is not set for other Announces.
+var ContinuityKey = continuity{}
+
+// Config represents the configuration for the udp session middleware.
+type Config struct {
+	// ConnectionIDTTL is the duration a connection ID is valid after it was
+	// issued. It must match the connection_id_ttl of the UDP frontend.
+	// If zero, a default of 2m is used.
+	ConnectionIDTTL time.Duration `yaml:"connection_id_ttl"`
+
+	// FlagBroken specifies whether Announces with ContinuityBroken are
+	// flagged as suspected abuse via middleware.SuspectedAbuseKey.
+	FlagBroken bool `yaml:"flag_broken"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"connectionIDTTL": cfg.ConnectionIDTTL,
+		"flagBroken":      cfg.FlagBroken,
+	}
+}
+
+// peerKey identifies a peer in a swarm.
+type peerKey struct {
+	infoHash bittorrent.InfoHash
+	peerID   bittorrent.PeerID
+}
+
+func (k peerKey) String() string {
+	return string(k.infoHash[:]) + string(k.peerID[:])
+}
+
+type hook struct {
+	cfg Config
+
+	// sessions holds the connection IDs of the previous Announces of the
+	// known peers until they expire.
+	sessions *expiring.Map
+}
+
+// NewHook returns an instance of the udp session middleware.
+//
+// Connection IDs expire after the ConnectionIDTTL, so clients obtain a new
+// one for most Announces. Continuity can therefore only be detected between
+// Announces sent within that window, e.g. a completed event followed by a
+// regular Announce, not across announce intervals.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if cfg.ConnectionIDTTL <= 0 {
+		cfg.ConnectionIDTTL = defaultConnectionIDTTL
+	}
+
+	return &hook{
+		cfg:      cfg,
+		sessions: expiring.New(0, cfg.ConnectionIDTTL),
+	}, nil
+}
+
+// track records connectionID as the current session of the peer identified by
+// k and returns the Continuity to its previous session.
+func (h *hook) track(k peerKey, connectionID []byte, now time.Time) (c Continuity) {
+	var id [8]byte
+	copy(id[:], connectionID)
+
+	// The connection ID starts with the unix time it was issued at.
+	issued := time.Unix(int64(binary.BigEndian.Uint32(connectionID[:4])), 0)
+
+	h.sessions.Update(k.String(), now, func(e expiring.Entry, ok bool) expiring.Entry {
+		switch {
+		case !ok:
+			c = ContinuityUnknown
+		case e.Value.([8]byte) == id:
+			c = ContinuityContinued
+		default:
+			c = ContinuityBroken
+		}
+		return expiring.Entry{Value: id, Expires: issued.Add(h.cfg.ConnectionIDTTL)}
+	})
+	return
+}
+
+// forget removes the peer identified by k from the known peers.
+func (h *hook) forget(k peerKey) {
+	h.sessions.Delete(k.String())
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if len(req.ConnectionID) != 8 {
+		// Not received via UDP.
+		return ctx, nil
+	}
+
+	k := peerKey{req.InfoHash, req.Peer.ID}
+	c := h.track(k, req.ConnectionID, time.Now())
+	if req.Event == bittorrent.Stopped {
+		h.forget(k)
+	}
+
+	ctx = context.WithValue(ctx, ContinuityKey, c)
+	if c == ContinuityBroken && h.cfg.FlagBroken {
+		log.Debug("udp session broken", log.RequestFields(ctx, log.Fields{
+			"infoHash": req.InfoHash,
+			"peerID":   req.Peer.ID,
+		}))
+		ctx = context.WithValue(ctx, middleware.SuspectedAbuseKey, struct{}{})
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't belong to a session.
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are not sent via UDP.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	return h.sessions.Stop()
+}
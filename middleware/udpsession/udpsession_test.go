@@ -0,0 +1,83 @@
+package udpsession
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+// connectionID creates a connection ID issued at the given time, like the UDP
+// frontend does.
+func connectionID(issued time.Time, mac byte) []byte {
+	cid := make([]byte, 8)
+	binary.BigEndian.PutUint32(cid, uint32(issued.Unix()))
+	cid[7] = mac
+	return cid
+}
+
+func announce(event bittorrent.Event, cid []byte) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		InfoHash:     bittorrent.InfoHashFromString("00000000000000000001"),
+		Event:        event,
+		ConnectionID: cid,
+		Peer:         bittorrent.Peer{ID: bittorrent.PeerIDFromString("-TR2940-000000000001")},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{FlagBroken: true})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	now := time.Now()
+	expired := connectionID(now.Add(-3*time.Minute), 1)
+	first := connectionID(now, 2)
+	second := connectionID(now, 3)
+
+	var table = []struct {
+		event    bittorrent.Event
+		cid      []byte
+		expected Continuity
+	}{
+		{bittorrent.Started, expired, ContinuityUnknown},
+		{bittorrent.None, first, ContinuityUnknown},
+		{bittorrent.Completed, first, ContinuityContinued},
+		{bittorrent.None, second, ContinuityBroken},
+
+		// Stopping ends the session.
+		{bittorrent.Stopped, second, ContinuityContinued},
+		{bittorrent.Started, first, ContinuityUnknown},
+	}
+
+	for _, tt := range table {
+		ctx, err := h.HandleAnnounce(context.Background(), announce(tt.event, tt.cid), &bittorrent.AnnounceResponse{})
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, ctx.Value(ContinuityKey))
+		require.Equal(t, tt.expected == ContinuityBroken, ctx.Value(middleware.SuspectedAbuseKey) != nil)
+	}
+
+	// Announces received via HTTP are ignored.
+	ctx, err := h.HandleAnnounce(context.Background(), announce(bittorrent.None, nil), &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Nil(t, ctx.Value(ContinuityKey))
+}
+
+func TestExpiry(t *testing.T) {
+	h, err := NewHook(Config{})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	k := peerKey{bittorrent.InfoHashFromString("00000000000000000001"), bittorrent.PeerIDFromString("-TR2940-000000000001")}
+	now := time.Now()
+	require.Equal(t, ContinuityUnknown, h.(*hook).track(k, connectionID(now, 1), now))
+	require.Equal(t, ContinuityContinued, h.(*hook).track(k, connectionID(now, 1), now.Add(time.Minute)))
+
+	// The session expires with its connection ID.
+	require.Equal(t, ContinuityUnknown, h.(*hook).track(k, connectionID(now, 2), now.Add(3*time.Minute)))
+}
@@ -0,0 +1,264 @@
+// Package useragent implements a Hook that rejects requests whose HTTP
+// User-Agent matches a denylist.
+package useragent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// ErrDeniedUserAgent is returned for requests whose User-Agent is denied.
+var ErrDeniedUserAgent = bittorrent.NewClientError("denied_user_agent", "user agent is not allowed")
+
+// ErrNoDenylist is returned for a config without any substrings, patterns
+// or denylist file.
+var ErrNoDenylist = errors.New("no substrings, patterns or denylist_file configured")
+
+// Config represents the configuration for the user agent denylist
+// middleware.
+type Config struct {
+	// Substrings are substrings of denied User-Agents.
+	Substrings []string `yaml:"substrings"`
+
+	// Patterns are regular expressions matching denied User-Agents.
+	Patterns []string `yaml:"patterns"`
+
+	// DenylistFile is the path to a file containing one substring per
+	// line. Lines enclosed in slashes are regular expressions. Empty lines
+	// and lines starting with # are ignored.
+	DenylistFile string `yaml:"denylist_file"`
+
+	// ReloadInterval is the interval in which DenylistFile is checked for
+	// modifications and reloaded. Zero disables reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	SoftReject middleware.SoftRejectConfig `yaml:"soft_reject"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"substrings":     len(cfg.Substrings),
+		"patterns":       len(cfg.Patterns),
+		"denylistFile":   cfg.DenylistFile,
+		"reloadInterval": cfg.ReloadInterval,
+		"softReject":     cfg.SoftReject.Enabled,
+	}
+}
+
+// denylist holds the substrings and patterns of denied User-Agents.
+type denylist struct {
+	substrings []string
+	patterns   []*regexp.Regexp
+}
+
+// insert adds an entry of the denylist file to d.
+func (d *denylist) insert(entry string) error {
+	if len(entry) < 2 || !strings.HasPrefix(entry, "/") || !strings.HasSuffix(entry, "/") {
+		d.substrings = append(d.substrings, entry)
+		return nil
+	}
+
+	return d.insertPattern(entry[1 : len(entry)-1])
+}
+
+func (d *denylist) insertPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return errors.New("invalid pattern " + pattern + ": " + err.Error())
+	}
+	d.patterns = append(d.patterns, re)
+	return nil
+}
+
+func (d *denylist) denies(userAgent string) bool {
+	for _, substring := range d.substrings {
+		if strings.Contains(userAgent, substring) {
+			return true
+		}
+	}
+	for _, re := range d.patterns {
+		if re.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+type hook struct {
+	cfg      Config
+	denylist atomic.Value // *denylist
+	modTime  time.Time
+	closing  chan struct{}
+}
+
+// NewHook returns an instance of the user agent denylist middleware.
+//
+// Only requests received by the HTTP frontend carry a User-Agent. Requests
+// without one are never denied.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	if len(cfg.Substrings) == 0 && len(cfg.Patterns) == 0 && cfg.DenylistFile == "" {
+		return nil, ErrNoDenylist
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+
+	if cfg.DenylistFile != "" && cfg.ReloadInterval > 0 {
+		go func() {
+			for {
+				select {
+				case <-h.closing:
+					return
+				case <-time.After(cfg.ReloadInterval):
+					if err := h.reload(); err != nil {
+						log.Error("failed to reload user agent denylist", log.Err(err))
+					}
+				}
+			}
+		}()
+	}
+
+	return h, nil
+}
+
+// load builds a new denylist from the configured substrings, patterns and the
+// denylist file and replaces the current denylist with it.
+func (h *hook) load() error {
+	d := &denylist{substrings: append([]string(nil), h.cfg.Substrings...)}
+
+	for _, pattern := range h.cfg.Patterns {
+		if err := d.insertPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	if h.cfg.DenylistFile != "" {
+		f, err := os.Open(h.cfg.DenylistFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		if err := parseDenylist(f, d); err != nil {
+			return err
+		}
+		h.modTime = fi.ModTime()
+	}
+
+	h.denylist.Store(d)
+	log.Debug("loaded user agent denylist", log.Fields{
+		"substrings": len(d.substrings),
+		"patterns":   len(d.patterns),
+	})
+
+	return nil
+}
+
+// reload loads the denylist again if the denylist file was modified.
+//
+// If the new denylist is invalid, the current denylist is kept.
+func (h *hook) reload() error {
+	fi, err := os.Stat(h.cfg.DenylistFile)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	return h.load()
+}
+
+func parseDenylist(r io.Reader, d *denylist) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := d.insert(line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// denied reports whether the request of ctx has a denied User-Agent.
+func (h *hook) denied(ctx context.Context) bool {
+	userAgent, ok := frontend.UserAgent(ctx)
+	if !ok {
+		return false
+	}
+
+	if !h.denylist.Load().(*denylist).denies(userAgent) {
+		return false
+	}
+
+	log.Debug("denied user agent", log.RequestFields(ctx, log.Fields{
+		"userAgent": userAgent,
+	}))
+	return true
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.denied(ctx) {
+		return h.cfg.SoftReject.Reject(ctx, resp, ErrDeniedUserAgent)
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.denied(ctx) {
+		return ctx, ErrDeniedUserAgent
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleApi(ctx context.Context, req *bittorrent.ApiRequest, resp *bittorrent.ApiResponse) (context.Context, error) {
+	// Api requests are authenticated.
+	return ctx, nil
+}
+
+func (h *hook) Stop() <-chan error {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(chan error)
+	go func() {
+		close(h.closing)
+		close(c)
+	}()
+	return c
+}
@@ -0,0 +1,94 @@
+package useragent
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func withUserAgent(userAgent string) context.Context {
+	return context.WithValue(context.Background(), frontend.UserAgentKey, userAgent)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrNoDenylist, err)
+
+	_, err = NewHook(Config{Patterns: []string{"("}})
+	require.NotNil(t, err)
+
+	h, err := NewHook(Config{Substrings: []string{"Mozilla/"}, Patterns: []string{`^curl/\d`}})
+	require.Nil(t, err)
+
+	var table = []struct {
+		ctx      context.Context
+		expected error
+	}{
+		{withUserAgent("Mozilla/5.0 (X11; Linux x86_64)"), ErrDeniedUserAgent},
+		{withUserAgent("curl/7.58.0"), ErrDeniedUserAgent},
+		{withUserAgent("Transmission/2.94"), nil},
+		{withUserAgent("libcurl/7.58.0"), nil},
+
+		// Requests without a User-Agent, e.g. via UDP, are never denied.
+		{context.Background(), nil},
+	}
+
+	for _, tt := range table {
+		_, err = h.HandleAnnounce(tt.ctx, &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err)
+		_, err = h.HandleScrape(tt.ctx, &bittorrent.ScrapeRequest{}, &bittorrent.ScrapeResponse{})
+		require.Equal(t, tt.expected, err)
+	}
+
+	h, err = NewHook(Config{
+		Substrings: []string{"Mozilla/"},
+		SoftReject: middleware.SoftRejectConfig{Enabled: true},
+	})
+	require.Nil(t, err)
+
+	ctx, err := h.HandleAnnounce(withUserAgent("Mozilla/5.0"), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.NotNil(t, ctx.Value(middleware.SkipSwarmInteractionKey))
+}
+
+func TestReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "useragent")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("# comment\n\nMozilla/\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	h, err := NewHook(Config{DenylistFile: f.Name()})
+	require.Nil(t, err)
+	defer func() { <-h.(*hook).Stop() }()
+
+	_, err = h.HandleAnnounce(withUserAgent("Mozilla/5.0"), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrDeniedUserAgent, err)
+
+	require.Nil(t, ioutil.WriteFile(f.Name(), []byte("/^Bad(Client|Bot)/\n"), 0644))
+	require.Nil(t, os.Chtimes(f.Name(), time.Now(), time.Now().Add(time.Minute)))
+	require.Nil(t, h.(*hook).reload())
+
+	_, err = h.HandleAnnounce(withUserAgent("Mozilla/5.0"), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(withUserAgent("BadBot/1.0"), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrDeniedUserAgent, err)
+
+	// Invalid files keep the current denylist.
+	require.Nil(t, ioutil.WriteFile(f.Name(), []byte("/(/\n"), 0644))
+	require.Nil(t, os.Chtimes(f.Name(), time.Now(), time.Now().Add(2*time.Minute)))
+	require.NotNil(t, h.(*hook).reload())
+
+	_, err = h.HandleAnnounce(withUserAgent("BadBot/1.0"), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrDeniedUserAgent, err)
+}
@@ -0,0 +1,124 @@
+// Package load implements a process-wide signal of how close the tracker is
+// to its concurrency limits.
+//
+// Frontends limit the number of requests they process concurrently using a
+// Limiter. Every Limiter is registered with this package until it is
+// unregistered, so that middleware can adapt its behavior to the current load
+// via Level.
+package load
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	limitersM sync.RWMutex
+	limiters  []*Limiter
+)
+
+// Limiter limits the number of concurrently processed requests.
+//
+// A nil *Limiter allows any number of concurrent requests and always reports
+// a Level of zero.
+type Limiter struct {
+	// inFlight must be accessed atomically!
+	inFlight int64
+	capacity int64
+}
+
+// NewLimiter creates and registers a Limiter that allows up to capacity
+// concurrent requests.
+//
+// If capacity is lower than one, no limit is enforced and nil is returned.
+func NewLimiter(capacity int) *Limiter {
+	if capacity < 1 {
+		return nil
+	}
+
+	l := &Limiter{capacity: int64(capacity)}
+
+	limitersM.Lock()
+	limiters = append(limiters, l)
+	limitersM.Unlock()
+
+	return l
+}
+
+// Unregister removes l from the Limiters considered by Level, e.g. when the
+// frontend owning it stops.
+func (l *Limiter) Unregister() {
+	if l == nil {
+		return
+	}
+
+	limitersM.Lock()
+	defer limitersM.Unlock()
+
+	for i, other := range limiters {
+		if other == l {
+			limiters = append(limiters[:i], limiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Acquire reports whether another request may be processed and reserves a
+// slot for it if so.
+//
+// Every successful call to Acquire must be followed by a call to Release.
+func (l *Limiter) Acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	if atomic.AddInt64(&l.inFlight, 1) > l.capacity {
+		atomic.AddInt64(&l.inFlight, -1)
+		return false
+	}
+
+	return true
+}
+
+// Release frees a slot reserved by Acquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+
+	atomic.AddInt64(&l.inFlight, -1)
+}
+
+// Level returns the fraction of the capacity of the Limiter that is currently
+// in use, ranging from 0 to 1.
+func (l *Limiter) Level() float64 {
+	if l == nil {
+		return 0
+	}
+
+	inFlight := atomic.LoadInt64(&l.inFlight)
+	if inFlight <= 0 {
+		return 0
+	}
+	if inFlight >= l.capacity {
+		return 1
+	}
+
+	return float64(inFlight) / float64(l.capacity)
+}
+
+// Level returns the highest Level of all registered Limiters.
+//
+// If no Limiters are registered, it returns zero.
+func Level() (level float64) {
+	limitersM.RLock()
+	defer limitersM.RUnlock()
+
+	for _, l := range limiters {
+		if lvl := l.Level(); lvl > level {
+			level = lvl
+		}
+	}
+
+	return
+}
@@ -0,0 +1,41 @@
+package load
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	require.Nil(t, NewLimiter(0))
+	require.True(t, l.Acquire())
+	l.Release()
+	require.Equal(t, float64(0), l.Level())
+	l.Unregister()
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(4)
+
+	for i := 0; i < 4; i++ {
+		require.True(t, l.Acquire())
+	}
+	require.False(t, l.Acquire())
+	require.Equal(t, float64(1), l.Level())
+	require.Equal(t, float64(1), Level())
+
+	l.Release()
+	l.Release()
+	require.Equal(t, 0.5, l.Level())
+	require.True(t, Level() >= 0.5)
+
+	l.Release()
+	l.Release()
+	require.Equal(t, float64(0), l.Level())
+
+	// Unregistered Limiters don't count.
+	require.True(t, l.Acquire())
+	l.Unregister()
+	require.Equal(t, float64(0), Level())
+}
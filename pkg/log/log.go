@@ -18,6 +18,13 @@ func SetDebug(to bool) {
 	debug = to
 }
 
+// DebugEnabled reports whether debug logging is enabled.
+//
+// It can be used to avoid building expensive Fields that would be discarded.
+func DebugEnabled() bool {
+	return debug
+}
+
 // SetFormatter sets the formatter.
 func SetFormatter(to logrus.Formatter) {
 	l.Formatter = to
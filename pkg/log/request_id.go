@@ -0,0 +1,62 @@
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+type requestIDKey struct{}
+
+// RequestIDKey is the key under which frontends store the ID of a request in
+// its context, so that log lines of the frontend and all hooks handling the
+// request can be correlated.
+// The value is expected to be of type string.
+var RequestIDKey = requestIDKey{}
+
+var (
+	// requestIDPrefix distinguishes the request IDs of different processes.
+	requestIDPrefix uint32
+
+	// requestIDCounter must be accessed atomically!
+	requestIDCounter uint64
+)
+
+func init() {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	requestIDPrefix = binary.BigEndian.Uint32(b[:])
+}
+
+// WithRequestID returns a copy of ctx tagged with a new, unique request ID.
+func WithRequestID(ctx context.Context) context.Context {
+	id := fmt.Sprintf("%08x%08x", requestIDPrefix, atomic.AddUint64(&requestIDCounter, 1))
+	return context.WithValue(ctx, RequestIDKey, id)
+}
+
+// RequestID returns the ID of a request from its context, if any.
+func RequestID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(RequestIDKey).(string)
+	return id, ok
+}
+
+// RequestFields returns the Fields of f, which may be nil, with the ID of the
+// request added, if any.
+func RequestFields(ctx context.Context, f Fielder) Fields {
+	fields := Fields{}
+	if f != nil {
+		for k, v := range f.LogFields() {
+			fields[k] = v
+		}
+	}
+
+	if id, ok := RequestID(ctx); ok {
+		fields["requestID"] = id
+	}
+
+	return fields
+}
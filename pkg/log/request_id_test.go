@@ -0,0 +1,25 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestID(t *testing.T) {
+	_, ok := RequestID(context.Background())
+	require.False(t, ok)
+	require.Equal(t, Fields{}, RequestFields(context.Background(), nil))
+
+	first, ok := RequestID(WithRequestID(context.Background()))
+	require.True(t, ok)
+	require.Len(t, first, 16)
+
+	ctx := WithRequestID(context.Background())
+	second, _ := RequestID(ctx)
+	require.NotEqual(t, first, second)
+
+	require.Equal(t, Fields{"error": "failed", "requestID": second}, RequestFields(ctx, Err(errors.New("failed"))))
+}
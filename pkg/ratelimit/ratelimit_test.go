@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowAt(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := New(10, 5)
+
+	for i := 0; i < 5; i++ {
+		require.True(t, l.AllowAt(now), "burst should be allowed")
+	}
+	require.False(t, l.AllowAt(now), "burst should be exhausted")
+
+	// 100ms refill a single token.
+	now = now.Add(100 * time.Millisecond)
+	require.True(t, l.AllowAt(now))
+	require.False(t, l.AllowAt(now))
+
+	// Tokens never exceed the burst size.
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		require.True(t, l.AllowAt(now))
+	}
+	require.False(t, l.AllowAt(now))
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	require.True(t, l.Allow())
+}
+
+func BenchmarkAllow(b *testing.B) {
+	l := New(1e9, 1e9)
+	for i := 0; i < b.N; i++ {
+		l.Allow()
+	}
+}
@@ -0,0 +1,190 @@
+// Package schedule implements schedules of recurring jobs in a subset of the
+// crontab format.
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxYears is the number of years Next searches for a matching time, so that
+// schedules that never match, e.g. on February 30th, terminate.
+const maxYears = 5
+
+// descriptors are the supported shorthands for common schedules.
+var descriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// field is the range of the values of a field of a schedule.
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = [5]field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Schedule is a set of recurring times in the local time zone.
+type Schedule struct {
+	// minute, hour, dom, month and dow are bit sets of the matching
+	// values of their field.
+	minute, hour, dom, month, dow uint64
+
+	// anyDay is set if either the day of month or the day of week is
+	// unrestricted, in which case a day must match both of them.
+	// Otherwise, it must match either of them.
+	anyDay bool
+}
+
+// Parse parses a schedule in the crontab format of five fields separated by
+// whitespace: minute, hour, day of month, month and day of week, where both
+// 0 and 7 are Sunday.
+//
+// A field is a comma-separated list of values, ranges "a-b" and "*", each of
+// which may be followed by a step "/n", e.g. "*/15" or "1-5". Names of months
+// and days of week are not supported.
+//
+// The descriptors @hourly, @daily, @weekly and @monthly are accepted as well.
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := descriptors[spec]; ok {
+		spec = d
+	}
+
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, errors.New("schedule must have 5 fields: " + spec)
+	}
+
+	var sets [5]uint64
+	for i, part := range parts {
+		set, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	// Sunday is both 0 and 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &Schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDay: strings.HasPrefix(parts[2], "*") || strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// parseField parses the value of a field into the bit set of its matching
+// values.
+func parseField(s string, f field) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(s, ",") {
+		invalid := errors.New("invalid " + f.name + " in schedule: " + item)
+
+		step := 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step < 1 {
+				return 0, invalid
+			}
+			item = item[:i]
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case item == "*":
+		case strings.IndexByte(item, '-') >= 0:
+			i := strings.IndexByte(item, '-')
+			var err error
+			if low, err = strconv.Atoi(item[:i]); err != nil {
+				return 0, invalid
+			}
+			if high, err = strconv.Atoi(item[i+1:]); err != nil {
+				return 0, invalid
+			}
+		default:
+			var err error
+			if low, err = strconv.Atoi(item); err != nil {
+				return 0, invalid
+			}
+			high = low
+			if step > 1 {
+				high = f.max
+			}
+		}
+
+		if low < f.min || high > f.max || low > high {
+			return 0, invalid
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// matchesDay reports whether the day of t matches s.
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time of s after t, truncated to the minute.
+//
+// If s matches no time within the next five years, Next returns the zero
+// time.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := t.Year() + maxYears
+
+	for t.Year() <= limit {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,72 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{
+		"* * * * *",
+		"0 4 * * *",
+		"*/15 1-5 * * 1-5",
+		"0,30 2 1,15 */2 7",
+		"5/10 * * * *",
+		"@daily",
+	} {
+		_, err := Parse(spec)
+		require.Nil(t, err, spec)
+	}
+
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@yearly",
+	} {
+		_, err := Parse(spec)
+		require.NotNil(t, err, spec)
+	}
+}
+
+func TestNext(t *testing.T) {
+	// 2018-03-14 is a Wednesday.
+	now := time.Date(2018, 3, 14, 10, 30, 15, 0, time.UTC)
+
+	var table = []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2018, 3, 14, 10, 31, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2018, 3, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 4 * * *", time.Date(2018, 3, 15, 4, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2018, 3, 14, 10, 40, 0, 0, time.UTC)},
+		{"0 3 * * 0", time.Date(2018, 3, 18, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2018, 3, 18, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2018, 3, 14, 11, 0, 0, 0, time.UTC)},
+
+		// Restricting both days matches either of them.
+		{"0 0 20 * 5", time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC)},
+
+		// Schedules that never match return the zero time.
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tt := range table {
+		s, err := Parse(tt.spec)
+		require.Nil(t, err, tt.spec)
+		require.Equal(t, tt.next, s.Next(now), tt.spec)
+	}
+}
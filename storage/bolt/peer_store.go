@@ -0,0 +1,946 @@
+// Package bolt implements the storage interface for a Chihaya BitTorrent
+// tracker keeping peer data in an embedded bbolt database, so that swarms
+// survive restarts of single-node deployments.
+package bolt
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	bbolt "github.com/coreos/bbolt"
+	"gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Name is the name by which this peer store is registered with Chihaya.
+const Name = "bolt"
+
+// Default config constants.
+const (
+	defaultPrometheusReportingInterval = time.Second * 10
+	defaultGarbageCollectionInterval   = time.Minute * 3
+	defaultPeerLifetime                = time.Minute * 30
+	defaultBatchSize                   = 1000
+	defaultBatchDelay                  = time.Millisecond * 10
+	defaultOpenTimeout                 = time.Second * 1
+
+	// gcBatchSize is the number of swarms swept per transaction by the
+	// garbage collection, so that writes are not blocked for long.
+	gcBatchSize = 256
+)
+
+// ErrMissingPath is returned for a config without a Path.
+var ErrMissingPath = errors.New("path must be set")
+
+// ErrMalformedPeerKey is returned for a key in a swarm that does not encode a
+// peer, e.g. because the database was modified by another program.
+var ErrMalformedPeerKey = errors.New("malformed peer key")
+
+// countsKey is the key of the peer counts in the bucket of a swarm.
+var countsKey = []byte("counts")
+
+// peerBuckets are the names of the buckets holding the peers of a swarm,
+// indexed by role and address family, see peerBucket.
+var peerBuckets = [4][]byte{
+	[]byte("seeders4"),
+	[]byte("leechers4"),
+	[]byte("seeders6"),
+	[]byte("leechers6"),
+}
+
+func init() {
+	// Register the storage driver.
+	storage.RegisterDriver(Name, driver{})
+}
+
+type driver struct{}
+
+func (d driver) NewPeerStore(icfg interface{}) (storage.PeerStore, error) {
+	// Marshal the config back into bytes.
+	bytes, err := yaml.Marshal(icfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal the bytes into the proper config type.
+	var cfg Config
+	err = yaml.Unmarshal(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(cfg)
+}
+
+// Config holds the configuration of a bolt PeerStore.
+type Config struct {
+	// Path is the path of the database file, which is created if it does
+	// not exist.
+	Path string `yaml:"path"`
+
+	GarbageCollectionInterval   time.Duration `yaml:"gc_interval"`
+	PrometheusReportingInterval time.Duration `yaml:"prometheus_reporting_interval"`
+	PeerLifetime                time.Duration `yaml:"peer_lifetime"`
+
+	// BatchSize is the maximum number of writes combined into a single
+	// transaction.
+	BatchSize int `yaml:"batch_size"`
+
+	// BatchDelay is the maximum duration a write waits for others to be
+	// combined with. Longer delays sync the disk less often.
+	BatchDelay time.Duration `yaml:"batch_delay"`
+
+	// NoSync skips syncing the database file after every transaction,
+	// which is faster on slow disks, but may lose the latest writes or
+	// corrupt the database on a crash of the host.
+	NoSync bool `yaml:"no_sync"`
+
+	// OpenTimeout is the maximum duration to wait for the lock of the
+	// database file, which is held by another process using it.
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"name":               Name,
+		"path":               cfg.Path,
+		"gcInterval":         cfg.GarbageCollectionInterval,
+		"promReportInterval": cfg.PrometheusReportingInterval,
+		"peerLifetime":       cfg.PeerLifetime,
+		"batchSize":          cfg.BatchSize,
+		"batchDelay":         cfg.BatchDelay,
+		"noSync":             cfg.NoSync,
+		"openTimeout":        cfg.OpenTimeout,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.GarbageCollectionInterval <= 0 {
+		validcfg.GarbageCollectionInterval = defaultGarbageCollectionInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GarbageCollectionInterval",
+			"provided": cfg.GarbageCollectionInterval,
+			"default":  validcfg.GarbageCollectionInterval,
+		})
+	}
+
+	if cfg.PrometheusReportingInterval <= 0 {
+		validcfg.PrometheusReportingInterval = defaultPrometheusReportingInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PrometheusReportingInterval",
+			"provided": cfg.PrometheusReportingInterval,
+			"default":  validcfg.PrometheusReportingInterval,
+		})
+	}
+
+	if cfg.PeerLifetime <= 0 {
+		validcfg.PeerLifetime = defaultPeerLifetime
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".PeerLifetime",
+			"provided": cfg.PeerLifetime,
+			"default":  validcfg.PeerLifetime,
+		})
+	}
+
+	if cfg.BatchSize <= 0 {
+		validcfg.BatchSize = defaultBatchSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".BatchSize",
+			"provided": cfg.BatchSize,
+			"default":  validcfg.BatchSize,
+		})
+	}
+
+	if cfg.BatchDelay <= 0 {
+		validcfg.BatchDelay = defaultBatchDelay
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".BatchDelay",
+			"provided": cfg.BatchDelay,
+			"default":  validcfg.BatchDelay,
+		})
+	}
+
+	if cfg.OpenTimeout <= 0 {
+		validcfg.OpenTimeout = defaultOpenTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".OpenTimeout",
+			"provided": cfg.OpenTimeout,
+			"default":  validcfg.OpenTimeout,
+		})
+	}
+
+	return validcfg
+}
+
+// New creates a new PeerStore backed by the bbolt database at the configured
+// path.
+//
+// Peers that expired while the tracker was not running are removed before New
+// returns.
+func New(provided Config) (storage.PeerStore, error) {
+	if provided.Path == "" {
+		return nil, ErrMissingPath
+	}
+
+	cfg := provided.Validate()
+	db, err := openDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &peerStore{
+		cfg:    cfg,
+		db:     db,
+		closed: make(chan struct{}),
+	}
+
+	if err := ps.collectGarbage(time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Start a goroutine for garbage collection.
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		for {
+			select {
+			case <-ps.closed:
+				return
+			case <-time.After(cfg.GarbageCollectionInterval):
+				now := time.Now()
+				log.Debug("storage: purging expired peers", log.Fields{"now": now})
+				if err := ps.collectGarbage(now); err != nil {
+					log.Error("storage: failed to purge expired peers", log.Err(err))
+				}
+			}
+		}
+	}()
+
+	// Start a goroutine for reporting statistics to Prometheus.
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		t := time.NewTicker(cfg.PrometheusReportingInterval)
+		for {
+			select {
+			case <-ps.closed:
+				t.Stop()
+				return
+			case <-t.C:
+				before := time.Now()
+				ps.populateProm()
+				log.Debug("storage: populateProm() finished", log.Fields{"timeTaken": time.Since(before)})
+			}
+		}
+	}()
+
+	return ps, nil
+}
+
+// openDB opens the database at the configured path.
+func openDB(cfg Config) (*bbolt.DB, error) {
+	db, err := bbolt.Open(cfg.Path, 0600, &bbolt.Options{Timeout: cfg.OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = cfg.NoSync
+	db.MaxBatchSize = cfg.BatchSize
+	db.MaxBatchDelay = cfg.BatchDelay
+	return db, nil
+}
+
+// newPeerKey encodes a Peer as the key of its entry in a swarm.
+func newPeerKey(p bittorrent.Peer) []byte {
+	b := make([]byte, 20+2+len(p.IP.IP))
+	copy(b[:20], p.ID[:])
+	binary.BigEndian.PutUint16(b[20:22], p.Port)
+	copy(b[22:], p.IP.IP)
+
+	return b
+}
+
+// decodePeerKey decodes the key of an entry in a swarm, see newPeerKey.
+func decodePeerKey(pk []byte) (bittorrent.Peer, error) {
+	if len(pk) != 20+2+net.IPv4len && len(pk) != 20+2+net.IPv6len {
+		return bittorrent.Peer{}, ErrMalformedPeerKey
+	}
+
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromBytes(pk[:20]),
+		Port: binary.BigEndian.Uint16(pk[20:22]),
+		IP:   bittorrent.IP{IP: net.IP(append([]byte(nil), pk[22:]...))}}
+
+	if ip := peer.IP.To4(); ip != nil {
+		peer.IP.IP = ip
+		peer.IP.AddressFamily = bittorrent.IPv4
+	} else {
+		peer.IP.AddressFamily = bittorrent.IPv6
+	}
+
+	return peer, nil
+}
+
+// peerBucket returns the index of the bucket of peerBuckets and of the count
+// holding the peers of the given role and address family.
+func peerBucket(seeder bool, af bittorrent.AddressFamily) int {
+	i := 1
+	if seeder {
+		i = 0
+	}
+	if af == bittorrent.IPv6 {
+		i += 2
+	}
+	return i
+}
+
+// counts are the numbers of peers in the buckets of a swarm, indexed like
+// peerBuckets.
+type counts [4]uint32
+
+func readCounts(swarm *bbolt.Bucket) (c counts) {
+	v := swarm.Get(countsKey)
+	if len(v) != 16 {
+		return
+	}
+	for i := range c {
+		c[i] = binary.BigEndian.Uint32(v[i*4:])
+	}
+	return
+}
+
+func (c counts) empty() bool {
+	return c == counts{}
+}
+
+func (c counts) bytes() []byte {
+	b := make([]byte, 16)
+	for i, n := range c {
+		binary.BigEndian.PutUint32(b[i*4:], n)
+	}
+	return b
+}
+
+type peerStore struct {
+	cfg Config
+
+	// db is replaced by Compact, so it must only be used while holding
+	// dbM, see view, update and batch.
+	db  *bbolt.DB
+	dbM sync.RWMutex
+	// writeM is held by Compact while copying the database, so that writes
+	// block, but reads continue on the old database until it is replaced.
+	writeM sync.RWMutex
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+var (
+	_ storage.PeerStore           = &peerStore{}
+	_ storage.CompactionStore     = &peerStore{}
+	_ storage.FallibleScrapeStore = &peerStore{}
+)
+
+// view runs fn in a read-only transaction of the database.
+func (ps *peerStore) view(fn func(*bbolt.Tx) error) error {
+	ps.dbM.RLock()
+	defer ps.dbM.RUnlock()
+	return ps.db.View(fn)
+}
+
+// update runs fn in a read-write transaction of the database.
+func (ps *peerStore) update(fn func(*bbolt.Tx) error) error {
+	ps.writeM.RLock()
+	defer ps.writeM.RUnlock()
+	ps.dbM.RLock()
+	defer ps.dbM.RUnlock()
+	return ps.db.Update(fn)
+}
+
+// batch runs fn in a read-write transaction of the database that may be
+// combined with concurrent ones.
+func (ps *peerStore) batch(fn func(*bbolt.Tx) error) error {
+	ps.writeM.RLock()
+	defer ps.writeM.RUnlock()
+	ps.dbM.RLock()
+	defer ps.dbM.RUnlock()
+	return ps.db.Batch(fn)
+}
+
+// populateProm aggregates metrics over all swarms and then posts them to
+// prometheus.
+func (ps *peerStore) populateProm() {
+	var numInfohashes uint64
+	var total counts
+
+	err := ps.view(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(_ []byte, swarm *bbolt.Bucket) error {
+			numInfohashes++
+			c := readCounts(swarm)
+			for i := range total {
+				total[i] += c[i]
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error("storage: failed to collect metrics", log.Err(err))
+		return
+	}
+
+	storage.PromInfohashesCount.Set(float64(numInfohashes))
+	storage.PromSeedersCount.Set(float64(total[0] + total[2]))
+	storage.PromLeechersCount.Set(float64(total[1] + total[3]))
+	for af, label := range map[bittorrent.AddressFamily]string{bittorrent.IPv4: "IPv4", bittorrent.IPv6: "IPv6"} {
+		storage.PromPeersCount.WithLabelValues(label, "seeder").Set(float64(total[peerBucket(true, af)]))
+		storage.PromPeersCount.WithLabelValues(label, "leecher").Set(float64(total[peerBucket(false, af)]))
+	}
+}
+
+func (ps *peerStore) expires() []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Add(ps.cfg.PeerLifetime).UnixNano()))
+	return b
+}
+
+// put stores p in the bucket i of the swarm identified by ih.
+func put(tx *bbolt.Tx, ih bittorrent.InfoHash, i int, p bittorrent.Peer, expires []byte) error {
+	swarm, err := tx.CreateBucketIfNotExists(ih[:])
+	if err != nil {
+		return err
+	}
+	peers, err := swarm.CreateBucketIfNotExists(peerBuckets[i])
+	if err != nil {
+		return err
+	}
+
+	pk := newPeerKey(p)
+	if peers.Get(pk) == nil {
+		c := readCounts(swarm)
+		c[i]++
+		if err := swarm.Put(countsKey, c.bytes()); err != nil {
+			return err
+		}
+	}
+
+	return peers.Put(pk, expires)
+}
+
+// remove deletes p from the bucket i of the swarm identified by ih and
+// reports whether it was present.
+//
+// Swarms without peers are deleted.
+func remove(tx *bbolt.Tx, ih bittorrent.InfoHash, i int, p bittorrent.Peer) (bool, error) {
+	swarm := tx.Bucket(ih[:])
+	if swarm == nil {
+		return false, nil
+	}
+	peers := swarm.Bucket(peerBuckets[i])
+	if peers == nil {
+		return false, nil
+	}
+
+	pk := newPeerKey(p)
+	if peers.Get(pk) == nil {
+		return false, nil
+	}
+	if err := peers.Delete(pk); err != nil {
+		return false, err
+	}
+
+	c := readCounts(swarm)
+	c[i]--
+	if c.empty() {
+		return true, tx.DeleteBucket(ih[:])
+	}
+	return true, swarm.Put(countsKey, c.bytes())
+}
+
+func (ps *peerStore) checkClosed() {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped bolt store")
+	default:
+	}
+}
+
+// putPeer stores p with the given role.
+//
+// Writes of concurrent announces are combined into a single transaction.
+func (ps *peerStore) putPeer(ih bittorrent.InfoHash, p bittorrent.Peer, seeder bool) error {
+	ps.checkClosed()
+
+	expires := ps.expires()
+	return ps.batch(func(tx *bbolt.Tx) error {
+		return put(tx, ih, peerBucket(seeder, p.IP.AddressFamily), p, expires)
+	})
+}
+
+// deletePeer removes p with the given role.
+func (ps *peerStore) deletePeer(ih bittorrent.InfoHash, p bittorrent.Peer, seeder bool) error {
+	ps.checkClosed()
+
+	// A failing function would be retried outside of the batch, so a
+	// missing peer is not reported as an error of the transaction.
+	var found bool
+	err := ps.batch(func(tx *bbolt.Tx) (err error) {
+		found, err = remove(tx, ih, peerBucket(seeder, p.IP.AddressFamily), p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return storage.ErrResourceDoesNotExist
+	}
+	return nil
+}
+
+func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.putPeer(ih, p, true)
+}
+
+func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.deletePeer(ih, p, true)
+}
+
+func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.putPeer(ih, p, false)
+}
+
+func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.deletePeer(ih, p, false)
+}
+
+func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	ps.checkClosed()
+
+	expires := ps.expires()
+	return ps.batch(func(tx *bbolt.Tx) error {
+		if _, err := remove(tx, ih, peerBucket(false, p.IP.AddressFamily), p); err != nil {
+			return err
+		}
+		return put(tx, ih, peerBucket(true, p.IP.AddressFamily), p, expires)
+	})
+}
+
+// appendPeers appends up to numWant unexpired peers of bucket to peers,
+// skipping the announcer.
+//
+// The peers are read starting at a random position, so that all peers of
+// large swarms are handed out, not only those with the lowest keys.
+func appendPeers(peers []bittorrent.Peer, bucket *bbolt.Bucket, numWant int, announcer []byte, now uint64) []bittorrent.Peer {
+	if bucket == nil {
+		return peers
+	}
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, rand.Uint64())
+
+	c := bucket.Cursor()
+	wrapped := false
+	for k, v := c.Seek(start); numWant > 0; k, v = c.Next() {
+		if k == nil {
+			if wrapped {
+				break
+			}
+			wrapped = true
+			k, v = c.First()
+			if k == nil {
+				break
+			}
+		}
+		if wrapped && string(k) >= string(start) {
+			break
+		}
+
+		if string(k) == string(announcer) || binary.BigEndian.Uint64(v) <= now {
+			continue
+		}
+
+		peer, err := decodePeerKey(k)
+		if err != nil {
+			log.Warn("storage: skipping malformed peer", log.Fields{"key": k}, log.Err(err))
+			continue
+		}
+
+		peers = append(peers, peer)
+		numWant--
+	}
+
+	return peers
+}
+
+func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	ps.checkClosed()
+
+	af := announcer.IP.AddressFamily
+	announcerPK := newPeerKey(announcer)
+	now := uint64(time.Now().UnixNano())
+
+	err = ps.view(func(tx *bbolt.Tx) error {
+		swarm := tx.Bucket(ih[:])
+		if swarm == nil {
+			return storage.ErrResourceDoesNotExist
+		}
+
+		if seeder {
+			// Append leechers as possible.
+			peers = appendPeers(peers, swarm.Bucket(peerBuckets[peerBucket(false, af)]), numWant, announcerPK, now)
+			return nil
+		}
+
+		// Append as many seeders as possible, then leechers until we
+		// reach numWant.
+		peers = appendPeers(peers, swarm.Bucket(peerBuckets[peerBucket(true, af)]), numWant, announcerPK, now)
+		peers = appendPeers(peers, swarm.Bucket(peerBuckets[peerBucket(false, af)]), numWant-len(peers), announcerPK, now)
+		return nil
+	})
+
+	return
+}
+
+func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) bittorrent.Scrape {
+	resp, err := ps.TryScrapeSwarm(ih, addressFamily)
+	if err != nil {
+		log.Error("storage: failed to scrape swarm", log.Fields{"infoHash": ih}, log.Err(err))
+	}
+
+	return resp
+}
+
+func (ps *peerStore) TryScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (resp bittorrent.Scrape, err error) {
+	ps.checkClosed()
+
+	resp.InfoHash = ih
+	err = ps.view(func(tx *bbolt.Tx) error {
+		swarm := tx.Bucket(ih[:])
+		if swarm == nil {
+			return nil
+		}
+
+		c := readCounts(swarm)
+		resp.Complete = c[peerBucket(true, addressFamily)]
+		resp.Incomplete = c[peerBucket(false, addressFamily)]
+		return nil
+	})
+	if err != nil {
+		return bittorrent.Scrape{InfoHash: ih}, err
+	}
+
+	return
+}
+
+func (ps *peerStore) DeleteInfoHash(ih bittorrent.InfoHash) error {
+	ps.checkClosed()
+
+	return ps.batch(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket(ih[:]); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// collectGarbage deletes all peers that expired before now.
+//
+// The swarms are swept in batches of gcBatchSize per transaction, so that
+// announces are not blocked for the whole sweep.
+func (ps *peerStore) collectGarbage(now time.Time) error {
+	start := time.Now()
+	cutoff := uint64(now.UnixNano())
+
+	var infoHashes [][]byte
+	err := ps.view(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			infoHashes = append(infoHashes, append([]byte(nil), name...))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var expired [2]int
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > gcBatchSize {
+			batch = batch[:gcBatchSize]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		var batchExpired [2]int
+		err := ps.update(func(tx *bbolt.Tx) error {
+			batchExpired = [2]int{}
+			for _, ih := range batch {
+				n, err := sweepSwarm(tx, ih, cutoff)
+				if err != nil {
+					return err
+				}
+				batchExpired[bittorrent.IPv4] += n[bittorrent.IPv4]
+				batchExpired[bittorrent.IPv6] += n[bittorrent.IPv6]
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		expired[bittorrent.IPv4] += batchExpired[bittorrent.IPv4]
+		expired[bittorrent.IPv6] += batchExpired[bittorrent.IPv6]
+	}
+
+	storage.PromPeersExpiredTotal.WithLabelValues("IPv4").Add(float64(expired[bittorrent.IPv4]))
+	storage.PromPeersExpiredTotal.WithLabelValues("IPv6").Add(float64(expired[bittorrent.IPv6]))
+	storage.PromGCDurationMilliseconds.Observe(float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond))
+
+	return nil
+}
+
+// sweepSwarm deletes the peers of the swarm identified by ih that expired
+// before cutoff and returns their number per address family.
+func sweepSwarm(tx *bbolt.Tx, ih []byte, cutoff uint64) (expired [2]int, err error) {
+	swarm := tx.Bucket(ih)
+	if swarm == nil {
+		return
+	}
+
+	c := readCounts(swarm)
+	for i, name := range peerBuckets {
+		peers := swarm.Bucket(name)
+		if peers == nil {
+			continue
+		}
+
+		// Keys are not deleted while iterating, because deletions may
+		// move the cursor.
+		var stale [][]byte
+		err = peers.ForEach(func(k, v []byte) error {
+			if binary.BigEndian.Uint64(v) <= cutoff {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		for _, pk := range stale {
+			if err = peers.Delete(pk); err != nil {
+				return
+			}
+		}
+
+		c[i] -= uint32(len(stale))
+		af := bittorrent.IPv4
+		if i >= 2 {
+			af = bittorrent.IPv6
+		}
+		expired[af] += len(stale)
+	}
+
+	if c.empty() {
+		err = tx.DeleteBucket(ih)
+		return
+	}
+	err = swarm.Put(countsKey, c.bytes())
+	return
+}
+
+// Compact rewrites the database into a new file and replaces the database
+// with it, which releases the pages of deleted peers that bbolt only reuses,
+// but never returns to the file system.
+//
+// Writes block while the database is copied, which takes time proportional to
+// the size of the live data. Reads only block while the database files are
+// swapped.
+// If the compacted database cannot be opened, the original one is opened
+// again.
+func (ps *peerStore) Compact() error {
+	ps.checkClosed()
+
+	ps.writeM.Lock()
+	defer ps.writeM.Unlock()
+
+	tmpPath := ps.cfg.Path + ".compact"
+	ps.dbM.RLock()
+	err := compactInto(ps.db, tmpPath, ps.cfg.OpenTimeout)
+	ps.dbM.RUnlock()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	ps.dbM.Lock()
+	defer ps.dbM.Unlock()
+
+	if err := ps.db.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	db, err := ps.replaceDB(tmpPath)
+	if db == nil {
+		// All further operations fail, as the closed database is kept.
+		return errors.New("failed to reopen database: " + err.Error())
+	}
+	ps.db = db
+
+	return err
+}
+
+// replaceDB replaces the closed database with the one at path and opens it.
+//
+// The original database is kept until the new one is opened, so that it is
+// opened again if anything fails. In that case, the error is returned along
+// with the original database.
+func (ps *peerStore) replaceDB(path string) (*bbolt.DB, error) {
+	oldPath := ps.cfg.Path + ".old"
+	if err := os.Rename(ps.cfg.Path, oldPath); err != nil {
+		os.Remove(path)
+		return reopenDB(ps.cfg, err)
+	}
+
+	err := os.Rename(path, ps.cfg.Path)
+	if err == nil {
+		var db *bbolt.DB
+		if db, err = openDB(ps.cfg); err == nil {
+			os.Remove(oldPath)
+			return db, nil
+		}
+	}
+
+	log.Error("storage: failed to replace database with compacted one", log.Fields{"path": ps.cfg.Path}, log.Err(err))
+	os.Remove(path)
+	if err := os.Rename(oldPath, ps.cfg.Path); err != nil {
+		return nil, err
+	}
+	return reopenDB(ps.cfg, err)
+}
+
+// reopenDB opens the original database after a failed compaction and returns
+// it along with the error of the compaction.
+func reopenDB(cfg Config, compactErr error) (*bbolt.DB, error) {
+	db, err := openDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return db, compactErr
+}
+
+// compactInto copies all buckets of src into a new database at path.
+//
+// The swarms are copied in batches of gcBatchSize per transaction, so that
+// the new database does not need to fit into a single transaction.
+func compactInto(src *bbolt.DB, path string, timeout time.Duration) error {
+	dst, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: timeout})
+	if err != nil {
+		return err
+	}
+	dst.NoSync = true
+
+	err = src.View(func(srcTx *bbolt.Tx) error {
+		var batch [][]byte
+		flush := func() error {
+			err := dst.Update(func(dstTx *bbolt.Tx) error {
+				for _, ih := range batch {
+					swarm, err := dstTx.CreateBucketIfNotExists(ih)
+					if err != nil {
+						return err
+					}
+					if err := copyBucket(swarm, srcTx.Bucket(ih)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			batch = batch[:0]
+			return err
+		}
+
+		err := srcTx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			batch = append(batch, name)
+			if len(batch) < gcBatchSize {
+				return nil
+			}
+			return flush()
+		})
+		if err != nil {
+			return err
+		}
+		return flush()
+	})
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	// NoSync skipped the syncs of the transactions, so the file is synced
+	// once by closing it.
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// copyBucket copies all keys and nested buckets of src into dst.
+//
+// The keys are inserted in order, so the pages of dst are filled completely.
+func copyBucket(dst, src *bbolt.Bucket) error {
+	dst.FillPercent = 1
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		nested, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, src.Bucket(k))
+	})
+}
+
+func (ps *peerStore) Stop() <-chan error {
+	select {
+	case <-ps.closed:
+		return stop.AlreadyStopped
+	default:
+	}
+
+	c := make(chan error, 1)
+	go func() {
+		close(ps.closed)
+		ps.wg.Wait()
+
+		ps.dbM.Lock()
+		err := ps.db.Close()
+		ps.dbM.Unlock()
+		if err != nil {
+			c <- err
+		}
+		close(c)
+	}()
+
+	return c
+}
+
+func (ps *peerStore) LogFields() log.Fields {
+	return ps.cfg.LogFields()
+}
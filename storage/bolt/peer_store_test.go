@@ -0,0 +1,255 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bbolt "github.com/coreos/bbolt"
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+// tempDir creates a directory for the databases of a test, which is removed
+// by the returned function.
+func tempDir(t testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "chihaya-bolt")
+	require.Nil(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func factory(dir string) s.PeerStoreFactory {
+	var n int
+	return func() s.PeerStore {
+		n++
+		ps, err := New(Config{
+			Path:                      filepath.Join(dir, fmt.Sprintf("%d.db", n)),
+			GarbageCollectionInterval: 10 * time.Minute,
+			NoSync:                    true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return ps
+	}
+}
+
+func TestPeerStore(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	s.RunTests(t, factory(dir))
+}
+
+func BenchmarkPeerStore(b *testing.B) {
+	dir, cleanup := tempDir(b)
+	defer cleanup()
+
+	s.RunBenchmarks(b, factory(dir))
+}
+
+func TestMissingPath(t *testing.T) {
+	_, err := New(Config{})
+	require.Equal(t, ErrMissingPath, err)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ps, err := New(Config{Path: filepath.Join(dir, "gc.db"), PeerLifetime: time.Minute})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	seeder := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("abab::0002"), AddressFamily: bittorrent.IPv6}}
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+	require.Nil(t, ps.PutLeecher(ih, leecher))
+
+	require.Nil(t, ps.(*peerStore).collectGarbage(time.Now()))
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv6).Incomplete)
+
+	require.Nil(t, ps.(*peerStore).collectGarbage(time.Now().Add(2*time.Minute)))
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ih, bittorrent.IPv6).Incomplete)
+	_, err = ps.AnnouncePeers(ih, false, 50, seeder)
+	require.Equal(t, s.ErrResourceDoesNotExist, err)
+}
+
+func TestAnnounceSkipsExpiredPeers(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ps, err := New(Config{Path: filepath.Join(dir, "expired.db"), PeerLifetime: time.Minute})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	announcer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	for i := 0; i < 10; i++ {
+		require.Nil(t, ps.PutSeeder(ih, bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("%020d", 100+i)),
+			Port: 6881,
+			IP:   bittorrent.IP{IP: net.IPv4(2, 2, 2, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}))
+	}
+
+	// Every peer is returned once, wherever the cursor starts.
+	peers, err := ps.AnnouncePeers(ih, false, 50, announcer)
+	require.Nil(t, err)
+	require.Equal(t, 10, len(peers))
+	for i, p := range peers {
+		for _, other := range peers[:i] {
+			require.False(t, p.Equal(other))
+		}
+	}
+
+	// Peers that expired are skipped before they are collected.
+	later := uint64(time.Now().Add(2 * time.Minute).UnixNano())
+	err = ps.(*peerStore).db.View(func(tx *bbolt.Tx) error {
+		seeders := tx.Bucket(ih[:]).Bucket(peerBuckets[peerBucket(true, bittorrent.IPv4)])
+		peers = appendPeers(nil, seeders, 50, newPeerKey(announcer), later)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(peers))
+}
+
+func TestAnnounceSkipsMalformedPeers(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ps, err := New(Config{Path: filepath.Join(dir, "malformed.db")})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	seeder := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+	require.Nil(t, ps.PutSeeder(ih, seeder))
+
+	expires := make([]byte, 8)
+	binary.BigEndian.PutUint64(expires, uint64(time.Now().Add(time.Hour).UnixNano()))
+	err = ps.(*peerStore).db.Update(func(tx *bbolt.Tx) error {
+		seeders := tx.Bucket(ih[:]).Bucket(peerBuckets[peerBucket(true, bittorrent.IPv4)])
+		return seeders.Put([]byte("short"), expires)
+	})
+	require.Nil(t, err)
+
+	peers, err := ps.AnnouncePeers(ih, false, 50, leecher)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{seeder}, peers)
+}
+
+func TestPersistence(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	cfg := Config{Path: filepath.Join(dir, "persist.db")}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	require.Nil(t, ps.PutSeeder(ih, peer))
+	for err := range ps.Stop() {
+		require.Nil(t, err)
+	}
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+}
+
+func TestCompact(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	cfg := Config{Path: filepath.Join(dir, "compact.db")}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	for i := 0; i < 10; i++ {
+		peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: uint16(i + 1), IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+		require.Nil(t, ps.PutLeecher(ih, peer))
+		if i%2 == 0 {
+			require.Nil(t, ps.DeleteLeecher(ih, peer))
+		}
+	}
+
+	require.Nil(t, ps.(s.CompactionStore).Compact())
+
+	_, err = os.Stat(cfg.Path + ".compact")
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, uint32(5), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+
+	// The compacted database is used for further operations.
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+	require.Nil(t, ps.PutSeeder(ih, peer))
+	peers, err := ps.AnnouncePeers(ih, false, 50, peer)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(peers))
+}
+
+func TestTryScrapeSwarmError(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ps, err := New(Config{Path: filepath.Join(dir, "scrape.db")})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	require.Nil(t, ps.PutSeeder(ih, peer))
+
+	// Errors of the database are returned instead of an empty Scrape.
+	store := ps.(*peerStore)
+	require.Nil(t, store.db.Close())
+	scrape, err := store.TryScrapeSwarm(ih, bittorrent.IPv4)
+	require.NotNil(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, scrape)
+
+	store.db, err = openDB(store.cfg)
+	require.Nil(t, err)
+	scrape, err = store.TryScrapeSwarm(ih, bittorrent.IPv4)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), scrape.Complete)
+}
+
+func TestCompactFailure(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	cfg := Config{Path: filepath.Join(dir, "compact.db")}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	require.Nil(t, ps.PutLeecher(ih, peer))
+
+	// The original database cannot be moved aside, so it is not replaced.
+	require.Nil(t, os.MkdirAll(filepath.Join(cfg.Path+".old", "dir"), 0700))
+	require.NotNil(t, ps.(s.CompactionStore).Compact())
+
+	_, err = os.Stat(cfg.Path + ".compact")
+	require.True(t, os.IsNotExist(err))
+
+	// The original database is opened again.
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ih, bittorrent.IPv4).Incomplete)
+	require.Nil(t, ps.PutSeeder(ih, peer))
+}
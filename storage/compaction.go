@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/schedule"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// ErrCompactionNotSupported is returned by NewCompactionScheduler for
+// PeerStores that do not implement CompactionStore.
+var ErrCompactionNotSupported = errors.New("peer store does not support compaction")
+
+// CompactionScheduler compacts a CompactionStore at the times of a schedule.
+type CompactionScheduler struct {
+	store    CompactionStore
+	schedule *schedule.Schedule
+	closing  chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewCompactionScheduler starts compacting ps at the times of the provided
+// schedule until it is stopped.
+//
+// If ps does not implement CompactionStore, ErrCompactionNotSupported is
+// returned.
+func NewCompactionScheduler(ps PeerStore, s *schedule.Schedule) (*CompactionScheduler, error) {
+	cs, ok := ps.(CompactionStore)
+	if !ok {
+		return nil, ErrCompactionNotSupported
+	}
+
+	sched := &CompactionScheduler{
+		store:    cs,
+		schedule: s,
+		closing:  make(chan struct{}),
+	}
+
+	sched.wg.Add(1)
+	go sched.run()
+
+	return sched, nil
+}
+
+func (s *CompactionScheduler) run() {
+	defer s.wg.Done()
+	for {
+		next := s.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Warn("storage: compaction schedule never matches, compaction disabled")
+			return
+		}
+		log.Debug("storage: scheduled compaction", log.Fields{"at": next})
+
+		select {
+		case <-s.closing:
+			return
+		case <-time.After(time.Until(next)):
+			s.compact()
+		}
+	}
+}
+
+// compact compacts the store once.
+func (s *CompactionScheduler) compact() {
+	start := time.Now()
+	log.Info("storage: compacting")
+	if err := s.store.Compact(); err != nil {
+		log.Error("storage: failed to compact", log.Err(err))
+		return
+	}
+
+	duration := time.Since(start)
+	PromCompactionDurationMilliseconds.Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+	log.Info("storage: compacted", log.Fields{"timeTaken": duration})
+}
+
+// Stop stops the CompactionScheduler, waiting for a running compaction to
+// finish.
+func (s *CompactionScheduler) Stop() <-chan error {
+	select {
+	case <-s.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+
+	c := make(chan error)
+	go func() {
+		close(s.closing)
+		s.wg.Wait()
+		close(c)
+	}()
+
+	return c
+}
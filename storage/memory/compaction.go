@@ -0,0 +1,80 @@
+package memory
+
+import (
+	"runtime"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+)
+
+var _ storage.CompactionStore = &peerStore{}
+
+// copyPeers returns a copy of peers that is sized to its current length.
+func copyPeers(peers map[serializedPeer]peerEntry) map[serializedPeer]peerEntry {
+	c := make(map[serializedPeer]peerEntry, len(peers))
+	for pk, entry := range peers {
+		c[pk] = entry
+	}
+	return c
+}
+
+// Compact reallocates the maps of all shards and swarms to their current
+// size. Go maps never shrink, so the memory of deleted peers is only
+// released by replacing the maps.
+//
+// Like the garbage collection, it locks a shard only to copy a single swarm
+// at a time, so announces are barely delayed.
+func (ps *peerStore) Compact() error {
+	for _, shard := range ps.shards {
+		select {
+		case <-ps.closed:
+			return nil
+		default:
+		}
+
+		shard.Lock()
+		swarms := make(map[bittorrent.InfoHash]swarm, len(shard.swarms))
+		infohashes := make([]bittorrent.InfoHash, 0, len(shard.swarms))
+		for ih, sw := range shard.swarms {
+			swarms[ih] = sw
+			infohashes = append(infohashes, ih)
+		}
+		shard.swarms = swarms
+
+		if shard.ips != nil {
+			ips := make(map[string]map[peerRef]struct{}, len(shard.ips))
+			for ip, refs := range shard.ips {
+				c := make(map[peerRef]struct{}, len(refs))
+				for ref := range refs {
+					c[ref] = struct{}{}
+				}
+				ips[ip] = c
+			}
+			shard.ips = ips
+		}
+
+		if shard.endpoints != nil {
+			endpoints := make(map[idRef][]serializedPeer, len(shard.endpoints))
+			for ref, pks := range shard.endpoints {
+				endpoints[ref] = pks
+			}
+			shard.endpoints = endpoints
+		}
+		shard.Unlock()
+		runtime.Gosched()
+
+		for _, ih := range infohashes {
+			shard.Lock()
+			if sw, ok := shard.swarms[ih]; ok {
+				shard.swarms[ih] = swarm{
+					seeders:  copyPeers(sw.seeders),
+					leechers: copyPeers(sw.leechers),
+				}
+			}
+			shard.Unlock()
+			runtime.Gosched()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package memory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestCompact(t *testing.T) {
+	ps, err := New(Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PrometheusReportingInterval: time.Hour, IndexPeersByIP: true})
+	require.Nil(t, err)
+	store := ps.(*peerStore)
+	defer func() { <-store.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	ip := bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}
+	for i := 0; i < 10; i++ {
+		p := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: uint16(i + 1), IP: ip}
+		require.Nil(t, store.PutSeeder(ih, p))
+		if i%2 == 0 {
+			require.Nil(t, store.DeleteSeeder(ih, p))
+		}
+	}
+
+	require.Nil(t, store.Compact())
+	require.Equal(t, uint32(5), store.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+
+	// The IP index still refers to the copied entries.
+	n, err := store.DeletePeersByIP(ip)
+	require.Nil(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, uint32(0), store.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+}
@@ -0,0 +1,74 @@
+package memory
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// idRef identifies a peer ID in the swarms of a shard.
+type idRef struct {
+	infoHash bittorrent.InfoHash
+	id       bittorrent.PeerID
+}
+
+// newIDRef returns the reference to the peer ID of the peer serialized as pk
+// in the swarm identified by ih.
+func newIDRef(ih bittorrent.InfoHash, pk serializedPeer) idRef {
+	ref := idRef{infoHash: ih}
+	copy(ref.id[:], pk[:20])
+	return ref
+}
+
+// indexEndpoints reports whether the endpoint index is maintained, which is
+// the case if entries of a peer at other endpoints are replaced, either on a
+// new port or by the Identity.
+func (ps *peerStore) indexEndpoints() bool {
+	return ps.cfg.UpdatePortInPlace || ps.cfg.Identity != IdentityEndpoint
+}
+
+// indexEndpoint adds the peer serialized as pk in the swarm identified by ih
+// to the endpoint index of the shard, if the index is maintained.
+// The shard must be locked.
+func (ps *peerStore) indexEndpoint(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer) {
+	if !ps.indexEndpoints() {
+		return
+	}
+
+	if shard.endpoints == nil {
+		shard.endpoints = make(map[idRef][]serializedPeer)
+	}
+
+	ref := newIDRef(ih, pk)
+	for _, other := range shard.endpoints[ref] {
+		if other == pk {
+			return
+		}
+	}
+	shard.endpoints[ref] = append(shard.endpoints[ref], pk)
+}
+
+// unindexEndpoint removes the peer serialized as pk in the swarm identified by
+// ih from the endpoint index of the shard.
+//
+// A new slice is stored, so that callers can keep iterating over the previous
+// endpoints of the peer ID.
+// The shard must be locked.
+func (ps *peerStore) unindexEndpoint(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer) {
+	if shard.endpoints == nil {
+		return
+	}
+
+	ref := newIDRef(ih, pk)
+	pks := shard.endpoints[ref]
+	for i, other := range pks {
+		if other != pk {
+			continue
+		}
+
+		if len(pks) == 1 {
+			delete(shard.endpoints, ref)
+		} else {
+			shard.endpoints[ref] = append(pks[:i:i], pks[i+1:]...)
+		}
+		return
+	}
+}
@@ -0,0 +1,80 @@
+package memory
+
+import (
+	"hash/fnv"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Identities of peers.
+const (
+	// IdentityEndpoint identifies a peer by its peer ID, IP and port.
+	// Entries a peer left at a previous endpoint are kept until they
+	// expire.
+	IdentityEndpoint = "endpoint"
+
+	// IdentityKey identifies a peer that announces a key by its peer ID and
+	// key, so that it replaces its entries at previous endpoints. Peers
+	// without a key are identified by their endpoint.
+	IdentityKey = "key"
+
+	// IdentityKeyOrPeerID identifies peers like IdentityKey, but peers
+	// without a key by their peer ID alone. This is a weaker guarantee:
+	// peer IDs are sent in the clear to other peers, so anyone who learned
+	// the peer ID of a client without a key can replace its entry.
+	IdentityKeyOrPeerID = "key_or_peer_id"
+)
+
+// keyHash returns the hash of key stored in the entries of peers, if the
+// Identity is based on keys. Zero stands for no key.
+func (ps *peerStore) keyHash(key string) uint32 {
+	if key == "" || ps.cfg.Identity == IdentityEndpoint {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	if sum := h.Sum32(); sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+// removeOtherEndpoints removes the entries of the peer serialized as pk with
+// the key hashed as key that were announced from a different IP or port, if
+// the Identity recognizes them as the same peer, and reports whether any were
+// removed.
+//
+// Only the swarm of the address family of pk is searched, so entries of the
+// other address family are kept until they expire. The entries are found via
+// the endpoint index, so the swarm is not scanned.
+// The shard must be locked.
+func (ps *peerStore) removeOtherEndpoints(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer, key uint32) (removed bool) {
+	switch {
+	case ps.cfg.Identity == IdentityEndpoint:
+		return false
+	case key == 0 && ps.cfg.Identity != IdentityKeyOrPeerID:
+		return false
+	}
+
+	sw := shard.swarms[ih]
+	for _, other := range shard.endpoints[newIDRef(ih, pk)] {
+		if other == pk {
+			continue
+		}
+
+		if entry, ok := sw.seeders[other]; ok && entry.key == key {
+			delete(sw.seeders, other)
+			shard.numSeeders--
+			removed = true
+		}
+		if entry, ok := sw.leechers[other]; ok && entry.key == key {
+			delete(sw.leechers, other)
+			shard.numLeechers--
+			removed = true
+		}
+		ps.unindexPeer(shard, ih, other)
+	}
+
+	return removed
+}
@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+func TestIdentity(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	withKey := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	keyless := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+	move := func(p bittorrent.Peer) bittorrent.Peer {
+		p.IP = bittorrent.IP{IP: net.ParseIP("3.3.3.3").To4(), AddressFamily: bittorrent.IPv4}
+		return p
+	}
+
+	var table = []struct {
+		identity string
+		withKey  int
+		keyless  int
+	}{
+		{IdentityEndpoint, 2, 2},
+		{IdentityKey, 1, 2},
+		{IdentityKeyOrPeerID, 1, 1},
+	}
+
+	for _, tt := range table {
+		ps, err := New(Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PrometheusReportingInterval: time.Hour, Identity: tt.identity})
+		require.Nil(t, err)
+		store := ps.(*peerStore)
+
+		require.Nil(t, store.PutLeecherWithAttributes(ih, withKey, s.PeerAttributes{Key: "abc"}))
+		require.Nil(t, store.PutLeecher(ih, keyless))
+
+		// Announcing with another key is another peer.
+		existed, err := store.CheckAndPutLeecher(ih, move(withKey), s.PeerAttributes{Key: "def"})
+		require.Nil(t, err)
+		require.False(t, existed)
+		require.Nil(t, store.DeleteLeecher(ih, move(withKey)))
+
+		existed, err = store.CheckAndPutSeeder(ih, move(withKey), s.PeerAttributes{Key: "abc"})
+		require.Nil(t, err)
+		require.Equal(t, tt.withKey == 1, existed)
+		require.Nil(t, store.PutSeeder(ih, move(keyless)))
+
+		infos, err := store.PeerInfo(ih, withKey.ID)
+		require.Nil(t, err)
+		require.Equal(t, tt.withKey, len(infos), tt.identity)
+		infos, err = store.PeerInfo(ih, keyless.ID)
+		require.Nil(t, err)
+		require.Equal(t, tt.keyless, len(infos), tt.identity)
+
+		scrape := store.ScrapeSwarm(ih, bittorrent.IPv4)
+		require.Equal(t, uint32(tt.withKey+tt.keyless), scrape.Complete+scrape.Incomplete)
+
+		// The endpoint index is cleaned up along with the entries.
+		require.Nil(t, store.DeleteInfoHash(ih))
+		for _, shard := range store.shards {
+			require.Empty(t, shard.endpoints)
+		}
+
+		<-store.Stop()
+	}
+}
@@ -0,0 +1,178 @@
+package memory
+
+import (
+	"net"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+)
+
+var _ storage.PeerDeletionStore = &peerStore{}
+
+// peerRef identifies an entry of a peer in the swarms of a shard.
+type peerRef struct {
+	infoHash bittorrent.InfoHash
+	pk       serializedPeer
+}
+
+// ipKey returns the key of the IP index for a serialized peer.
+func ipKey(pk serializedPeer) string {
+	return string(pk[22:])
+}
+
+// indexPeer adds the peer serialized as pk in the swarm identified by ih to
+// the IP index and the endpoint index of the shard, if they are enabled.
+// The shard must be locked.
+func (ps *peerStore) indexPeer(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer) {
+	ps.indexEndpoint(shard, ih, pk)
+	if !ps.cfg.IndexPeersByIP {
+		return
+	}
+
+	if shard.ips == nil {
+		shard.ips = make(map[string]map[peerRef]struct{})
+	}
+
+	refs, ok := shard.ips[ipKey(pk)]
+	if !ok {
+		refs = make(map[peerRef]struct{})
+		shard.ips[ipKey(pk)] = refs
+	}
+	refs[peerRef{ih, pk}] = struct{}{}
+}
+
+// unindexPeer removes the peer serialized as pk in the swarm identified by ih
+// from the indexes of the shard, unless it is still a seeder or leecher in the
+// swarm.
+// The shard must be locked.
+func (ps *peerStore) unindexPeer(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer) {
+	if shard.ips == nil && shard.endpoints == nil {
+		return
+	}
+
+	if s, ok := shard.swarms[ih]; ok {
+		if _, ok := s.seeders[pk]; ok {
+			return
+		}
+		if _, ok := s.leechers[pk]; ok {
+			return
+		}
+	}
+
+	ps.unindexEndpoint(shard, ih, pk)
+	if shard.ips == nil {
+		return
+	}
+
+	refs := shard.ips[ipKey(pk)]
+	delete(refs, peerRef{ih, pk})
+	if len(refs) == 0 {
+		delete(shard.ips, ipKey(pk))
+	}
+}
+
+// deletePeer removes the peer serialized as pk from the swarm identified by
+// ih and returns the number of entries removed.
+// The shard must be locked.
+func (ps *peerStore) deletePeer(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer) (deleted int) {
+	s, ok := shard.swarms[ih]
+	if !ok {
+		return 0
+	}
+
+	if _, ok := s.seeders[pk]; ok {
+		delete(s.seeders, pk)
+		shard.numSeeders--
+		deleted++
+	}
+
+	if _, ok := s.leechers[pk]; ok {
+		delete(s.leechers, pk)
+		shard.numLeechers--
+		deleted++
+	}
+
+	if len(s.seeders)|len(s.leechers) == 0 {
+		delete(shard.swarms, ih)
+	}
+	ps.unindexEndpoint(shard, ih, pk)
+
+	return deleted
+}
+
+// DeletePeer removes p from both the seeders and the leechers of the swarm
+// identified by ih.
+func (ps *peerStore) DeletePeer(ih bittorrent.InfoHash, p bittorrent.Peer) (bool, error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	pk := newPeerKey(p)
+
+	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
+	ps.lock(shard)
+	deleted := ps.deletePeer(shard, ih, pk)
+	ps.unindexPeer(shard, ih, pk)
+	shard.Unlock()
+
+	return deleted > 0, nil
+}
+
+// DeletePeersByIP removes all Peers announced from ip from all swarms.
+//
+// With IndexPeersByIP enabled, only the affected swarms are visited.
+// Otherwise all swarms are scanned.
+func (ps *peerStore) DeletePeersByIP(ip bittorrent.IP) (int, error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	key := ip.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		key = ip4
+	} else if len(ip.IP) != net.IPv6len {
+		return 0, storage.ErrResourceDoesNotExist
+	}
+
+	var deleted int
+	for _, shard := range ps.shards {
+		shard.Lock()
+
+		if ps.cfg.IndexPeersByIP {
+			for ref := range shard.ips[string(key)] {
+				deleted += ps.deletePeer(shard, ref.infoHash, ref.pk)
+			}
+			delete(shard.ips, string(key))
+		} else {
+			for ih, s := range shard.swarms {
+				var pks []serializedPeer
+				for pk := range s.seeders {
+					if ipKey(pk) == string(key) {
+						pks = append(pks, pk)
+					}
+				}
+				for pk := range s.leechers {
+					if ipKey(pk) == string(key) {
+						pks = append(pks, pk)
+					}
+				}
+
+				for _, pk := range pks {
+					deleted += ps.deletePeer(shard, ih, pk)
+				}
+			}
+		}
+
+		shard.Unlock()
+	}
+
+	if deleted == 0 {
+		return 0, storage.ErrResourceDoesNotExist
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,175 @@
+package memory
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+)
+
+var _ storage.PeerMigrationStore = &peerStore{}
+
+// toMigratedPeers converts the unexpired entries of peers at now.
+//
+// The entries are serialized like for snapshots, so that they keep all their
+// attributes.
+func (ps *peerStore) toMigratedPeers(peers map[serializedPeer]peerEntry, now int64) []storage.MigratedPeer {
+	migrated := make([]storage.MigratedPeer, 0, len(peers))
+	for pk, entry := range peers {
+		if entry.expires <= now {
+			continue
+		}
+		e := ps.toSnapshotEntry(entry)
+		migrated = append(migrated, storage.MigratedPeer{
+			Peer:       decodePeerKey(pk),
+			Flags:      e.Flags,
+			LastSeen:   time.Unix(0, e.MTime),
+			TTL:        time.Duration(e.Expires - e.MTime),
+			SeenCount:  e.Seen,
+			Origin:     e.Origin,
+			KeyHash:    e.Key,
+			SourceIP:   entry.source(),
+			Uploaded:   e.Uploaded,
+			Downloaded: e.Downloaded,
+		})
+	}
+	return migrated
+}
+
+// putMigratedPeers stores the peers of one address family in the swarm
+// identified by ih of the shard, which must be locked, and returns the number
+// of new entries.
+func (ps *peerStore) putMigratedPeers(shard *peerShard, ih bittorrent.InfoHash, entries map[serializedPeer]peerEntry, peers []storage.MigratedPeer, now int64) (added uint64) {
+	for _, p := range peers {
+		ttl := p.TTL
+		if ttl <= 0 {
+			ttl = ps.cfg.PeerLifetime
+		}
+		pk := newPeerKey(p.Peer)
+		entry := ps.fromSnapshotEntry(snapshotEntry{
+			MTime:      p.LastSeen.UnixNano(),
+			Expires:    p.LastSeen.Add(ttl).UnixNano(),
+			Flags:      p.Flags,
+			Seen:       p.SeenCount,
+			Origin:     p.Origin,
+			Key:        p.KeyHash,
+			Source:     ps.sourceKey(pk, p.SourceIP),
+			Uploaded:   p.Uploaded,
+			Downloaded: p.Downloaded,
+		})
+		if entry.expires <= now {
+			continue
+		}
+
+		existing, ok := entries[pk]
+		if ok && existing.mtime >= entry.mtime {
+			continue
+		}
+		if !ok {
+			added++
+			ps.indexPeer(shard, ih, pk)
+		}
+		entries[pk] = entry
+	}
+
+	return added
+}
+
+// PutPeers stores the peers of each address family under a single lock of
+// its shard.
+//
+// Imported peers are not merged with entries of the same peer on other ports.
+func (ps *peerStore) PutPeers(ih bittorrent.InfoHash, seeders, leechers []storage.MigratedPeer) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	byFamily := func(peers []storage.MigratedPeer) (split [2][]storage.MigratedPeer) {
+		for _, p := range peers {
+			af := bittorrent.IPv4
+			if p.Peer.IP.AddressFamily == bittorrent.IPv6 {
+				af = bittorrent.IPv6
+			}
+			split[af] = append(split[af], p)
+		}
+		return split
+	}
+	seedersByFamily := byFamily(seeders)
+	leechersByFamily := byFamily(leechers)
+
+	now := ps.getClock()
+	for _, af := range [2]bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		if len(seedersByFamily[af])+len(leechersByFamily[af]) == 0 {
+			continue
+		}
+
+		shard := ps.shards[ps.shardIndex(ih, af)]
+		shard.Lock()
+
+		sw, ok := shard.swarms[ih]
+		if !ok {
+			sw = swarm{
+				seeders:  make(map[serializedPeer]peerEntry),
+				leechers: make(map[serializedPeer]peerEntry),
+			}
+		}
+
+		shard.numSeeders += ps.putMigratedPeers(shard, ih, sw.seeders, seedersByFamily[af], now)
+		shard.numLeechers += ps.putMigratedPeers(shard, ih, sw.leechers, leechersByFamily[af], now)
+
+		// Don't create swarms of only expired peers.
+		if !ok && len(sw.seeders)|len(sw.leechers) != 0 {
+			shard.swarms[ih] = sw
+		}
+
+		shard.Unlock()
+	}
+
+	return nil
+}
+
+// DumpPeers copies every swarm under a read lock of its shard and calls fn
+// without holding the lock, so fn may interact with the PeerStore.
+//
+// Expired peers that were not garbage collected yet are skipped.
+func (ps *peerStore) DumpPeers(fn func(ih bittorrent.InfoHash, seeders, leechers []storage.MigratedPeer) error) error {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	for _, shard := range ps.shards {
+		shard.RLock()
+		infohashes := make([]bittorrent.InfoHash, 0, len(shard.swarms))
+		for ih := range shard.swarms {
+			infohashes = append(infohashes, ih)
+		}
+		shard.RUnlock()
+
+		for _, ih := range infohashes {
+			now := ps.getClock()
+
+			shard.RLock()
+			sw, ok := shard.swarms[ih]
+			if !ok {
+				shard.RUnlock()
+				continue
+			}
+			seeders := ps.toMigratedPeers(sw.seeders, now)
+			leechers := ps.toMigratedPeers(sw.leechers, now)
+			shard.RUnlock()
+
+			if len(seeders)+len(leechers) == 0 {
+				continue
+			}
+			if err := fn(ih, seeders, leechers); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package memory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+func TestMigration(t *testing.T) {
+	src := createNew().(*peerStore)
+	defer func() { <-src.Stop() }()
+	dst := createNew().(*peerStore)
+	defer func() { <-dst.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}}
+
+	require.Nil(t, src.PutSeeder(ih, v4))
+	require.Nil(t, src.PutLeecherWithAttributes(ih, v6, s.PeerAttributes{Flags: bittorrent.PeerFlagCrypto, TTL: time.Minute}))
+
+	var swarms int
+	err := src.DumpPeers(func(infoHash bittorrent.InfoHash, seeders, leechers []s.MigratedPeer) error {
+		swarms++
+		return dst.PutPeers(infoHash, seeders, leechers)
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, swarms)
+
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1}, dst.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Incomplete: 1}, dst.ScrapeSwarm(ih, bittorrent.IPv6))
+	require.Equal(t, s.PeerCounts{Seeders: 1}, dst.PeerCounts(bittorrent.IPv4))
+
+	infos, err := dst.PeerInfo(ih, v6.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(infos))
+	require.Equal(t, bittorrent.PeerFlagCrypto, infos[0].Flags)
+
+	// The TTLs of the source are kept.
+	require.Nil(t, dst.collectGarbage(time.Unix(0, dst.getClock()).Add(2*time.Minute)))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, dst.ScrapeSwarm(ih, bittorrent.IPv6))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1}, dst.ScrapeSwarm(ih, bittorrent.IPv4))
+}
+
+func TestPutPeers(t *testing.T) {
+	ps := createNew().(*peerStore)
+	defer func() { <-ps.Stop() }()
+	now := time.Now()
+	ps.setClock(now.UnixNano())
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+
+	// Expired peers are skipped.
+	expired := s.MigratedPeer{Peer: peer, LastSeen: now.Add(-time.Hour), TTL: time.Minute}
+	require.Nil(t, ps.PutPeers(ih, []s.MigratedPeer{expired}, nil))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, ps.ScrapeSwarm(ih, bittorrent.IPv4))
+	require.Equal(t, 0, len(ps.shards[ps.shardIndex(ih, bittorrent.IPv4)].swarms))
+
+	// Older entries don't replace newer ones.
+	require.Nil(t, ps.PutLeecher(ih, peer))
+	older := s.MigratedPeer{Peer: peer, LastSeen: now.Add(-time.Minute), Flags: bittorrent.PeerFlagCrypto}
+	require.Nil(t, ps.PutPeers(ih, nil, []s.MigratedPeer{older}))
+	infos, err := ps.PeerInfo(ih, peer.ID)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.PeerFlags(0), infos[0].Flags)
+
+	newer := s.MigratedPeer{Peer: peer, LastSeen: now.Add(time.Second), Flags: bittorrent.PeerFlagCrypto}
+	require.Nil(t, ps.PutPeers(ih, nil, []s.MigratedPeer{newer}))
+	infos, err = ps.PeerInfo(ih, peer.ID)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.PeerFlagCrypto, infos[0].Flags)
+	require.Equal(t, s.PeerCounts{Leechers: 1}, ps.PeerCounts(bittorrent.IPv4))
+}
+
+func TestMigrationKeepsAttributes(t *testing.T) {
+	cfg := Config{ShardCount: 1, CountAnnounces: true, TrackOrigins: true, TrackSourceIPs: true, TrackTransfers: true}
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	src := ps.(*peerStore)
+	defer func() { <-src.Stop() }()
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	dst := ps.(*peerStore)
+	defer func() { <-dst.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	source := bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}
+	require.Nil(t, src.PutLeecherWithAttributes(ih, peer, s.PeerAttributes{Origin: "udp"}))
+	require.Nil(t, src.PutLeecherWithAttributes(ih, peer, s.PeerAttributes{Origin: "udp", SourceIP: source, Uploaded: 10, Downloaded: 20}))
+
+	err = src.DumpPeers(func(infoHash bittorrent.InfoHash, seeders, leechers []s.MigratedPeer) error {
+		return dst.PutPeers(infoHash, seeders, leechers)
+	})
+	require.Nil(t, err)
+
+	infos, err := dst.PeerInfo(ih, peer.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(infos))
+	require.Equal(t, uint32(2), infos[0].SeenCount)
+	require.Equal(t, "udp", infos[0].Origin)
+	require.Equal(t, source, infos[0].SourceIP)
+	require.Equal(t, uint64(10), infos[0].Uploaded)
+	require.Equal(t, uint64(20), infos[0].Downloaded)
+}
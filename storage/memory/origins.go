@@ -0,0 +1,119 @@
+package memory
+
+import (
+	"math"
+	"sync"
+
+	"github.com/chihaya/chihaya/storage"
+)
+
+var _ storage.PeerOriginStore = &peerStore{}
+
+// originTable assigns the origins of peers the small numbers stored in their
+// entries. Zero is the unknown origin.
+//
+// Entries only hold a single byte, so origins beyond the first 255 are stored
+// as unknown.
+type originTable struct {
+	sync.RWMutex
+	names []string
+	index map[string]uint8
+}
+
+func newOriginTable() *originTable {
+	return &originTable{names: []string{""}, index: map[string]uint8{"": 0}}
+}
+
+// number returns the number of origin, assigning a new one if necessary.
+func (t *originTable) number(origin string) uint8 {
+	t.RLock()
+	n, ok := t.index[origin]
+	t.RUnlock()
+	if ok {
+		return n
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if n, ok := t.index[origin]; ok {
+		return n
+	}
+	if len(t.names) > math.MaxUint8 {
+		return 0
+	}
+	n = uint8(len(t.names))
+	t.names = append(t.names, origin)
+	t.index[origin] = n
+	return n
+}
+
+// name returns the origin with the number n.
+func (t *originTable) name(n uint8) string {
+	t.RLock()
+	defer t.RUnlock()
+	if int(n) >= len(t.names) {
+		return ""
+	}
+	return t.names[n]
+}
+
+// all returns the origins indexed by their numbers.
+func (t *originTable) all() []string {
+	t.RLock()
+	defer t.RUnlock()
+	return append([]string(nil), t.names...)
+}
+
+// originNumber returns the number to store in the entry of a peer with the
+// given origin, if TrackOrigins is enabled.
+func (ps *peerStore) originNumber(origin string) uint8 {
+	if !ps.cfg.TrackOrigins {
+		return 0
+	}
+	return ps.origins.number(origin)
+}
+
+// originTally counts the peers per origin number during a GC sweep.
+type originTally [math.MaxUint8 + 1]storage.PeerCounts
+
+// add counts the unexpired peers of a swarm.
+func (t *originTally) add(sw swarm) {
+	for _, entry := range sw.seeders {
+		t[entry.origin].Seeders++
+	}
+	for _, entry := range sw.leechers {
+		t[entry.origin].Leechers++
+	}
+}
+
+// recordOrigins replaces the PeerCounts per origin with the tally of a GC
+// sweep and posts them to prometheus.
+//
+// Origins without peers are only reported to prometheus, with zero peers.
+func (ps *peerStore) recordOrigins(tally *originTally) {
+	counts := make(map[string]storage.PeerCounts)
+	for n, name := range ps.origins.all() {
+		c := tally[n]
+		if name == "" {
+			name = storage.UnknownOrigin
+		}
+		if c.Seeders+c.Leechers > 0 {
+			counts[name] = c
+		}
+		storage.PromPeersByOrigin.WithLabelValues(name, "seeder").Set(float64(c.Seeders))
+		storage.PromPeersByOrigin.WithLabelValues(name, "leecher").Set(float64(c.Leechers))
+	}
+
+	ps.originCounts.Store(counts)
+}
+
+// PeerOriginCounts returns the PeerCounts per origin as of the last garbage
+// collection, or nil if TrackOrigins is disabled.
+func (ps *peerStore) PeerOriginCounts() map[string]storage.PeerCounts {
+	if !ps.cfg.TrackOrigins {
+		return nil
+	}
+
+	counts, _ := ps.originCounts.Load().(map[string]storage.PeerCounts)
+	return counts
+}
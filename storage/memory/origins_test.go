@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+func TestTrackOrigins(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}}
+	unknown := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000003"), Port: 3, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.3").To4(), AddressFamily: bittorrent.IPv4}}
+
+	for _, track := range []bool{false, true} {
+		ps, err := New(Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PrometheusReportingInterval: time.Hour, TrackOrigins: track})
+		require.Nil(t, err)
+		store := ps.(*peerStore)
+
+		require.Nil(t, store.PutSeederWithAttributes(ih, v4, s.PeerAttributes{Origin: "http"}))
+		require.Nil(t, store.PutLeecherWithAttributes(ih, v6, s.PeerAttributes{Origin: "udp"}))
+		require.Nil(t, store.PutLeecher(ih, unknown))
+		require.Nil(t, store.collectGarbage(time.Unix(0, store.getClock())))
+
+		infos, err := store.PeerInfo(ih, v6.ID)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(infos))
+
+		if !track {
+			require.Equal(t, "", infos[0].Origin)
+			require.Nil(t, store.PeerOriginCounts())
+		} else {
+			require.Equal(t, "udp", infos[0].Origin)
+			require.Equal(t, map[string]s.PeerCounts{
+				"http":          {Seeders: 1},
+				"udp":           {Leechers: 1},
+				s.UnknownOrigin: {Leechers: 1},
+			}, store.PeerOriginCounts())
+		}
+
+		<-ps.Stop()
+	}
+}
+
+func TestOriginTable(t *testing.T) {
+	table := newOriginTable()
+	require.Equal(t, uint8(0), table.number(""))
+	require.Equal(t, uint8(1), table.number("http"))
+	require.Equal(t, uint8(1), table.number("http"))
+	require.Equal(t, "http", table.name(1))
+	require.Equal(t, "", table.name(2))
+
+	// Origins beyond the capacity of an entry are unknown.
+	for i := 0; i < 300; i++ {
+		table.number(string(rune('a' + i)))
+	}
+	require.Equal(t, 256, len(table.all()))
+	require.Equal(t, uint8(0), table.number("overflow"))
+}
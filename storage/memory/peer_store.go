@@ -4,8 +4,11 @@ package memory
 
 import (
 	"encoding/binary"
+	"errors"
+	"math"
 	"net"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -58,16 +61,74 @@ type Config struct {
 	PrometheusReportingInterval time.Duration `yaml:"prometheus_reporting_interval"`
 	PeerLifetime                time.Duration `yaml:"peer_lifetime"`
 	ShardCount                  int           `yaml:"shard_count"`
+
+	// SnapshotPath is the path of a file the swarms are written to when
+	// the PeerStore is stopped and restored from when it is created.
+	// Empty disables snapshots.
+	SnapshotPath string `yaml:"snapshot_path"`
+
+	// UpdatePortInPlace specifies whether a peer announcing from the same
+	// IP with a different port replaces its previous entry in the swarm.
+	// By default, the previous entry is kept until it expires.
+	UpdatePortInPlace bool `yaml:"update_port_in_place"`
+
+	// IndexPeersByIP specifies whether an index of the peers by IP is
+	// maintained. It speeds up deleting the peers of an IP at the cost of
+	// additional memory. Without it, all swarms are scanned.
+	IndexPeersByIP bool `yaml:"index_peers_by_ip"`
+
+	// CountAnnounces specifies whether the number of announces of every
+	// peer in a swarm is counted, which allows preferring long-lived peers
+	// in announce responses.
+	CountAnnounces bool `yaml:"count_announces"`
+
+	// TrackOrigins specifies whether the origin of every peer, i.e. the
+	// frontend that registered it, is stored and the peers are counted per
+	// origin by the garbage collection.
+	TrackOrigins bool `yaml:"track_origins"`
+
+	// TrackSourceIPs specifies whether the address the last announce of
+	// every peer was received from is stored if it differs from the IP of
+	// the peer, e.g. the address of a reverse proxy, and reported by the
+	// diagnostic API.
+	TrackSourceIPs bool `yaml:"track_source_ips"`
+
+	// TrackTransfers specifies whether the uploaded and downloaded totals
+	// the last announce of every peer reported are stored. They are
+	// reported by the diagnostic API and PeerTransfers, e.g. for accounting.
+	TrackTransfers bool `yaml:"track_transfers"`
+
+	// MeasureLockContention specifies whether the time announces and
+	// scrapes wait for the locks of the shards is measured, which reveals
+	// hot shards, e.g. of a viral torrent, at the cost of reading the clock
+	// twice per lock.
+	MeasureLockContention bool `yaml:"measure_lock_contention"`
+
+	// Identity selects how a peer announcing from a new IP or port is
+	// recognized as the same peer, whose entries at its previous endpoints
+	// are then replaced. It is one of IdentityEndpoint, IdentityKey and
+	// IdentityKeyOrPeerID.
+	// If empty, IdentityEndpoint is used.
+	Identity string `yaml:"identity"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
-		"name":               Name,
-		"gcInterval":         cfg.GarbageCollectionInterval,
-		"promReportInterval": cfg.PrometheusReportingInterval,
-		"peerLifetime":       cfg.PeerLifetime,
-		"shardCount":         cfg.ShardCount,
+		"name":                  Name,
+		"gcInterval":            cfg.GarbageCollectionInterval,
+		"promReportInterval":    cfg.PrometheusReportingInterval,
+		"peerLifetime":          cfg.PeerLifetime,
+		"shardCount":            cfg.ShardCount,
+		"snapshotPath":          cfg.SnapshotPath,
+		"updatePortInPlace":     cfg.UpdatePortInPlace,
+		"indexPeersByIP":        cfg.IndexPeersByIP,
+		"countAnnounces":        cfg.CountAnnounces,
+		"trackOrigins":          cfg.TrackOrigins,
+		"trackSourceIPs":        cfg.TrackSourceIPs,
+		"trackTransfers":        cfg.TrackTransfers,
+		"measureLockContention": cfg.MeasureLockContention,
+		"identity":              cfg.Identity,
 	}
 }
 
@@ -105,6 +166,19 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	switch cfg.Identity {
+	case "":
+		validcfg.Identity = IdentityEndpoint
+	case IdentityEndpoint, IdentityKey, IdentityKeyOrPeerID:
+	default:
+		validcfg.Identity = IdentityEndpoint
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Identity",
+			"provided": cfg.Identity,
+			"default":  validcfg.Identity,
+		})
+	}
+
 	if cfg.PeerLifetime <= 0 {
 		validcfg.PeerLifetime = defaultPeerLifetime
 		log.Warn("falling back to default configuration", log.Fields{
@@ -121,15 +195,22 @@ func (cfg Config) Validate() Config {
 func New(provided Config) (storage.PeerStore, error) {
 	cfg := provided.Validate()
 	ps := &peerStore{
-		cfg:    cfg,
-		shards: make([]*peerShard, cfg.ShardCount*2),
-		closed: make(chan struct{}),
+		cfg:     cfg,
+		shards:  make([]*peerShard, cfg.ShardCount*2),
+		origins: newOriginTable(),
+		closed:  make(chan struct{}),
 	}
 
 	for i := 0; i < cfg.ShardCount*2; i++ {
 		ps.shards[i] = &peerShard{swarms: make(map[bittorrent.InfoHash]swarm)}
 	}
 
+	if cfg.SnapshotPath != "" {
+		if err := ps.readSnapshot(cfg.SnapshotPath); err != nil {
+			return nil, errors.New("failed to restore snapshot: " + err.Error())
+		}
+	}
+
 	// Start a goroutine for garbage collection.
 	ps.wg.Add(1)
 	go func() {
@@ -139,9 +220,9 @@ func New(provided Config) (storage.PeerStore, error) {
 			case <-ps.closed:
 				return
 			case <-time.After(cfg.GarbageCollectionInterval):
-				before := time.Now().Add(-cfg.PeerLifetime)
-				log.Debug("storage: purging peers with no announces since", log.Fields{"before": before})
-				ps.collectGarbage(before)
+				now := time.Now()
+				log.Debug("storage: purging peers that expired before", log.Fields{"now": now})
+				ps.collectGarbage(now)
 			}
 		}
 	}()
@@ -213,16 +294,73 @@ func decodePeerKey(pk serializedPeer) bittorrent.Peer {
 }
 
 type peerShard struct {
+	// locks is the number of times announces and scrapes locked the shard
+	// and lockWait the total time in nanoseconds they waited for it, if
+	// MeasureLockContention is enabled. They are updated atomically, as
+	// readers share the lock, and come first to be aligned for that.
+	locks    uint64
+	lockWait int64
+
 	swarms      map[bittorrent.InfoHash]swarm
 	numSeeders  uint64
 	numLeechers uint64
+
+	// ips maps IPs to the entries of their peers in the swarms, if
+	// IndexPeersByIP is enabled.
+	ips map[string]map[peerRef]struct{}
+
+	// endpoints maps the peer IDs in the swarms to the serialized peers
+	// announced with them, if UpdatePortInPlace is enabled.
+	endpoints map[idRef][]serializedPeer
 	sync.RWMutex
 }
 
+// peerEntry is the data stored alongside a serialized peer.
+type peerEntry struct {
+	// mtime is the time in nanoseconds of the last announce of the peer.
+	mtime int64
+
+	// expires is the time in nanoseconds after which the peer is
+	// garbage collected.
+	expires int64
+	flags   bittorrent.PeerFlags
+
+	// seen is the number of announces of the peer in the swarm, if
+	// CountAnnounces is enabled.
+	seen uint32
+
+	// origin is the number of the origin of the last announce of the peer
+	// in the originTable, if TrackOrigins is enabled. It fits into the
+	// padding of the entry.
+	origin uint8
+
+	// key is the hash of the key of the last announce of the peer, or zero
+	// if it had none, if an Identity based on keys is configured.
+	key uint32
+
+	// extra holds the optional data of the peer, or nil if none of it is
+	// tracked or the peer has none, so that it only costs a pointer per
+	// peer otherwise.
+	extra *peerExtra
+}
+
+// peerExtra is the optional data stored alongside a serialized peer.
+type peerExtra struct {
+	// source is the address the last announce of the peer was received
+	// from, if TrackSourceIPs is enabled and it differs from the IP of the
+	// peer.
+	source string
+
+	// uploaded and downloaded are the totals the last announce of the peer
+	// reported, if TrackTransfers is enabled.
+	uploaded   uint64
+	downloaded uint64
+}
+
 type swarm struct {
-	// map serialized peer to mtime
-	seeders  map[serializedPeer]int64
-	leechers map[serializedPeer]int64
+	// map serialized peer to its entry
+	seeders  map[serializedPeer]peerEntry
+	leechers map[serializedPeer]peerEntry
 }
 
 type peerStore struct {
@@ -233,28 +371,73 @@ type peerStore struct {
 	// Must be accessed atomically!
 	clock int64
 
+	// origins and originCounts hold the origins of the peers and the
+	// PeerCounts per origin of the last GC sweep, if TrackOrigins is
+	// enabled.
+	origins      *originTable
+	originCounts atomic.Value // map[string]storage.PeerCounts
+
+	// reportedLockWait is the total time announces waited for the locks
+	// of the shards as of the last report to prometheus. It is only
+	// accessed by the reporting goroutine.
+	reportedLockWait time.Duration
+
 	closed chan struct{}
 	wg     sync.WaitGroup
 }
 
-var _ storage.PeerStore = &peerStore{}
+var (
+	_ storage.PeerStore          = &peerStore{}
+	_ storage.PeerAttributeStore = &peerStore{}
+	_ storage.PeerInfoStore      = &peerStore{}
+	_ storage.PeerEvictionStore  = &peerStore{}
+	_ storage.CheckAndPutStore   = &peerStore{}
+	_ storage.PeerCountStore     = &peerStore{}
+	_ storage.PeerGroupStore     = &peerStore{}
+)
 
 // populateProm aggregates metrics over all shards and then posts them to
 // prometheus.
 func (ps *peerStore) populateProm() {
-	var numInfohashes, numSeeders, numLeechers uint64
+	var numInfohashes, numSeeders, numLeechers, maxShardPeers uint64
+	var lockWait time.Duration
 
 	for _, s := range ps.shards {
 		s.RLock()
 		numInfohashes += uint64(len(s.swarms))
 		numSeeders += s.numSeeders
 		numLeechers += s.numLeechers
+		if peers := s.numSeeders + s.numLeechers; peers > maxShardPeers {
+			maxShardPeers = peers
+		}
+		lockWait += time.Duration(atomic.LoadInt64(&s.lockWait))
 		s.RUnlock()
 	}
 
 	storage.PromInfohashesCount.Set(float64(numInfohashes))
 	storage.PromSeedersCount.Set(float64(numSeeders))
 	storage.PromLeechersCount.Set(float64(numLeechers))
+	storage.PromShardPeersMax.Set(float64(maxShardPeers))
+	storage.PromShardLockWaitSecondsTotal.Add((lockWait - ps.reportedLockWait).Seconds())
+	ps.reportedLockWait = lockWait
+	ps.recordPeerCounts()
+}
+
+// recordPeerCounts posts the PeerCounts of both address families to
+// prometheus.
+func (ps *peerStore) recordPeerCounts() {
+	for af, label := range map[bittorrent.AddressFamily]string{bittorrent.IPv4: "IPv4", bittorrent.IPv6: "IPv6"} {
+		counts := ps.PeerCounts(af)
+		storage.PromPeersCount.WithLabelValues(label, "seeder").Set(float64(counts.Seeders))
+		storage.PromPeersCount.WithLabelValues(label, "leecher").Set(float64(counts.Leechers))
+	}
+}
+
+// recordExpiredPeers records the number of peers removed by a GC sweep per
+// address family.
+func recordExpiredPeers(expired [2]int) {
+	storage.PromPeersExpiredTotal.WithLabelValues("IPv4").Add(float64(expired[bittorrent.IPv4]))
+	storage.PromPeersExpiredTotal.WithLabelValues("IPv6").Add(float64(expired[bittorrent.IPv6]))
 }
 
 // recordGCDuration records the duration of a GC sweep.
@@ -270,6 +453,102 @@ func (ps *peerStore) setClock(to int64) {
 	atomic.StoreInt64(&ps.clock, to)
 }
 
+// newEntry creates the entry for the peer serialized as pk that announced just
+// now.
+func (ps *peerStore) newEntry(pk serializedPeer, attrs storage.PeerAttributes, seen uint32) peerEntry {
+	ttl := attrs.TTL
+	if ttl <= 0 {
+		ttl = ps.cfg.PeerLifetime
+	}
+
+	now := ps.getClock()
+	return peerEntry{
+		mtime:   now,
+		expires: now + ttl.Nanoseconds(),
+		flags:   attrs.Flags,
+		seen:    seen,
+		origin:  ps.originNumber(attrs.Origin),
+		key:     ps.keyHash(attrs.Key),
+		extra:   ps.newExtra(pk, attrs),
+	}
+}
+
+// newExtra returns the optional data to store for the peer serialized as pk,
+// or nil if it has none.
+func (ps *peerStore) newExtra(pk serializedPeer, attrs storage.PeerAttributes) *peerExtra {
+	extra := peerExtra{source: ps.sourceKey(pk, attrs.SourceIP)}
+	if ps.cfg.TrackTransfers {
+		extra.uploaded, extra.downloaded = attrs.Uploaded, attrs.Downloaded
+	}
+	return extra.ptr()
+}
+
+// ptr returns a pointer to a copy of extra to store in an entry, or nil if it
+// is empty.
+func (extra peerExtra) ptr() *peerExtra {
+	if extra == (peerExtra{}) {
+		return nil
+	}
+	return &extra
+}
+
+// seenCount returns the number of announces of the peer serialized as pk in sw
+// including the current one, if CountAnnounces is enabled.
+// The count saturates at math.MaxUint32.
+func (ps *peerStore) seenCount(sw swarm, pk serializedPeer) uint32 {
+	if !ps.cfg.CountAnnounces {
+		return 0
+	}
+
+	seen := sw.seeders[pk].seen
+	if leecherSeen := sw.leechers[pk].seen; leecherSeen > seen {
+		seen = leecherSeen
+	}
+	if seen == math.MaxUint32 {
+		return seen
+	}
+
+	return seen + 1
+}
+
+// sameIDAndIP reports whether two serialized peers only differ in their port.
+func sameIDAndIP(a, b serializedPeer) bool {
+	return a[:20] == b[:20] && a[22:] == b[22:]
+}
+
+// removeOtherPorts removes the entries of the peer serialized as pk that
+// were announced with a different port, if the PeerStore is configured to
+// update ports in place, and reports whether any were removed.
+//
+// The entries are found via the endpoint index, so the swarm is not scanned.
+// The shard must be locked.
+func (ps *peerStore) removeOtherPorts(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer) (removed bool) {
+	if !ps.cfg.UpdatePortInPlace {
+		return false
+	}
+
+	sw := shard.swarms[ih]
+	for _, other := range shard.endpoints[newIDRef(ih, pk)] {
+		if other == pk || !sameIDAndIP(other, pk) {
+			continue
+		}
+
+		if _, ok := sw.seeders[other]; ok {
+			delete(sw.seeders, other)
+			shard.numSeeders--
+			removed = true
+		}
+		if _, ok := sw.leechers[other]; ok {
+			delete(sw.leechers, other)
+			shard.numLeechers--
+			removed = true
+		}
+		ps.unindexPeer(shard, ih, other)
+	}
+
+	return removed
+}
+
 func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) uint32 {
 	// There are twice the amount of shards specified by the user, the first
 	// half is dedicated to IPv4 swarms and the second half is dedicated to
@@ -282,6 +561,15 @@ func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, af bittorrent.Addr
 }
 
 func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.PutSeederWithAttributes(ih, p, storage.PeerAttributes{})
+}
+
+func (ps *peerStore) PutSeederWithAttributes(ih bittorrent.InfoHash, p bittorrent.Peer, attrs storage.PeerAttributes) error {
+	_, err := ps.CheckAndPutSeeder(ih, p, attrs)
+	return err
+}
+
+func (ps *peerStore) CheckAndPutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer, attrs storage.PeerAttributes) (existed bool, err error) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -291,25 +579,38 @@ func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
+			seeders:  make(map[serializedPeer]peerEntry),
+			leechers: make(map[serializedPeer]peerEntry),
 		}
 	}
 
+	seen := ps.seenCount(shard.swarms[ih], pk)
+
+	// A peer that changed its port or, if identified by its key, its IP is
+	// not new to the swarm.
+	existed = ps.removeOtherPorts(shard, ih, pk)
+	existed = ps.removeOtherEndpoints(shard, ih, pk, ps.keyHash(attrs.Key)) || existed
+
 	// If this peer isn't already a seeder, update the stats for the swarm.
 	if _, ok := shard.swarms[ih].seeders[pk]; !ok {
 		shard.numSeeders++
+	} else {
+		existed = true
+	}
+	if _, ok := shard.swarms[ih].leechers[pk]; ok {
+		existed = true
 	}
 
 	// Update the peer in the swarm.
-	shard.swarms[ih].seeders[pk] = ps.getClock()
+	shard.swarms[ih].seeders[pk] = ps.newEntry(pk, attrs, seen)
+	ps.indexPeer(shard, ih, pk)
 
 	shard.Unlock()
-	return nil
+	return existed, nil
 }
 
 func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
@@ -322,7 +623,7 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.Unlock()
@@ -340,12 +641,22 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 	if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
 		delete(shard.swarms, ih)
 	}
+	ps.unindexPeer(shard, ih, pk)
 
 	shard.Unlock()
 	return nil
 }
 
 func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.PutLeecherWithAttributes(ih, p, storage.PeerAttributes{})
+}
+
+func (ps *peerStore) PutLeecherWithAttributes(ih bittorrent.InfoHash, p bittorrent.Peer, attrs storage.PeerAttributes) error {
+	_, err := ps.CheckAndPutLeecher(ih, p, attrs)
+	return err
+}
+
+func (ps *peerStore) CheckAndPutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer, attrs storage.PeerAttributes) (existed bool, err error) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -355,25 +666,38 @@ func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
+			seeders:  make(map[serializedPeer]peerEntry),
+			leechers: make(map[serializedPeer]peerEntry),
 		}
 	}
 
+	seen := ps.seenCount(shard.swarms[ih], pk)
+
+	// A peer that changed its port or, if identified by its key, its IP is
+	// not new to the swarm.
+	existed = ps.removeOtherPorts(shard, ih, pk)
+	existed = ps.removeOtherEndpoints(shard, ih, pk, ps.keyHash(attrs.Key)) || existed
+
 	// If this peer isn't already a leecher, update the stats for the swarm.
 	if _, ok := shard.swarms[ih].leechers[pk]; !ok {
 		shard.numLeechers++
+	} else {
+		existed = true
+	}
+	if _, ok := shard.swarms[ih].seeders[pk]; ok {
+		existed = true
 	}
 
 	// Update the peer in the swarm.
-	shard.swarms[ih].leechers[pk] = ps.getClock()
+	shard.swarms[ih].leechers[pk] = ps.newEntry(pk, attrs, seen)
+	ps.indexPeer(shard, ih, pk)
 
 	shard.Unlock()
-	return nil
+	return existed, nil
 }
 
 func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
@@ -386,7 +710,7 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.Unlock()
@@ -404,12 +728,17 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 	if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
 		delete(shard.swarms, ih)
 	}
+	ps.unindexPeer(shard, ih, pk)
 
 	shard.Unlock()
 	return nil
 }
 
 func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.GraduateLeecherWithAttributes(ih, p, storage.PeerAttributes{})
+}
+
+func (ps *peerStore) GraduateLeecherWithAttributes(ih bittorrent.InfoHash, p bittorrent.Peer, attrs storage.PeerAttributes) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -419,34 +748,58 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 	pk := newPeerKey(p)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+	ps.lock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
+			seeders:  make(map[serializedPeer]peerEntry),
+			leechers: make(map[serializedPeer]peerEntry),
 		}
 	}
 
+	seen := ps.seenCount(shard.swarms[ih], pk)
+
 	// If this peer is a leecher, update the stats for the swarm and remove them.
 	if _, ok := shard.swarms[ih].leechers[pk]; ok {
 		shard.numLeechers--
 		delete(shard.swarms[ih].leechers, pk)
 	}
 
+	ps.removeOtherPorts(shard, ih, pk)
+	ps.removeOtherEndpoints(shard, ih, pk, ps.keyHash(attrs.Key))
+
 	// If this peer isn't already a seeder, update the stats for the swarm.
 	if _, ok := shard.swarms[ih].seeders[pk]; !ok {
 		shard.numSeeders++
 	}
 
 	// Update the peer in the swarm.
-	shard.swarms[ih].seeders[pk] = ps.getClock()
+	shard.swarms[ih].seeders[pk] = ps.newEntry(pk, attrs, seen)
+	ps.indexPeer(shard, ih, pk)
 
 	shard.Unlock()
 	return nil
 }
 
 func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	return ps.AnnouncePeersWithFlags(ih, seeder, numWant, announcer, 0)
+}
+
+func (ps *peerStore) AnnouncePeersWithFlags(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer, mask bittorrent.PeerFlags) (peers []bittorrent.Peer, err error) {
+	peers, _, err = ps.announcePeers(ih, seeder, numWant, announcer, mask)
+	return
+}
+
+// AnnouncePeerGroups behaves like AnnouncePeers, but also returns the ends of
+// the reachable seeders, if the announcer is not seeding, the reachable
+// leechers and the unreachable peers in peers.
+func (ps *peerStore) AnnouncePeerGroups(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, ends []int, err error) {
+	return ps.announcePeers(ih, seeder, numWant, announcer, 0)
+}
+
+// announcePeers returns up to numWant peers of the swarm identified by ih with
+// all flags of mask, and the ends of their groups, see AnnouncePeerGroups.
+func (ps *peerStore) announcePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer, mask bittorrent.PeerFlags) (peers []bittorrent.Peer, ends []int, err error) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -454,59 +807,154 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 	}
 
 	shard := ps.shards[ps.shardIndex(ih, announcer.IP.AddressFamily)]
-	shard.RLock()
+	ps.rlock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.RUnlock()
-		return nil, storage.ErrResourceDoesNotExist
+		return nil, nil, storage.ErrResourceDoesNotExist
 	}
 
-	if seeder {
-		// Append leechers as possible.
-		leechers := shard.swarms[ih].leechers
-		for pk := range leechers {
+	announcerPK := newPeerKey(announcer)
+
+	// Unreachable peers are only returned if there are not enough others.
+	var unreachable []serializedPeer
+	appendPeers := func(entries map[serializedPeer]peerEntry, skip serializedPeer) {
+		for pk, entry := range entries {
 			if numWant == 0 {
 				break
 			}
 
-			peers = append(peers, decodePeerKey(pk))
-			numWant--
-		}
-	} else {
-		// Append as many seeders as possible.
-		seeders := shard.swarms[ih].seeders
-		for pk := range seeders {
-			if numWant == 0 {
-				break
+			if pk == skip || !entry.flags.Has(mask) {
+				continue
+			}
+
+			if entry.flags.Has(bittorrent.PeerFlagUnreachable) {
+				if len(unreachable) < numWant {
+					unreachable = append(unreachable, pk)
+				}
+				continue
 			}
 
 			peers = append(peers, decodePeerKey(pk))
 			numWant--
 		}
+	}
 
-		// Append leechers until we reach numWant.
-		if numWant > 0 {
-			leechers := shard.swarms[ih].leechers
-			announcerPK := newPeerKey(announcer)
-			for pk := range leechers {
-				if pk == announcerPK {
-					continue
-				}
-
-				if numWant == 0 {
-					break
-				}
+	if seeder {
+		// Append leechers as possible.
+		appendPeers(shard.swarms[ih].leechers, announcerPK)
+	} else {
+		// Append as many seeders as possible, then leechers until we
+		// reach numWant.
+		appendPeers(shard.swarms[ih].seeders, "")
+		ends = append(ends, len(peers))
+		appendPeers(shard.swarms[ih].leechers, announcerPK)
+	}
+	ends = append(ends, len(peers))
 
-				peers = append(peers, decodePeerKey(pk))
-				numWant--
-			}
+	for _, pk := range unreachable {
+		if numWant == 0 {
+			break
 		}
+
+		peers = append(peers, decodePeerKey(pk))
+		numWant--
 	}
+	ends = append(ends, len(peers))
 
 	shard.RUnlock()
 	return
 }
 
+// longLivedCandidates is the factor of numWant peers considered by
+// AnnounceLongLivedPeers, which bounds the work per announce in large swarms.
+const longLivedCandidates = 4
+
+// longLivedPeers returns up to numWant peers of peers except skip, preferring
+// peers that announced more often.
+// Only longLivedCandidates times numWant peers are considered.
+func longLivedPeers(peers map[serializedPeer]peerEntry, numWant int, skip serializedPeer) []bittorrent.Peer {
+	if numWant <= 0 {
+		return nil
+	}
+
+	type candidate struct {
+		pk   serializedPeer
+		seen uint32
+	}
+	candidates := make([]candidate, 0, numWant)
+	for pk, entry := range peers {
+		if len(candidates) == longLivedCandidates*numWant {
+			break
+		}
+		if pk == skip {
+			continue
+		}
+		candidates = append(candidates, candidate{pk, entry.seen})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].seen > candidates[j].seen })
+	if len(candidates) > numWant {
+		candidates = candidates[:numWant]
+	}
+
+	result := make([]bittorrent.Peer, 0, len(candidates))
+	for _, c := range candidates {
+		result = append(result, decodePeerKey(c.pk))
+	}
+	return result
+}
+
+func (ps *peerStore) AnnounceLongLivedPeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	shard := ps.shards[ps.shardIndex(ih, announcer.IP.AddressFamily)]
+	ps.rlock(shard)
+	defer shard.RUnlock()
+
+	sw, ok := shard.swarms[ih]
+	if !ok {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	announcerPK := newPeerKey(announcer)
+	if seeder {
+		return longLivedPeers(sw.leechers, numWant, announcerPK), nil
+	}
+
+	peers = longLivedPeers(sw.seeders, numWant, announcerPK)
+	return append(peers, longLivedPeers(sw.leechers, numWant-len(peers), announcerPK)...), nil
+}
+
+// PeerCounts sums up the numbers of peers maintained by the shards of the
+// given address family.
+func (ps *peerStore) PeerCounts(af bittorrent.AddressFamily) (counts storage.PeerCounts) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	// See shardIndex for the layout of the shards.
+	shards := ps.shards[:len(ps.shards)/2]
+	if af == bittorrent.IPv6 {
+		shards = ps.shards[len(ps.shards)/2:]
+	}
+
+	for _, shard := range shards {
+		shard.RLock()
+		counts.Seeders += shard.numSeeders
+		counts.Leechers += shard.numLeechers
+		shard.RUnlock()
+	}
+
+	return counts
+}
+
 func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (resp bittorrent.Scrape) {
 	select {
 	case <-ps.closed:
@@ -516,7 +964,7 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorren
 
 	resp.InfoHash = ih
 	shard := ps.shards[ps.shardIndex(ih, addressFamily)]
-	shard.RLock()
+	ps.rlock(shard)
 
 	if _, ok := shard.swarms[ih]; !ok {
 		shard.RUnlock()
@@ -530,7 +978,97 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorren
 	return
 }
 
-// collectGarbage deletes all Peers from the PeerStore which are older than the
+func (ps *peerStore) PeerInfo(ih bittorrent.InfoHash, id bittorrent.PeerID) (infos []storage.PeerInfo, err error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	now := time.Unix(0, ps.getClock())
+	appendMatches := func(shard *peerShard, peers map[serializedPeer]peerEntry, seeder bool) {
+		for pk, entry := range peers {
+			if pk[:20] != serializedPeer(id[:]) {
+				continue
+			}
+
+			uploaded, downloaded := entry.transfers()
+			infos = append(infos, storage.PeerInfo{
+				Peer:       decodePeerKey(pk),
+				Seeder:     seeder,
+				Flags:      entry.flags,
+				LastSeen:   time.Unix(0, entry.mtime),
+				TTL:        time.Unix(0, entry.expires).Sub(now),
+				SeenCount:  entry.seen,
+				Origin:     ps.origins.name(entry.origin),
+				SourceIP:   entry.source(),
+				Uploaded:   uploaded,
+				Downloaded: downloaded,
+			})
+		}
+	}
+
+	addressFamilies := [2]bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6}
+	for _, family := range addressFamilies {
+		shard := ps.shards[ps.shardIndex(ih, family)]
+		shard.RLock()
+		if s, ok := shard.swarms[ih]; ok {
+			appendMatches(shard, s.seeders, true)
+			appendMatches(shard, s.leechers, false)
+		}
+		shard.RUnlock()
+	}
+
+	if len(infos) == 0 {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	return infos, nil
+}
+
+func (ps *peerStore) ClientStats(ih bittorrent.InfoHash) (map[bittorrent.ClientID]storage.ClientCounts, error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	var stats map[bittorrent.ClientID]storage.ClientCounts
+	count := func(peers map[serializedPeer]peerEntry, seeder bool) {
+		for pk := range peers {
+			cid := bittorrent.NewClientID(bittorrent.PeerIDFromString(string(pk[:20])))
+			counts := stats[cid]
+			if seeder {
+				counts.Seeders++
+			} else {
+				counts.Leechers++
+			}
+			stats[cid] = counts
+		}
+	}
+
+	addressFamilies := [2]bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6}
+	for _, family := range addressFamilies {
+		shard := ps.shards[ps.shardIndex(ih, family)]
+		shard.RLock()
+		if s, ok := shard.swarms[ih]; ok {
+			if stats == nil {
+				stats = make(map[bittorrent.ClientID]storage.ClientCounts)
+			}
+			count(s.seeders, true)
+			count(s.leechers, false)
+		}
+		shard.RUnlock()
+	}
+
+	if stats == nil {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	return stats, nil
+}
+
+// collectGarbage deletes all Peers from the PeerStore which expired before the
 // cutoff time.
 //
 // This function must be able to execute while other methods on this interface
@@ -545,7 +1083,19 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 	cutoffUnix := cutoff.UnixNano()
 	start := time.Now()
 
-	for _, shard := range ps.shards {
+	var expired [2]int
+	var origins *originTally
+	if ps.cfg.TrackOrigins {
+		origins = &originTally{}
+	}
+	for i, shard := range ps.shards {
+		// The first half of the shards holds IPv4 swarms, the second half
+		// IPv6 swarms.
+		af := bittorrent.IPv4
+		if i >= len(ps.shards)/2 {
+			af = bittorrent.IPv6
+		}
+
 		shard.RLock()
 		var infohashes []bittorrent.InfoHash
 		for ih := range shard.swarms {
@@ -563,22 +1113,28 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 				continue
 			}
 
-			for pk, mtime := range shard.swarms[ih].leechers {
-				if mtime <= cutoffUnix {
+			for pk, entry := range shard.swarms[ih].leechers {
+				if entry.expires <= cutoffUnix {
 					shard.numLeechers--
+					expired[af]++
 					delete(shard.swarms[ih].leechers, pk)
+					ps.unindexPeer(shard, ih, pk)
 				}
 			}
 
-			for pk, mtime := range shard.swarms[ih].seeders {
-				if mtime <= cutoffUnix {
+			for pk, entry := range shard.swarms[ih].seeders {
+				if entry.expires <= cutoffUnix {
 					shard.numSeeders--
+					expired[af]++
 					delete(shard.swarms[ih].seeders, pk)
+					ps.unindexPeer(shard, ih, pk)
 				}
 			}
 
 			if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
 				delete(shard.swarms, ih)
+			} else if origins != nil {
+				origins.add(shard.swarms[ih])
 			}
 
 			shard.Unlock()
@@ -589,16 +1145,25 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 	}
 
 	recordGCDuration(time.Since(start))
+	recordExpiredPeers(expired)
+	if origins != nil {
+		ps.recordOrigins(origins)
+	}
 
 	return nil
 }
 
 func (ps *peerStore) Stop() <-chan error {
-	c := make(chan error)
+	c := make(chan error, 1)
 	go func() {
 		close(ps.closed)
 		ps.wg.Wait()
 
+		var err error
+		if ps.cfg.SnapshotPath != "" {
+			err = ps.writeSnapshot(ps.cfg.SnapshotPath)
+		}
+
 		// Explicitly deallocate our storage.
 		shards := make([]*peerShard, len(ps.shards))
 		for i := 0; i < len(ps.shards); i++ {
@@ -606,6 +1171,9 @@ func (ps *peerStore) Stop() <-chan error {
 		}
 		ps.shards = shards
 
+		if err != nil {
+			c <- err
+		}
 		close(c)
 	}()
 
@@ -629,12 +1197,21 @@ func (ps *peerStore) DeleteInfoHash(ih bittorrent.InfoHash) error {
 		shard := ps.shards[ps.shardIndex(ih, family)]
 		shard.Lock()
 
-		if _, ok := shard.swarms[ih]; !ok {
+		s, ok := shard.swarms[ih]
+		if !ok {
 			shard.Unlock()
 			continue
 		}
 
 		delete(shard.swarms, ih)
+		shard.numSeeders -= uint64(len(s.seeders))
+		shard.numLeechers -= uint64(len(s.leechers))
+		for pk := range s.seeders {
+			ps.unindexPeer(shard, ih, pk)
+		}
+		for pk := range s.leechers {
+			ps.unindexPeer(shard, ih, pk)
+		}
 
 		shard.Unlock()
 	}
@@ -1,10 +1,15 @@
 package memory
 
 import (
+	"math"
+	"net"
 	"testing"
 
 	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
 	s "github.com/chihaya/chihaya/storage"
 )
 
@@ -16,29 +21,198 @@ func createNew() s.PeerStore {
 	return ps
 }
 
-func TestPeerStore(t *testing.T) { s.TestPeerStore(t, createNew()) }
-
-func BenchmarkPut(b *testing.B)                        { s.Put(b, createNew()) }
-func BenchmarkPut1k(b *testing.B)                      { s.Put1k(b, createNew()) }
-func BenchmarkPut1kInfohash(b *testing.B)              { s.Put1kInfohash(b, createNew()) }
-func BenchmarkPut1kInfohash1k(b *testing.B)            { s.Put1kInfohash1k(b, createNew()) }
-func BenchmarkPutDelete(b *testing.B)                  { s.PutDelete(b, createNew()) }
-func BenchmarkPutDelete1k(b *testing.B)                { s.PutDelete1k(b, createNew()) }
-func BenchmarkPutDelete1kInfohash(b *testing.B)        { s.PutDelete1kInfohash(b, createNew()) }
-func BenchmarkPutDelete1kInfohash1k(b *testing.B)      { s.PutDelete1kInfohash1k(b, createNew()) }
-func BenchmarkDeleteNonexist(b *testing.B)             { s.DeleteNonexist(b, createNew()) }
-func BenchmarkDeleteNonexist1k(b *testing.B)           { s.DeleteNonexist1k(b, createNew()) }
-func BenchmarkDeleteNonexist1kInfohash(b *testing.B)   { s.DeleteNonexist1kInfohash(b, createNew()) }
-func BenchmarkDeleteNonexist1kInfohash1k(b *testing.B) { s.DeleteNonexist1kInfohash1k(b, createNew()) }
-func BenchmarkPutGradDelete(b *testing.B)              { s.PutGradDelete(b, createNew()) }
-func BenchmarkPutGradDelete1k(b *testing.B)            { s.PutGradDelete1k(b, createNew()) }
-func BenchmarkPutGradDelete1kInfohash(b *testing.B)    { s.PutGradDelete1kInfohash(b, createNew()) }
-func BenchmarkPutGradDelete1kInfohash1k(b *testing.B)  { s.PutGradDelete1kInfohash1k(b, createNew()) }
-func BenchmarkGradNonexist(b *testing.B)               { s.GradNonexist(b, createNew()) }
-func BenchmarkGradNonexist1k(b *testing.B)             { s.GradNonexist1k(b, createNew()) }
-func BenchmarkGradNonexist1kInfohash(b *testing.B)     { s.GradNonexist1kInfohash(b, createNew()) }
-func BenchmarkGradNonexist1kInfohash1k(b *testing.B)   { s.GradNonexist1kInfohash1k(b, createNew()) }
-func BenchmarkAnnounceLeecher(b *testing.B)            { s.AnnounceLeecher(b, createNew()) }
-func BenchmarkAnnounceLeecher1kInfohash(b *testing.B)  { s.AnnounceLeecher1kInfohash(b, createNew()) }
-func BenchmarkAnnounceSeeder(b *testing.B)             { s.AnnounceSeeder(b, createNew()) }
-func BenchmarkAnnounceSeeder1kInfohash(b *testing.B)   { s.AnnounceSeeder1kInfohash(b, createNew()) }
+func TestPeerStore(t *testing.T) { s.RunTests(t, createNew) }
+
+func TestPeerEvictionStoreWithIndex(t *testing.T) {
+	ps, err := New(Config{IndexPeersByIP: true})
+	require.Nil(t, err)
+	s.TestPeerEvictionStore(t, ps.(*peerStore))
+
+	// The index must not retain deleted peers.
+	for _, shard := range ps.(*peerStore).shards {
+		require.Equal(t, 0, len(shard.ips))
+	}
+}
+
+func TestPeerTTL(t *testing.T) {
+	ps := createNew().(*peerStore)
+	now := time.Now()
+	ps.setClock(now.UnixNano())
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	short := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	long := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+
+	require.Nil(t, ps.PutLeecherWithAttributes(ih, short, s.PeerAttributes{TTL: time.Minute}))
+	// Without a TTL hint the default peer lifetime is used.
+	require.Nil(t, ps.PutSeeder(ih, long))
+
+	require.Nil(t, ps.collectGarbage(now.Add(2*time.Minute)))
+	scrape := ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+	require.Equal(t, uint32(1), scrape.Complete)
+
+	require.Nil(t, ps.collectGarbage(now.Add(defaultPeerLifetime)))
+	scrape = ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Complete)
+}
+
+func TestUpdatePortInPlace(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	moved := peer
+	moved.Port = 2
+	other := peer
+	other.Port = 3
+	other.IP = bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}
+
+	var table = []struct {
+		inPlace bool
+		seeders uint32
+		peers   uint32
+	}{
+		{false, 3, 4},
+		{true, 2, 2},
+	}
+
+	for _, tt := range table {
+		ps, err := New(Config{UpdatePortInPlace: tt.inPlace})
+		require.Nil(t, err)
+
+		require.Nil(t, ps.PutSeeder(ih, peer))
+		// The same peer ID from a different IP is a different peer.
+		require.Nil(t, ps.PutSeeder(ih, other))
+		require.Nil(t, ps.PutSeeder(ih, moved))
+		require.Equal(t, tt.seeders, ps.ScrapeSwarm(ih, bittorrent.IPv4).Complete)
+
+		require.Nil(t, ps.PutLeecher(ih, peer))
+		scrape := ps.ScrapeSwarm(ih, bittorrent.IPv4)
+		require.Equal(t, tt.peers, scrape.Complete+scrape.Incomplete)
+
+		// The endpoint index is cleaned up along with the entries.
+		require.Nil(t, ps.(*peerStore).DeleteInfoHash(ih))
+		for _, shard := range ps.(*peerStore).shards {
+			require.Empty(t, shard.endpoints)
+		}
+
+		<-ps.Stop()
+	}
+}
+
+func TestCheckAndPutPortChange(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	moved := peer
+	moved.Port = 2
+
+	for _, inPlace := range []bool{false, true} {
+		ps, err := New(Config{UpdatePortInPlace: inPlace})
+		require.Nil(t, err)
+
+		existed, err := ps.(*peerStore).CheckAndPutLeecher(ih, peer, s.PeerAttributes{})
+		require.Nil(t, err)
+		require.False(t, existed)
+
+		// A peer that changed its port is only known if it replaces its
+		// old entry.
+		existed, err = ps.(*peerStore).CheckAndPutLeecher(ih, moved, s.PeerAttributes{})
+		require.Nil(t, err)
+		require.Equal(t, inPlace, existed)
+
+		<-ps.Stop()
+	}
+}
+
+func TestCountAnnounces(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	other := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000003"), Port: 3, IP: bittorrent.IP{IP: net.ParseIP("3.3.3.3").To4(), AddressFamily: bittorrent.IPv4}}
+
+	for _, count := range []bool{false, true} {
+		ps, err := New(Config{CountAnnounces: count})
+		require.Nil(t, err)
+
+		require.Nil(t, ps.PutLeecher(ih, peer))
+		require.Nil(t, ps.PutLeecher(ih, peer))
+		// Graduating keeps the count.
+		require.Nil(t, ps.GraduateLeecher(ih, peer))
+		require.Nil(t, ps.PutSeeder(ih, other))
+
+		infos, err := ps.(*peerStore).PeerInfo(ih, peer.ID)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(infos))
+		if !count {
+			require.Equal(t, uint32(0), infos[0].SeenCount)
+			<-ps.Stop()
+			continue
+		}
+		require.Equal(t, uint32(3), infos[0].SeenCount)
+
+		// The long-lived seeder is preferred.
+		peers, err := ps.(*peerStore).AnnounceLongLivedPeers(ih, false, 1, leecher)
+		require.Nil(t, err)
+		require.Equal(t, []bittorrent.Peer{peer}, peers)
+
+		// The count saturates.
+		shard := ps.(*peerStore).shards[ps.(*peerStore).shardIndex(ih, bittorrent.IPv4)]
+		entry := shard.swarms[ih].seeders[newPeerKey(peer)]
+		entry.seen = math.MaxUint32
+		shard.swarms[ih].seeders[newPeerKey(peer)] = entry
+		require.Nil(t, ps.PutSeeder(ih, peer))
+		infos, err = ps.(*peerStore).PeerInfo(ih, peer.ID)
+		require.Nil(t, err)
+		require.Equal(t, uint32(math.MaxUint32), infos[0].SeenCount)
+
+		<-ps.Stop()
+	}
+}
+
+func TestPeerCounts(t *testing.T) {
+	ps := createNew().(*peerStore)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("fc00::2"), AddressFamily: bittorrent.IPv6}}
+
+	require.Nil(t, ps.PutSeeder(ih, v4))
+	require.Nil(t, ps.PutLeecher(ih, v6))
+	require.Equal(t, s.PeerCounts{Seeders: 1}, ps.PeerCounts(bittorrent.IPv4))
+	require.Equal(t, s.PeerCounts{Leechers: 1}, ps.PeerCounts(bittorrent.IPv6))
+
+	require.Nil(t, ps.GraduateLeecher(ih, v6))
+	require.Equal(t, s.PeerCounts{Seeders: 1}, ps.PeerCounts(bittorrent.IPv6))
+
+	require.Nil(t, ps.DeleteInfoHash(ih))
+	require.Equal(t, s.PeerCounts{}, ps.PeerCounts(bittorrent.IPv4))
+	require.Equal(t, s.PeerCounts{}, ps.PeerCounts(bittorrent.IPv6))
+}
+
+func BenchmarkPeerStore(b *testing.B) { s.RunBenchmarks(b, createNew) }
+
+func TestUnreachablePeersLast(t *testing.T) {
+	ps := createNew().(*peerStore)
+	defer func() { <-ps.Stop() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	reachable := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	unreachable := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000003"), Port: 3, IP: bittorrent.IP{IP: net.ParseIP("3.3.3.3").To4(), AddressFamily: bittorrent.IPv4}}
+	announcer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000004"), Port: 4, IP: bittorrent.IP{IP: net.ParseIP("4.4.4.4").To4(), AddressFamily: bittorrent.IPv4}}
+
+	require.Nil(t, ps.PutSeederWithAttributes(ih, unreachable, s.PeerAttributes{Flags: bittorrent.PeerFlagUnreachable}))
+	require.Nil(t, ps.PutSeeder(ih, reachable))
+	require.Nil(t, ps.PutLeecher(ih, leecher))
+
+	// Unreachable seeders come after reachable leechers.
+	peers, err := ps.AnnouncePeers(ih, false, 2, announcer)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(peers))
+	require.NotContains(t, peers, unreachable)
+
+	// They are still returned if there are not enough other peers.
+	peers, err = ps.AnnouncePeers(ih, false, 3, announcer)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{reachable, leecher, unreachable}, peers)
+}
@@ -0,0 +1,75 @@
+package memory
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+)
+
+var _ storage.ShardStatsStore = &peerStore{}
+
+// lock locks shard for an announce, measuring the time it waited if
+// MeasureLockContention is enabled.
+func (ps *peerStore) lock(shard *peerShard) {
+	if !ps.cfg.MeasureLockContention {
+		shard.Lock()
+		return
+	}
+
+	start := time.Now()
+	shard.Lock()
+	shard.recordWait(time.Since(start))
+}
+
+// rlock read-locks shard for an announce or a scrape, measuring the time it
+// waited if MeasureLockContention is enabled.
+func (ps *peerStore) rlock(shard *peerShard) {
+	if !ps.cfg.MeasureLockContention {
+		shard.RLock()
+		return
+	}
+
+	start := time.Now()
+	shard.RLock()
+	shard.recordWait(time.Since(start))
+}
+
+// recordWait records that the lock of the shard was taken after waiting for
+// wait.
+func (shard *peerShard) recordWait(wait time.Duration) {
+	atomic.AddUint64(&shard.locks, 1)
+	atomic.AddInt64(&shard.lockWait, int64(wait))
+}
+
+// ShardStats returns the ShardStats of all shards, the IPv4 shards first.
+func (ps *peerStore) ShardStats() []storage.ShardStats {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	stats := make([]storage.ShardStats, len(ps.shards))
+	for i, shard := range ps.shards {
+		// See shardIndex for the layout of the shards.
+		af := bittorrent.IPv4
+		if i >= len(ps.shards)/2 {
+			af = bittorrent.IPv6
+		}
+
+		shard.RLock()
+		stats[i] = storage.ShardStats{
+			AddressFamily: af,
+			Swarms:        uint64(len(shard.swarms)),
+			Seeders:       shard.numSeeders,
+			Leechers:      shard.numLeechers,
+			Locks:         atomic.LoadUint64(&shard.locks),
+			LockWait:      time.Duration(atomic.LoadInt64(&shard.lockWait)),
+		}
+		shard.RUnlock()
+	}
+
+	return stats
+}
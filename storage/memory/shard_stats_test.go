@@ -0,0 +1,59 @@
+package memory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestShardStats(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}}
+
+	for _, measure := range []bool{false, true} {
+		ps, err := New(Config{ShardCount: 2, GarbageCollectionInterval: time.Hour, PrometheusReportingInterval: time.Hour, MeasureLockContention: measure})
+		require.Nil(t, err)
+		store := ps.(*peerStore)
+
+		require.Nil(t, store.PutSeeder(ih, v4))
+		require.Nil(t, store.PutLeecher(ih, v6))
+
+		stats := store.ShardStats()
+		require.Equal(t, 4, len(stats))
+
+		v4Shard := stats[store.shardIndex(ih, bittorrent.IPv4)]
+		require.Equal(t, bittorrent.IPv4, v4Shard.AddressFamily)
+		require.Equal(t, uint64(1), v4Shard.Swarms)
+		require.Equal(t, uint64(1), v4Shard.Seeders)
+
+		v6Shard := stats[store.shardIndex(ih, bittorrent.IPv6)]
+		require.Equal(t, bittorrent.IPv6, v6Shard.AddressFamily)
+		require.Equal(t, uint64(1), v6Shard.Leechers)
+
+		if measure {
+			require.Equal(t, uint64(1), v4Shard.Locks)
+		} else {
+			require.Equal(t, uint64(0), v4Shard.Locks)
+		}
+
+		// Announces and scrapes only read-lock the shard, which is
+		// measured as well.
+		store.ScrapeSwarm(ih, bittorrent.IPv4)
+		_, err = store.AnnouncePeers(ih, false, 50, v4)
+		require.Nil(t, err)
+
+		v4Shard = store.ShardStats()[store.shardIndex(ih, bittorrent.IPv4)]
+		if measure {
+			require.Equal(t, uint64(3), v4Shard.Locks)
+		} else {
+			require.Equal(t, uint64(0), v4Shard.Locks)
+		}
+
+		<-ps.Stop()
+	}
+}
@@ -0,0 +1,181 @@
+package memory
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// snapshotEntry is the serialized form of a peerEntry.
+type snapshotEntry struct {
+	MTime   int64
+	Expires int64
+	Flags   bittorrent.PeerFlags
+	Seen    uint32
+	Origin  string
+	Key     uint32
+
+	// Source, Uploaded and Downloaded are the optional data of the entry,
+	// see peerExtra.
+	Source     string
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// snapshotSwarm is the serialized form of a swarm of one address family.
+type snapshotSwarm struct {
+	InfoHash      bittorrent.InfoHash
+	AddressFamily bittorrent.AddressFamily
+	Seeders       map[string]snapshotEntry
+	Leechers      map[string]snapshotEntry
+}
+
+// toSnapshotEntry serializes entry.
+func (ps *peerStore) toSnapshotEntry(entry peerEntry) snapshotEntry {
+	e := snapshotEntry{MTime: entry.mtime, Expires: entry.expires, Flags: entry.flags, Seen: entry.seen, Origin: ps.origins.name(entry.origin), Key: entry.key}
+	if entry.extra != nil {
+		e.Source = entry.extra.source
+		e.Uploaded, e.Downloaded = entry.extra.uploaded, entry.extra.downloaded
+	}
+	return e
+}
+
+// fromSnapshotEntry deserializes entry. Optional data that is not tracked is
+// dropped.
+func (ps *peerStore) fromSnapshotEntry(entry snapshotEntry) peerEntry {
+	var extra peerExtra
+	if ps.cfg.TrackSourceIPs {
+		extra.source = entry.Source
+	}
+	if ps.cfg.TrackTransfers {
+		extra.uploaded, extra.downloaded = entry.Uploaded, entry.Downloaded
+	}
+
+	return peerEntry{mtime: entry.MTime, expires: entry.Expires, flags: entry.Flags, seen: entry.Seen, origin: ps.originNumber(entry.Origin), key: entry.Key, extra: extra.ptr()}
+}
+
+func (ps *peerStore) toSnapshotEntries(peers map[serializedPeer]peerEntry) map[string]snapshotEntry {
+	entries := make(map[string]snapshotEntry, len(peers))
+	for pk, entry := range peers {
+		entries[string(pk)] = ps.toSnapshotEntry(entry)
+	}
+	return entries
+}
+
+func (ps *peerStore) fromSnapshotEntries(entries map[string]snapshotEntry) map[serializedPeer]peerEntry {
+	peers := make(map[serializedPeer]peerEntry, len(entries))
+	for pk, entry := range entries {
+		peers[serializedPeer(pk)] = ps.fromSnapshotEntry(entry)
+	}
+	return peers
+}
+
+// writeSnapshot writes all swarms to the file at path.
+//
+// The snapshot is written to a temporary file first, which replaces the file
+// at path once it is complete and synced to disk.
+func (ps *peerStore) writeSnapshot(path string) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	enc := gob.NewEncoder(f)
+	var numSwarms int
+	for i, shard := range ps.shards {
+		af := bittorrent.IPv4
+		if i >= len(ps.shards)/2 {
+			af = bittorrent.IPv6
+		}
+
+		shard.RLock()
+		for ih, s := range shard.swarms {
+			err = enc.Encode(snapshotSwarm{
+				InfoHash:      ih,
+				AddressFamily: af,
+				Seeders:       ps.toSnapshotEntries(s.seeders),
+				Leechers:      ps.toSnapshotEntries(s.leechers),
+			})
+			if err != nil {
+				shard.RUnlock()
+				f.Close()
+				os.Remove(f.Name())
+				return err
+			}
+			numSwarms++
+		}
+		shard.RUnlock()
+	}
+
+	// The data must be on disk before the file replaces the previous
+	// snapshot, or a crash could leave an empty or partial snapshot.
+	if err = f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	log.Info("storage: wrote snapshot", log.Fields{
+		"path":   path,
+		"swarms": numSwarms,
+	})
+
+	return os.Rename(f.Name(), path)
+}
+
+// readSnapshot restores the swarms from the file at path.
+//
+// A missing file is not an error. Peers that expired in the meantime are
+// removed by the next garbage collection.
+// It must be called before the PeerStore is used.
+func (ps *peerStore) readSnapshot(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(f)
+	var numSwarms int
+	for {
+		var s snapshotSwarm
+		if err := dec.Decode(&s); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		shard := ps.shards[ps.shardIndex(s.InfoHash, s.AddressFamily)]
+		shard.swarms[s.InfoHash] = swarm{
+			seeders:  ps.fromSnapshotEntries(s.Seeders),
+			leechers: ps.fromSnapshotEntries(s.Leechers),
+		}
+		shard.numSeeders += uint64(len(s.Seeders))
+		shard.numLeechers += uint64(len(s.Leechers))
+		for pk := range shard.swarms[s.InfoHash].seeders {
+			ps.indexPeer(shard, s.InfoHash, pk)
+		}
+		for pk := range shard.swarms[s.InfoHash].leechers {
+			ps.indexPeer(shard, s.InfoHash, pk)
+		}
+		numSwarms++
+	}
+
+	log.Info("storage: restored snapshot", log.Fields{
+		"path":   path,
+		"swarms": numSwarms,
+	})
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package memory
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		ShardCount:                  16,
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		SnapshotPath:                filepath.Join(dir, "snapshot"),
+	}
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}}
+
+	// Starting without a snapshot must not fail.
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	require.Nil(t, ps.PutSeeder(ih, v4))
+	require.Nil(t, ps.(s.PeerAttributeStore).PutLeecherWithAttributes(ih, v6, s.PeerAttributes{Flags: bittorrent.PeerFlagCrypto}))
+
+	err, ok := <-ps.Stop()
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// Restore into a store with a different number of shards.
+	cfg.ShardCount = 4
+	ps, err = New(cfg)
+	require.Nil(t, err)
+
+	scrape := ps.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+
+	announcer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000003"), Port: 3, IP: bittorrent.IP{IP: net.ParseIP("fc00::2"), AddressFamily: bittorrent.IPv6}}
+	peers, err := ps.(s.PeerAttributeStore).AnnouncePeersWithFlags(ih, true, 50, announcer, bittorrent.PeerFlagCrypto)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(peers))
+	require.True(t, peers[0].Equal(v6))
+
+	<-ps.Stop()
+}
+
+func TestSnapshotKeepsExtras(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{ShardCount: 1, SnapshotPath: filepath.Join(dir, "snapshot"), TrackSourceIPs: true, TrackTransfers: true}
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	source := bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}
+
+	ps, err := New(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.(s.PeerAttributeStore).PutSeederWithAttributes(ih, peer, s.PeerAttributes{SourceIP: source, Uploaded: 10, Downloaded: 20}))
+	<-ps.Stop()
+
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	infos, err := ps.(*peerStore).PeerInfo(ih, peer.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(infos))
+	require.Equal(t, source, infos[0].SourceIP)
+	require.Equal(t, uint64(10), infos[0].Uploaded)
+	require.Equal(t, uint64(20), infos[0].Downloaded)
+	<-ps.Stop()
+
+	// Sources are dropped if they are no longer tracked, totals are kept
+	// while they are.
+	cfg.TrackSourceIPs = false
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	infos, err = ps.(*peerStore).PeerInfo(ih, peer.ID)
+	require.Nil(t, err)
+	require.Nil(t, infos[0].SourceIP.IP)
+	uploaded, downloaded, err := ps.(*peerStore).PeerTransfers(ih, peer)
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), uploaded)
+	require.Equal(t, uint64(20), downloaded)
+	<-ps.Stop()
+}
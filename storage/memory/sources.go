@@ -0,0 +1,39 @@
+package memory
+
+import (
+	"net"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// sourceKey returns ip as the source to store for the peer serialized as pk,
+// if TrackSourceIPs is enabled. Sources equal to the IP of the peer are not
+// stored, so the empty string is returned.
+func (ps *peerStore) sourceKey(pk serializedPeer, ip bittorrent.IP) string {
+	if !ps.cfg.TrackSourceIPs {
+		return ""
+	}
+
+	key := ip.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		key = ip4
+	}
+	if len(key) != net.IPv4len && len(key) != net.IPv6len || string(key) == ipKey(pk) {
+		return ""
+	}
+	return string(key)
+}
+
+// source returns the source of the last announce of the peer, if it was
+// stored.
+func (e peerEntry) source() bittorrent.IP {
+	if e.extra == nil || e.extra.source == "" {
+		return bittorrent.IP{}
+	}
+
+	key := e.extra.source
+	if len(key) == net.IPv4len {
+		return bittorrent.IP{IP: net.IP(key), AddressFamily: bittorrent.IPv4}
+	}
+	return bittorrent.IP{IP: net.IP(key), AddressFamily: bittorrent.IPv6}
+}
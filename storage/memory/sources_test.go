@@ -0,0 +1,58 @@
+package memory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+func TestTrackSourceIPs(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	proxy := bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}
+
+	for _, track := range []bool{false, true} {
+		ps, err := New(Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PrometheusReportingInterval: time.Hour, TrackSourceIPs: track})
+		require.Nil(t, err)
+		store := ps.(*peerStore)
+
+		require.Nil(t, store.PutLeecherWithAttributes(ih, peer, s.PeerAttributes{SourceIP: proxy}))
+		infos, err := store.PeerInfo(ih, peer.ID)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(infos))
+		if !track {
+			require.Nil(t, infos[0].SourceIP.IP)
+			<-ps.Stop()
+			continue
+		}
+		require.Equal(t, proxy, infos[0].SourceIP)
+
+		// The source moves with the peer when it completes.
+		require.Nil(t, store.GraduateLeecherWithAttributes(ih, peer, s.PeerAttributes{SourceIP: proxy}))
+		infos, err = store.PeerInfo(ih, peer.ID)
+		require.Nil(t, err)
+		require.Equal(t, proxy, infos[0].SourceIP)
+
+		// Announcing directly forgets the source.
+		require.Nil(t, store.PutSeederWithAttributes(ih, peer, s.PeerAttributes{SourceIP: peer.IP}))
+		infos, err = store.PeerInfo(ih, peer.ID)
+		require.Nil(t, err)
+		require.Nil(t, infos[0].SourceIP.IP)
+
+		// Sources are kept by the entries of the peers themselves.
+		require.Nil(t, store.PutSeederWithAttributes(ih, peer, s.PeerAttributes{SourceIP: proxy}))
+		entry := store.shards[0].swarms[ih].seeders[newPeerKey(peer)]
+		require.Equal(t, string(proxy.IP), entry.extra.source)
+
+		// Peers without a source don't store any optional data.
+		require.Nil(t, store.PutSeeder(ih, peer))
+		require.Nil(t, store.shards[0].swarms[ih].seeders[newPeerKey(peer)].extra)
+
+		<-ps.Stop()
+	}
+}
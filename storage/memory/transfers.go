@@ -0,0 +1,46 @@
+package memory
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+)
+
+var _ storage.TransferStore = &peerStore{}
+
+// transfers returns the uploaded and downloaded totals of the last announce of
+// the peer, if they were stored.
+func (e peerEntry) transfers() (uploaded, downloaded uint64) {
+	if e.extra == nil {
+		return 0, 0
+	}
+	return e.extra.uploaded, e.extra.downloaded
+}
+
+func (ps *peerStore) PeerTransfers(ih bittorrent.InfoHash, p bittorrent.Peer) (uploaded, downloaded uint64, err error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	pk := newPeerKey(p)
+
+	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
+	shard.RLock()
+	defer shard.RUnlock()
+
+	s, ok := shard.swarms[ih]
+	if !ok {
+		return 0, 0, storage.ErrResourceDoesNotExist
+	}
+
+	entry, ok := s.seeders[pk]
+	if !ok {
+		if entry, ok = s.leechers[pk]; !ok {
+			return 0, 0, storage.ErrResourceDoesNotExist
+		}
+	}
+
+	uploaded, downloaded = entry.transfers()
+	return uploaded, downloaded, nil
+}
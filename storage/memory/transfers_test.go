@@ -0,0 +1,71 @@
+package memory
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	s "github.com/chihaya/chihaya/storage"
+)
+
+func TestTrackTransfers(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+
+	for _, track := range []bool{false, true} {
+		ps, err := New(Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PrometheusReportingInterval: time.Hour, TrackTransfers: track})
+		require.Nil(t, err)
+		store := ps.(*peerStore)
+
+		require.Nil(t, store.PutLeecherWithAttributes(ih, peer, s.PeerAttributes{Uploaded: 10, Downloaded: 20}))
+		infos, err := store.PeerInfo(ih, peer.ID)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(infos))
+		if !track {
+			require.Equal(t, uint64(0), infos[0].Uploaded)
+			require.Equal(t, uint64(0), infos[0].Downloaded)
+			<-ps.Stop()
+			continue
+		}
+		require.Equal(t, uint64(10), infos[0].Uploaded)
+		require.Equal(t, uint64(20), infos[0].Downloaded)
+
+		// The totals are updated by every announce.
+		require.Nil(t, store.GraduateLeecherWithAttributes(ih, peer, s.PeerAttributes{Uploaded: 30, Downloaded: 40}))
+		infos, err = store.PeerInfo(ih, peer.ID)
+		require.Nil(t, err)
+		require.Equal(t, uint64(30), infos[0].Uploaded)
+		require.Equal(t, uint64(40), infos[0].Downloaded)
+
+		// They can be looked up by peer.
+		uploaded, downloaded, err := store.PeerTransfers(ih, peer)
+		require.Nil(t, err)
+		require.Equal(t, uint64(30), uploaded)
+		require.Equal(t, uint64(40), downloaded)
+
+		// They don't affect the counts of the swarm.
+		scrape := store.ScrapeSwarm(ih, bittorrent.IPv4)
+		require.Equal(t, uint32(1), scrape.Complete)
+		require.Equal(t, uint32(0), scrape.Incomplete)
+
+		// Totals of zero, e.g. after a restart of the client, replace them
+		// without costing memory.
+		require.Nil(t, store.PutSeeder(ih, peer))
+		uploaded, downloaded, err = store.PeerTransfers(ih, peer)
+		require.Nil(t, err)
+		require.Equal(t, uint64(0), uploaded)
+		require.Equal(t, uint64(0), downloaded)
+		require.Nil(t, store.shards[0].swarms[ih].seeders[newPeerKey(peer)].extra)
+
+		// Totals are removed with their peers.
+		require.Nil(t, store.PutSeederWithAttributes(ih, peer, s.PeerAttributes{Uploaded: 1}))
+		require.Nil(t, store.DeleteSeeder(ih, peer))
+		_, _, err = store.PeerTransfers(ih, peer)
+		require.Equal(t, s.ErrResourceDoesNotExist, err)
+
+		<-ps.Stop()
+	}
+}
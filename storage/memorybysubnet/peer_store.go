@@ -297,6 +297,13 @@ func (ps *peerStore) populateProm() {
 	storage.PromLeechersCount.Set(float64(numLeechers))
 }
 
+// recordExpiredPeers records the number of peers removed by a GC sweep per
+// address family.
+func recordExpiredPeers(expired [2]int) {
+	storage.PromPeersExpiredTotal.WithLabelValues("IPv4").Add(float64(expired[bittorrent.IPv4]))
+	storage.PromPeersExpiredTotal.WithLabelValues("IPv6").Add(float64(expired[bittorrent.IPv6]))
+}
+
 // recordGCDuration records the duration of a GC sweep.
 func recordGCDuration(duration time.Duration) {
 	storage.PromGCDurationMilliseconds.Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
@@ -528,11 +535,16 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 	}
 
 	preferredSubnet := newPeerSubnet(announcer.IP, ps.ipv4Mask, ps.ipv6Mask)
+	announcerPK := newPeerKey(announcer)
 
 	if seeder {
 		// Append as many close leechers as possible.
 		closestLeechers := shard.swarms[ih].leechers[preferredSubnet]
 		for pk := range closestLeechers {
+			if pk == announcerPK {
+				continue
+			}
+
 			if numWant == 0 {
 				break
 			}
@@ -574,7 +586,6 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 		// Append as many close leechers as possible.
 		if numWant > 0 {
 			closestLeechers := shard.swarms[ih].leechers[preferredSubnet]
-			announcerPK := newPeerKey(announcer)
 			for pk := range closestLeechers {
 				if pk == announcerPK {
 					continue
@@ -670,7 +681,15 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 	cutoffUnix := cutoff.UnixNano()
 	start := time.Now()
 
-	for _, shard := range ps.shards {
+	var expired [2]int
+	for i, shard := range ps.shards {
+		// The first half of the shards holds IPv4 swarms, the second half
+		// IPv6 swarms.
+		af := bittorrent.IPv4
+		if i >= len(ps.shards)/2 {
+			af = bittorrent.IPv6
+		}
+
 		shard.RLock()
 		var infohashes []bittorrent.InfoHash
 		for ih := range shard.swarms {
@@ -692,6 +711,7 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 				for pk, mtime := range shard.swarms[ih].leechers[subnet] {
 					if mtime <= cutoffUnix {
 						shard.numLeechers--
+						expired[af]++
 						delete(shard.swarms[ih].leechers[subnet], pk)
 					}
 				}
@@ -705,6 +725,7 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 				for pk, mtime := range shard.swarms[ih].seeders[subnet] {
 					if mtime <= cutoffUnix {
 						shard.numSeeders--
+						expired[af]++
 						delete(shard.swarms[ih].seeders[subnet], pk)
 					}
 				}
@@ -726,6 +747,7 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 	}
 
 	recordGCDuration(time.Since(start))
+	recordExpiredPeers(expired)
 
 	return nil
 }
@@ -6,9 +6,15 @@ func init() {
 	// Register the metrics.
 	prometheus.MustRegister(
 		PromGCDurationMilliseconds,
+		PromCompactionDurationMilliseconds,
 		PromInfohashesCount,
 		PromSeedersCount,
 		PromLeechersCount,
+		PromPeersCount,
+		PromPeersExpiredTotal,
+		PromPeersByOrigin,
+		PromShardPeersMax,
+		PromShardLockWaitSecondsTotal,
 	)
 }
 
@@ -21,6 +27,14 @@ var (
 		Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
 	})
 
+	// PromCompactionDurationMilliseconds is a histogram used by storage to
+	// record the durations of compactions.
+	PromCompactionDurationMilliseconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chihaya_storage_compaction_duration_milliseconds",
+		Help:    "The time it takes to perform storage compaction",
+		Buckets: prometheus.ExponentialBuckets(9.375, 2, 14),
+	})
+
 	// PromInfohashesCount is a gauge used to hold the current total amount of
 	// unique swarms being tracked by a storage.
 	PromInfohashesCount = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -41,4 +55,43 @@ var (
 		Name: "chihaya_storage_leechers_count",
 		Help: "The number of leechers tracked",
 	})
+
+	// PromPeersCount is a gauge used to hold the current total amount of
+	// peers, labeled by address family and role, i.e. seeder or leecher.
+	PromPeersCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chihaya_storage_peers_count",
+		Help: "The number of peers tracked by address family and role",
+	}, []string{"address_family", "role"})
+
+	// PromPeersExpiredTotal is a counter of the peers removed by storage
+	// garbage collection because they did not announce in time, labeled by
+	// address family.
+	PromPeersExpiredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_storage_peers_expired_total",
+		Help: "The number of peers removed by storage garbage collection",
+	}, []string{"address_family"})
+
+	// PromPeersByOrigin is a gauge used to hold the total amount of peers,
+	// labeled by origin, i.e. the frontend that registered them, and role,
+	// if the storage stores origins.
+	PromPeersByOrigin = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chihaya_storage_peers_by_origin_count",
+		Help: "The number of peers tracked by origin and role",
+	}, []string{"origin", "role"})
+
+	// PromShardPeersMax is a gauge used to hold the number of peers of the
+	// shard with the most peers, if the storage is sharded. Compared to the
+	// total number of peers, it reveals hot shards.
+	PromShardPeersMax = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_storage_shard_peers_max",
+		Help: "The number of peers of the most loaded shard",
+	})
+
+	// PromShardLockWaitSecondsTotal is a counter of the time announces and
+	// scrapes waited for the locks of the shards of the storage, if it
+	// measures lock contention.
+	PromShardLockWaitSecondsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_storage_shard_lock_wait_seconds_total",
+		Help: "The time announces and scrapes waited for the locks of storage shards",
+	})
 )
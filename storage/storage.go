@@ -3,6 +3,7 @@ package storage
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/pkg/log"
@@ -21,7 +22,7 @@ type Driver interface {
 
 // ErrResourceDoesNotExist is the error returned by all delete methods in the
 // store if the requested resource does not exist.
-var ErrResourceDoesNotExist = bittorrent.ClientError("resource does not exist")
+var ErrResourceDoesNotExist = bittorrent.NewClientError("resource_does_not_exist", "resource does not exist")
 
 // ErrDriverDoesNotExist is the error returned by NewPeerStore when a peer
 // store driver with that name does not exist.
@@ -96,6 +97,335 @@ type PeerStore interface {
 	DeleteInfoHash(infoHash bittorrent.InfoHash) error
 }
 
+// PeerAttributes are optional data stored alongside a Peer by a
+// PeerAttributeStore.
+type PeerAttributes struct {
+	// Flags are the PeerFlags of the Peer.
+	Flags bittorrent.PeerFlags
+
+	// TTL is a hint for how long the Peer should be kept without
+	// announcing again.
+	// Zero selects the default peer lifetime of the PeerStore.
+	TTL time.Duration
+
+	// Origin identifies the frontend that registered the Peer, e.g. the
+	// scheme of the announce URL. It is only stored by PeerStores that
+	// implement PeerOriginStore and are configured to do so.
+	Origin string
+
+	// Key is the key the Peer announced with, or empty if it omitted it.
+	// It is only used by PeerStores that are configured to identify Peers
+	// by their key.
+	Key string
+
+	// SourceIP is the address the Announce was received from, e.g. the
+	// address of a reverse proxy, if it differs from the IP of the Peer.
+	// It is only stored by PeerStores that are configured to do so.
+	SourceIP bittorrent.IP
+
+	// Uploaded and Downloaded are the totals the Peer reported in the
+	// Announce. They are only stored by PeerStores that are configured to
+	// do so.
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// IsZero reports whether attrs holds no attributes, in which case storing a
+// Peer with them is equivalent to storing it without.
+func (attrs PeerAttributes) IsZero() bool {
+	return attrs.Flags == 0 && attrs.TTL == 0 && attrs.Origin == "" && attrs.Key == "" && attrs.SourceIP.IP == nil && attrs.Uploaded == 0 && attrs.Downloaded == 0
+}
+
+// PeerAttributeStore is an optional interface for PeerStores that are able to
+// store PeerAttributes alongside Peers and to filter the Peers returned for an
+// Announce by their PeerFlags.
+type PeerAttributeStore interface {
+	// PutSeederWithAttributes behaves like PutSeeder, but stores attrs
+	// with the Peer.
+	PutSeederWithAttributes(infoHash bittorrent.InfoHash, p bittorrent.Peer, attrs PeerAttributes) error
+
+	// PutLeecherWithAttributes behaves like PutLeecher, but stores attrs
+	// with the Peer.
+	PutLeecherWithAttributes(infoHash bittorrent.InfoHash, p bittorrent.Peer, attrs PeerAttributes) error
+
+	// GraduateLeecherWithAttributes behaves like GraduateLeecher, but
+	// stores attrs with the Peer.
+	GraduateLeecherWithAttributes(infoHash bittorrent.InfoHash, p bittorrent.Peer, attrs PeerAttributes) error
+
+	// AnnouncePeersWithFlags behaves like AnnouncePeers, but only returns
+	// Peers which have all bits of mask set in their flags.
+	//
+	// A mask of zero matches all Peers.
+	AnnouncePeersWithFlags(infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer, mask bittorrent.PeerFlags) (peers []bittorrent.Peer, err error)
+}
+
+// CheckAndPutStore is an optional interface for PeerStores that are able to
+// report whether a Peer was already present in a Swarm when storing it, so
+// that the first contact of a Peer can be detected without a separate lookup.
+type CheckAndPutStore interface {
+	// CheckAndPutSeeder behaves like PutSeederWithAttributes, but
+	// additionally returns whether the Peer was already present in the
+	// Swarm, either as a Seeder or as a Leecher.
+	//
+	// The check and the put must happen atomically.
+	CheckAndPutSeeder(infoHash bittorrent.InfoHash, p bittorrent.Peer, attrs PeerAttributes) (existed bool, err error)
+
+	// CheckAndPutLeecher behaves like PutLeecherWithAttributes, but
+	// additionally returns whether the Peer was already present in the
+	// Swarm, either as a Seeder or as a Leecher.
+	//
+	// The check and the put must happen atomically.
+	CheckAndPutLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer, attrs PeerAttributes) (existed bool, err error)
+}
+
+// PeerInfo describes a Peer as stored in a swarm.
+type PeerInfo struct {
+	Peer   bittorrent.Peer
+	Seeder bool
+	Flags  bittorrent.PeerFlags
+
+	// LastSeen is the time of the last announce of the Peer.
+	LastSeen time.Time
+
+	// TTL is the remaining time until the Peer expires.
+	TTL time.Duration
+
+	// SeenCount is the number of Announces of the Peer in the Swarm, if the
+	// PeerStore counts them. Otherwise it is zero.
+	SeenCount uint32
+
+	// Origin is the origin of the last Announce of the Peer, if the
+	// PeerStore stores origins. Otherwise it is empty.
+	Origin string
+
+	// SourceIP is the address the last Announce of the Peer was received
+	// from, if the PeerStore stores it and it differs from the IP of the
+	// Peer. Otherwise its IP is nil.
+	SourceIP bittorrent.IP
+
+	// Uploaded and Downloaded are the totals the Peer reported in its last
+	// Announce, if the PeerStore stores them. Otherwise they are zero.
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// PeerInfoStore is an optional interface for PeerStores that are able to
+// describe the Peers they store. It is intended for diagnostics and need not
+// be fast.
+type PeerInfoStore interface {
+	// PeerInfo returns the state of all Peers with the given ID in the
+	// Swarm identified by the provided infoHash, in both address families.
+	//
+	// If the Swarm or Peer does not exist, this function should return
+	// ErrResourceDoesNotExist.
+	PeerInfo(infoHash bittorrent.InfoHash, id bittorrent.PeerID) ([]PeerInfo, error)
+}
+
+// TransferStore is an optional interface for PeerStores that store the
+// uploaded and downloaded totals the Peers reported, e.g. for accounting.
+type TransferStore interface {
+	// PeerTransfers returns the totals the given Peer reported in its last
+	// Announce to the Swarm identified by the provided infoHash. Totals that
+	// are not stored are zero.
+	//
+	// If the Swarm or Peer does not exist, this function should return
+	// ErrResourceDoesNotExist.
+	PeerTransfers(infoHash bittorrent.InfoHash, p bittorrent.Peer) (uploaded, downloaded uint64, err error)
+}
+
+// SeenCountStore is an optional interface for PeerStores that count the
+// Announces of every Peer in a Swarm, which distinguishes long-lived Peers
+// from transient ones.
+type SeenCountStore interface {
+	// AnnounceLongLivedPeers behaves like AnnouncePeers, but prefers Peers
+	// that announced more often, as they are more likely to be stable.
+	// Seeders and Leechers are still preferred like by AnnouncePeers.
+	AnnounceLongLivedPeers(infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) (peers []bittorrent.Peer, err error)
+}
+
+// PeerGroupStore is an optional interface for PeerStores that are able to
+// report which of the Peers returned for an Announce they prioritize equally,
+// e.g. so that a cache can return different Peers to every announcer without
+// returning Leechers instead of Seeders.
+type PeerGroupStore interface {
+	// AnnouncePeerGroups behaves like AnnouncePeers, but also returns the
+	// ends of the groups of Peers of equal priority in peers, in order of
+	// priority, e.g. the Seeders, the Leechers and the Peers that are
+	// unreachable.
+	AnnouncePeerGroups(infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) (peers []bittorrent.Peer, ends []int, err error)
+}
+
+// ClientCounts are the numbers of Seeders and Leechers of a Swarm that use the
+// same client software.
+type ClientCounts struct {
+	Seeders  int
+	Leechers int
+}
+
+// ClientStatsStore is an optional interface for PeerStores that are able to
+// break the Peers of a Swarm down by their client software. It is intended for
+// diagnostics and need not be fast.
+type ClientStatsStore interface {
+	// ClientStats returns the ClientCounts of the Swarm identified by the
+	// provided infoHash per ClientID, across both address families.
+	//
+	// If the Swarm does not exist, this function should return
+	// ErrResourceDoesNotExist.
+	ClientStats(infoHash bittorrent.InfoHash) (map[bittorrent.ClientID]ClientCounts, error)
+}
+
+// PeerCounts are the numbers of Seeders and Leechers across all Swarms.
+type PeerCounts struct {
+	Seeders  uint64
+	Leechers uint64
+}
+
+// PeerCountStore is an optional interface for PeerStores that maintain the
+// total numbers of their Peers, e.g. for dashboards. It must be fast, i.e. not
+// iterate the Swarms.
+type PeerCountStore interface {
+	// PeerCounts returns the PeerCounts of all Swarms of the provided
+	// address family.
+	PeerCounts(addressFamily bittorrent.AddressFamily) PeerCounts
+}
+
+// ShardStats describe the load of a shard of a PeerStore.
+type ShardStats struct {
+	// AddressFamily is the address family of the Swarms of the shard.
+	AddressFamily bittorrent.AddressFamily
+
+	Swarms   uint64
+	Seeders  uint64
+	Leechers uint64
+
+	// Locks is the number of times Announces and Scrapes locked the shard
+	// and LockWait the total time they waited for it, if the PeerStore
+	// measures lock contention. Otherwise both are zero.
+	Locks    uint64
+	LockWait time.Duration
+}
+
+// ShardStatsStore is an optional interface for PeerStores that split their
+// Swarms into shards, so that hot shards, e.g. of a viral torrent, can be
+// detected. It is intended for diagnostics and need not be fast.
+type ShardStatsStore interface {
+	// ShardStats returns the ShardStats of all shards, ordered by shard.
+	ShardStats() []ShardStats
+}
+
+// UnknownOrigin is the origin reported by a PeerOriginStore for Peers that
+// were registered without one.
+const UnknownOrigin = "unknown"
+
+// PeerOriginStore is an optional interface for PeerStores that are able to
+// store the origin of every Peer, i.e. the frontend that registered it, and
+// to count their Peers per origin. It must be fast, i.e. not iterate the
+// Swarms.
+type PeerOriginStore interface {
+	// PeerOriginCounts returns the PeerCounts of all Swarms of both address
+	// families per origin. The counts may be out of date by the interval
+	// of the garbage collection of the PeerStore.
+	//
+	// If origins are not stored, this function should return nil.
+	PeerOriginCounts() map[string]PeerCounts
+}
+
+// PeerEvictionStore is an optional interface for PeerStores that are able to
+// remove all Peers of an IP at once, e.g. in response to abuse.
+type PeerEvictionStore interface {
+	// DeletePeersByIP removes all Peers announced from the provided IP from
+	// all Swarms and returns the number of removed Peers.
+	//
+	// If no Peers were announced from the IP, this function should return
+	// ErrResourceDoesNotExist.
+	DeletePeersByIP(ip bittorrent.IP) (int, error)
+}
+
+// PeerDeletionStore is an optional interface for PeerStores that are able to
+// remove a Peer from a Swarm regardless of its role, e.g. to kick it out of
+// the Swarm in response to abuse.
+type PeerDeletionStore interface {
+	// DeletePeer removes the Peer from both the Seeders and the Leechers of
+	// the Swarm identified by the provided infoHash and reports whether it
+	// was present in either.
+	DeletePeer(infoHash bittorrent.InfoHash, p bittorrent.Peer) (bool, error)
+}
+
+// FallibleScrapeStore is an optional interface for PeerStores whose Scrapes
+// can fail, e.g. because they are backed by an external database, so that
+// the failure of one Swarm does not have to fail a whole Scrape.
+type FallibleScrapeStore interface {
+	// TryScrapeSwarm is like ScrapeSwarm, but returns the error that
+	// prevented scraping the Swarm instead of an empty Scrape.
+	TryScrapeSwarm(infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (bittorrent.Scrape, error)
+}
+
+// CompactionStore is an optional interface for PeerStores that are able to
+// reclaim the space left by deleted Peers, e.g. by rewriting their database.
+type CompactionStore interface {
+	// Compact reclaims the space left by deleted Peers.
+	//
+	// Unlike the garbage collection, it may block all other operations
+	// for its whole duration, so it is meant to run during off-peak hours,
+	// see CompactionScheduler.
+	Compact() error
+}
+
+// MigratedPeer is a Peer as transferred between PeerStores, e.g. to migrate
+// the Swarms of one tracker to another.
+type MigratedPeer struct {
+	Peer  bittorrent.Peer
+	Flags bittorrent.PeerFlags
+
+	// LastSeen is the time of the last announce of the Peer.
+	LastSeen time.Time
+
+	// TTL is the duration after LastSeen until the Peer expires.
+	// Zero selects the default peer lifetime of the PeerStore.
+	TTL time.Duration
+
+	// SeenCount and Origin are the count of Announces and the origin of
+	// the last Announce of the Peer, see PeerInfo.
+	// PeerStores that don't track them ignore them.
+	SeenCount uint32
+	Origin    string
+
+	// KeyHash is the hash of the key of the last Announce of the Peer, if
+	// the PeerStore identifies Peers by their keys. Otherwise it is zero.
+	KeyHash uint32
+
+	// SourceIP is the address the last Announce of the Peer was received
+	// from, Uploaded and Downloaded are the totals it reported, see
+	// PeerInfo. PeerStores that don't track them ignore them.
+	SourceIP   bittorrent.IP
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// PeerMigrationStore is an optional interface for PeerStores that are able to
+// export and import their Swarms in bulk, e.g. to migrate to another tracker.
+// The Swarms dumped from one PeerStore can be put into another one as they
+// are.
+type PeerMigrationStore interface {
+	// PutPeers stores the provided Seeders and Leechers in the Swarm
+	// identified by the provided infoHash at once, which is much faster
+	// than storing them one by one. The Peers may be of both address
+	// families.
+	//
+	// The Peers expire their TTL after their LastSeen, so Peers that
+	// already expired are skipped. An existing entry of a Peer is only
+	// replaced by a more recent one.
+	PutPeers(infoHash bittorrent.InfoHash, seeders, leechers []MigratedPeer) error
+
+	// DumpPeers calls fn with the Seeders and Leechers of every Swarm, one
+	// address family at a time, until fn returns an error, which is
+	// returned.
+	//
+	// The Swarms are not locked while fn runs, so the dump is not a
+	// consistent snapshot of the PeerStore.
+	DumpPeers(fn func(infoHash bittorrent.InfoHash, seeders, leechers []MigratedPeer) error) error
+}
+
 // RegisterDriver makes a Driver available by the provided name.
 //
 // If called twice with the same name, the name is blank, or if the provided
@@ -53,6 +53,47 @@ func generatePeers() (a [1000]bittorrent.Peer) {
 	return
 }
 
+// RunBenchmarks runs all benchmarks of this package as sub-benchmarks against
+// PeerStores created by factory.
+//
+// Every benchmark uses a new PeerStore, which is stopped afterwards.
+func RunBenchmarks(b *testing.B, factory PeerStoreFactory) {
+	benchmarks := []struct {
+		name string
+		run  func(*testing.B, PeerStore)
+	}{
+		{"Put", Put},
+		{"Put1k", Put1k},
+		{"Put1kInfohash", Put1kInfohash},
+		{"Put1kInfohash1k", Put1kInfohash1k},
+		{"PutDelete", PutDelete},
+		{"PutDelete1k", PutDelete1k},
+		{"PutDelete1kInfohash", PutDelete1kInfohash},
+		{"PutDelete1kInfohash1k", PutDelete1kInfohash1k},
+		{"DeleteNonexist", DeleteNonexist},
+		{"DeleteNonexist1k", DeleteNonexist1k},
+		{"DeleteNonexist1kInfohash", DeleteNonexist1kInfohash},
+		{"DeleteNonexist1kInfohash1k", DeleteNonexist1kInfohash1k},
+		{"PutGradDelete", PutGradDelete},
+		{"PutGradDelete1k", PutGradDelete1k},
+		{"PutGradDelete1kInfohash", PutGradDelete1kInfohash},
+		{"PutGradDelete1kInfohash1k", PutGradDelete1kInfohash1k},
+		{"GradNonexist", GradNonexist},
+		{"GradNonexist1k", GradNonexist1k},
+		{"GradNonexist1kInfohash", GradNonexist1kInfohash},
+		{"GradNonexist1kInfohash1k", GradNonexist1kInfohash1k},
+		{"AnnounceLeecher", AnnounceLeecher},
+		{"AnnounceLeecher1kInfohash", AnnounceLeecher1kInfohash},
+		{"AnnounceSeeder", AnnounceSeeder},
+		{"AnnounceSeeder1kInfohash", AnnounceSeeder1kInfohash},
+	}
+
+	for _, bm := range benchmarks {
+		bm := bm
+		b.Run(bm.name, func(b *testing.B) { bm.run(b, factory()) })
+	}
+}
+
 type executionFunc func(int, PeerStore, *benchData) error
 type setupFunc func(PeerStore, *benchData) error
 
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"fmt"
 	"net"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -12,6 +14,128 @@ import (
 // PeerEqualityFunc is the boolean function to use to check two Peers for equality.
 var PeerEqualityFunc = func(p1, p2 bittorrent.Peer) bool { return p1.Equal(p2) }
 
+// PeerStoreFactory creates a new, empty PeerStore for every test or benchmark
+// run by RunTests and RunBenchmarks.
+type PeerStoreFactory func() PeerStore
+
+// RunTests runs the conformance suite against PeerStores created by factory.
+//
+// Besides the PeerStore interface, the optional interfaces of this package
+// are tested if the PeerStores implement them. Every test uses a new
+// PeerStore, which is stopped afterwards.
+//
+// The concurrency tests are most useful with the race detector enabled.
+func RunTests(t *testing.T, factory PeerStoreFactory) {
+	run := func(name string, test func(*testing.T, PeerStore)) {
+		t.Run(name, func(t *testing.T) {
+			ps := factory()
+			defer stopPeerStore(t, ps)
+			test(t, ps)
+		})
+	}
+
+	run("PeerStore", TestPeerStore)
+	run("Graduation", TestGraduation)
+	run("AnnouncerExclusion", TestAnnouncerExclusion)
+	run("Scrape", TestScrape)
+	run("DeleteInfoHash", TestDeleteInfoHash)
+	run("Concurrency", TestConcurrency)
+
+	run("PeerAttributeStore", func(t *testing.T, ps PeerStore) {
+		as, ok := ps.(PeerAttributeStore)
+		if !ok {
+			t.Skip("PeerAttributeStore not implemented")
+		}
+		TestPeerAttributeStore(t, as)
+	})
+	run("PeerInfoStore", func(t *testing.T, ps PeerStore) {
+		is, ok := ps.(interface {
+			PeerStore
+			PeerInfoStore
+		})
+		if !ok {
+			t.Skip("PeerInfoStore not implemented")
+		}
+		TestPeerInfoStore(t, is)
+	})
+	run("ClientStatsStore", func(t *testing.T, ps PeerStore) {
+		cs, ok := ps.(interface {
+			PeerStore
+			ClientStatsStore
+		})
+		if !ok {
+			t.Skip("ClientStatsStore not implemented")
+		}
+		TestClientStatsStore(t, cs)
+	})
+	run("CheckAndPutStore", func(t *testing.T, ps PeerStore) {
+		cs, ok := ps.(interface {
+			PeerStore
+			CheckAndPutStore
+		})
+		if !ok {
+			t.Skip("CheckAndPutStore not implemented")
+		}
+		TestCheckAndPutStore(t, cs)
+	})
+	run("PeerEvictionStore", func(t *testing.T, ps PeerStore) {
+		es, ok := ps.(interface {
+			PeerStore
+			PeerEvictionStore
+		})
+		if !ok {
+			t.Skip("PeerEvictionStore not implemented")
+		}
+		TestPeerEvictionStore(t, es)
+	})
+	run("PeerDeletionStore", func(t *testing.T, ps PeerStore) {
+		ds, ok := ps.(interface {
+			PeerStore
+			PeerDeletionStore
+		})
+		if !ok {
+			t.Skip("PeerDeletionStore not implemented")
+		}
+		TestPeerDeletionStore(t, ds)
+	})
+	run("PeerGroupStore", func(t *testing.T, ps PeerStore) {
+		gs, ok := ps.(interface {
+			PeerStore
+			PeerGroupStore
+		})
+		if !ok {
+			t.Skip("PeerGroupStore not implemented")
+		}
+		TestPeerGroupStore(t, gs)
+	})
+	run("FallibleScrapeStore", func(t *testing.T, ps PeerStore) {
+		fs, ok := ps.(interface {
+			PeerStore
+			FallibleScrapeStore
+		})
+		if !ok {
+			t.Skip("FallibleScrapeStore not implemented")
+		}
+		TestFallibleScrapeStore(t, fs)
+	})
+	run("TransferStore", func(t *testing.T, ps PeerStore) {
+		ts, ok := ps.(interface {
+			PeerStore
+			TransferStore
+		})
+		if !ok {
+			t.Skip("TransferStore not implemented")
+		}
+		TestTransferStore(t, ts)
+	})
+}
+
+func stopPeerStore(t *testing.T, ps PeerStore) {
+	for err := range ps.Stop() {
+		t.Fatal(err)
+	}
+}
+
 // TestPeerStore tests a PeerStore implementation against the interface.
 func TestPeerStore(t *testing.T, p PeerStore) {
 	testData := []struct {
@@ -148,6 +272,584 @@ func TestPeerStore(t *testing.T, p PeerStore) {
 
 }
 
+// TestPeerAttributeStore tests a PeerAttributeStore implementation against
+// the interface.
+func TestPeerAttributeStore(t *testing.T, p PeerAttributeStore) {
+	ih := bittorrent.InfoHashFromString("00000000000000000003")
+	announcer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("99999999999999999994"), IP: bittorrent.IP{IP: net.ParseIP("99.99.99.99").To4(), AddressFamily: bittorrent.IPv4}, Port: 9994}
+	plain := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	crypto := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+	both := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000003"), Port: 3, IP: bittorrent.IP{IP: net.ParseIP("3.3.3.3").To4(), AddressFamily: bittorrent.IPv4}}
+
+	err := p.PutSeederWithAttributes(ih, plain, PeerAttributes{})
+	require.Nil(t, err)
+	err = p.PutLeecherWithAttributes(ih, crypto, PeerAttributes{Flags: bittorrent.PeerFlagCrypto})
+	require.Nil(t, err)
+	err = p.PutLeecherWithAttributes(ih, both, PeerAttributes{Flags: bittorrent.PeerFlagCrypto | bittorrent.PeerFlagSeedbox})
+	require.Nil(t, err)
+
+	// A zero mask matches all Peers.
+	peers, err := p.AnnouncePeersWithFlags(ih, false, 50, announcer, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(peers))
+
+	peers, err = p.AnnouncePeersWithFlags(ih, false, 50, announcer, bittorrent.PeerFlagCrypto)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(peers))
+	require.True(t, containsPeer(peers, crypto))
+	require.True(t, containsPeer(peers, both))
+
+	peers, err = p.AnnouncePeersWithFlags(ih, true, 50, announcer, bittorrent.PeerFlagCrypto|bittorrent.PeerFlagSeedbox)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(peers))
+	require.True(t, containsPeer(peers, both))
+
+	// Graduating a Leecher replaces its flags.
+	err = p.GraduateLeecherWithAttributes(ih, crypto, PeerAttributes{})
+	require.Nil(t, err)
+
+	peers, err = p.AnnouncePeersWithFlags(ih, false, 50, announcer, bittorrent.PeerFlagCrypto)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(peers))
+	require.True(t, containsPeer(peers, both))
+
+	_, err = p.AnnouncePeersWithFlags(bittorrent.InfoHashFromString("00000000000000000004"), false, 50, announcer, bittorrent.PeerFlagCrypto)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+}
+
+// TestPeerInfoStore tests a PeerInfoStore implementation against the
+// interface.
+func TestPeerInfoStore(t *testing.T, p interface {
+	PeerStore
+	PeerInfoStore
+}) {
+	ih := bittorrent.InfoHashFromString("00000000000000000005")
+	id := bittorrent.PeerIDFromString("00000000000000000001")
+	v4Peer := bittorrent.Peer{ID: id, Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	v6Peer := bittorrent.Peer{ID: id, Port: 2, IP: bittorrent.IP{IP: net.ParseIP("abab::0001"), AddressFamily: bittorrent.IPv6}}
+
+	_, err := p.PeerInfo(ih, id)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	err = p.PutSeeder(ih, v4Peer)
+	require.Nil(t, err)
+	err = p.PutLeecher(ih, v6Peer)
+	require.Nil(t, err)
+
+	_, err = p.PeerInfo(ih, bittorrent.PeerIDFromString("00000000000000000002"))
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	infos, err := p.PeerInfo(ih, id)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(infos))
+	for _, info := range infos {
+		if info.Peer.IP.AddressFamily == bittorrent.IPv4 {
+			require.True(t, PeerEqualityFunc(v4Peer, info.Peer))
+			require.True(t, info.Seeder)
+		} else {
+			require.True(t, PeerEqualityFunc(v6Peer, info.Peer))
+			require.False(t, info.Seeder)
+		}
+		require.True(t, info.TTL > 0)
+	}
+
+	err = p.DeleteSeeder(ih, v4Peer)
+	require.Nil(t, err)
+	err = p.DeleteLeecher(ih, v6Peer)
+	require.Nil(t, err)
+
+	_, err = p.PeerInfo(ih, id)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+}
+
+// TestClientStatsStore tests a ClientStatsStore implementation against the
+// interface.
+func TestClientStatsStore(t *testing.T, p interface {
+	PeerStore
+	ClientStatsStore
+}) {
+	ih := bittorrent.InfoHashFromString("00000000000000000007")
+	peer := func(id string, n byte, af bittorrent.AddressFamily) bittorrent.Peer {
+		ip := net.IPv4(1, 1, 1, n).To4()
+		if af == bittorrent.IPv6 {
+			ip = net.ParseIP("abab::" + string('0'+n))
+		}
+		return bittorrent.Peer{ID: bittorrent.PeerIDFromString(id), Port: 1, IP: bittorrent.IP{IP: ip, AddressFamily: af}}
+	}
+	tr1 := peer("-TR2940-000000000001", 1, bittorrent.IPv4)
+	tr2 := peer("-TR2940-000000000002", 2, bittorrent.IPv6)
+	tr3 := peer("-TR2940-000000000003", 3, bittorrent.IPv4)
+	qb := peer("-qB4250-000000000004", 4, bittorrent.IPv4)
+
+	_, err := p.ClientStats(ih)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	require.Nil(t, p.PutSeeder(ih, tr1))
+	require.Nil(t, p.PutSeeder(ih, tr2))
+	require.Nil(t, p.PutLeecher(ih, tr3))
+	require.Nil(t, p.PutLeecher(ih, qb))
+
+	stats, err := p.ClientStats(ih)
+	require.Nil(t, err)
+	require.Equal(t, map[bittorrent.ClientID]ClientCounts{
+		bittorrent.NewClientID(tr1.ID): {Seeders: 2, Leechers: 1},
+		bittorrent.NewClientID(qb.ID):  {Leechers: 1},
+	}, stats)
+
+	for _, peer := range []bittorrent.Peer{tr1, tr2} {
+		require.Nil(t, p.DeleteSeeder(ih, peer))
+	}
+	for _, peer := range []bittorrent.Peer{tr3, qb} {
+		require.Nil(t, p.DeleteLeecher(ih, peer))
+	}
+
+	_, err = p.ClientStats(ih)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+}
+
+// TestCheckAndPutStore tests a CheckAndPutStore implementation.
+func TestCheckAndPutStore(t *testing.T, p interface {
+	PeerStore
+	CheckAndPutStore
+}) {
+	ih := bittorrent.InfoHashFromString("00000000000000000008")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000001"),
+		Port: 1,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	other := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("-TR2940-000000000002"),
+		Port: 1,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.1.1.2").To4(), AddressFamily: bittorrent.IPv4},
+	}
+
+	existed, err := p.CheckAndPutLeecher(ih, peer, PeerAttributes{})
+	require.Nil(t, err)
+	require.False(t, existed)
+
+	existed, err = p.CheckAndPutLeecher(ih, peer, PeerAttributes{})
+	require.Nil(t, err)
+	require.True(t, existed)
+
+	// Peers are known regardless of their role.
+	existed, err = p.CheckAndPutSeeder(ih, peer, PeerAttributes{})
+	require.Nil(t, err)
+	require.True(t, existed)
+
+	existed, err = p.CheckAndPutSeeder(ih, other, PeerAttributes{})
+	require.Nil(t, err)
+	require.False(t, existed)
+
+	scrape := p.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(2), scrape.Complete)
+
+	// Deleted peers are new again.
+	require.Nil(t, p.DeleteSeeder(ih, other))
+	existed, err = p.CheckAndPutSeeder(ih, other, PeerAttributes{})
+	require.Nil(t, err)
+	require.False(t, existed)
+}
+
+// TestPeerEvictionStore tests a PeerEvictionStore implementation.
+func TestPeerEvictionStore(t *testing.T, p interface {
+	PeerStore
+	PeerEvictionStore
+}) {
+	ih1 := bittorrent.InfoHashFromString("00000000000000000006")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000007")
+	ip := bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}
+	abuser1 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: ip}
+	abuser2 := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: ip}
+	other := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000003"), Port: 3, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+
+	_, err := p.DeletePeersByIP(ip)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	require.Nil(t, p.PutSeeder(ih1, abuser1))
+	require.Nil(t, p.PutLeecher(ih1, abuser2))
+	require.Nil(t, p.PutLeecher(ih1, other))
+	require.Nil(t, p.PutLeecher(ih2, abuser1))
+	require.Nil(t, p.GraduateLeecher(ih2, abuser1))
+	require.Nil(t, p.PutSeeder(ih2, other))
+
+	// Deleted peers must not be counted.
+	require.Nil(t, p.DeleteLeecher(ih1, abuser2))
+	require.Nil(t, p.PutLeecher(ih1, abuser2))
+
+	deleted, err := p.DeletePeersByIP(bittorrent.IP{IP: net.ParseIP("1.1.1.1"), AddressFamily: bittorrent.IPv4})
+	require.Nil(t, err)
+	require.Equal(t, 3, deleted)
+
+	scrape := p.ScrapeSwarm(ih1, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+	scrape = p.ScrapeSwarm(ih2, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+
+	_, err = p.DeletePeersByIP(ip)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	require.Nil(t, p.DeleteLeecher(ih1, other))
+	require.Nil(t, p.DeleteSeeder(ih2, other))
+}
+
+// TestPeerDeletionStore tests a PeerDeletionStore implementation.
+func TestPeerDeletionStore(t *testing.T, p interface {
+	PeerStore
+	PeerDeletionStore
+}) {
+	ih := bittorrent.InfoHashFromString("00000000000000000008")
+	kicked := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	other := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+
+	removed, err := p.DeletePeer(ih, kicked)
+	require.Nil(t, err)
+	require.False(t, removed)
+
+	require.Nil(t, p.PutSeeder(ih, kicked))
+	require.Nil(t, p.PutLeecher(ih, kicked))
+	require.Nil(t, p.PutLeecher(ih, other))
+
+	// Both roles of the peer are removed.
+	removed, err = p.DeletePeer(ih, kicked)
+	require.Nil(t, err)
+	require.True(t, removed)
+
+	scrape := p.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	removed, err = p.DeletePeer(ih, kicked)
+	require.Nil(t, err)
+	require.False(t, removed)
+
+	require.Nil(t, p.DeleteLeecher(ih, other))
+}
+
+// TestPeerGroupStore tests a PeerGroupStore implementation against the
+// interface.
+func TestPeerGroupStore(t *testing.T, p interface {
+	PeerStore
+	PeerGroupStore
+}) {
+	ih := bittorrent.InfoHashFromString("00000000000000000013")
+	seeder := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+	announcer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000003"), Port: 3, IP: bittorrent.IP{IP: net.ParseIP("3.3.3.3").To4(), AddressFamily: bittorrent.IPv4}}
+
+	require.Nil(t, p.PutSeeder(ih, seeder))
+	require.Nil(t, p.PutLeecher(ih, leecher))
+
+	for _, seeding := range []bool{false, true} {
+		peers, ends, err := p.AnnouncePeerGroups(ih, seeding, 50, announcer)
+		require.Nil(t, err)
+
+		// The groups are ordered and cover all peers.
+		require.NotEmpty(t, ends)
+		for i := 1; i < len(ends); i++ {
+			require.True(t, ends[i-1] <= ends[i])
+		}
+		require.Equal(t, len(peers), ends[len(ends)-1])
+
+		// The seeder is not grouped with the leecher.
+		if !seeding {
+			require.Equal(t, []bittorrent.Peer{seeder, leecher}, peers)
+			require.Contains(t, ends, 1)
+		}
+	}
+
+	require.Nil(t, p.DeleteSeeder(ih, seeder))
+	require.Nil(t, p.DeleteLeecher(ih, leecher))
+}
+
+// TestFallibleScrapeStore tests a FallibleScrapeStore implementation against
+// the interface.
+func TestFallibleScrapeStore(t *testing.T, p interface {
+	PeerStore
+	FallibleScrapeStore
+}) {
+	ih := bittorrent.InfoHashFromString("00000000000000000012")
+	seeder := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("abab::0002"), AddressFamily: bittorrent.IPv6}}
+
+	// Unknown swarms are scraped as empty without an error.
+	scrape, err := p.TryScrapeSwarm(ih, bittorrent.IPv4)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, scrape)
+
+	require.Nil(t, p.PutSeeder(ih, seeder))
+	require.Nil(t, p.PutLeecher(ih, leecher))
+
+	// The Scrapes match those of ScrapeSwarm.
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		scrape, err = p.TryScrapeSwarm(ih, af)
+		require.Nil(t, err)
+		require.Equal(t, p.ScrapeSwarm(ih, af), scrape)
+	}
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	require.Nil(t, p.DeleteSeeder(ih, seeder))
+	require.Nil(t, p.DeleteLeecher(ih, leecher))
+}
+
+// TestTransferStore tests that PeerTransfers finds the stored Peers of a Swarm
+// and only those.
+func TestTransferStore(t *testing.T, p interface {
+	PeerStore
+	TransferStore
+}) {
+	ih := bittorrent.InfoHashFromString("00000000000000000013")
+	seeder := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("abab::0002"), AddressFamily: bittorrent.IPv6}}
+
+	_, _, err := p.PeerTransfers(ih, seeder)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	require.Nil(t, p.PutSeeder(ih, seeder))
+	require.Nil(t, p.PutLeecher(ih, leecher))
+
+	_, _, err = p.PeerTransfers(ih, seeder)
+	require.Nil(t, err)
+	_, _, err = p.PeerTransfers(ih, leecher)
+	require.Nil(t, err)
+
+	// Peers are identified by their ID, IP and port.
+	other := seeder
+	other.Port = 3
+	_, _, err = p.PeerTransfers(ih, other)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+
+	require.Nil(t, p.DeleteSeeder(ih, seeder))
+	require.Nil(t, p.DeleteLeecher(ih, leecher))
+
+	_, _, err = p.PeerTransfers(ih, seeder)
+	require.Equal(t, ErrResourceDoesNotExist, err)
+}
+
+// TestAnnouncerExclusion tests that AnnouncePeers never returns the leecher
+// entry of the announcer, in both address families.
+func TestAnnouncerExclusion(t *testing.T, p PeerStore) {
+	ih := bittorrent.InfoHashFromString("00000000000000000009")
+	pairs := [][2]bittorrent.Peer{
+		{
+			{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}},
+			{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}},
+		},
+		{
+			{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}},
+			{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("fc00::2"), AddressFamily: bittorrent.IPv6}},
+		},
+	}
+
+	for _, pair := range pairs {
+		announcer, other := pair[0], pair[1]
+		require.Nil(t, p.PutLeecher(ih, announcer))
+		require.Nil(t, p.PutLeecher(ih, other))
+
+		for _, seeder := range []bool{false, true} {
+			peers, err := p.AnnouncePeers(ih, seeder, 50, announcer)
+			require.Nil(t, err)
+			require.False(t, containsPeer(peers, announcer))
+			require.True(t, containsPeer(peers, other))
+		}
+	}
+}
+
+// TestGraduation tests the GraduateLeecher method of a PeerStore.
+func TestGraduation(t *testing.T, p PeerStore) {
+	ih := bittorrent.InfoHashFromString("00000000000000000008")
+	leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	unknown := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+
+	// Graduating a leecher moves it to the seeders.
+	require.Nil(t, p.PutLeecher(ih, leecher))
+	require.Nil(t, p.GraduateLeecher(ih, leecher))
+	scrape := p.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+
+	// Graduating a peer that is not a leecher adds it as a seeder, even to
+	// a swarm that does not exist yet.
+	require.Nil(t, p.GraduateLeecher(ih, unknown))
+	scrape = p.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(2), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+
+	other := bittorrent.InfoHashFromString("00000000000000000009")
+	require.Nil(t, p.GraduateLeecher(other, unknown))
+	require.Equal(t, uint32(1), p.ScrapeSwarm(other, bittorrent.IPv4).Complete)
+
+	require.Nil(t, p.DeleteSeeder(ih, leecher))
+	require.Equal(t, ErrResourceDoesNotExist, p.DeleteLeecher(ih, leecher))
+	require.Nil(t, p.DeleteSeeder(ih, unknown))
+	require.Nil(t, p.DeleteSeeder(other, unknown))
+}
+
+// TestScrape tests the ScrapeSwarm method of a PeerStore.
+func TestScrape(t *testing.T, p PeerStore) {
+	ih := bittorrent.InfoHashFromString("00000000000000000010")
+	v4Seeder := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	v4Leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("2.2.2.2").To4(), AddressFamily: bittorrent.IPv4}}
+	v6Leecher := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000003"), Port: 3, IP: bittorrent.IP{IP: net.ParseIP("abab::0003"), AddressFamily: bittorrent.IPv6}}
+
+	// Unknown swarms are scraped as empty.
+	scrape := p.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, ih, scrape.InfoHash)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+
+	require.Nil(t, p.PutSeeder(ih, v4Seeder))
+	require.Nil(t, p.PutLeecher(ih, v4Leecher))
+	require.Nil(t, p.PutLeecher(ih, v6Leecher))
+
+	// Putting a peer again does not count it twice.
+	require.Nil(t, p.PutLeecher(ih, v4Leecher))
+
+	// The address families are scraped separately.
+	scrape = p.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, ih, scrape.InfoHash)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	scrape = p.ScrapeSwarm(ih, bittorrent.IPv6)
+	require.Equal(t, ih, scrape.InfoHash)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+
+	require.Nil(t, p.DeleteSeeder(ih, v4Seeder))
+	require.Nil(t, p.DeleteLeecher(ih, v4Leecher))
+	require.Nil(t, p.DeleteLeecher(ih, v6Leecher))
+
+	scrape = p.ScrapeSwarm(ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Complete)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+	require.Equal(t, uint32(0), p.ScrapeSwarm(ih, bittorrent.IPv6).Incomplete)
+}
+
+// TestDeleteInfoHash tests the DeleteInfoHash method of a PeerStore.
+func TestDeleteInfoHash(t *testing.T, p PeerStore) {
+	ih := bittorrent.InfoHashFromString("00000000000000000011")
+	v4Peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000001"), Port: 1, IP: bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4}}
+	v6Peer := bittorrent.Peer{ID: bittorrent.PeerIDFromString("00000000000000000002"), Port: 2, IP: bittorrent.IP{IP: net.ParseIP("abab::0002"), AddressFamily: bittorrent.IPv6}}
+
+	require.Nil(t, p.PutSeeder(ih, v4Peer))
+	require.Nil(t, p.PutLeecher(ih, v6Peer))
+
+	require.Nil(t, p.DeleteInfoHash(ih))
+
+	// The swarm is gone in both address families.
+	for _, peer := range []bittorrent.Peer{v4Peer, v6Peer} {
+		scrape := p.ScrapeSwarm(ih, peer.IP.AddressFamily)
+		require.Equal(t, uint32(0), scrape.Complete)
+		require.Equal(t, uint32(0), scrape.Incomplete)
+
+		_, err := p.AnnouncePeers(ih, false, 50, peer)
+		require.Equal(t, ErrResourceDoesNotExist, err)
+		require.Equal(t, ErrResourceDoesNotExist, p.DeleteSeeder(ih, peer))
+		require.Equal(t, ErrResourceDoesNotExist, p.DeleteLeecher(ih, peer))
+	}
+}
+
+// TestConcurrency tests concurrent access to a PeerStore.
+//
+// Every goroutine runs through the lifecycle of its own peers in a few shared
+// swarms, so the results are deterministic. Run it with the race detector to
+// find unsynchronized access.
+func TestConcurrency(t *testing.T, p PeerStore) {
+	const (
+		workers    = 16
+		swarms     = 4
+		iterations = 50
+	)
+
+	infoHashes := make([]bittorrent.InfoHash, swarms)
+	for i := range infoHashes {
+		infoHashes[i] = bittorrent.InfoHashFromString(fmt.Sprintf("%020d", 100+i))
+	}
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- concurrencyWorker(p, w, iterations, infoHashes)
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	// All peers removed themselves.
+	for _, ih := range infoHashes {
+		for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+			scrape := p.ScrapeSwarm(ih, af)
+			require.Equal(t, uint32(0), scrape.Complete)
+			require.Equal(t, uint32(0), scrape.Incomplete)
+		}
+	}
+}
+
+// concurrencyWorker puts, announces, graduates, scrapes and deletes a peer
+// that is unique to w in every iteration.
+func concurrencyWorker(p PeerStore, w, iterations int, infoHashes []bittorrent.InfoHash) error {
+	check := func(op string, err error) error {
+		if err != nil {
+			return fmt.Errorf("worker %d: %s: %s", w, op, err)
+		}
+		return nil
+	}
+
+	for i := 0; i < iterations; i++ {
+		ih := infoHashes[i%len(infoHashes)]
+		peer := bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString(fmt.Sprintf("%010d%010d", w, i)),
+			Port: uint16(i + 1),
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, byte(w), byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+		}
+		if i%2 == 1 {
+			peer.IP = bittorrent.IP{IP: net.ParseIP(fmt.Sprintf("fc00::%x:%x", w+1, i+1)), AddressFamily: bittorrent.IPv6}
+		}
+
+		if err := check("put leecher", p.PutLeecher(ih, peer)); err != nil {
+			return err
+		}
+
+		// The swarm contains at least this peer.
+		_, err := p.AnnouncePeers(ih, false, 50, peer)
+		if err := check("announce leecher", err); err != nil {
+			return err
+		}
+
+		if err := check("graduate", p.GraduateLeecher(ih, peer)); err != nil {
+			return err
+		}
+
+		_, err = p.AnnouncePeers(ih, true, 50, peer)
+		if err := check("announce seeder", err); err != nil {
+			return err
+		}
+
+		if p.ScrapeSwarm(ih, peer.IP.AddressFamily).Complete == 0 {
+			return fmt.Errorf("worker %d: scrape: seeder missing", w)
+		}
+
+		if err := check("delete seeder", p.DeleteSeeder(ih, peer)); err != nil {
+			return err
+		}
+		if err := p.DeleteLeecher(ih, peer); err != ErrResourceDoesNotExist {
+			return fmt.Errorf("worker %d: delete graduated leecher: expected %s, got %v", w, ErrResourceDoesNotExist, err)
+		}
+	}
+
+	return nil
+}
+
 func containsPeer(peers []bittorrent.Peer, p bittorrent.Peer) bool {
 	for _, peer := range peers {
 		if PeerEqualityFunc(peer, p) {